@@ -0,0 +1,219 @@
+package flv
+
+import (
+	"fmt"
+	"github.com/lkmio/avformat/bufio"
+)
+
+const (
+	AACObjectTypeMain = 1
+	AACObjectTypeLC   = 2
+	AACObjectTypeSBR  = 5
+	AACObjectTypeER   = 17
+	AACObjectTypePS   = 29
+	AACObjectTypeEsc  = 31
+)
+
+var (
+	aacSampleRates = [13]int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+	// channelConfiguration对应的通道数, 0由program_config_element决定, 8-10保留
+	aacChannels = [15]int{0, 1, 2, 3, 4, 5, 6, 8, -1, -1, -1, 7, 8, 24, 8}
+)
+
+// AudioSpecificConfig ISO/IEC 14496-3 1.6.2.1
+type AudioSpecificConfig struct {
+	ObjectType          int
+	SamplingIndex       int
+	SampleRate          int // 核心编码器采样率
+	ChannelConfig       int
+	Channels            int // 核心编码器通道数
+	ExtensionObjectType int // SBR扩展, 没有扩展为0
+	ExtensionSampleRate int // SBR输出采样率
+	SBR                 bool
+	PS                  bool
+	FrameLength         int // 每帧采样数, 960或1024
+}
+
+// OutputSampleRate 返回解码输出的采样率, 包含SBR时为扩展采样率
+func (c *AudioSpecificConfig) OutputSampleRate() int {
+	if c.SBR && c.ExtensionSampleRate > 0 {
+		return c.ExtensionSampleRate
+	}
+
+	return c.SampleRate
+}
+
+// OutputChannels 返回解码输出的通道数, PS将单通道扩展为立体声
+func (c *AudioSpecificConfig) OutputChannels() int {
+	if c.PS && c.Channels == 1 {
+		return 2
+	}
+
+	return c.Channels
+}
+
+func readAACObjectType(reader *bufio.BitsReader) int {
+	objectType := int(reader.Read(5))
+	if AACObjectTypeEsc == objectType {
+		objectType = 32 + int(reader.Read(6))
+	}
+
+	return objectType
+}
+
+func readAACSampleRate(reader *bufio.BitsReader) (int, int, error) {
+	index := int(reader.Read(4))
+	if 0xF == index {
+		return index, int(reader.Read(24)), nil
+	} else if index >= len(aacSampleRates) {
+		return index, 0, fmt.Errorf("invalid sampling frequency index %d", index)
+	}
+
+	return index, aacSampleRates[index], nil
+}
+
+// readProgramConfigElement 解析program_config_element, 返回通道数
+func readProgramConfigElement(reader *bufio.BitsReader) int {
+	// element_instance_tag(4) object_type(2) sampling_frequency_index(4)
+	reader.Seek(10)
+	front := int(reader.Read(4))
+	side := int(reader.Read(4))
+	back := int(reader.Read(4))
+	lfe := int(reader.Read(2))
+	assoc := int(reader.Read(3))
+	cc := int(reader.Read(4))
+
+	// mono_mixdown, stereo_mixdown, matrix_mixdown
+	if reader.Read(1) == 1 {
+		reader.Seek(4)
+	}
+	if reader.Read(1) == 1 {
+		reader.Seek(4)
+	}
+	if reader.Read(1) == 1 {
+		reader.Seek(3)
+	}
+
+	var channels int
+	for i := 0; i < front+side+back; i++ {
+		// is_cpe(1) tag_select(4)
+		channels += 1 + int(reader.Read(1))
+		reader.Seek(4)
+	}
+
+	channels += lfe
+	reader.Seek(lfe*4 + assoc*4 + cc*5)
+	return channels
+}
+
+// ParseAudioSpecificConfig 解析AAC AudioSpecificConfig, 支持显式采样率, PCE通道配置和SBR/PS扩展
+func ParseAudioSpecificConfig(data []byte) (*AudioSpecificConfig, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("invalid audio specific config")
+	}
+
+	reader := &bufio.BitsReader{Data: data}
+	config := &AudioSpecificConfig{FrameLength: 1024}
+
+	var err error
+	config.ObjectType = readAACObjectType(reader)
+	if config.SamplingIndex, config.SampleRate, err = readAACSampleRate(reader); err != nil {
+		return nil, err
+	}
+
+	config.ChannelConfig = int(reader.Read(4))
+	if config.ChannelConfig >= len(aacChannels) || aacChannels[config.ChannelConfig] < 0 {
+		return nil, fmt.Errorf("invalid channel configuration %d", config.ChannelConfig)
+	}
+
+	config.Channels = aacChannels[config.ChannelConfig]
+
+	// 显式的层级SBR/PS信令
+	if AACObjectTypeSBR == config.ObjectType || AACObjectTypePS == config.ObjectType {
+		config.ExtensionObjectType = AACObjectTypeSBR
+		config.SBR = true
+		config.PS = AACObjectTypePS == config.ObjectType
+		if _, config.ExtensionSampleRate, err = readAACSampleRate(reader); err != nil {
+			return nil, err
+		}
+
+		config.ObjectType = readAACObjectType(reader)
+	}
+
+	switch config.ObjectType {
+	case 1, 2, 3, 4, 6, 7, 17, 19, 20, 21, 22, 23:
+		// GASpecificConfig: frameLengthFlag(1) dependsOnCoreCoder(1) extensionFlag(1)
+		if reader.Read(1) == 1 {
+			config.FrameLength = 960
+		}
+
+		if reader.Read(1) == 1 {
+			// coreCoderDelay
+			reader.Seek(14)
+		}
+
+		extensionFlag := reader.Read(1)
+		if config.ChannelConfig == 0 {
+			config.Channels = readProgramConfigElement(reader)
+		}
+
+		if config.ObjectType == 6 || config.ObjectType == 20 {
+			// layerNr
+			reader.Seek(3)
+		}
+
+		if extensionFlag == 1 {
+			if config.ObjectType == 22 {
+				// numOfSubFrame(5) layer_length(11)
+				reader.Seek(16)
+			} else if config.ObjectType == 17 || config.ObjectType == 19 || config.ObjectType == 20 || config.ObjectType == 23 {
+				// aacSectionDataResilienceFlag, aacScalefactorDataResilienceFlag, aacSpectralDataResilienceFlag
+				reader.Seek(3)
+			}
+
+			// extensionFlag3
+			reader.Seek(1)
+		}
+	default:
+		// 非GA编码器, 不解析后续扩展
+		return validateAudioSpecificConfig(reader, config)
+	}
+
+	switch config.ObjectType {
+	case 17, 19, 20, 21, 22, 23, 24, 25, 26, 27, 39:
+		// epConfig
+		reader.Seek(2)
+	}
+
+	// 后向兼容的SBR/PS信令
+	if config.ExtensionObjectType != AACObjectTypeSBR && len(data)*8-reader.Offset >= 16 {
+		if reader.Read(11) == 0x2B7 {
+			if readAACObjectType(reader) == AACObjectTypeSBR {
+				config.ExtensionObjectType = AACObjectTypeSBR
+				config.SBR = reader.Read(1) == 1
+				if config.SBR {
+					if _, config.ExtensionSampleRate, err = readAACSampleRate(reader); err != nil {
+						return nil, err
+					}
+
+					if len(data)*8-reader.Offset >= 12 && reader.Read(11) == 0x548 {
+						config.PS = reader.Read(1) == 1
+					}
+				}
+			}
+		}
+	}
+
+	return validateAudioSpecificConfig(reader, config)
+}
+
+func validateAudioSpecificConfig(reader *bufio.BitsReader, config *AudioSpecificConfig) (*AudioSpecificConfig, error) {
+	if reader.Offset > len(reader.Data)*8 {
+		return nil, fmt.Errorf("invalid audio specific config")
+	} else if config.SampleRate <= 0 || config.Channels <= 0 {
+		return nil, fmt.Errorf("unsupported audio specific config, sample rate: %d channels: %d", config.SampleRate, config.Channels)
+	}
+
+	return config, nil
+}
@@ -0,0 +1,131 @@
+package flv
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/lkmio/avformat/utils"
+)
+
+const (
+	ADTSHeaderSize = 7
+)
+
+// IsADTS 判断数据是否以ADTS syncword开头
+func IsADTS(data []byte) bool {
+	return len(data) >= ADTSHeaderSize && data[0] == 0xFF && data[1]&0xF6 == 0xF0
+}
+
+// NewADTSHeader 根据AudioSpecificConfig生成ADTS头模板, aac_frame_length由AppendADTS填写
+func NewADTSHeader(config []byte) ([]byte, error) {
+	asc, err := ParseAudioSpecificConfig(config)
+	if err != nil {
+		return nil, err
+	} else if asc.ObjectType < 1 || asc.ObjectType > 4 {
+		return nil, fmt.Errorf("aac object type %d can not be carried in adts", asc.ObjectType)
+	}
+
+	index := asc.SamplingIndex
+	if index > 12 {
+		index = utils.GetSampleRateIndex(asc.SampleRate)
+	}
+
+	header := make([]byte, ADTSHeaderSize)
+	utils.SetADtsHeader(header, 0, asc.ObjectType-1, index, asc.ChannelConfig, 0)
+	return header, nil
+}
+
+// AppendADTS 在dst后添加NewADTSHeader生成的ADTS头和AAC帧
+func AppendADTS(dst, header, frame []byte) []byte {
+	offset := len(dst)
+	dst = append(append(dst, header...), frame...)
+	// aac_frame_length(13)包含ADTS头
+	size := len(dst) - offset
+	dst[offset+3] = dst[offset+3]&0xFC | byte(size>>11&0x3)
+	dst[offset+4] = byte(size >> 3)
+	dst[offset+5] = dst[offset+5]&0x1F | byte(size&0x7)<<5
+	return dst
+}
+
+// ADTSHeader2AudioSpecificConfig 根据ADTS头生成AudioSpecificConfig
+func ADTSHeader2AudioSpecificConfig(header utils.ADtsHeader) []byte {
+	// audioObjectType(5) samplingFrequencyIndex(4) channelConfiguration(4) GASpecificConfig(3)
+	objectType := byte(header.Profile() + 1)
+	frequency := byte(header.Frequency())
+	channels := byte(header.Channel())
+	return []byte{objectType<<3 | frequency>>1, frequency&0x1<<7 | channels<<3}
+}
+
+// SplitADTS 切分一个或多个连续的ADTS帧, 返回去掉ADTS头的AAC帧和第一个ADTS头
+func SplitADTS(data []byte) ([][]byte, utils.ADtsHeader, error) {
+	var frames [][]byte
+	var first utils.ADtsHeader
+
+	for offset := 0; offset < len(data); {
+		if !IsADTS(data[offset:]) {
+			return nil, 0, fmt.Errorf("invalid adts header at %d", offset)
+		}
+
+		header, err := utils.ReadADtsFixedHeader(data[offset:])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		headerSize := ADTSHeaderSize
+		// protection_absent为0时, 多2字节crc
+		if header.ProtectionAbsent() == 0 {
+			headerSize += 2
+		}
+
+		frameLength := header.FrameLength()
+		if frameLength < headerSize || offset+frameLength > len(data) {
+			return nil, 0, fmt.Errorf("invalid adts frame length %d", frameLength)
+		}
+
+		if frames == nil {
+			first = header
+		}
+
+		frames = append(frames, data[offset+headerSize:offset+frameLength])
+		offset += frameLength
+	}
+
+	return frames, first, nil
+}
+
+// ConvertADTS 去掉AAC帧的ADTS头, 返回一个或多个AAC帧.
+// 如果音频track没有AudioSpecificConfig, 或者ADTS头中的profile/采样率/通道数发生变化, 使用ADTS头生成新的AudioSpecificConfig,
+// 更新track的编码器信息并作为sequence header返回. 不包含ADTS头的数据原样返回.
+func (m *Muxer) ConvertADTS(data []byte) ([][]byte, []byte, error) {
+	track := m.Tracks.FindTrackWithType(utils.AVMediaTypeAudio)
+	if track == nil {
+		return nil, nil, fmt.Errorf("audio track not found")
+	} else if utils.AVCodecIdAAC != track.GetStream().CodecID {
+		return nil, nil, fmt.Errorf("adts is not supported for codec: %s", track.GetStream().CodecID)
+	} else if !IsADTS(data) {
+		return [][]byte{data}, nil, nil
+	}
+
+	frames, header, err := SplitADTS(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stream := track.GetStream()
+	config := ADTSHeader2AudioSpecificConfig(header)
+	// 只比较前2个字节, 不包含扩展信息
+	if len(stream.Data) >= 2 && bytes.Equal(stream.Data[:2], config) {
+		return frames, nil, nil
+	}
+
+	stream.Data = config
+	stream.HasADTSHeader = false
+	if rate, ok := utils.GetSampleRateFromFrequency(header.Frequency()); ok && rate > 0 {
+		stream.SampleRate = rate
+	}
+
+	if header.Channel() > 0 {
+		stream.Channels = header.Channel()
+	}
+
+	return frames, config, nil
+}
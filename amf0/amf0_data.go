@@ -51,6 +51,16 @@ func (a *Data) Unmarshal(data []byte) error {
 	return nil
 }
 
+// MarshalSize 返回所有元素序列化后的字节数
+func (a *Data) MarshalSize() int {
+	var size int
+	for _, element := range a.elements {
+		size += MarshalSize(element)
+	}
+
+	return size
+}
+
 func (a *Data) Size() int {
 	return len(a.elements)
 }
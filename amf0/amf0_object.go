@@ -28,6 +28,16 @@ func (a *Object) Marshal(dst []byte) (int, error) {
 	return length + 3, nil
 }
 
+// propertiesSize 所有属性和结束标记序列化后的字节数
+func (a *Object) propertiesSize() int {
+	size := 3
+	for _, property := range a.properties {
+		size += 2 + len(property.Name) + MarshalSize(property.Value)
+	}
+
+	return size
+}
+
 func (a *Object) AddProperty(name string, value Element) {
 	a.properties = append(a.properties, &Property{name, value})
 }
@@ -42,6 +52,11 @@ func (a *Object) FindProperty(name string) *Property {
 	return nil
 }
 
+// Properties 返回所有属性
+func (a *Object) Properties() []*Property {
+	return a.properties
+}
+
 func (a *Object) AddStringProperty(name, value string) {
 	a.AddProperty(name, String(value))
 }
@@ -142,13 +142,13 @@ func ReadElement(buffer bufio.BytesReader) (Element, error) {
 
 		return StrictArray(array), nil
 	case DataTypeDate:
-
-		zone, err := buffer.ReadUint16()
+		// date-type = date-marker DOUBLE time-zone
+		date, err := buffer.ReadUint64()
 		if err != nil {
 			return nil, err
 		}
 
-		date, err := buffer.ReadUint64()
+		zone, err := buffer.ReadUint16()
 		if err != nil {
 			return nil, err
 		}
@@ -26,3 +26,29 @@ func TestAMFO(t *testing.T) {
 
 	}
 }
+
+func TestArrayMarshal(t *testing.T) {
+	object := &Object{}
+	object.AddNumberProperty("duration", 10)
+	object.AddStringProperty("encoder", "lkm")
+
+	data := Data{}
+	data.AddString("onMetaData")
+	data.Add(ECMAArray{object})
+	data.Add(StrictArray{Number(1), String("2"), Boolean(true)})
+
+	dst := make([]byte, data.MarshalSize())
+	n, err := data.Marshal(dst)
+	utils.Assert(err == nil)
+	utils.Assert(n == len(dst))
+
+	unmarshal := Data{}
+	utils.Assert(unmarshal.Unmarshal(dst) == nil)
+	utils.Assert(unmarshal.Size() == 3)
+
+	array := ToObject(unmarshal.Get(1))
+	utils.Assert(array != nil)
+	duration, _ := ToNumber(array.FindProperty("duration").Value)
+	utils.Assert(duration == 10)
+	utils.Assert(len(unmarshal.Get(2).(StrictArray)) == 3)
+}
@@ -79,6 +79,17 @@ func (a ECMAArray) Type() DataType {
 	return DataTypeECMAArray
 }
 
+func (a ECMAArray) Marshal(dst []byte) (int, error) {
+	// associative-count
+	binary.BigEndian.PutUint32(dst, uint32(len(a.properties)))
+	n, err := a.Object.Marshal(dst[4:])
+	if err != nil {
+		return 0, err
+	}
+
+	return 4 + n, nil
+}
+
 type StrictArray []Element
 
 func (s StrictArray) Type() DataType {
@@ -86,7 +97,14 @@ func (s StrictArray) Type() DataType {
 }
 
 func (s StrictArray) Marshal(dst []byte) (int, error) {
-	return MarshalElements(s, dst)
+	// array-count
+	binary.BigEndian.PutUint32(dst, uint32(len(s)))
+	n, err := MarshalElements(s, dst[4:])
+	if err != nil {
+		return 0, err
+	}
+
+	return 4 + n, nil
 }
 
 type Date struct {
@@ -99,8 +117,8 @@ func (a Date) Type() DataType {
 }
 
 func (a Date) Marshal(dst []byte) (int, error) {
-	binary.BigEndian.PutUint16(dst, a.zone)
-	binary.BigEndian.PutUint16(dst[2:], a.zone)
+	binary.BigEndian.PutUint64(dst, math.Float64bits(a.date))
+	binary.BigEndian.PutUint16(dst[8:], a.zone)
 	return 10, nil
 }
 
@@ -170,6 +188,44 @@ func MarshalElement(element Element, dst []byte) (int, error) {
 	return 1 + n, nil
 }
 
+// MarshalSize 返回元素序列化后的字节数, 包含类型标记
+func MarshalSize(element Element) int {
+	switch v := element.(type) {
+	case Number:
+		return 1 + 8
+	case Boolean:
+		return 1 + 1
+	case String:
+		return 1 + 2 + len(v)
+	case LongString:
+		return 1 + 4 + len(v)
+	case XMLDocument:
+		return 1 + 4 + len(v.LongString)
+	case Null, Undefined:
+		return 1
+	case Reference:
+		return 1 + 2
+	case Date:
+		return 1 + 10
+	case *Object:
+		return 1 + v.propertiesSize()
+	case ECMAArray:
+		return 1 + 4 + v.propertiesSize()
+	case *ECMAArray:
+		return 1 + 4 + v.propertiesSize()
+	case TypedObject:
+		return 1 + 2 + len(v.ClassName) + v.propertiesSize()
+	case StrictArray:
+		size := 1 + 4
+		for _, e := range v {
+			size += MarshalSize(e)
+		}
+		return size
+	}
+
+	return 1
+}
+
 func MarshalElements(elements []Element, dst []byte) (int, error) {
 	var length int
 	for _, element := range elements {
@@ -183,3 +239,49 @@ func MarshalElements(elements []Element, dst []byte) (int, error) {
 
 	return length, nil
 }
+
+// ToString 返回String或LongString元素的值
+func ToString(element Element) (string, bool) {
+	switch v := element.(type) {
+	case String:
+		return string(v), true
+	case LongString:
+		return string(v), true
+	}
+
+	return "", false
+}
+
+// ToNumber 返回Number元素的值
+func ToNumber(element Element) (float64, bool) {
+	if v, ok := element.(Number); ok {
+		return float64(v), true
+	}
+
+	return 0, false
+}
+
+// ToBoolean 返回Boolean元素的值
+func ToBoolean(element Element) (bool, bool) {
+	if v, ok := element.(Boolean); ok {
+		return bool(v), true
+	}
+
+	return false, false
+}
+
+// ToObject 返回Object/ECMAArray/TypedObject元素的属性集合, 其他类型返回nil
+func ToObject(element Element) *Object {
+	switch v := element.(type) {
+	case *Object:
+		return v
+	case *ECMAArray:
+		return v.Object
+	case ECMAArray:
+		return v.Object
+	case TypedObject:
+		return v.Object
+	}
+
+	return nil
+}
@@ -0,0 +1,276 @@
+package flv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/avc"
+	"github.com/lkmio/avformat/hevc"
+	"github.com/lkmio/avformat/utils"
+)
+
+var (
+	ErrSequenceHeaderNotFound = errors.New("sequence header not found")
+)
+
+// parameterSets 当前decoder configuration record使用的参数集, 不包含start code
+type parameterSets struct {
+	vps []byte
+	sps []byte
+	pps []byte
+}
+
+func (p *parameterSets) equal(other *parameterSets) bool {
+	return bytes.Equal(p.vps, other.vps) && bytes.Equal(p.sps, other.sps) && bytes.Equal(p.pps, other.pps)
+}
+
+func (p *parameterSets) complete(id utils.AVCodecID) bool {
+	return p.sps != nil && p.pps != nil && (utils.AVCodecIdH265 != id || p.vps != nil)
+}
+
+func addStartCode(nalu []byte) []byte {
+	return append([]byte{0x0, 0x0, 0x0, 0x1}, nalu...)
+}
+
+// ParseParameterSets 从H.264/H.265 track的decoder configuration record中获取AVCC的长度前缀字节数和AnnexB格式的vps/sps/pps
+func ParseParameterSets(stream *avformat.AVStream) (int, []byte, error) {
+	lengthSize := 4
+	if utils.AVCodecIdH264 == stream.CodecID && len(stream.Data) > 4 {
+		lengthSize = int(stream.Data[4]&0x3) + 1
+	} else if utils.AVCodecIdH265 == stream.CodecID && len(stream.Data) > 21 {
+		lengthSize = int(stream.Data[21]&0x3) + 1
+	}
+
+	codecData := stream.CodecParameters
+	if codecData == nil && len(stream.Data) > 0 {
+		var err error
+		if utils.AVCodecIdH264 == stream.CodecID {
+			codecData, err = avformat.ParseAVCDecoderConfigurationRecord(stream.Data)
+		} else {
+			codecData, err = avformat.ParseHEVCDecoderConfigurationRecord(stream.Data)
+		}
+
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if codecData == nil {
+		return lengthSize, nil, nil
+	}
+
+	var lists [][][]byte
+	if hevc, ok := codecData.(interface{ VPS() [][]byte }); ok {
+		lists = append(lists, hevc.VPS())
+	}
+
+	var parameterSets []byte
+	add := func(nalu []byte) {
+		parameterSets = append(parameterSets, 0x0, 0x0, 0x0, 0x1)
+		parameterSets = append(parameterSets, nalu...)
+	}
+
+	// 参数集可能已经包含start code
+	lists = append(lists, codecData.SPS(), codecData.PPS())
+	for _, list := range lists {
+		for _, nalu := range list {
+			if IsAnnexB(nalu) {
+				SplitAnnexB(nalu, add)
+			} else if len(nalu) > 0 {
+				add(nalu)
+			}
+		}
+	}
+
+	return lengthSize, parameterSets, nil
+}
+
+// NewVideoCodecData 根据参数集生成decoder configuration record和CodecData, 参数集不包含start code
+func NewVideoCodecData(id utils.AVCodecID, vps, sps, pps []byte) ([]byte, avformat.CodecData, error) {
+	var record []byte
+	var err error
+
+	if utils.AVCodecIdH264 == id {
+		configurationRecord := avc.AVCDecoderConfigurationRecord{}
+		record, err = configurationRecord.Marshal([][]byte{addStartCode(sps)}, [][]byte{addStartCode(pps)})
+	} else if utils.AVCodecIdH265 == id {
+		configurationRecord := hevc.HEVCDecoderConfigurationRecord{}
+		record, err = configurationRecord.Marshal([][]byte{addStartCode(vps)}, [][]byte{addStartCode(sps)}, [][]byte{addStartCode(pps)})
+		if err == nil {
+			err = fillHEVCRecordProfile(record, sps)
+		}
+	} else {
+		return nil, nil, fmt.Errorf("unsupported codec: %s", id)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var codecData avformat.CodecData
+	if utils.AVCodecIdH264 == id {
+		codecData, err = avformat.ParseAVCDecoderConfigurationRecord(record)
+	} else {
+		codecData, err = avformat.ParseHEVCDecoderConfigurationRecord(record)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return record, codecData, nil
+}
+
+// annexBExtraData2Record 将AnnexB格式的编码器信息转换为decoder configuration record
+func annexBExtraData2Record(stream *avformat.AVStream) error {
+	sets := parameterSets{}
+	SplitAnnexB(stream.Data, func(nalu []byte) {
+		switch NalUnitType(stream.CodecID, nalu) {
+		case H264NalSPS, HEVCNalSPS:
+			sets.sps = nalu
+		case H264NalPPS, HEVCNalPPS:
+			sets.pps = nalu
+		case HEVCNalVPS:
+			sets.vps = nalu
+		}
+	})
+
+	if !sets.complete(stream.CodecID) {
+		return fmt.Errorf("incomplete parameter sets in extra data")
+	}
+
+	record, codecData, err := NewVideoCodecData(stream.CodecID, sets.vps, sets.sps, sets.pps)
+	if err != nil {
+		return err
+	}
+
+	stream.Data = record
+	stream.CodecParameters = codecData
+	return nil
+}
+
+// fillHEVCRecordProfile 使用sps中的profile_tier_level, 色度格式和位深填充HEVCDecoderConfigurationRecord
+func fillHEVCRecordProfile(record, sps []byte) error {
+	info, chromaBitDepth, err := parseHEVCSPS(sps)
+	if err != nil {
+		return err
+	}
+
+	// 跳过2字节nalu header
+	rbsp := RemoveEmulationPrevention(sps[2:])
+	if len(rbsp) < 13 || len(record) < 23 {
+		return fmt.Errorf("invalid hevc sps")
+	}
+
+	// sps_video_parameter_set_id(4) sps_max_sub_layers_minus1(3) sps_temporal_id_nesting_flag(1)
+	maxSubLayers := rbsp[0]>>1&0x7 + 1
+	temporalIdNested := rbsp[0] & 0x1
+	// general_profile_space ... general_level_idc, 共12字节
+	copy(record[1:13], rbsp[1:13])
+	// min_spatial_segmentation_idc
+	record[13] = 0xF0
+	record[14] = 0x0
+	// parallelismType
+	record[15] = 0xFC
+	// chroma_format_idc
+	record[16] = 0xFC | byte(info.ChromaFormat)
+	// bit_depth_luma_minus8/bit_depth_chroma_minus8
+	record[17] = 0xF8 | byte(info.BitDepth-8)
+	record[18] = 0xF8 | byte(chromaBitDepth-8)
+	// avgFrameRate
+	record[19] = 0x0
+	record[20] = 0x0
+	// constantFrameRate(2) numTemporalLayers(3) temporalIdNested(1) lengthSizeMinusOne(2)
+	record[21] = maxSubLayers<<3 | temporalIdNested<<2 | 0x3
+	return nil
+}
+
+// ConvertAnnexB 将AnnexB格式的H264/H265视频帧转换为AVCC格式, 去除AUD和带内参数集.
+// 如果视频track没有编码器信息, 使用带内参数集生成decoder configuration record, 并返回sequence header(AVCC格式);
+// 如果带内参数集发生变化并且开启了UpdateSequenceHeader, 也返回新的sequence header.
+// 在获取到第一个sequence header之前, 返回ErrSequenceHeaderNotFound.
+// 返回的frame引用Muxer内部缓冲区, 在下一次调用前有效.
+func (m *Muxer) ConvertAnnexB(data []byte) ([]byte, []byte, error) {
+	track := m.Tracks.FindTrackWithType(utils.AVMediaTypeVideo)
+	if track == nil {
+		return nil, nil, fmt.Errorf("video track not found")
+	}
+
+	stream := track.GetStream()
+	if utils.AVCodecIdH264 != stream.CodecID && utils.AVCodecIdH265 != stream.CodecID {
+		return nil, nil, fmt.Errorf("annexb is not supported for codec: %s", stream.CodecID)
+	}
+
+	// 初始化当前参数集
+	if m.videoParameterSets == nil && stream.CodecParameters != nil && len(stream.CodecParameters.SPS()) > 0 && len(stream.CodecParameters.PPS()) > 0 {
+		m.videoParameterSets = &parameterSets{
+			sps: avc.RemoveStartCode(stream.CodecParameters.SPS()[0]),
+			pps: avc.RemoveStartCode(stream.CodecParameters.PPS()[0]),
+		}
+
+		if codecData, ok := stream.CodecParameters.(*avformat.HEVCCodecData); ok && len(codecData.VPS()) > 0 {
+			m.videoParameterSets.vps = avc.RemoveStartCode(codecData.VPS()[0])
+		}
+	}
+
+	inBand := parameterSets{}
+	frame := m.videoBuffer[:0]
+	SplitAnnexB(data, func(nalu []byte) {
+		switch NalUnitType(stream.CodecID, nalu) {
+		case H264NalSPS:
+			if utils.AVCodecIdH264 == stream.CodecID {
+				inBand.sps = nalu
+				return
+			}
+		case H264NalPPS:
+			if utils.AVCodecIdH264 == stream.CodecID {
+				inBand.pps = nalu
+				return
+			}
+		case H264NalAUD:
+			if utils.AVCodecIdH264 == stream.CodecID {
+				return
+			}
+		case HEVCNalVPS:
+			inBand.vps = nalu
+			return
+		case HEVCNalSPS:
+			inBand.sps = nalu
+			return
+		case HEVCNalPPS:
+			inBand.pps = nalu
+			return
+		case HEVCNalAUD:
+			return
+		}
+
+		frame = appendAVCCNalu(frame, nalu)
+	})
+
+	m.videoBuffer = frame
+
+	var sequenceHeader []byte
+	if inBand.complete(stream.CodecID) && (m.videoParameterSets == nil || (m.UpdateSequenceHeader && !m.videoParameterSets.equal(&inBand))) {
+		// 拷贝参数集, 不引用输入数据
+		sets := &parameterSets{
+			vps: append([]byte(nil), inBand.vps...),
+			sps: append([]byte(nil), inBand.sps...),
+			pps: append([]byte(nil), inBand.pps...),
+		}
+
+		record, codecData, err := NewVideoCodecData(stream.CodecID, sets.vps, sets.sps, sets.pps)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		m.videoParameterSets = sets
+		stream.Data = record
+		stream.CodecParameters = codecData
+		sequenceHeader = record
+	} else if m.videoParameterSets == nil {
+		return nil, nil, ErrSequenceHeaderNotFound
+	}
+
+	return frame, sequenceHeader, nil
+}
@@ -2,6 +2,7 @@ package flv
 
 import (
 	"fmt"
+	"github.com/lkmio/avformat"
 	"github.com/lkmio/avformat/bufio"
 	"github.com/lkmio/avformat/utils"
 )
@@ -9,7 +10,7 @@ import (
 type SoundFormat int
 
 const (
-	SoundFormatPCMPlatform         = SoundFormat(0) // 按照创建文件的平台字序, 16-bit
+	SoundFormatPCMPlatform         = SoundFormat(0) // 按照创建文件的平台字序, 实际文件都来自x86/ARM编码器, 16-bit按小端处理(与ffmpeg一致)
 	SoundFormatADPCM               = SoundFormat(1)
 	SoundFormatMP3                 = SoundFormat(2)
 	SoundFormatPCMLittle           = SoundFormat(3) // 如果SoundRate是8-bit无符号字节, 16-bit有符号字节
@@ -24,8 +25,29 @@ const (
 	SoundFormatExHeader            = SoundFormat(9)
 )
 
+// AudioFourCC 增强flv的音频编码器FourCC
+type AudioFourCC uint32
+
+const (
+	AudioFourCCAC3  = AudioFourCC(0x61632D33) // ac-3
+	AudioFourCCEAC3 = AudioFourCC(0x65632D33) // ec-3
+	AudioFourCCOpus = AudioFourCC(0x4F707573) // Opus
+	AudioFourCCMP3  = AudioFourCC(0x2E6D7033) // .mp3
+	AudioFourCCFLAC = AudioFourCC(0x664C6143) // fLaC
+	AudioFourCCAAC  = AudioFourCC(0x6D703461) // mp4a
+)
+
 var (
-	SupportedSampleRates = [4]int{5500, 11000, 22000, 44000}
+	SupportedSampleRates = [4]int{5512, 11025, 22050, 44100}
+
+	audioFourCCCodecs = map[AudioFourCC]utils.AVCodecID{
+		AudioFourCCAC3:  utils.AVCodecIdAC3,
+		AudioFourCCEAC3: utils.AVCodecIdEAC3,
+		AudioFourCCOpus: utils.AVCodecIdOPUS,
+		AudioFourCCMP3:  utils.AVCodecIdMP3,
+		AudioFourCCFLAC: utils.AVCodecIdFLAC,
+		AudioFourCCAAC:  utils.AVCodecIdAAC,
+	}
 )
 
 type AudioData struct {
@@ -33,6 +55,9 @@ type AudioData struct {
 	Rate        int // 0-5.5k/1-11k/2-22k/3-44k
 	Size        int // 0-8bit/1-16bit
 	Type        int // 0-Mono/1-Stereo
+
+	PacketType PacketType  // Unmarshal解析出的包类型, 仅AAC和增强flv有效
+	FourCC     AudioFourCC // 增强flv的编码器
 }
 
 func (a *AudioData) Marshal(dst []byte, sequenceHeader bool) int {
@@ -75,17 +100,135 @@ func (a *AudioData) Unmarshal(data []byte) ([]byte, bool, error) {
 			return nil, false, err
 		}
 
+		a.PacketType = PacketType(pktType)
 		return reader.RemainingBytes(), pktType == 0, nil
+	} else if SoundFormatExHeader == a.SoundFormat {
+		return a.unmarshalExHeader(reader, flags)
 	} else {
 		return reader.RemainingBytes(), false, err
 	}
 }
 
+// unmarshalExHeader 解析增强flv的音频tag头
+func (a *AudioData) unmarshalExHeader(reader bufio.BytesReader, flags byte) ([]byte, bool, error) {
+	a.PacketType = PacketType(flags & 0xF)
+
+	// 跳过ModEx数据
+	for AudioPacketTypeModEx == a.PacketType {
+		size, err := reader.ReadUint8()
+		if err != nil {
+			return nil, false, err
+		}
+
+		modExDataSize := int(size) + 1
+		if modExDataSize == 256 {
+			size16, err := reader.ReadUint16()
+			if err != nil {
+				return nil, false, err
+			}
+
+			modExDataSize = int(size16) + 1
+		}
+
+		if _, err = reader.ReadBytes(modExDataSize); err != nil {
+			return nil, false, err
+		}
+
+		// modExType(4) audioPacketType(4)
+		next, err := reader.ReadUint8()
+		if err != nil {
+			return nil, false, err
+		}
+
+		a.PacketType = PacketType(next & 0xF)
+	}
+
+	if AudioPacketTypeMultiTrack == a.PacketType {
+		return nil, false, fmt.Errorf("audio multitrack is not supported")
+	}
+
+	fourCC, err := reader.ReadUint32()
+	if err != nil {
+		return nil, false, err
+	}
+
+	a.FourCC = AudioFourCC(fourCC)
+	return reader.RemainingBytes(), AudioPacketTypeSequenceStart == a.PacketType, nil
+}
+
+// AudioConfig 根据音频tag头返回编码器ID和音频参数
+// 增强flv的音频参数由sequence header决定, 返回的采样率和通道数为0.
+func (a *AudioData) AudioConfig() (utils.AVCodecID, avformat.AudioConfig, error) {
+	if SoundFormatExHeader == a.SoundFormat {
+		id, ok := audioFourCCCodecs[a.FourCC]
+		if !ok {
+			return utils.AVCodecIdNONE, avformat.AudioConfig{}, fmt.Errorf("unknow audio fourcc: %x", uint32(a.FourCC))
+		}
+
+		return id, avformat.AudioConfig{SampleSize: 16}, nil
+	}
+
+	bits := 16
+	if 0 == a.Size {
+		bits = 8
+	}
+
+	id, err := SoundFormat2AVCodecID(a.SoundFormat, bits)
+	if err != nil {
+		return utils.AVCodecIdNONE, avformat.AudioConfig{}, err
+	}
+
+	return id, avformat.AudioConfig{
+		SampleRate:    SoundFormatSampleRate(a.SoundFormat, a.Rate),
+		SampleSize:    bits,
+		Channels:      SoundFormatChannels(a.SoundFormat, a.Type),
+		HasADTSHeader: false,
+	}, nil
+}
+
+// ParseAudioSequenceHeader 使用sequence header中的编码器信息更新音频参数.
+// AAC解析AudioSpecificConfig, Opus解析OpusHead, FLAC解析STREAMINFO, 其他编码器不处理.
+func ParseAudioSequenceHeader(id utils.AVCodecID, data []byte, config *avformat.AudioConfig) error {
+	switch id {
+	case utils.AVCodecIdAAC:
+		asc, err := ParseAudioSpecificConfig(data)
+		if err != nil {
+			return err
+		}
+
+		config.SampleRate = asc.OutputSampleRate()
+		config.Channels = asc.OutputChannels()
+		config.SampleSize = 16
+	case utils.AVCodecIdOPUS:
+		head, err := ParseOpusHead(data)
+		if err != nil {
+			return err
+		}
+
+		config.SampleRate = OpusSampleRate
+		config.Channels = head.Channels
+		config.SampleSize = 16
+	case utils.AVCodecIdFLAC:
+		info, err := ParseFLACStreamInfo(data)
+		if err != nil {
+			return err
+		}
+
+		config.SampleRate = info.SampleRate
+		config.Channels = info.Channels
+		config.SampleSize = info.BitsPerSample
+	}
+
+	return nil
+}
+
 func AVCodecID2SoundFormat(id utils.AVCodecID, sampleRate int) (SoundFormat, error) {
 	soundFormat, ok := SupportedCodecs[id]
 	if !ok {
 		return SoundFormat(-1), fmt.Errorf("unsupported audio codec: %v", id)
-	} else if utils.AVCodecIdNELLYMOSER == soundFormat {
+	}
+
+	if utils.AVCodecIdNELLYMOSER == id {
 		if 8000 == sampleRate {
 			soundFormat = SoundFormatNELLYMOSER8KHZMono
 		} else if 16000 == sampleRate {
@@ -93,37 +236,42 @@ func AVCodecID2SoundFormat(id utils.AVCodecID, sampleRate int) (SoundFormat, err
 		} else {
 			soundFormat = SoundFormatNELLYMOSER
 		}
+	} else if utils.AVCodecIdMP3 == id && 8000 == sampleRate {
+		soundFormat = SoundFormatMP38K
 	}
 
 	return soundFormat.(SoundFormat), nil
 }
 
+// SoundFormat2AVCodecID sampleSize为采样位深(8/16)
 func SoundFormat2AVCodecID(format SoundFormat, sampleSize int) (utils.AVCodecID, error) {
-	for avCodec, flvCodec := range SupportedCodecs {
-		if flvCodec != format {
-			continue
+	switch format {
+	case SoundFormatPCMPlatform:
+		if 8 == sampleSize {
+			return utils.AVCodecIdPCMU8, nil
 		}
 
-		if SoundFormatPCMPlatform == format {
-			if sampleSize == 8000 {
-				return utils.AVCodecIdPCMU8, nil
-			} else {
-				//id = utils.AVCodecIdPCMS16BE
-				return utils.AVCodecIdPCMS16LE, nil
-			}
-		} else if SoundFormatPCMLittle == format {
-			if sampleSize == 8000 {
-				return utils.AVCodecIdPCMU8, nil
-			} else {
-				return utils.AVCodecIdPCMS16LE, nil
-			}
+		return utils.AVCodecIdPCMS16LE, nil
+	case SoundFormatPCMLittle:
+		if 8 == sampleSize {
+			return utils.AVCodecIdPCMU8, nil
 		}
 
-		return avCodec, nil
-	}
-
-	if SoundFormatNELLYMOSER16KHZMono == format || SoundFormatNELLYMOSER8KHZMono == format || SoundFormatNELLYMOSER == format {
+		return utils.AVCodecIdPCMS16LE, nil
+	case SoundFormatADPCM:
+		return utils.AVCodecIdADPCMSWF, nil
+	case SoundFormatMP3, SoundFormatMP38K:
+		return utils.AVCodecIdMP3, nil
+	case SoundFormatNELLYMOSER16KHZMono, SoundFormatNELLYMOSER8KHZMono, SoundFormatNELLYMOSER:
 		return utils.AVCodecIdNELLYMOSER, nil
+	case SoundFormatG711A:
+		return utils.AVCodecIdPCMALAW, nil
+	case SoundFormatG711B:
+		return utils.AVCodecIdPCMMULAW, nil
+	case SoundFormatAAC:
+		return utils.AVCodecIdAAC, nil
+	case SoundFormatSpeex:
+		return utils.AVCodecIdSPEEX, nil
 	}
 
 	return utils.AVCodecIdNONE, fmt.Errorf("unknow sound format: %d", format)
@@ -137,6 +285,57 @@ func GetSampleRate(rate int) int {
 	return -1
 }
 
+// SoundFormatSampleRate 返回音频格式的实际采样率, 部分格式的采样率由格式决定, 忽略SoundRate字段
+func SoundFormatSampleRate(format SoundFormat, rate int) int {
+	switch format {
+	case SoundFormatNELLYMOSER8KHZMono, SoundFormatG711A, SoundFormatG711B, SoundFormatMP38K:
+		return 8000
+	case SoundFormatNELLYMOSER16KHZMono, SoundFormatSpeex:
+		return 16000
+	}
+
+	return GetSampleRate(rate)
+}
+
+// SoundFormatChannels 返回音频格式的实际通道数, Speex和Nellymoser 8k/16k固定为单通道
+func SoundFormatChannels(format SoundFormat, type_ int) int {
+	switch format {
+	case SoundFormatNELLYMOSER8KHZMono, SoundFormatNELLYMOSER16KHZMono, SoundFormatSpeex:
+		return 1
+	}
+
+	if 1 == type_ {
+		return 2
+	}
+
+	return 1
+}
+
+// sampleRate2SoundRate 返回采样率在flv中的SoundRate
+func sampleRate2SoundRate(format SoundFormat, sampleRate int) (int, error) {
+	switch format {
+	case SoundFormatAAC:
+		// AAC固定为44k, 实际采样率由AudioSpecificConfig决定
+		return 3, nil
+	case SoundFormatSpeex, SoundFormatNELLYMOSER8KHZMono, SoundFormatNELLYMOSER16KHZMono, SoundFormatG711A, SoundFormatG711B, SoundFormatMP38K:
+		// 采样率由格式决定
+		return 0, nil
+	}
+
+	for i, v := range SupportedSampleRates {
+		if v == sampleRate {
+			return i, nil
+		}
+	}
+
+	// 48k的mp3使用44k标记
+	if SoundFormatMP3 == format && 48000 == sampleRate {
+		return 3, nil
+	}
+
+	return -1, fmt.Errorf("unsupported sample rate %d for sound format %d", sampleRate, format)
+}
+
 func NewAudioData(id utils.AVCodecID, sampleRate, sampleSize, channels int) (*AudioData, error) {
 	format, err := AVCodecID2SoundFormat(id, sampleRate)
 	if err != nil {
@@ -144,19 +343,15 @@ func NewAudioData(id utils.AVCodecID, sampleRate, sampleSize, channels int) (*Au
 	}
 
 	// 0-5.5k/1-11k/2-22k/3-44k
-	var rate int
-	for i, v := range SupportedSampleRates {
-		if v == sampleRate {
-			rate = i
-		}
+	rate, err := sampleRate2SoundRate(format, sampleRate)
+	if err != nil {
+		return nil, err
 	}
 
-	// 0-8bit/1-16bit
-	var size int
-	if sampleSize == 8000 {
+	// 0-8bit/1-16bit, 压缩格式固定为16bit
+	size := 1
+	if utils.AVCodecIdPCMU8 == id || ((SoundFormatPCMPlatform == format || SoundFormatPCMLittle == format) && 8 == sampleSize) {
 		size = 0
-	} else {
-		size = 1
 	}
 
 	// 0-Mono/1-Stereo
@@ -173,11 +368,8 @@ func NewAudioData(id utils.AVCodecID, sampleRate, sampleSize, channels int) (*Au
 	}
 
 	if SoundFormatAAC == data.SoundFormat {
-		data.Rate = 3
 		data.Type = 1
-	} else if SoundFormatSpeex == data.SoundFormat {
-		data.Rate = 0
-		data.Size = 1
+	} else if SoundFormatSpeex == data.SoundFormat || SoundFormatNELLYMOSER8KHZMono == data.SoundFormat || SoundFormatNELLYMOSER16KHZMono == data.SoundFormat {
 		data.Type = 0
 	}
 
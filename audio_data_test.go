@@ -0,0 +1,147 @@
+package flv
+
+import (
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"testing"
+)
+
+func TestAudioDataMapping(t *testing.T) {
+	// avformat音频参数 -> flv音频tag头
+	marshalCases := []struct {
+		id         utils.AVCodecID
+		sampleRate int
+		sampleSize int
+		channels   int
+		flags      byte
+	}{
+		{utils.AVCodecIdPCMU8, 44100, 8, 1, 0x3C},
+		{utils.AVCodecIdPCMS16LE, 22050, 16, 2, 0x3B},
+		{utils.AVCodecIdADPCMSWF, 5512, 16, 1, 0x12},
+		{utils.AVCodecIdMP3, 44100, 16, 2, 0x2F},
+		{utils.AVCodecIdMP3, 48000, 16, 2, 0x2F},
+		{utils.AVCodecIdMP3, 8000, 16, 1, 0xE2},
+		{utils.AVCodecIdNELLYMOSER, 8000, 16, 1, 0x52},
+		{utils.AVCodecIdNELLYMOSER, 16000, 16, 1, 0x42},
+		{utils.AVCodecIdNELLYMOSER, 22050, 16, 1, 0x6A},
+		{utils.AVCodecIdPCMALAW, 8000, 16, 1, 0x72},
+		{utils.AVCodecIdPCMMULAW, 8000, 16, 1, 0x82},
+		{utils.AVCodecIdAAC, 48000, 16, 1, 0xAF},
+		{utils.AVCodecIdSPEEX, 16000, 16, 1, 0xB2},
+	}
+
+	for _, c := range marshalCases {
+		data, err := NewAudioData(c.id, c.sampleRate, c.sampleSize, c.channels)
+		if err != nil {
+			t.Fatalf("%s %d: %s", c.id, c.sampleRate, err.Error())
+		}
+
+		dst := make([]byte, 2)
+		data.Marshal(dst, false)
+		if dst[0] != c.flags {
+			t.Fatalf("%s %d: expected flags 0x%X, got 0x%X", c.id, c.sampleRate, c.flags, dst[0])
+		}
+	}
+
+	// 无法表示的采样率, flv没有大端PCM
+	_, err := NewAudioData(utils.AVCodecIdPCMS16LE, 48000, 16, 2)
+	utils.Assert(err != nil)
+	_, err = NewAudioData(utils.AVCodecIdPCMS16BE, 11025, 16, 1)
+	utils.Assert(err != nil)
+
+	// flv音频tag头 -> avformat音频参数
+	unmarshalCases := []struct {
+		flags      byte
+		id         utils.AVCodecID
+		sampleRate int
+		sampleSize int
+		channels   int
+	}{
+		{0x3C, utils.AVCodecIdPCMU8, 44100, 8, 1},
+		{0x0C, utils.AVCodecIdPCMU8, 44100, 8, 1},
+		{0x3B, utils.AVCodecIdPCMS16LE, 22050, 16, 2},
+		{0x06, utils.AVCodecIdPCMS16LE, 11025, 16, 1},
+		{0x12, utils.AVCodecIdADPCMSWF, 5512, 16, 1},
+		{0x2F, utils.AVCodecIdMP3, 44100, 16, 2},
+		{0xE2, utils.AVCodecIdMP3, 8000, 16, 1},
+		{0x52, utils.AVCodecIdNELLYMOSER, 8000, 16, 1},
+		{0x42, utils.AVCodecIdNELLYMOSER, 16000, 16, 1},
+		{0x6A, utils.AVCodecIdNELLYMOSER, 22050, 16, 1},
+		{0x72, utils.AVCodecIdPCMALAW, 8000, 16, 1},
+		{0x83, utils.AVCodecIdPCMMULAW, 8000, 16, 2},
+		{0xAF, utils.AVCodecIdAAC, 44100, 16, 2},
+		{0xB2, utils.AVCodecIdSPEEX, 16000, 16, 1},
+	}
+
+	for _, c := range unmarshalCases {
+		data := AudioData{}
+		_, _, err = data.Unmarshal([]byte{c.flags, 0x1})
+		utils.Assert(err == nil)
+
+		id, config, err := data.AudioConfig()
+		if err != nil {
+			t.Fatalf("0x%X: %s", c.flags, err.Error())
+		}
+
+		actual := fmt.Sprint(id, config.SampleRate, config.SampleSize, config.Channels)
+		if expected := fmt.Sprint(c.id, c.sampleRate, c.sampleSize, c.channels); actual != expected {
+			t.Fatalf("0x%X: expected %s, got %s", c.flags, expected, actual)
+		}
+	}
+}
+
+func TestAudioSpecificConfig(t *testing.T) {
+	cases := []struct {
+		name       string
+		data       []byte
+		objectType int
+		sampleRate int
+		channels   int
+		sbr        bool
+		ps         bool
+	}{
+		{"lc 48k mono", []byte{0x11, 0x88}, AACObjectTypeLC, 48000, 1, false, false},
+		{"explicit sample rate", []byte{0x17, 0x80, 0x2A, 0xF8, 0x10}, AACObjectTypeLC, 22000, 2, false, false},
+		{"he-aac", []byte{0x2B, 0x11, 0x88, 0x00}, AACObjectTypeLC, 48000, 2, true, false},
+		{"he-aac v2", []byte{0xEB, 0x09, 0x88, 0x00}, AACObjectTypeLC, 48000, 2, true, true},
+		{"backward compatible sbr/ps", []byte{0x13, 0x08, 0x56, 0xE5, 0x9D, 0x48, 0x80}, AACObjectTypeLC, 48000, 2, true, true},
+		{"program config element", []byte{0x12, 0x00, 0x05, 0x04, 0x05, 0x00, 0x21, 0x10}, AACObjectTypeLC, 44100, 5, false, false},
+		{"escape object type", []byte{0xF9, 0x46, 0x40}, 42, 48000, 2, false, false},
+	}
+
+	for _, c := range cases {
+		config, err := ParseAudioSpecificConfig(c.data)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err.Error())
+		}
+
+		actual := fmt.Sprint(config.ObjectType, config.OutputSampleRate(), config.OutputChannels(), config.SBR, config.PS)
+		if expected := fmt.Sprint(c.objectType, c.sampleRate, c.channels, c.sbr, c.ps); actual != expected {
+			t.Fatalf("%s: expected %s, got %s", c.name, expected, actual)
+		}
+	}
+
+	// 长度不足和保留的通道配置
+	_, err := ParseAudioSpecificConfig([]byte{0x12})
+	utils.Assert(err != nil)
+	_, err = ParseAudioSpecificConfig([]byte{0x11, 0xC0})
+	utils.Assert(err != nil)
+}
+
+func TestAudioSequenceHeader(t *testing.T) {
+	opusHead := []byte{'O', 'p', 'u', 's', 'H', 'e', 'a', 'd', 0x1, 0x2, 0x38, 0x1, 0x44, 0xAC, 0x0, 0x0, 0x0, 0x0, 0x0}
+	config := avformat.AudioConfig{}
+	utils.Assert(ParseAudioSequenceHeader(utils.AVCodecIdOPUS, opusHead, &config) == nil)
+	utils.Assert(config.SampleRate == 48000 && config.Channels == 2)
+
+	head, err := ParseOpusHead(opusHead)
+	utils.Assert(err == nil)
+	utils.Assert(head.PreSkip == 312 && head.InputSampleRate == 44100)
+
+	// 96000Hz 6通道 24bit
+	streamInfo := []byte{'f', 'L', 'a', 'C', 0x80, 0x0, 0x0, 0x22, 0x10, 0x0, 0x10, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x17, 0x70, 0x0b, 0x70, 0x0, 0x0, 0x0, 0x0}
+	config = avformat.AudioConfig{}
+	utils.Assert(ParseAudioSequenceHeader(utils.AVCodecIdFLAC, streamInfo, &config) == nil)
+	utils.Assert(config.SampleRate == 96000 && config.Channels == 6 && config.SampleSize == 24)
+}
@@ -0,0 +1,184 @@
+package flv
+
+import (
+	"fmt"
+	"github.com/lkmio/avformat/bufio"
+)
+
+const (
+	AV1OBUSequenceHeader = 1
+)
+
+// readLEB128 读取leb128编码的无符号整数, 返回值和占用的字节数
+func readLEB128(data []byte) (int, int) {
+	var value int
+	for i := 0; i < 8 && i < len(data); i++ {
+		value |= int(data[i]&0x7F) << (i * 7)
+		if data[i]&0x80 == 0 {
+			return value, i + 1
+		}
+	}
+
+	return 0, -1
+}
+
+// readUVLC 读取AV1 uvlc()
+func readUVLC(reader *bufio.BitsReader) int {
+	var zeros int
+	for zeros < 32 && reader.Read(1) == 0 {
+		zeros++
+	}
+
+	if zeros >= 32 {
+		return 1<<32 - 1
+	}
+
+	return int(reader.Read(zeros)) + 1<<zeros - 1
+}
+
+// ParseAV1CodecConfigurationRecord 解析AV1CodecConfigurationRecord, 位深和色度采样取自record头, 分辨率和帧率取自configOBUs中的sequence header
+func ParseAV1CodecConfigurationRecord(record []byte) (*VideoInfo, error) {
+	// marker(1) version(7)
+	if len(record) < 4 || record[0]&0x80 == 0 {
+		return nil, fmt.Errorf("invalid av1 codec configuration record")
+	}
+
+	// seq_profile(3) seq_level_idx_0(5)
+	// seq_tier_0(1) high_bitdepth(1) twelve_bit(1) monochrome(1) chroma_subsampling_x(1) chroma_subsampling_y(1) chroma_sample_position(2)
+	info := &VideoInfo{
+		Profile:  int(record[1] >> 5),
+		Level:    int(record[1] & 0x1F),
+		Tier:     int(record[2] >> 7),
+		BitDepth: 8,
+	}
+
+	if record[2]>>6&0x1 == 1 {
+		info.BitDepth = 10
+		if record[2]>>5&0x1 == 1 {
+			info.BitDepth = 12
+		}
+	}
+
+	subsamplingX, subsamplingY := record[2]>>3&0x1, record[2]>>2&0x1
+	if record[2]>>4&0x1 == 1 {
+		info.ChromaFormat = ChromaFormatMonochrome
+	} else if subsamplingX == 1 && subsamplingY == 1 {
+		info.ChromaFormat = ChromaFormat420
+	} else if subsamplingX == 1 {
+		info.ChromaFormat = ChromaFormat422
+	} else {
+		info.ChromaFormat = ChromaFormat444
+	}
+
+	// 查找sequence header OBU
+	for offset := 4; offset < len(record); {
+		// obu_forbidden_bit(1) obu_type(4) obu_extension_flag(1) obu_has_size_field(1) obu_reserved_1bit(1)
+		header := record[offset]
+		obuType := int(header >> 3 & 0xF)
+		offset++
+		if header&0x4 != 0 {
+			offset++
+		}
+
+		size := len(record) - offset
+		if header&0x2 != 0 {
+			value, n := readLEB128(record[offset:])
+			if n < 0 {
+				return nil, fmt.Errorf("invalid av1 obu size")
+			}
+
+			offset += n
+			size = value
+		}
+
+		if offset+size > len(record) {
+			return nil, fmt.Errorf("invalid av1 obu size")
+		} else if AV1OBUSequenceHeader == obuType {
+			if err := parseAV1SequenceHeader(record[offset:offset+size], info); err != nil {
+				return nil, err
+			}
+
+			break
+		}
+
+		offset += size
+	}
+
+	return info, nil
+}
+
+// parseAV1SequenceHeader 解析sequence_header_obu中的分辨率和帧率
+func parseAV1SequenceHeader(data []byte, info *VideoInfo) error {
+	reader := &bufio.BitsReader{Data: data}
+	// seq_profile(3) still_picture(1)
+	info.Profile = int(reader.Read(3))
+	reader.Seek(1)
+
+	// reduced_still_picture_header
+	if reader.Read(1) == 1 {
+		info.Level = int(reader.Read(5))
+	} else {
+		var decoderModelInfoPresent bool
+		var bufferDelayLength int
+
+		// timing_info_present_flag
+		if reader.Read(1) == 1 {
+			numUnitsInDisplayTick := reader.Read(32)
+			timeScale := reader.Read(32)
+			ticksPerPicture := 1
+			// equal_picture_interval
+			if reader.Read(1) == 1 {
+				ticksPerPicture = readUVLC(reader) + 1
+			}
+
+			if numUnitsInDisplayTick > 0 {
+				info.FrameRate = float64(timeScale) / float64(numUnitsInDisplayTick*uint64(ticksPerPicture))
+			}
+
+			// decoder_model_info_present_flag
+			if decoderModelInfoPresent = reader.Read(1) == 1; decoderModelInfoPresent {
+				bufferDelayLength = int(reader.Read(5)) + 1
+				// num_units_in_decoding_tick(32) buffer_removal_time_length_minus_1(5) frame_presentation_time_length_minus_1(5)
+				reader.Seek(42)
+			}
+		}
+
+		initialDisplayDelayPresent := reader.Read(1) == 1
+		operatingPoints := int(reader.Read(5)) + 1
+		for i := 0; i < operatingPoints; i++ {
+			// operating_point_idc
+			reader.Seek(12)
+			level := int(reader.Read(5))
+			tier := 0
+			if level > 7 {
+				tier = int(reader.Read(1))
+			}
+
+			if i == 0 {
+				info.Level, info.Tier = level, tier
+			}
+
+			// decoder_model_present_for_this_op
+			if decoderModelInfoPresent && reader.Read(1) == 1 {
+				// decoder_buffer_delay, encoder_buffer_delay, low_delay_mode_flag
+				reader.Seek(2*bufferDelayLength + 1)
+			}
+
+			// initial_display_delay_present_for_this_op
+			if initialDisplayDelayPresent && reader.Read(1) == 1 {
+				reader.Seek(4)
+			}
+		}
+	}
+
+	widthBits := int(reader.Read(4)) + 1
+	heightBits := int(reader.Read(4)) + 1
+	info.Width = int(reader.Read(widthBits)) + 1
+	info.Height = int(reader.Read(heightBits)) + 1
+
+	if overflow(reader) {
+		return fmt.Errorf("invalid av1 sequence header")
+	}
+
+	return nil
+}
@@ -0,0 +1,352 @@
+package flv
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+var (
+	ErrSlowConsumer      = errors.New("subscriber queue overflow")
+	ErrBroadcasterClosed = errors.New("broadcaster closed")
+)
+
+// Broadcaster 将一个推流端的tag分发给多个订阅者. 所有订阅者共享同一份TagBuffer, 不按订阅者拷贝.
+// 新的订阅者从GOPCache的关键帧开始; 每个订阅者有独立的有界队列, 队列满时先丢弃未发送的非关键视频帧,
+// 并等待下一个关键帧, 仍然放不下时断开该订阅者. 线程安全.
+type Broadcaster struct {
+	QueueSize int // 每个订阅者最多排队的tag数, 0不限制. 应大于GOP缓存的tag数
+
+	mutex       sync.Mutex
+	cache       *GOPCache
+	subscribers map[*Subscriber]struct{}
+	splitter    tagSplitter
+	closed      bool
+}
+
+// Subscriber 订阅者, 通过Read或WriteTo读取tag
+type Subscriber struct {
+	broadcaster *Broadcaster
+	header      []byte // flv头和PreviousTagSize0
+
+	mutex   sync.Mutex
+	signal  chan struct{}
+	queue   []*TagBuffer
+	audio   bool // 是否接收音频
+	video   bool // 是否接收视频
+	joining bool // 加入时没有缓存关键帧, 丢弃第一个关键帧之前的音视频
+	waitKey bool // 丢帧后等待关键帧, 丢弃非关键视频帧
+	err     error
+	dropped int
+}
+
+// Header 返回订阅者的flv头和PreviousTagSize0, TypeFlag只包含订阅的track
+func (s *Subscriber) Header() []byte {
+	return s.header
+}
+
+// Dropped 返回因为消费过慢丢弃的tag数
+func (s *Subscriber) Dropped() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.dropped
+}
+
+// push 将tag加入队列, 队列满时执行丢帧策略. 返回false表示订阅者因消费过慢被断开
+func (s *Subscriber) push(tag *TagBuffer, limit int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err != nil || !s.accept(tag) {
+		return true
+	}
+
+	media := TagTypeScriptData != tag.Type && !tag.SequenceHeader
+	if media && s.joining {
+		if !tag.Key {
+			return true
+		}
+
+		s.joining = false
+	}
+
+	if limit > 0 && len(s.queue) >= limit {
+		// 丢弃后的非关键帧无法解码, 等待下一个关键帧
+		if s.dropNonKeyVideo() {
+			s.waitKey = true
+		}
+
+		if len(s.queue) >= limit {
+			s.closeLocked(ErrSlowConsumer)
+			return false
+		}
+	}
+
+	if TagTypeVideoData == tag.Type && media && s.waitKey {
+		if !tag.Key {
+			s.dropped++
+			return true
+		}
+
+		s.waitKey = false
+	}
+
+	tag.Retain()
+	s.queue = append(s.queue, tag)
+	s.notify()
+	return true
+}
+
+// accept 返回是否接收tag
+func (s *Subscriber) accept(tag *TagBuffer) bool {
+	return (TagTypeAudioData != tag.Type || s.audio) && (TagTypeVideoData != tag.Type || s.video)
+}
+
+// dropNonKeyVideo 丢弃队列中的非关键视频帧, 返回是否有帧被丢弃
+func (s *Subscriber) dropNonKeyVideo() bool {
+	queue := s.queue[:0]
+	for _, tag := range s.queue {
+		if TagTypeVideoData == tag.Type && !tag.Key && !tag.SequenceHeader {
+			tag.Release()
+			s.dropped++
+			continue
+		}
+
+		queue = append(queue, tag)
+	}
+
+	dropped := len(queue) < len(s.queue)
+	for i := len(queue); i < len(s.queue); i++ {
+		s.queue[i] = nil
+	}
+
+	s.queue = queue
+	return dropped
+}
+
+func (s *Subscriber) notify() {
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Subscriber) closeLocked(err error) {
+	if s.err != nil {
+		return
+	}
+
+	s.err = err
+	// 被断开的订阅者不再发送排队的数据
+	if err != io.EOF {
+		s.releaseQueue()
+	}
+
+	s.notify()
+}
+
+func (s *Subscriber) releaseQueue() {
+	for i, tag := range s.queue {
+		tag.Release()
+		s.queue[i] = nil
+	}
+
+	s.queue = s.queue[:0]
+}
+
+// Read 阻塞读取排队的tag, 调用方发送后负责Release每个tag.
+// 推流结束时先读完排队的tag再返回io.EOF, 被断开时返回ErrSlowConsumer.
+func (s *Subscriber) Read() ([]*TagBuffer, error) {
+	for {
+		s.mutex.Lock()
+		if len(s.queue) > 0 {
+			tags := s.queue
+			s.queue = nil
+			s.mutex.Unlock()
+			return tags, nil
+		} else if s.err != nil {
+			err := s.err
+			s.mutex.Unlock()
+			return nil, err
+		}
+
+		s.mutex.Unlock()
+		<-s.signal
+	}
+}
+
+// WriteTo 写入flv头和所有tag, 直到推流结束, 订阅者被断开或者写入失败
+func (s *Subscriber) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(s.header)
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	var buffers net.Buffers
+	for {
+		tags, err := s.Read()
+		if err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+
+		buffers = buffers[:0]
+		for _, tag := range tags {
+			buffers = append(buffers, tag.Data)
+		}
+
+		vector := buffers
+		written, err := vector.WriteTo(w)
+		total += written
+		for _, tag := range tags {
+			tag.Release()
+		}
+
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// Close 取消订阅并释放排队的tag
+func (s *Subscriber) Close() {
+	s.broadcaster.unsubscribe(s)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closeLocked(io.ErrClosedPipe)
+	s.releaseQueue()
+}
+
+// Cache 返回GOP缓存, 修改缓存参数需要在推流前进行
+func (b *Broadcaster) Cache() *GOPCache {
+	return b.cache
+}
+
+// Write 输入推流端的flv流, 可以是任意分片
+func (b *Broadcaster) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	err := b.splitter.split(p, func(flag TypeFlag) {
+		b.cache.SetHeader(flag.ExistAudio(), flag.ExistVideo())
+	}, func(tag *TagBuffer) {
+		b.writeTag(tag)
+		tag.Release()
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// WriteTag 分发一个tag, 调用方仍然持有自己的引用
+func (b *Broadcaster) WriteTag(tag *TagBuffer) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.writeTag(tag)
+}
+
+func (b *Broadcaster) writeTag(tag *TagBuffer) {
+	if b.closed {
+		return
+	}
+
+	b.cache.WriteTag(tag)
+	for subscriber := range b.subscribers {
+		if !subscriber.push(tag, b.QueueSize) {
+			delete(b.subscribers, subscriber)
+		}
+	}
+}
+
+// Subscribe 添加订阅者, 队列中预先放入onMetaData, sequence header和GOP缓存.
+// 没有缓存关键帧时, 从下一个关键帧开始接收音视频.
+func (b *Broadcaster) Subscribe() (*Subscriber, error) {
+	return b.SubscribeTracks(true, true)
+}
+
+// SubscribeTracks 添加只接收音频或视频的订阅者, 被过滤的tag不进入队列, flv头的TypeFlag同步修改.
+// 不接收视频时不等待视频关键帧, 从缓存或下一个音频帧开始.
+func (b *Broadcaster) SubscribeTracks(audio, video bool) (*Subscriber, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil, ErrBroadcasterClosed
+	}
+
+	header := b.cache.Header()
+	flag := TypeFlag(header[4])
+	MarshalHeader(header, flag.ExistAudio() && audio, flag.ExistVideo() && video)
+	subscriber := &Subscriber{
+		broadcaster: b,
+		header:      header,
+		signal:      make(chan struct{}, 1),
+		audio:       audio,
+		video:       video,
+		joining:     video && b.cache.hasVideo && b.cache.GOPs() == 0,
+	}
+
+	for _, tag := range b.cache.Tags() {
+		if !subscriber.accept(tag) {
+			continue
+		}
+
+		tag.Retain()
+		subscriber.queue = append(subscriber.queue, tag)
+	}
+
+	b.subscribers[subscriber] = struct{}{}
+	return subscriber, nil
+}
+
+func (b *Broadcaster) unsubscribe(subscriber *Subscriber) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.subscribers, subscriber)
+}
+
+// Subscribers 返回订阅者数量
+func (b *Broadcaster) Subscribers() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.subscribers)
+}
+
+// Close 推流结束, 订阅者读完排队的tag后收到io.EOF
+func (b *Broadcaster) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	b.closed = true
+	for subscriber := range b.subscribers {
+		subscriber.mutex.Lock()
+		subscriber.closeLocked(io.EOF)
+		subscriber.mutex.Unlock()
+	}
+
+	b.subscribers = nil
+	b.cache.Reset()
+}
+
+func NewBroadcaster(cache *GOPCache, queueSize int) *Broadcaster {
+	if cache == nil {
+		cache = NewGOPCache(0, 0, 1)
+	}
+
+	return &Broadcaster{
+		QueueSize:   queueSize,
+		cache:       cache,
+		subscribers: make(map[*Subscriber]struct{}),
+	}
+}
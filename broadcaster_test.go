@@ -0,0 +1,150 @@
+package flv
+
+import (
+	"bytes"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv/internal/flvtest"
+	"io"
+	"testing"
+)
+
+func TestBroadcaster(t *testing.T) {
+	broadcaster := NewBroadcaster(nil, 0)
+	writer := newTestGOPWriter(broadcaster.Cache())
+	// Writer直接写入Broadcaster
+	writer = NewWriterWithMuxer(broadcaster, writer.Muxer())
+	utils.Assert(writer.WriteHeader() == nil)
+	flvtest.WriteGOPs(writer, 0, 15)
+
+	// 从缓存的关键帧10开始
+	subscriber, err := broadcaster.Subscribe()
+	utils.Assert(err == nil)
+	done := make(chan *bytes.Buffer)
+	go func() {
+		output := &bytes.Buffer{}
+		_, err := subscriber.WriteTo(output)
+		utils.Assert(err == nil)
+		done <- output
+	}()
+
+	flvtest.WriteGOPs(writer, 15, 20)
+	broadcaster.Close()
+	output := <-done
+
+	handler := &PacketCollector{}
+	demuxer := NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	_, err = demuxer.Input(output.Bytes())
+	utils.Assert(err == nil)
+	utils.Assert(len(handler.tracks) == 2)
+	utils.Assert(handler.packets[0].Key && handler.packets[0].Data[5] == 10)
+	// 10-34帧, 每个track最后一帧缓存在demuxer中
+	utils.Assert(len(handler.packets) == 25*2-2)
+
+	_, err = broadcaster.Subscribe()
+	utils.Assert(err == ErrBroadcasterClosed)
+}
+
+func TestBroadcasterSubscribeTracks(t *testing.T) {
+	broadcaster := NewBroadcaster(nil, 0)
+	writer := newTestGOPWriter(broadcaster.Cache())
+	writer = NewWriterWithMuxer(broadcaster, writer.Muxer())
+	utils.Assert(writer.WriteHeader() == nil)
+
+	// 没有缓存关键帧时加入, 只接收音频的订阅者不等待视频关键帧
+	audio, err := broadcaster.SubscribeTracks(true, false)
+	utils.Assert(err == nil && audio.Header()[4] == 0x4)
+	video, err := broadcaster.SubscribeTracks(false, true)
+	utils.Assert(err == nil && video.Header()[4] == 0x1)
+	flvtest.WriteGOPs(writer, 5, 20)
+	broadcaster.Close()
+
+	read := func(subscriber *Subscriber) []*TagBuffer {
+		var tags []*TagBuffer
+		for {
+			queue, err := subscriber.Read()
+			if err != nil {
+				utils.Assert(err == io.EOF)
+				return tags
+			}
+
+			tags = append(tags, queue...)
+		}
+	}
+
+	var frames []*TagBuffer
+	for _, tag := range read(audio) {
+		utils.Assert(TagTypeVideoData != tag.Type)
+		if TagTypeAudioData == tag.Type && !tag.SequenceHeader {
+			frames = append(frames, tag)
+		}
+	}
+
+	utils.Assert(len(frames) == 20 && frames[0].Timestamp == 5*40)
+
+	frames = frames[:0]
+	for _, tag := range read(video) {
+		utils.Assert(TagTypeAudioData != tag.Type)
+		if TagTypeVideoData == tag.Type && !tag.SequenceHeader {
+			frames = append(frames, tag)
+		}
+	}
+
+	utils.Assert(len(frames) == 15 && frames[0].Key && frames[0].Timestamp == 10*40)
+}
+
+func TestBroadcasterSlowConsumer(t *testing.T) {
+	broadcaster := NewBroadcaster(nil, 40)
+	writer := newTestGOPWriter(broadcaster.Cache())
+	writer = NewWriterWithMuxer(broadcaster, writer.Muxer())
+	utils.Assert(writer.WriteHeader() == nil)
+
+	// 没有缓存关键帧时加入, 从关键帧开始接收
+	subscriber, err := broadcaster.Subscribe()
+	utils.Assert(err == nil)
+	flvtest.WriteGOPs(writer, 5, 25)
+
+	// 队列满后丢弃非关键视频帧, 保留音频和关键帧
+	utils.Assert(subscriber.Dropped() > 0)
+	tags, err := subscriber.Read()
+	utils.Assert(err == nil)
+	utils.Assert(tags[0].SequenceHeader || TagTypeScriptData == tags[0].Type)
+
+	var video []*TagBuffer
+	for _, tag := range tags {
+		if TagTypeVideoData == tag.Type && !tag.SequenceHeader {
+			video = append(video, tag)
+		}
+	}
+
+	utils.Assert(video[0].Key && video[0].Timestamp == 10*40)
+	// 丢帧后的第一个视频帧是关键帧
+	for i := 1; i < len(video); i++ {
+		if video[i].Timestamp-video[i-1].Timestamp > 40 {
+			utils.Assert(video[i].Key)
+		}
+	}
+
+	for _, tag := range tags {
+		tag.Release()
+	}
+
+	// 只有音频也放不下时断开
+	for i := 0; i < 50; i++ {
+		utils.Assert(writer.WritePacket(avformat.NewAudioPacket([]byte{0x21, 0x10}, int64(1200+i*20), utils.AVCodecIdAAC, 1, 1000)) == nil)
+	}
+
+	_, err = subscriber.Read()
+	utils.Assert(err == ErrSlowConsumer)
+	utils.Assert(broadcaster.Subscribers() == 0)
+
+	// 断开后不再持有GOP缓存之外的引用
+	for _, tag := range broadcaster.Cache().Tags() {
+		utils.Assert(tag.refs == 1)
+	}
+
+	broadcaster.Close()
+	_, err = subscriber.Read()
+	utils.Assert(err == ErrSlowConsumer)
+}
@@ -0,0 +1,313 @@
+package flv
+
+import (
+	"encoding/binary"
+	"github.com/lkmio/flv/amf0"
+	"sort"
+)
+
+// FourCCInfo videoFourCcInfoMap/audioFourCcInfoMap中每个编码器的能力标记
+type FourCCInfo int
+
+const (
+	FourCCInfoCanDecode  = FourCCInfo(0x01)
+	FourCCInfoCanEncode  = FourCCInfo(0x02)
+	FourCCInfoCanForward = FourCCInfo(0x04)
+)
+
+// CapsEx 增强RTMP的扩展能力
+type CapsEx int
+
+const (
+	CapsExReconnect           = CapsEx(0x01)
+	CapsExMultitrack          = CapsEx(0x02)
+	CapsExModEx               = CapsEx(0x04)
+	CapsExTimestampNanoOffset = CapsEx(0x08)
+
+	// FourCCWildcard 支持转发任意编码器
+	FourCCWildcard = "*"
+)
+
+// Capabilities 增强RTMP v2在connect命令对象中协商的编码器和扩展能力.
+// nil表示对端没有声明任何能力, 按传统flv处理.
+type Capabilities struct {
+	FourCCList         []string              // fourCcList
+	VideoFourCCInfoMap map[string]FourCCInfo // videoFourCcInfoMap
+	AudioFourCCInfoMap map[string]FourCCInfo // audioFourCcInfoMap
+	CapsEx             CapsEx                // capsEx
+}
+
+// Marshal 将能力添加到connect命令对象或_result的属性对象
+func (c *Capabilities) Marshal(object *amf0.Object) {
+	if len(c.FourCCList) > 0 {
+		list := make(amf0.StrictArray, 0, len(c.FourCCList))
+		for _, fourCC := range c.FourCCList {
+			list = append(list, amf0.String(fourCC))
+		}
+
+		object.AddProperty("fourCcList", list)
+	}
+
+	marshalInfoMap := func(name string, infoMap map[string]FourCCInfo) {
+		if len(infoMap) == 0 {
+			return
+		}
+
+		keys := make([]string, 0, len(infoMap))
+		for fourCC := range infoMap {
+			keys = append(keys, fourCC)
+		}
+
+		sort.Strings(keys)
+		value := &amf0.Object{}
+		for _, fourCC := range keys {
+			value.AddNumberProperty(fourCC, float64(infoMap[fourCC]))
+		}
+
+		object.AddProperty(name, value)
+	}
+
+	marshalInfoMap("videoFourCcInfoMap", c.VideoFourCCInfoMap)
+	marshalInfoMap("audioFourCcInfoMap", c.AudioFourCCInfoMap)
+	if c.CapsEx != 0 {
+		object.AddNumberProperty("capsEx", float64(c.CapsEx))
+	}
+}
+
+// UnmarshalCapabilities 解析connect命令对象中的增强RTMP能力, 没有任何能力属性时返回nil
+func UnmarshalCapabilities(object *amf0.Object) *Capabilities {
+	if object == nil {
+		return nil
+	}
+
+	capabilities := &Capabilities{}
+	var found bool
+	if property := object.FindProperty("fourCcList"); property != nil {
+		found = true
+		if list, ok := property.Value.(amf0.StrictArray); ok {
+			for _, element := range list {
+				if fourCC, ok := amf0.ToString(element); ok {
+					capabilities.FourCCList = append(capabilities.FourCCList, fourCC)
+				}
+			}
+		}
+	}
+
+	unmarshalInfoMap := func(name string) map[string]FourCCInfo {
+		property := object.FindProperty(name)
+		if property == nil {
+			return nil
+		}
+
+		found = true
+		infoMap := make(map[string]FourCCInfo)
+		if value := amf0.ToObject(property.Value); value != nil {
+			for _, item := range value.Properties() {
+				info, _ := amf0.ToNumber(item.Value)
+				infoMap[item.Name] = FourCCInfo(info)
+			}
+		}
+
+		return infoMap
+	}
+
+	capabilities.VideoFourCCInfoMap = unmarshalInfoMap("videoFourCcInfoMap")
+	capabilities.AudioFourCCInfoMap = unmarshalInfoMap("audioFourCcInfoMap")
+	if property := object.FindProperty("capsEx"); property != nil {
+		found = true
+		value, _ := amf0.ToNumber(property.Value)
+		capabilities.CapsEx = CapsEx(value)
+	}
+
+	if !found {
+		return nil
+	}
+
+	return capabilities
+}
+
+// fourCCString 返回FourCC的字符串形式, 例如hvc1
+func fourCCString(fourCC uint32) string {
+	var buffer [4]byte
+	binary.BigEndian.PutUint32(buffer[:], fourCC)
+	return string(buffer[:])
+}
+
+// supports 对端可以解码或转发该编码器
+func (c *Capabilities) supports(infoMap map[string]FourCCInfo, fourCC string) bool {
+	if c == nil {
+		return false
+	}
+
+	for _, value := range c.FourCCList {
+		if value == fourCC || FourCCWildcard == value {
+			return true
+		}
+	}
+
+	for _, key := range []string{fourCC, FourCCWildcard} {
+		if info, ok := infoMap[key]; ok && info&(FourCCInfoCanDecode|FourCCInfoCanForward) != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SupportsVideo 对端是否支持该视频编码器, 传统flv的编码器总是支持
+func (c *Capabilities) SupportsVideo(id VideoCodecID) bool {
+	if id <= 0xF {
+		return true
+	}
+
+	return c.supports(c.videoInfoMap(), fourCCString(uint32(id)))
+}
+
+// SupportsAudio 对端是否支持增强flv的音频编码器
+func (c *Capabilities) SupportsAudio(fourCC AudioFourCC) bool {
+	return c.supports(c.audioInfoMap(), fourCCString(uint32(fourCC)))
+}
+
+// SupportsCapsEx 对端是否声明了扩展能力
+func (c *Capabilities) SupportsCapsEx(caps CapsEx) bool {
+	return c != nil && c.CapsEx&caps == caps
+}
+
+func (c *Capabilities) videoInfoMap() map[string]FourCCInfo {
+	if c == nil {
+		return nil
+	}
+
+	return c.VideoFourCCInfoMap
+}
+
+func (c *Capabilities) audioInfoMap() map[string]FourCCInfo {
+	if c == nil {
+		return nil
+	}
+
+	return c.AudioFourCCInfoMap
+}
+
+// stripModEx 跳过增强flv tag头中的ModEx数据, 返回实际的包类型和之后的数据
+func stripModEx(packetType PacketType, modEx PacketType, data []byte) (PacketType, []byte, bool) {
+	for modEx == packetType {
+		if len(data) < 1 {
+			return packetType, nil, false
+		}
+
+		size := int(data[0]) + 1
+		data = data[1:]
+		if size == 256 {
+			if len(data) < 2 {
+				return packetType, nil, false
+			}
+
+			size = int(binary.BigEndian.Uint16(data)) + 1
+			data = data[2:]
+		}
+
+		// modExData + modExType(4) packetType(4)
+		if len(data) < size+1 {
+			return packetType, nil, false
+		}
+
+		packetType = PacketType(data[size] & 0xF)
+		data = data[size+1:]
+	}
+
+	return packetType, data, true
+}
+
+// FilterTag 按对端能力限制或降级一个音视频tag的数据, 返回需要发送的数据, false表示丢弃.
+// 对端不支持ModEx时去掉ModEx数据, 不支持多轨时丢弃多轨tag; 不支持的增强flv编码器中,
+// avc1降级为传统AVC, mp4a降级为传统AAC, .mp3降级为传统MP3, 其他编码器丢弃. 数据被修改时返回新的切片.
+func (c *Capabilities) FilterTag(tagType TagType, data []byte) ([]byte, bool) {
+	if len(data) < 1 {
+		return data, true
+	} else if TagTypeVideoData == tagType && data[0]>>7 == 1 {
+		return c.filterVideo(data)
+	} else if TagTypeAudioData == tagType && SoundFormatExHeader == SoundFormat(data[0]>>4) {
+		return c.filterAudio(data)
+	}
+
+	return data, true
+}
+
+func (c *Capabilities) filterVideo(data []byte) ([]byte, bool) {
+	frameType := data[0] >> 4 & 0x7
+	packetType, body, ok := stripModEx(PacketType(data[0]&0xF), VideoPacketTypeModEx, data[1:])
+	if !ok {
+		return nil, false
+	} else if VideoPacketTypeModEx == PacketType(data[0]&0xF) && !c.SupportsCapsEx(CapsExModEx) {
+		data = append([]byte{1<<7 | frameType<<4 | byte(packetType)}, body...)
+	}
+
+	if VideoPacketTypeMultitrack == packetType {
+		return data, c.SupportsCapsEx(CapsExMultitrack)
+	} else if len(body) < 4 {
+		return nil, false
+	}
+
+	fourCC := VideoCodecID(binary.BigEndian.Uint32(body))
+	if c.SupportsVideo(fourCC) {
+		return data, true
+	} else if VideoCodecID(0x61766331) != fourCC { // avc1
+		return nil, false
+	}
+
+	// 降级为传统AVC: FrameType + CodecID, AVCPacketType, CompositionTime
+	frame := body[4:]
+	avc := []byte{frameType<<4 | byte(VideoCodecIDAVC), 1, 0, 0, 0}
+	switch packetType {
+	case PacketTypeSequenceStart:
+		avc[1] = 0
+	case PacketTypeCodedFrames:
+		if len(frame) < 3 {
+			return nil, false
+		}
+
+		copy(avc[2:], frame[:3])
+		frame = frame[3:]
+	case PacketTypeCodedFramesX:
+	case PacketTypeSequenceEnd:
+		avc[1] = 2
+	default:
+		return nil, false
+	}
+
+	return append(avc, frame...), true
+}
+
+func (c *Capabilities) filterAudio(data []byte) ([]byte, bool) {
+	packetType, body, ok := stripModEx(PacketType(data[0]&0xF), AudioPacketTypeModEx, data[1:])
+	if !ok {
+		return nil, false
+	} else if AudioPacketTypeModEx == PacketType(data[0]&0xF) && !c.SupportsCapsEx(CapsExModEx) {
+		data = append([]byte{byte(SoundFormatExHeader)<<4 | byte(packetType)}, body...)
+	}
+
+	if AudioPacketTypeMultiTrack == packetType {
+		return data, c.SupportsCapsEx(CapsExMultitrack)
+	} else if len(body) < 4 {
+		return nil, false
+	}
+
+	fourCC := AudioFourCC(binary.BigEndian.Uint32(body))
+	if c.SupportsAudio(fourCC) {
+		return data, true
+	}
+
+	// 传统AAC和MP3的采样率等标记固定为44kHz, 16bit, 立体声
+	frame := body[4:]
+	switch {
+	case AudioFourCCAAC == fourCC && AudioPacketTypeSequenceStart == packetType:
+		return append([]byte{byte(SoundFormatAAC)<<4 | 0xF, 0}, frame...), true
+	case AudioFourCCAAC == fourCC && AudioPacketTypeCodedFrames == packetType:
+		return append([]byte{byte(SoundFormatAAC)<<4 | 0xF, 1}, frame...), true
+	case AudioFourCCMP3 == fourCC && AudioPacketTypeCodedFrames == packetType:
+		return append([]byte{byte(SoundFormatMP3)<<4 | 0xF}, frame...), true
+	}
+
+	return nil, false
+}
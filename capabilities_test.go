@@ -0,0 +1,90 @@
+package flv
+
+import (
+	"bytes"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv/amf0"
+	"testing"
+)
+
+func TestCapabilities(t *testing.T) {
+	capabilities := &Capabilities{
+		FourCCList:         []string{"av01"},
+		VideoFourCCInfoMap: map[string]FourCCInfo{"hvc1": FourCCInfoCanDecode | FourCCInfoCanForward, "vp09": FourCCInfoCanEncode},
+		AudioFourCCInfoMap: map[string]FourCCInfo{"Opus": FourCCInfoCanDecode},
+		CapsEx:             CapsExReconnect | CapsExModEx,
+	}
+
+	// 经过AMF0编码后解析
+	object := &amf0.Object{}
+	object.AddStringProperty("app", "live")
+	capabilities.Marshal(object)
+	data := amf0.Data{}
+	data.Add(object)
+	buffer := make([]byte, data.MarshalSize())
+	_, err := data.Marshal(buffer)
+	utils.Assert(err == nil)
+	data = amf0.Data{}
+	utils.Assert(data.Unmarshal(buffer) == nil)
+
+	parsed := UnmarshalCapabilities(amf0.ToObject(data.Get(0)))
+	utils.Assert(parsed != nil && len(parsed.FourCCList) == 1 && parsed.CapsEx == capabilities.CapsEx)
+	utils.Assert(parsed.SupportsVideo(VideoCodecIDAV1) && parsed.SupportsVideo(VideoCodecIDHEVC) && parsed.SupportsVideo(VideoCodecIDAVC))
+	utils.Assert(!parsed.SupportsVideo(VideoCodecIDVP9))
+	utils.Assert(parsed.SupportsAudio(AudioFourCCOpus) && !parsed.SupportsAudio(AudioFourCCFLAC))
+	utils.Assert(parsed.SupportsCapsEx(CapsExModEx) && !parsed.SupportsCapsEx(CapsExMultitrack))
+
+	// 传统客户端
+	utils.Assert(UnmarshalCapabilities(&amf0.Object{}) == nil)
+	var legacy *Capabilities
+	utils.Assert(legacy.SupportsVideo(VideoCodecIDAVC) && !legacy.SupportsVideo(VideoCodecIDHEVC))
+	utils.Assert((&Capabilities{FourCCList: []string{FourCCWildcard}}).SupportsVideo(VideoCodecIDVP9))
+}
+
+func TestCapabilitiesFilterTag(t *testing.T) {
+	var legacy *Capabilities
+	enhanced := &Capabilities{FourCCList: []string{"hvc1", "avc1"}}
+
+	// hvc1只发送给声明了hvc1的对端
+	hevc := []byte{0x80 | 1<<4 | byte(PacketTypeCodedFramesX), 'h', 'v', 'c', '1', 0xAA}
+	_, ok := legacy.FilterTag(TagTypeVideoData, hevc)
+	utils.Assert(!ok)
+	data, ok := enhanced.FilterTag(TagTypeVideoData, hevc)
+	utils.Assert(ok && bytes.Equal(data, hevc))
+
+	// avc1降级为传统AVC
+	data, ok = legacy.FilterTag(TagTypeVideoData, []byte{0x80 | 1<<4 | byte(PacketTypeCodedFrames), 'a', 'v', 'c', '1', 0, 0, 40, 0xBB})
+	utils.Assert(ok && bytes.Equal(data, []byte{0x17, 1, 0, 0, 40, 0xBB}))
+	data, ok = legacy.FilterTag(TagTypeVideoData, []byte{0x80 | 2<<4 | byte(PacketTypeCodedFramesX), 'a', 'v', 'c', '1', 0xBB})
+	utils.Assert(ok && bytes.Equal(data, []byte{0x27, 1, 0, 0, 0, 0xBB}))
+
+	// 对端不支持ModEx时去掉ModEx数据
+	modEx := []byte{0x80 | 1<<4 | byte(VideoPacketTypeModEx), 2, 1, 2, 3, byte(PacketTypeCodedFramesX), 'h', 'v', 'c', '1', 0xAA}
+	data, ok = enhanced.FilterTag(TagTypeVideoData, modEx)
+	utils.Assert(ok && bytes.Equal(data, hevc))
+	data, ok = (&Capabilities{FourCCList: []string{"hvc1"}, CapsEx: CapsExModEx}).FilterTag(TagTypeVideoData, modEx)
+	utils.Assert(ok && bytes.Equal(data, modEx))
+
+	// mp4a降级为传统AAC, 不支持的Opus被丢弃
+	data, ok = legacy.FilterTag(TagTypeAudioData, []byte{byte(SoundFormatExHeader)<<4 | byte(AudioPacketTypeSequenceStart), 'm', 'p', '4', 'a', 0x12, 0x10})
+	utils.Assert(ok && bytes.Equal(data, []byte{0xAF, 0, 0x12, 0x10}))
+	_, ok = legacy.FilterTag(TagTypeAudioData, []byte{byte(SoundFormatExHeader)<<4 | byte(AudioPacketTypeCodedFrames), 'O', 'p', 'u', 's', 0xCC})
+	utils.Assert(!ok)
+
+	// 传统tag不修改
+	data, ok = legacy.FilterTag(TagTypeAudioData, []byte{0xAF, 1, 0xCC})
+	utils.Assert(ok && bytes.Equal(data, []byte{0xAF, 1, 0xCC}))
+}
+
+func TestMuxerCapabilities(t *testing.T) {
+	muxer := NewMuxer(nil)
+	muxer.SetCapabilities(nil)
+	_, err := muxer.AddTrack(avformat.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdHEVC, nil, nil))
+	utils.Assert(err != nil)
+
+	muxer = NewMuxer(nil)
+	muxer.SetCapabilities(&Capabilities{VideoFourCCInfoMap: map[string]FourCCInfo{"hvc1": FourCCInfoCanDecode}})
+	_, err = muxer.AddTrack(avformat.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdHEVC, nil, nil))
+	utils.Assert(err == nil)
+}
@@ -0,0 +1,59 @@
+// flvcut 无损截取flv文件的时间范围, 不重新编码.
+//
+//	flvcut -ss 1m30s -t 10s input.flv output.flv
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/lkmio/flv"
+	"os"
+)
+
+func cut(input, output string, options flv.CutOptions) error {
+	src, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+	dst, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+
+	if err = flv.Cut(dst, src, options); err != nil {
+		dst.Close()
+		os.Remove(output)
+		return err
+	}
+
+	return dst.Close()
+}
+
+func main() {
+	options := flv.CutOptions{}
+	flag.DurationVar(&options.Start, "ss", 0, "start time, e.g. 90s or 1m30s")
+	flag.DurationVar(&options.End, "to", 0, "end time (exclusive), 0 means the end of the input")
+	duration := flag.Duration("t", 0, "duration, overrides -to")
+	flag.BoolVar(&options.NextKeyframe, "next-keyframe", false, "start at the first keyframe at or after -ss instead of the last keyframe before it")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [options] input.flv output.flv\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *duration > 0 {
+		options.End = options.Start + *duration
+	}
+
+	if err := cut(flag.Arg(0), flag.Arg(1), options); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
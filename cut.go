@@ -0,0 +1,305 @@
+package flv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/lkmio/flv/amf0"
+	"io"
+	"time"
+)
+
+// CutOptions 截取的时间范围[Start, End)
+type CutOptions struct {
+	Start        time.Duration
+	End          time.Duration // 0表示截取到文件结尾
+	NextKeyframe bool          // 从Start处或之后的第一个关键帧开始, 默认从Start处或之前的最后一个关键帧开始, 保证包含Start时刻的画面
+}
+
+// cutTag 源文件中一个tag的位置和类型
+type cutTag struct {
+	offset    int64 // tag头在源文件中的位置, 不包含PreviousTagSize
+	tagType   TagType
+	dataSize  int
+	timestamp int64
+	key       bool // 视频关键帧, 纯音频文件中的所有音频帧
+	header    bool // sequence header
+}
+
+// scanTags 读取所有tag的位置, onMetaData和sequence header的数据. 文件末尾不完整的tag被忽略
+func scanTags(src io.ReadSeeker) ([]*cutTag, map[*cutTag][]byte, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReaderSize(src, 64*1024)
+	var header [9]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, nil, err
+	} else if _, err = UnmarshalHeader(header[:]); err != nil {
+		return nil, nil, err
+	}
+
+	var tags []*cutTag
+	data := make(map[*cutTag][]byte)
+	offset := int64(9)
+	var metaData bool
+	for {
+		var tagHeader [TagHeaderSize]byte
+		if _, err := io.ReadFull(reader, tagHeader[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		tag := UnmarshalTag(tagHeader[:])
+		t := &cutTag{offset: offset + 4, tagType: tag.Type, dataSize: tag.DataSize, timestamp: int64(tag.Timestamp)}
+		// 大于缓冲区的tag只用前面的数据判断类型
+		prefix, err := reader.Peek(tag.DataSize)
+		if err == io.EOF {
+			break
+		} else if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, nil, err
+		}
+
+		switch tag.Type {
+		case TagTypeVideoData:
+			var frameType int
+			videoData := VideoData{}
+			_, t.header, frameType, _, err = videoData.Unmarshal(prefix)
+			t.header = err == nil && t.header
+			t.key = err == nil && !t.header && frameType == 1
+		case TagTypeAudioData:
+			audioData := AudioData{}
+			_, t.header, err = audioData.Unmarshal(prefix)
+			t.header = err == nil && t.header
+		}
+
+		// 保存第一个script tag(onMetaData)和sequence header, 读取完整的数据
+		if t.header || (TagTypeScriptData == t.tagType && !metaData) {
+			metaData = metaData || TagTypeScriptData == t.tagType
+			buffer := make([]byte, tag.DataSize)
+			if _, err = io.ReadFull(reader, buffer); err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			} else if err != nil {
+				return nil, nil, err
+			}
+
+			data[t] = buffer
+		} else if _, err = reader.Discard(tag.DataSize); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		tags = append(tags, t)
+		offset += TagHeaderSize + int64(tag.DataSize)
+	}
+
+	return tags, data, nil
+}
+
+// Cut 无损截取src中[Start, End)范围内的音视频写入dst. 从关键帧开始, 开头写入截取位置生效的sequence header和onMetaData,
+// 时间戳从0开始, onMetaData中的duration, filesize和关键帧索引(keyframes.times/filepositions)为截取后的值.
+// 截取范围内的tag按原样拷贝, 只修改时间戳.
+func Cut(dst io.Writer, src io.ReadSeeker, options CutOptions) error {
+	tags, data, err := scanTags(src)
+	if err != nil {
+		return err
+	}
+
+	hasVideo := false
+	for _, t := range tags {
+		hasVideo = hasVideo || (TagTypeVideoData == t.tagType && !t.header)
+	}
+
+	// 纯音频文件的所有音频帧都可以作为开始位置
+	if !hasVideo {
+		for _, t := range tags {
+			t.key = TagTypeAudioData == t.tagType && !t.header
+		}
+	}
+
+	startMs, endMs := options.Start.Milliseconds(), options.End.Milliseconds()
+	first := -1
+	for i, t := range tags {
+		if !t.key {
+			continue
+		} else if options.NextKeyframe && t.timestamp >= startMs {
+			first = i
+			break
+		} else if !options.NextKeyframe && (t.timestamp <= startMs || first < 0) {
+			first = i
+		}
+
+		if t.timestamp >= startMs {
+			break
+		}
+	}
+
+	if first < 0 || (endMs > 0 && tags[first].timestamp >= endMs) {
+		return fmt.Errorf("no keyframe found in range [%s, %s)", options.Start, options.End)
+	}
+
+	base := tags[first].timestamp
+	// 开始位置生效的音视频sequence header
+	var selected []*cutTag
+	var metaData *amf0.Object
+	headers := make(map[TagType]*cutTag)
+	for _, t := range tags[:first] {
+		if t.header {
+			headers[t.tagType] = t
+		} else if TagTypeScriptData == t.tagType && data[t] != nil {
+			metaData = parseOnMetaData(data[t])
+		}
+	}
+
+	for _, tagType := range []TagType{TagTypeVideoData, TagTypeAudioData} {
+		if t := headers[tagType]; t != nil {
+			selected = append(selected, t)
+		}
+	}
+
+	// 丢弃开始位置之后早于关键帧的音频和结束位置之后的帧, 流中途的sequence header和其他script tag原样保留
+	var index KeyframeIndex
+	var lastTs, lastFrameTs, frameDuration int64
+	for _, t := range tags[first:] {
+		if !t.header && (t.timestamp < base || (endMs > 0 && t.timestamp >= endMs)) {
+			continue
+		} else if TagTypeScriptData == t.tagType && data[t] != nil {
+			continue
+		}
+
+		selected = append(selected, t)
+		if t.key && hasVideo {
+			index.Add(float64(t.timestamp-base)/1000, 0)
+		}
+
+		if t.timestamp > lastTs {
+			lastTs = t.timestamp
+		}
+
+		// 时长为最后的时间戳加上一帧的时长, 帧时长使用视频(纯音频文件使用音频)相邻帧的间隔估计
+		if primary := hasVideo == (TagTypeVideoData == t.tagType); primary && !t.header && TagTypeScriptData != t.tagType {
+			if t.timestamp > lastFrameTs && lastFrameTs >= base {
+				frameDuration = t.timestamp - lastFrameTs
+			}
+
+			lastFrameTs = t.timestamp
+		}
+	}
+
+	if metaData == nil {
+		metaData = &amf0.Object{}
+	}
+
+	setProperty(metaData, "duration", amf0.Number(float64(lastTs-base+frameDuration)/1000))
+	setProperty(metaData, "filesize", amf0.Number(0))
+	setProperty(metaData, "keyframes", index.Object())
+
+	// 数值的序列化长度固定, 先计算onMetaData的大小, 再计算关键帧的位置和文件大小
+	script := amf0.Data{}
+	script.AddString("onMetaData")
+	script.Add(metaData)
+	scriptSize := script.MarshalSize()
+	position := int64(9 + TagHeaderSize + scriptSize)
+	var keyframe int
+	for _, t := range selected {
+		if hasVideo && t.key && t.timestamp >= base {
+			index.Positions[keyframe] = position + 4
+			keyframe++
+		}
+
+		position += TagHeaderSize + int64(t.dataSize)
+	}
+
+	setProperty(metaData, "keyframes", index.Object())
+	setProperty(metaData, "filesize", amf0.Number(position+4))
+	return writeCut(dst, src, selected, data, &script, base)
+}
+
+// writeCut 写入flv头, onMetaData和选中的tag
+func writeCut(dst io.Writer, src io.ReadSeeker, selected []*cutTag, data map[*cutTag][]byte, script *amf0.Data, base int64) error {
+	writer := bufio.NewWriterSize(dst, 64*1024)
+	var audio, video bool
+	for _, t := range selected {
+		audio = audio || TagTypeAudioData == t.tagType
+		video = video || TagTypeVideoData == t.tagType
+	}
+
+	buffer := make([]byte, 9+TagHeaderSize+script.MarshalSize())
+	MarshalHeader(buffer, audio, video)
+	n, err := script.Marshal(buffer[9+TagHeaderSize:])
+	if err != nil {
+		return err
+	}
+
+	muxer := &Muxer{}
+	muxer.WriteTag(buffer[9:], TagTypeScriptData, uint32(n), 0)
+	if _, err = writer.Write(buffer); err != nil {
+		return err
+	}
+
+	var header [TagHeaderSize]byte
+	var reader *bufio.Reader
+	var readerOffset int64 = -1
+	for _, t := range selected {
+		ts := t.timestamp - base
+		if ts < 0 {
+			ts = 0
+		}
+
+		muxer.WriteTag(header[:], t.tagType, uint32(t.dataSize), uint32(ts))
+		if _, err = writer.Write(header[:]); err != nil {
+			return err
+		}
+
+		if payload, ok := data[t]; ok {
+			if _, err = writer.Write(payload); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// 选中的tag在源文件中基本连续, 顺序读取, 跳过未选中的tag
+		dataOffset := t.offset + TagHeaderSizeWithoutPrevTagSize
+		if reader == nil || dataOffset < readerOffset {
+			if _, err = src.Seek(dataOffset, io.SeekStart); err != nil {
+				return err
+			}
+
+			reader = bufio.NewReaderSize(src, 64*1024)
+			readerOffset = dataOffset
+		} else if _, err = reader.Discard(int(dataOffset - readerOffset)); err != nil {
+			return err
+		}
+
+		if _, err = io.CopyN(writer, reader, int64(t.dataSize)); err != nil {
+			return err
+		}
+
+		readerOffset = dataOffset + int64(t.dataSize)
+	}
+
+	binary.BigEndian.PutUint32(header[:], muxer.PrevTagSize())
+	if _, err = writer.Write(header[:4]); err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
+
+// parseOnMetaData 解析onMetaData, 不是onMetaData时返回nil
+func parseOnMetaData(data []byte) *amf0.Object {
+	script := amf0.Data{}
+	if err := script.Unmarshal(data); err != nil || script.Size() < 2 {
+		return nil
+	} else if name, ok := script.Get(0).(amf0.String); !ok || name != "onMetaData" {
+		return nil
+	}
+
+	// onMetaData可能是ECMA数组
+	return amf0.ToObject(script.Get(1))
+}
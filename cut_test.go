@@ -0,0 +1,113 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv/amf0"
+	"github.com/lkmio/flv/internal/flvtest"
+	"testing"
+	"time"
+)
+
+func TestCut(t *testing.T) {
+	input := &bytes.Buffer{}
+	writer := NewWriter(input)
+	flvtest.AddTracks(writer)
+	utils.Assert(writer.WriteHeader() == nil)
+	flvtest.WriteGOPs(writer, 0, 60)
+	// 末尾不完整的tag被忽略
+	src := input.Bytes()[:input.Len()-3]
+
+	cut := func(options CutOptions) []byte {
+		output := &bytes.Buffer{}
+		utils.Assert(Cut(output, bytes.NewReader(src), options) == nil)
+		return output.Bytes()
+	}
+
+	// 从500ms之前的关键帧(第10帧)截取到1500ms
+	data := cut(CutOptions{Start: 500 * time.Millisecond, End: 1500 * time.Millisecond})
+	checkTestRecording(data, 10, 28)
+
+	// 从500ms之后的关键帧(第20帧)开始
+	data = cut(CutOptions{Start: 500 * time.Millisecond, End: 1500 * time.Millisecond, NextKeyframe: true})
+	checkTestRecording(data, 20, 18)
+
+	// 音频不早于第一个视频帧
+	collector := &PacketCollector{}
+	demuxer := NewDemuxer(false)
+	demuxer.SetHandler(collector)
+	_, err := demuxer.Input(data)
+	utils.Assert(err == nil)
+	demuxer.Flush()
+	for _, packet := range collector.packets {
+		if packet.Index == 1 {
+			utils.Assert(packet.Dts == 0 && packet.Data[1] == 20)
+			break
+		}
+	}
+
+	// 截取整个文件, 不完整的最后一个音频帧被丢弃
+	data = cut(CutOptions{})
+	checkTestRecording(data, 0, 60)
+
+	// 范围内没有关键帧
+	utils.Assert(Cut(&bytes.Buffer{}, bytes.NewReader(src), CutOptions{Start: 3 * time.Second}) == nil)
+	utils.Assert(Cut(&bytes.Buffer{}, bytes.NewReader(src), CutOptions{Start: 3 * time.Second, NextKeyframe: true}) != nil)
+}
+
+func TestCutLargeMetaData(t *testing.T) {
+	input := &bytes.Buffer{}
+	writer := NewWriter(input)
+	flvtest.AddTracks(writer)
+	utils.Assert(writer.WriteHeader() == nil)
+	flvtest.WriteGOPs(writer, 0, 20)
+
+	// 大于扫描缓冲区的onMetaData位于sequence header之后
+	metaData := &amf0.Object{}
+	metaData.AddProperty("padding", amf0.LongString(make([]byte, 100*1024)))
+	script := amf0.Data{}
+	script.AddString("onMetaData")
+	script.Add(metaData)
+	scriptTag := make([]byte, TagHeaderSize+script.MarshalSize())
+	NewMuxer(nil).WriteTag(scriptTag, TagTypeScriptData, uint32(script.MarshalSize()), 0)
+	_, err := script.Marshal(scriptTag[TagHeaderSize:])
+	utils.Assert(err == nil)
+
+	// 依次追加PreviousTagSize和tag, 跳过原来的onMetaData
+	src := append([]byte(nil), input.Bytes()[:9]...)
+	var prevTagSize uint32
+	appendTag := func(tag []byte) {
+		binary.BigEndian.PutUint32(tag, prevTagSize)
+		src = append(src, tag...)
+		prevTagSize = uint32(len(tag) - 4)
+	}
+
+	var tags int
+	for offset := 9; offset < input.Len()-4; tags++ {
+		tag := input.Bytes()[offset:]
+		size := TagHeaderSize + (int(tag[5])<<16 | int(tag[6])<<8 | int(tag[7]))
+		if TagTypeScriptData != TagType(tag[4]) {
+			appendTag(append([]byte(nil), tag[:size]...))
+		}
+
+		// 两个sequence header之后
+		if tags == 2 {
+			appendTag(scriptTag)
+		}
+
+		offset += size
+	}
+
+	src = binary.BigEndian.AppendUint32(src, prevTagSize)
+	output := &bytes.Buffer{}
+	utils.Assert(Cut(output, bytes.NewReader(src), CutOptions{}) == nil)
+	checkTestRecording(output.Bytes(), 0, 20)
+
+	demuxer := NewDemuxer(false)
+	demuxer.SetHandler(&PacketCollector{})
+	_, err = demuxer.Input(output.Bytes())
+	utils.Assert(err == nil)
+	padding := amf0.ToObject(demuxer.Metadata().Get(1)).FindProperty("padding")
+	utils.Assert(padding != nil && len(padding.Value.(amf0.LongString)) == 100*1024)
+}
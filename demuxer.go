@@ -1,15 +1,14 @@
 package flv
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/lkmio/avformat"
 	"github.com/lkmio/avformat/bufio"
 	"github.com/lkmio/avformat/utils"
 	"github.com/lkmio/flv/amf0"
-)
-
-const (
-	TagHeaderSize = 15
+	"math"
+	"sort"
 )
 
 type Demuxer struct {
@@ -22,13 +21,40 @@ type Demuxer struct {
 	metadata       *amf0.Data // 元数据
 	preTagDataSize uint32
 
+	audioSequenceHeader []byte // 最近一次的音频sequence header, 用于区分重复和变化的编码器信息
+	videoSequenceHeader []byte
+	videoInfo           *VideoInfo // 从视频sequence header解析的视频参数
+
 	// onAV1Descriptor func(data []byte, ts uint32)
 }
 
+// CodecParametersHandler Demuxer的Handler可选实现该接口, 接收流中途的编码器信息变化.
+// 重复的sequence header不会回调, track的编码器信息在回调前已经更新.
+type CodecParametersHandler interface {
+	// OnCodecParametersChanged sequence header发生变化, 例如分辨率或编码器切换
+	OnCodecParametersChanged(track avformat.Track, ts uint32)
+
+	// OnSequenceEnd 收到序列结束包
+	OnSequenceEnd(track avformat.Track, ts uint32)
+}
+
+// VideoInfoHandler Demuxer的Handler可选实现该接口, 接收从视频sequence header解析的视频参数, 包括流中途的变化.
+// mismatch为onMetaData中的width/height/framerate与码流参数不一致的错误, 一致时为nil. 未实现该接口时只打印不一致的错误.
+// VP9的分辨率在第一个关键帧后才会填充到info.
+type VideoInfoHandler interface {
+	OnVideoInfo(track avformat.Track, info *VideoInfo, mismatch error)
+}
+
 func (d *Demuxer) Metadata() *amf0.Data {
 	return d.metadata
 }
 
+// VideoInfo 返回从视频sequence header解析的分辨率, 帧率, profile等参数, 没有视频或解析失败返回nil.
+// VP9的分辨率在第一个关键帧后可用.
+func (d *Demuxer) VideoInfo() *VideoInfo {
+	return d.videoInfo
+}
+
 func (d *Demuxer) Input(data []byte) (int, error) {
 	length := len(data)
 	var n int
@@ -74,7 +100,7 @@ func (d *Demuxer) readTagData(data []byte) int {
 	min := bufio.MinInt(d.tag.DataSize-d.tagDataSize, len(data))
 	mediaType := TagType2AVMediaType(d.tag.Type)
 	n, _ := d.BaseDemuxer.DataPipeline.Write(data[:min], d.BaseDemuxer.FindBufferIndexByMediaType(mediaType), mediaType)
-	d.tagDataSize = n
+	d.tagDataSize += n
 	return min
 }
 
@@ -102,13 +128,11 @@ func (d *Demuxer) processTag() error {
 	} else if TagTypeVideoData == d.tag.Type {
 		discard, err = d.ProcessVideoData(bytes, d.tag.Timestamp)
 	} else if TagTypeScriptData == d.tag.Type {
-		data := amf0.Data{}
-		err = data.Unmarshal(bytes)
-
+		// 解析后的amf0元素不再引用缓冲区, 直接释放
+		discard = true
+		err = d.ProcessScriptData(bytes, d.tag.Timestamp)
 		if err != nil {
 			println(err.Error())
-		} else {
-			d.metadata = &data
 		}
 	} else {
 		fmt.Printf("unkonw tag type %d\r\n", d.tag.Type)
@@ -125,34 +149,49 @@ func (d *Demuxer) ProcessAudioData(data []byte, ts uint32) (bool, error) {
 		return true, err
 	}
 
-	id, err := SoundFormat2AVCodecID(audioData.SoundFormat, audioData.Size)
+	id, config, err := audioData.AudioConfig()
 	if err != nil {
 		return true, err
+	} else if SoundFormatExHeader == audioData.SoundFormat && AudioPacketTypeSequenceEnd == audioData.PacketType {
+		d.onSequenceEnd(utils.AVMediaTypeAudio, ts)
+		return true, nil
+	} else if SoundFormatExHeader == audioData.SoundFormat && AudioPacketTypeSequenceStart != audioData.PacketType && AudioPacketTypeCodedFrames != audioData.PacketType {
+		// 多通道配置等不是音频帧
+		return true, nil
 	}
 
-	rate := GetSampleRate(audioData.Rate)
-	var bits int
-	var channels int
-	if 0 == audioData.Size {
-		bits = 8
-	} else {
-		bits = 16
+	// 采样率和通道数以sequence header为准, AAC tag头中的参数固定为44k立体声
+	if header {
+		if err = ParseAudioSequenceHeader(id, frame, &config); err != nil {
+			return true, err
+		}
 	}
 
-	if 1 == audioData.Type {
-		channels = 2
-	} else {
-		channels = 1
+	return d.processAudioData(id, ts, frame, header, config)
+}
+
+// ProcessScriptData 解析脚本tag, 按名称分发给Handler.
+// 首个onMetaData保存为Metadata, 后续的onMetaData作为更新事件回调.
+func (d *Demuxer) ProcessScriptData(data []byte, ts uint32) error {
+	scriptData, err := UnmarshalScriptData(data, ts)
+	if err != nil {
+		return err
 	}
 
-	config := avformat.AudioConfig{
-		SampleRate:    rate,
-		SampleSize:    bits,
-		Channels:      channels,
-		HasADTSHeader: false,
+	if ScriptDataNameOnMetaData == scriptData.Name {
+		metadata := scriptData.Elements()
+		if d.metadata == nil {
+			d.metadata = metadata
+		} else if handler, ok := d.Handler.(MetaDataHandler); ok {
+			handler.OnMetaDataUpdate(metadata, ts)
+		}
+	}
+
+	if handler, ok := d.Handler.(ScriptDataHandler); ok {
+		handler.OnScriptData(scriptData)
 	}
 
-	return false, d.processAudioData(id, ts, frame, header, config)
+	return nil
 }
 
 func (d *Demuxer) ProcessVideoData(data []byte, ts uint32) (bool, error) {
@@ -171,31 +210,240 @@ func (d *Demuxer) ProcessVideoData(data []byte, ts uint32) (bool, error) {
 	id, err := VideoCodecID2AVCodecID(videoData.CodecID)
 	if err != nil {
 		return true, err
+	} else if PacketTypeMetaData == videoData.PacketType {
+		// 增强flv的视频元数据(colorInfo)不是视频帧
+		return true, nil
+	} else if PacketTypeSequenceEnd == videoData.PacketType && (VideoCodecIDAVC == videoData.CodecID || videoData.CodecID > 0xF) {
+		d.onSequenceEnd(utils.AVMediaTypeVideo, ts)
+		return true, nil
 	}
 
-	return false, d.processVideoData(id, ts, frame, header, frameType == FrameTypeKeyFrame, ct)
+	return d.processVideoData(id, ts, frame, header, frameType == FrameTypeKeyFrame, ct)
 }
 
-func (d *Demuxer) processAudioData(id utils.AVCodecID, ts uint32, frame []byte, header bool, config avformat.AudioConfig) error {
+// processAudioData 返回是否释放tag缓冲区, 由processTag统一释放
+func (d *Demuxer) processAudioData(id utils.AVCodecID, ts uint32, frame []byte, header bool, config avformat.AudioConfig) (bool, error) {
 	bufferIndex := d.FindBufferIndexByMediaType(utils.AVMediaTypeAudio)
-	if header {
-		d.BaseDemuxer.OnNewAudioTrack(bufferIndex, id, 1000, frame, config)
-	} else {
+	if !header {
+		// 没有sequence header的音频格式, 使用tag头中的音频参数创建track
+		if !requireAudioSequenceHeader(id) && !d.Completed && d.Tracks.FindTrackWithType(utils.AVMediaTypeAudio) == nil {
+			d.BaseDemuxer.OnNewAudioTrack(bufferIndex, id, 1000, nil, config)
+		}
+
 		d.BaseDemuxer.OnAudioPacket(bufferIndex, id, frame, int64(ts))
+	} else if d.audioSequenceHeader == nil {
+		if track := d.BaseDemuxer.OnNewAudioTrack(bufferIndex, id, 1000, frame, config); track != nil {
+			// 覆盖BaseDemuxer只解析前2个字节的AAC参数
+			track.GetStream().AudioConfig = config
+			d.audioSequenceHeader = copyBytes(frame)
+		}
+	} else if !bytes.Equal(d.audioSequenceHeader, frame) {
+		// 变化的sequence header, 编码器信息已经拷贝, 释放缓冲区
+		return true, d.onAudioSequenceHeaderChanged(bufferIndex, id, ts, frame, config)
+	} else {
+		// 重复的sequence header
+		return true, nil
 	}
-	return nil
+
+	return false, nil
 }
 
-func (d *Demuxer) processVideoData(id utils.AVCodecID, ts uint32, frame []byte, header, key bool, ct int) error {
+// processVideoData 返回是否释放tag缓冲区, 由processTag统一释放
+func (d *Demuxer) processVideoData(id utils.AVCodecID, ts uint32, frame []byte, header, key bool, ct int) (bool, error) {
 	bufferIndex := d.FindBufferIndexByMediaType(utils.AVMediaTypeVideo)
-	if header {
-		d.BaseDemuxer.OnNewVideoTrack(bufferIndex, id, 1000, frame)
-	} else {
+	if !header {
+		if key && utils.AVCodecIdVP9 == id && d.videoInfo != nil && d.videoInfo.Width == 0 {
+			d.videoInfo.Width, d.videoInfo.Height, _ = ParseVP9FrameSize(frame)
+		}
+
 		d.BaseDemuxer.OnVideoPacket(bufferIndex, id, frame, key, int64(ts), int64(ts+uint32(ct)), avformat.PacketTypeAVCC)
+	} else if d.videoSequenceHeader == nil {
+		info := d.parseVideoInfo(id, frame)
+		if track := d.BaseDemuxer.OnNewVideoTrack(bufferIndex, id, 1000, frame); track != nil {
+			d.videoSequenceHeader = copyBytes(frame)
+			d.videoInfo = info
+			if stream := track.GetStream(); stream.CodecParameters == nil && info != nil {
+				stream.CodecParameters = &VideoCodecData{Info: info, Record: stream.Data}
+			}
+
+			d.onVideoInfo(track, info)
+		}
+	} else if !bytes.Equal(d.videoSequenceHeader, frame) {
+		return true, d.onVideoSequenceHeaderChanged(bufferIndex, id, ts, frame)
+	} else {
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (d *Demuxer) onAudioSequenceHeaderChanged(bufferIndex int, id utils.AVCodecID, ts uint32, extraData []byte, config avformat.AudioConfig) error {
+	track := d.Tracks.FindTrackWithType(utils.AVMediaTypeAudio)
+	if track == nil {
+		return fmt.Errorf("audio track not found")
 	}
+
+	data := copyBytes(extraData)
+
+	// 先回调旧编码器信息的缓存帧
+	d.flushPendingPacket(track, bufferIndex, ts)
+
+	stream := track.GetStream()
+	stream.CodecID = id
+	stream.Data = data
+	stream.AudioConfig = config
+	d.audioSequenceHeader = data
+
+	if handler, ok := d.Handler.(CodecParametersHandler); ok && d.Completed {
+		handler.OnCodecParametersChanged(track, ts)
+	}
+
 	return nil
 }
 
+func (d *Demuxer) onVideoSequenceHeaderChanged(bufferIndex int, id utils.AVCodecID, ts uint32, extraData []byte) error {
+	track := d.Tracks.FindTrackWithType(utils.AVMediaTypeVideo)
+	if track == nil {
+		return fmt.Errorf("video track not found")
+	}
+
+	data := copyBytes(extraData)
+	info := d.parseVideoInfo(id, data)
+	var codecData avformat.CodecData
+	var err error
+	switch id {
+	case utils.AVCodecIdH264:
+		codecData, err = avformat.ParseAVCDecoderConfigurationRecord(data)
+	case utils.AVCodecIdH265:
+		codecData, err = avformat.ParseHEVCDecoderConfigurationRecord(data)
+	default:
+		if info != nil {
+			codecData = &VideoCodecData{Info: info, Record: data}
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	d.videoInfo = info
+
+	d.flushPendingPacket(track, bufferIndex, ts)
+
+	stream := track.GetStream()
+	stream.CodecID = id
+	stream.Data = data
+	stream.CodecParameters = codecData
+	d.videoSequenceHeader = data
+
+	if handler, ok := d.Handler.(CodecParametersHandler); ok && d.Completed {
+		handler.OnCodecParametersChanged(track, ts)
+	}
+
+	d.onVideoInfo(track, info)
+	return nil
+}
+
+// parseVideoInfo 解析视频参数, 解析失败不影响解复用
+func (d *Demuxer) parseVideoInfo(id utils.AVCodecID, record []byte) *VideoInfo {
+	info, err := ParseVideoInfo(id, record)
+	if err != nil {
+		println(err.Error())
+		return nil
+	}
+
+	return info
+}
+
+// onVideoInfo 与onMetaData交叉校验, 回调VideoInfoHandler
+func (d *Demuxer) onVideoInfo(track avformat.Track, info *VideoInfo) {
+	if info == nil {
+		return
+	}
+
+	var mismatch error
+	if d.metadata != nil && d.metadata.Size() > 1 {
+		mismatch = info.CheckMetaData(amf0.ToObject(d.metadata.Get(1)))
+	}
+
+	if handler, ok := d.Handler.(VideoInfoHandler); ok {
+		handler.OnVideoInfo(track, info, mismatch)
+	} else if mismatch != nil {
+		println(mismatch.Error())
+	}
+}
+
+func (d *Demuxer) onSequenceEnd(mediaType utils.AVMediaType, ts uint32) {
+	track := d.Tracks.FindTrackWithType(mediaType)
+	if track == nil {
+		return
+	}
+
+	d.flushPendingPacket(track, d.FindBufferIndexByMediaType(mediaType), ts)
+	if handler, ok := d.Handler.(CodecParametersHandler); ok && d.Completed {
+		handler.OnSequenceEnd(track, ts)
+	}
+}
+
+// flushPendingPacket 回调track缓存的最后一帧, 保证编码器信息变化前的帧先于变化事件回调.
+// 探测未完成时不处理, 由探测完成后统一回调.
+func (d *Demuxer) flushPendingPacket(track avformat.Track, bufferIndex int, ts uint32) {
+	index := track.GetStream().Index
+	if !d.Completed || d.Handler == nil || index >= len(d.Packets) {
+		return
+	}
+
+	packets := d.Packets[index]
+	for packets.Size() > 0 {
+		packet := packets.Remove(0)
+		if duration := int64(ts) - packet.Dts; duration > 0 {
+			packet.Duration = duration
+		}
+
+		d.Handler.OnPacket(packet)
+		if d.AutoFree {
+			d.DataPipeline.DiscardHeadPacket(bufferIndex)
+			avformat.FreePacket(packet)
+		}
+	}
+}
+
+// Flush 输入结束时调用, 完成探测并按dts顺序回调每个track缓存的最后一帧
+func (d *Demuxer) Flush() {
+	if d.Handler == nil {
+		return
+	}
+
+	d.ProbeComplete()
+	pendingDts := func(track avformat.Track) int64 {
+		if index := track.GetStream().Index; index < len(d.Packets) && d.Packets[index].Size() > 0 {
+			return d.Packets[index].Get(0).Dts
+		}
+
+		return math.MaxInt64
+	}
+
+	tracks := append([]avformat.Track(nil), d.Tracks.Tracks...)
+	sort.SliceStable(tracks, func(i, j int) bool {
+		return pendingDts(tracks[i]) < pendingDts(tracks[j])
+	})
+
+	for _, track := range tracks {
+		d.flushPendingPacket(track, d.FindBufferIndexByMediaType(track.GetStream().MediaType), 0)
+	}
+}
+
+// requireAudioSequenceHeader 音频编码器是否需要sequence header才能解码
+func requireAudioSequenceHeader(id utils.AVCodecID) bool {
+	return utils.AVCodecIdAAC == id || utils.AVCodecIdOPUS == id || utils.AVCodecIdFLAC == id
+}
+
+func copyBytes(data []byte) []byte {
+	dst := make([]byte, len(data))
+	copy(dst, data)
+	return dst
+}
+
 func NewDemuxer(autoFree bool) *Demuxer {
 	demuxer := &Demuxer{
 		BaseDemuxer: avformat.BaseDemuxer{
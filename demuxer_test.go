@@ -1,23 +1,28 @@
 package flv
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/bufio"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv/amf0"
+	"github.com/lkmio/flv/internal/flvtest"
 	"os"
 	"testing"
 )
 
 type RemuxHandler struct {
 	avformat.OnUnpackStreamLogger
-	muxer              *Muxer
-	file               *os.File
-	tagData            []byte
-	firstOfVideoPacket bool
+	writer *Writer
 }
 
 func (s *RemuxHandler) OnNewTrack(stream avformat.Track) {
 	s.OnUnpackStreamLogger.OnNewTrack(stream)
 
-	_, err := s.muxer.AddTrack(stream.GetStream())
+	_, err := s.writer.AddTrack(stream.GetStream())
 	if err != nil {
 		panic(err)
 	}
@@ -26,9 +31,7 @@ func (s *RemuxHandler) OnNewTrack(stream avformat.Track) {
 func (s *RemuxHandler) OnTrackComplete() {
 	s.OnUnpackStreamLogger.OnTrackComplete()
 
-	n := s.muxer.WriteHeader(s.tagData)
-	_, err := s.file.Write(s.tagData[:n])
-	if err != nil {
+	if err := s.writer.WriteHeader(); err != nil {
 		panic(err)
 	}
 }
@@ -36,32 +39,7 @@ func (s *RemuxHandler) OnTrackComplete() {
 func (s *RemuxHandler) OnPacket(packet *avformat.AVPacket) {
 	s.OnUnpackStreamLogger.OnPacket(packet)
 
-	track := s.muxer.Tracks.Get(packet.Index)
-	if s.firstOfVideoPacket {
-		if track.GetStream().Colors != nil {
-			n := s.muxer.Input(s.tagData, packet.MediaType, len(track.GetStream().Colors), packet.Dts, packet.Pts, false, FrameTypeVideoInfoCommand)
-			_, err := s.file.Write(s.tagData[:n])
-			_, err = s.file.Write(track.GetStream().Colors)
-			if err != nil {
-				panic(err)
-			}
-
-		}
-	}
-
-	pktType := FrameTypeInterFrame
-	if packet.Key {
-		pktType = FrameTypeKeyFrame
-	}
-
-	n := s.muxer.Input(s.tagData, packet.MediaType, len(packet.Data), packet.Dts, packet.Pts, false, pktType)
-	_, err := s.file.Write(s.tagData[:n])
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = s.file.Write(packet.Data)
-	if err != nil {
+	if err := s.writer.WritePacket(packet); err != nil {
 		panic(err)
 	}
 }
@@ -121,13 +99,258 @@ func TestDeMuxer(t *testing.T) {
 				panic(err)
 			}
 
-			handler := &RemuxHandler{
-				tagData: make([]byte, 2048),
-			}
-			handler.muxer = NewMuxer(nil)
-			handler.file = outfile
+			handler := &RemuxHandler{writer: NewWriter(outfile)}
 			unpack(file, handler)
-			handler.file.Close()
+			if err = handler.writer.Close(); err != nil {
+				panic(err)
+			}
 		}
 	})
 }
+
+func TestScriptData(t *testing.T) {
+	muxer := NewMuxer(nil)
+	buffer := make([]byte, 1024)
+	n := muxer.WriteHeader(buffer)
+
+	parameters := &amf0.Object{}
+	parameters.AddStringProperty("scte35", "/DAlAAAAAAAAAP/wFAUAAAABf+/+AAAAAH4AKTLgAAEAAAAAbzpEQA==")
+	cuePoint := &CuePoint{Name: "ad", Time: 10, Type: CuePointTypeEvent, Parameters: parameters}
+
+	written, err := muxer.WriteCuePoint(buffer[n:], cuePoint, 10000)
+	utils.Assert(err == nil)
+	n += written
+
+	written, err = muxer.WriteCaptionInfo(buffer[n:], &CaptionInfo{Type: CaptionTypeCEA708, Data: []byte{0xFC, 0x94, 0x20}}, 10040)
+	utils.Assert(err == nil)
+	n += written
+
+	written, err = muxer.WriteScriptData(buffer[n:], ScriptDataNameOnMetaData, muxer.MetaData(), 10080)
+	utils.Assert(err == nil)
+	n += written
+
+	_, err = muxer.WriteScriptData(buffer[n:n+16], ScriptDataNameOnMetaData, muxer.MetaData(), 10080)
+	utils.Assert(err != nil)
+
+	handler := &ScriptDataCollector{}
+	demuxer := NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	// 补上最后一个tag的PrevTagSize
+	binary.BigEndian.PutUint32(buffer[n:], muxer.PrevTagSize())
+	_, err = demuxer.Input(buffer[:n+4])
+	utils.Assert(err == nil)
+
+	utils.Assert(demuxer.Metadata() != nil)
+	utils.Assert(handler.updates == 1)
+	utils.Assert(len(handler.scriptData) == 4)
+
+	parsedCuePoint, err := ParseCuePoint(handler.scriptData[1])
+	utils.Assert(err == nil)
+	utils.Assert(handler.scriptData[1].Timestamp == 10000)
+	utils.Assert(*parsedCuePoint.Parameters.FindProperty("scte35") == *parameters.FindProperty("scte35"))
+	utils.Assert(parsedCuePoint.Name == "ad" && parsedCuePoint.Time == 10 && parsedCuePoint.Type == CuePointTypeEvent)
+
+	captionInfo, err := ParseCaptionInfo(handler.scriptData[2])
+	utils.Assert(err == nil)
+	utils.Assert(captionInfo.Type == CaptionTypeCEA708 && bytes.Equal(captionInfo.Data, []byte{0xFC, 0x94, 0x20}))
+}
+
+type CodecParametersCollector struct {
+	PacketCollector
+	events []string
+}
+
+func (c *CodecParametersCollector) OnPacket(packet *avformat.AVPacket) {
+	c.PacketCollector.OnPacket(packet)
+	c.events = append(c.events, "packet")
+}
+
+func (c *CodecParametersCollector) OnCodecParametersChanged(track avformat.Track, ts uint32) {
+	c.events = append(c.events, fmt.Sprintf("changed %dx%d", track.GetStream().CodecParameters.Width(), track.GetStream().CodecParameters.Height()))
+}
+
+func (c *CodecParametersCollector) OnSequenceEnd(track avformat.Track, ts uint32) {
+	c.events = append(c.events, "end")
+}
+
+func TestCodecParametersChanged(t *testing.T) {
+	output := &bytes.Buffer{}
+	writer := NewWriter(output)
+	stream := flvtest.NewVideoStream()
+	index, err := writer.AddTrack(stream)
+	utils.Assert(err == nil)
+	utils.Assert(writer.WriteHeader() == nil)
+
+	frame := []byte{0x0, 0x0, 0x0, 0x3, 0x65, 0x88, 0x84}
+	writePackets := func(start int) {
+		for i := start; i < start+10; i++ {
+			packet := avformat.NewVideoPacket(frame, int64(i*40), int64(i*40), i%10 == 0, avformat.PacketTypeAVCC, utils.AVCodecIdH264, 0, 1000)
+			utils.Assert(writer.WritePacket(packet) == nil)
+		}
+	}
+
+	writePackets(0)
+	// 重复的sequence header不回调
+	utils.Assert(writer.WriteSequenceHeader(index, 400) == nil)
+	writePackets(10)
+
+	// 切换为1920x1080
+	sps, _ := hex.DecodeString("67640028acd940780227e5c044000003000400000300c83c60c658")
+	record, codecData, err := NewVideoCodecData(utils.AVCodecIdH264, nil, sps, flvtest.PPS)
+	utils.Assert(err == nil)
+	stream.Data = record
+	stream.CodecParameters = codecData
+	utils.Assert(writer.WriteSequenceHeader(index, 800) == nil)
+	writePackets(20)
+	utils.Assert(writer.WriteSequenceEnd(index, 1200) == nil)
+	writePackets(30)
+	utils.Assert(writer.Close() == nil)
+
+	handler := &CodecParametersCollector{}
+	demuxer := NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	_, err = demuxer.Input(output.Bytes())
+	utils.Assert(err == nil)
+
+	// 变化前的20帧先回调
+	var expected []string
+	for i := 0; i < 20; i++ {
+		expected = append(expected, "packet")
+	}
+	expected = append(expected, "changed 1920x1080")
+	for i := 0; i < 10; i++ {
+		expected = append(expected, "packet")
+	}
+	expected = append(expected, "end")
+	for i := 0; i < 9; i++ {
+		expected = append(expected, "packet")
+	}
+
+	utils.Assert(fmt.Sprint(handler.events) == fmt.Sprint(expected))
+	utils.Assert(handler.tracks[0].GetStream().CodecParameters.Width() == 1920)
+}
+
+func TestMalformedSequenceHeaderChange(t *testing.T) {
+	output := &bytes.Buffer{}
+	writer := NewWriter(output)
+	stream := flvtest.NewVideoStream()
+	index, err := writer.AddTrack(stream)
+	utils.Assert(err == nil)
+	utils.Assert(writer.WriteHeader() == nil)
+
+	writePackets := func(start int) {
+		for i := start; i < start+10; i++ {
+			frame := []byte{0x0, 0x0, 0x0, 0x2, 0x65, byte(i)}
+			packet := avformat.NewVideoPacket(frame, int64(i*40), int64(i*40), i%10 == 0, avformat.PacketTypeAVCC, utils.AVCodecIdH264, 0, 1000)
+			utils.Assert(writer.WritePacket(packet) == nil)
+		}
+	}
+
+	// 缓存帧之后的sequence header无法解析
+	writePackets(0)
+	stream.Data = []byte{0x01, 0x64, 0x00}
+	stream.CodecParameters = nil
+	utils.Assert(writer.WriteSequenceHeader(index, 400) == nil)
+	writePackets(10)
+	utils.Assert(writer.Close() == nil)
+
+	handler := &PacketCollector{}
+	demuxer := NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	data := output.Bytes()
+	n, err := demuxer.Input(data)
+	utils.Assert(err != nil)
+	_, err = demuxer.Input(data[n:])
+	utils.Assert(err == nil)
+	demuxer.Flush()
+
+	// 缓存的帧没有被释放
+	utils.Assert(len(handler.packets) == 20)
+	for i, packet := range handler.packets {
+		utils.Assert(packet.Dts == int64(i*40) && bytes.Equal(packet.Data, []byte{0x0, 0x0, 0x0, 0x2, 0x65, byte(i)}))
+	}
+}
+
+func TestAudioParametersFromSequenceHeader(t *testing.T) {
+	// HE-AAC v2, tag头固定为44k立体声
+	output := &bytes.Buffer{}
+	writer := NewWriter(output)
+	stream := avformat.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdAAC, []byte{0xEB, 0x09, 0x88, 0x00}, nil)
+	stream.SampleRate = 48000
+	_, err := writer.AddTrack(stream)
+	utils.Assert(err == nil)
+	utils.Assert(writer.WriteHeader() == nil)
+	for i := 0; i < 10; i++ {
+		utils.Assert(writer.WritePacket(avformat.NewAudioPacket([]byte{0x21, 0x10}, int64(i*42), utils.AVCodecIdAAC, 0, 1000)) == nil)
+	}
+	utils.Assert(writer.Close() == nil)
+
+	handler := &PacketCollector{}
+	demuxer := NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	_, err = demuxer.Input(output.Bytes())
+	utils.Assert(err == nil)
+	utils.Assert(len(handler.tracks) == 1)
+	utils.Assert(handler.tracks[0].GetStream().SampleRate == 48000 && handler.tracks[0].GetStream().Channels == 2)
+
+	// 增强flv的opus
+	muxer := NewMuxer(nil)
+	output.Reset()
+	output.Write([]byte{0x46, 0x4C, 0x56, 0x1, 0x4, 0x0, 0x0, 0x0, 0x9})
+	writeTag := func(ts uint32, payload []byte) {
+		tag := make([]byte, TagHeaderSize+len(payload))
+		n := muxer.WriteTag(tag, TagTypeAudioData, uint32(len(payload)), ts)
+		copy(tag[n:], payload)
+		output.Write(tag)
+	}
+
+	opusHead := []byte{'O', 'p', 'u', 's', 'H', 'e', 'a', 'd', 0x1, 0x1, 0x38, 0x1, 0x80, 0xBB, 0x0, 0x0, 0x0, 0x0, 0x0}
+	writeTag(0, append([]byte{0x90, 'O', 'p', 'u', 's'}, opusHead...))
+	for i := 0; i < 20; i++ {
+		// ModEx包裹的CodedFrames
+		writeTag(uint32(i*20), []byte{0x97, 0x0, 0x0, 0x11, 'O', 'p', 'u', 's', 0xFC, byte(i)})
+	}
+	// SequenceEnd回调缓存的最后一帧
+	writeTag(400, []byte{0x92, 'O', 'p', 'u', 's'})
+
+	handler = &PacketCollector{}
+	demuxer = NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	_, err = demuxer.Input(output.Bytes())
+	utils.Assert(err == nil)
+	utils.Assert(len(handler.tracks) == 1)
+	stream = handler.tracks[0].GetStream()
+	utils.Assert(stream.CodecID == utils.AVCodecIdOPUS && stream.SampleRate == 48000 && stream.Channels == 1)
+	utils.Assert(bytes.Equal(stream.Data, opusHead))
+	utils.Assert(len(handler.packets) == 20)
+	utils.Assert(bytes.Equal(handler.packets[1].Data, []byte{0xFC, 0x1}))
+}
+
+func TestDemuxerPartialInput(t *testing.T) {
+	output := &bytes.Buffer{}
+	writer := NewWriter(output)
+	flvtest.AddTracks(writer)
+	utils.Assert(writer.WriteHeader() == nil)
+	flvtest.WriteGOPs(writer, 0, 20)
+
+	// 每次输入7个字节, 未消费的数据和下次输入拼接
+	handler := &PacketCollector{}
+	demuxer := NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	var pending []byte
+	for data := output.Bytes(); len(data) > 0; {
+		size := bufio.MinInt(7, len(data))
+		pending = append(pending, data[:size]...)
+		data = data[size:]
+
+		n, err := demuxer.Input(pending)
+		utils.Assert(err == nil)
+		pending = pending[:copy(pending, pending[n:])]
+	}
+
+	utils.Assert(len(handler.tracks) == 2)
+	utils.Assert(len(handler.packets) == 20*2-2)
+	for i, packet := range handler.packets {
+		utils.Assert(int(packet.Data[len(packet.Data)-1]) == i/2)
+	}
+}
@@ -0,0 +1,40 @@
+package es
+
+import (
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/flv"
+	"io"
+)
+
+// adtsWriter 为AAC帧添加ADTS头, 已经包含ADTS头的流原样写入
+type adtsWriter struct {
+	writer io.Writer
+	header []byte // ADTS头模板, nil表示帧已经包含ADTS头
+	buffer []byte
+}
+
+func (w *adtsWriter) update(stream *avformat.AVStream) error {
+	w.header = nil
+	if stream.HasADTSHeader {
+		return nil
+	}
+
+	var err error
+	w.header, err = flv.NewADTSHeader(stream.Data)
+	return err
+}
+
+func (w *adtsWriter) writePacket(packet *avformat.AVPacket) error {
+	if w.header == nil || flv.IsADTS(packet.Data) {
+		_, err := w.writer.Write(packet.Data)
+		return err
+	}
+
+	w.buffer = flv.AppendADTS(w.buffer[:0], w.header, packet.Data)
+	_, err := w.writer.Write(w.buffer)
+	return err
+}
+
+func (w *adtsWriter) close() error {
+	return nil
+}
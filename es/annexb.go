@@ -0,0 +1,61 @@
+package es
+
+import (
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"io"
+)
+
+var startCode = []byte{0x0, 0x0, 0x0, 0x1}
+
+// annexBWriter 将H.264/H.265帧转换为AnnexB格式, 关键帧没有带内参数集时插入sequence header中的参数集
+type annexBWriter struct {
+	writer        io.Writer
+	stream        *avformat.AVStream
+	lengthSize    int    // AVCC的长度前缀字节数
+	parameterSets []byte // AnnexB格式的vps/sps/pps
+	buffer        []byte
+}
+
+// update 从decoder configuration record中获取长度前缀字节数和参数集
+func (w *annexBWriter) update(stream *avformat.AVStream) error {
+	w.stream = stream
+	var err error
+	w.lengthSize, w.parameterSets, err = flv.ParseParameterSets(stream)
+	return err
+}
+
+func (w *annexBWriter) writePacket(packet *avformat.AVPacket) error {
+	id := w.stream.CodecID
+	var nalus [][]byte
+	var hasSPS bool
+	collect := func(nalu []byte) {
+		naluType := flv.NalUnitType(id, nalu)
+		hasSPS = hasSPS || (utils.AVCodecIdH265 == id && flv.HEVCNalSPS == naluType) || (utils.AVCodecIdH264 == id && flv.H264NalSPS == naluType)
+		nalus = append(nalus, nalu)
+	}
+
+	if avformat.PacketTypeAnnexB == packet.PacketType {
+		flv.SplitAnnexB(packet.Data, collect)
+	} else {
+		flv.SplitAVCC(packet.Data, w.lengthSize, collect)
+	}
+
+	w.buffer = w.buffer[:0]
+	if packet.Key && !hasSPS {
+		w.buffer = append(w.buffer, w.parameterSets...)
+	}
+
+	for _, nalu := range nalus {
+		w.buffer = append(w.buffer, startCode...)
+		w.buffer = append(w.buffer, nalu...)
+	}
+
+	_, err := w.writer.Write(w.buffer)
+	return err
+}
+
+func (w *annexBWriter) close() error {
+	return nil
+}
@@ -0,0 +1,270 @@
+// Package es 将flv中的每个track提取为对应编码器的标准裸流文件, 用于检查编码数据, 不依赖ffmpeg.
+package es
+
+import (
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// streamWriter 将一个track的帧写入标准容器
+type streamWriter interface {
+	writePacket(packet *avformat.AVPacket) error
+
+	// update 流中途的编码器信息变化
+	update(stream *avformat.AVStream) error
+
+	// close 补全文件头等信息, 不关闭输出
+	close() error
+}
+
+// Extension 返回编码器对应的文件扩展名, 不支持的编码器返回错误
+func Extension(id utils.AVCodecID) (string, error) {
+	switch id {
+	case utils.AVCodecIdH264:
+		return "h264", nil
+	case utils.AVCodecIdH265:
+		return "h265", nil
+	case utils.AVCodecIdAAC:
+		return "aac", nil
+	case utils.AVCodecIdMP3:
+		return "mp3", nil
+	case utils.AVCodecIdVP9, utils.AVCodecIdAV1:
+		return "ivf", nil
+	case utils.AVCodecIdOPUS:
+		return "opus", nil
+	case utils.AVCodecIdPCMU8, utils.AVCodecIdPCMS16LE, utils.AVCodecIdPCMS16BE, utils.AVCodecIdPCMALAW, utils.AVCodecIdPCMMULAW:
+		return "wav", nil
+	}
+
+	return "", fmt.Errorf("unsupported codec %s", id)
+}
+
+func newStreamWriter(writer io.Writer, stream *avformat.AVStream) (streamWriter, error) {
+	var w streamWriter
+	switch stream.CodecID {
+	case utils.AVCodecIdH264, utils.AVCodecIdH265:
+		w = &annexBWriter{writer: writer}
+	case utils.AVCodecIdAAC:
+		w = &adtsWriter{writer: writer}
+	case utils.AVCodecIdMP3:
+		w = &rawWriter{writer: writer}
+	case utils.AVCodecIdVP9, utils.AVCodecIdAV1:
+		w = &ivfWriter{writer: writer}
+	case utils.AVCodecIdOPUS:
+		w = &oggWriter{writer: writer, serial: uint32(stream.Index + 1)}
+	default:
+		if _, err := Extension(stream.CodecID); err != nil {
+			return nil, err
+		}
+
+		w = &wavWriter{writer: writer}
+	}
+
+	return w, w.update(stream)
+}
+
+// rawWriter 原样写入帧数据, 用于自带帧头的mp3
+type rawWriter struct {
+	writer io.Writer
+}
+
+func (w *rawWriter) writePacket(packet *avformat.AVPacket) error {
+	_, err := w.writer.Write(packet.Data)
+	return err
+}
+
+func (w *rawWriter) update(stream *avformat.AVStream) error {
+	return nil
+}
+
+func (w *rawWriter) close() error {
+	return nil
+}
+
+// output 一个track的输出
+type output struct {
+	stream *avformat.AVStream
+	file   io.WriteCloser
+	writer streamWriter
+}
+
+// Extractor 将flv流中的每个track写入单独的文件: H.264/H.265为带参数集的AnnexB, AAC为ADTS, mp3为裸流,
+// VP9/AV1为IVF, Opus为Ogg, PCM和G.711为WAV. 通过Write输入flv流的任意分片, 输入结束后调用Close.
+// 跳过Speex, ADPCM和Nellymoser等不支持的编码器, 没有可以提取的track时Close返回错误.
+type Extractor struct {
+	demuxer *flv.Demuxer
+	create  func(stream *avformat.AVStream, ext string) (io.WriteCloser, error)
+	outputs []*output
+	skipped map[int]bool // 不支持的track
+	err     error
+}
+
+func (e *Extractor) findOutput(index int) *output {
+	for _, o := range e.outputs {
+		if o.stream.Index == index {
+			return o
+		}
+	}
+
+	return nil
+}
+
+// Skipped 返回跳过的track索引
+func (e *Extractor) Skipped() []int {
+	var skipped []int
+	for index := range e.skipped {
+		skipped = append(skipped, index)
+	}
+
+	sort.Ints(skipped)
+	return skipped
+}
+
+func (e *Extractor) OnNewTrack(track avformat.Track) {
+	if e.err != nil {
+		return
+	}
+
+	stream := track.GetStream()
+	ext, err := Extension(stream.CodecID)
+	if err != nil {
+		e.skipped[stream.Index] = true
+		return
+	}
+
+	file, err := e.create(stream, ext)
+	if err != nil {
+		e.err = err
+		return
+	}
+
+	o := &output{stream: stream, file: file}
+	e.outputs = append(e.outputs, o)
+	o.writer, e.err = newStreamWriter(file, stream)
+}
+
+func (e *Extractor) OnTrackComplete() {
+}
+
+func (e *Extractor) OnTrackNotFind() {
+}
+
+func (e *Extractor) OnPacket(packet *avformat.AVPacket) {
+	if e.err != nil || e.skipped[packet.Index] {
+		return
+	} else if o := e.findOutput(packet.Index); o == nil {
+		e.err = fmt.Errorf("track %d not found", packet.Index)
+	} else {
+		e.err = o.writer.writePacket(packet)
+	}
+}
+
+// OnCodecParametersChanged 流中途的sequence header变化, 编码器切换到其他容器时返回错误
+func (e *Extractor) OnCodecParametersChanged(track avformat.Track, ts uint32) {
+	stream := track.GetStream()
+	if e.err != nil || e.skipped[stream.Index] {
+		return
+	}
+
+	o := e.findOutput(stream.Index)
+	if o == nil {
+		e.err = fmt.Errorf("track %d not found", stream.Index)
+		return
+	}
+
+	ext, err := Extension(stream.CodecID)
+	if prev, _ := Extension(o.stream.CodecID); err != nil || ext != prev {
+		e.err = fmt.Errorf("codec of track %d changed from %s to %s", stream.Index, o.stream.CodecID, stream.CodecID)
+		return
+	}
+
+	o.stream = stream
+	e.err = o.writer.update(stream)
+}
+
+func (e *Extractor) OnSequenceEnd(track avformat.Track, ts uint32) {
+}
+
+// Write 输入flv流
+func (e *Extractor) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+
+	if _, err := e.demuxer.Input(p); err != nil {
+		return 0, err
+	} else if e.err != nil {
+		return 0, e.err
+	}
+
+	return len(p), nil
+}
+
+// Close 输入结束, 写入demuxer缓存的帧, 补全文件头并关闭所有输出
+func (e *Extractor) Close() error {
+	if e.err == nil {
+		e.demuxer.Flush()
+	}
+
+	if e.err == nil && len(e.outputs) == 0 {
+		e.err = fmt.Errorf("no track can be extracted")
+	}
+
+	for _, o := range e.outputs {
+		var err error
+		if o.writer != nil {
+			err = o.writer.close()
+		}
+
+		if closeErr := o.file.Close(); err == nil {
+			err = closeErr
+		}
+
+		if e.err == nil {
+			e.err = err
+		}
+	}
+
+	e.outputs = nil
+	e.demuxer.Close()
+	return e.err
+}
+
+// NewExtractor create为每个track创建输出, ext为文件扩展名. 输出实现io.WriteSeeker时, 关闭前回填WAV和IVF文件头中的长度
+func NewExtractor(create func(stream *avformat.AVStream, ext string) (io.WriteCloser, error)) *Extractor {
+	extractor := &Extractor{
+		demuxer: flv.NewDemuxer(true),
+		create:  create,
+		skipped: make(map[int]bool),
+	}
+
+	extractor.demuxer.SetHandler(extractor)
+	return extractor
+}
+
+// Extract 将src中的flv流提取到dir目录, 文件名为name-<track索引>.<扩展名>, 返回创建的文件
+func Extract(src io.Reader, dir, name string) ([]string, error) {
+	var files []string
+	extractor := NewExtractor(func(stream *avformat.AVStream, ext string) (io.WriteCloser, error) {
+		path := filepath.Join(dir, fmt.Sprintf("%s-%d.%s", name, stream.Index, ext))
+		file, err := os.Create(path)
+		if err == nil {
+			files = append(files, path)
+		}
+
+		return file, err
+	})
+
+	if _, err := io.Copy(extractor, src); err != nil {
+		extractor.Close()
+		return files, err
+	}
+
+	return files, extractor.Close()
+}
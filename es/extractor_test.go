@@ -0,0 +1,198 @@
+package es
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"github.com/lkmio/flv/internal/flvtest"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testOpusHead 2通道, pre-skip 312, 48000Hz
+var testOpusHead = []byte{'O', 'p', 'u', 's', 'H', 'e', 'a', 'd', 1, 2, 0x38, 0x1, 0x80, 0xBB, 0, 0, 0, 0, 0}
+
+type testOutput struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (o *testOutput) Close() error {
+	o.closed = true
+	return nil
+}
+
+// newTestFLV 生成H.264和AAC的flv流, 每5帧一个关键帧
+func newTestFLV(frames int) []byte {
+	output := &bytes.Buffer{}
+	flvtest.WriteFLV(flv.NewWriter(output), frames, flvtest.Options{GOP: 5})
+	return output.Bytes()
+}
+
+func TestExtractor(t *testing.T) {
+	outputs := make(map[string]*testOutput)
+	extractor := NewExtractor(func(stream *avformat.AVStream, ext string) (io.WriteCloser, error) {
+		outputs[ext] = &testOutput{}
+		return outputs[ext], nil
+	})
+
+	_, err := extractor.Write(newTestFLV(10))
+	utils.Assert(err == nil)
+	utils.Assert(extractor.Close() == nil)
+	utils.Assert(len(outputs) == 2 && outputs["h264"].closed && outputs["aac"].closed)
+
+	// 每个关键帧前插入sps和pps
+	var expected []byte
+	for i := 0; i < 10; i++ {
+		if i%5 == 0 {
+			expected = append(append(append(expected, startCode...), flvtest.SPS...), startCode...)
+			expected = append(append(expected, flvtest.PPS...), 0, 0, 0, 1, 0x65, byte(i))
+		} else {
+			expected = append(expected, 0, 0, 0, 1, 0x41, byte(i))
+		}
+	}
+
+	utils.Assert(bytes.Equal(outputs["h264"].Bytes(), expected))
+
+	// 每个AAC帧添加7字节ADTS头
+	frames, header, err := flv.SplitADTS(outputs["aac"].Bytes())
+	utils.Assert(err == nil && len(frames) == 10)
+	utils.Assert(bytes.Equal(flv.ADTSHeader2AudioSpecificConfig(header), flvtest.ASC))
+	for i, frame := range frames {
+		utils.Assert(bytes.Equal(frame, []byte{0x21, byte(i)}))
+	}
+
+	files, err := Extract(bytes.NewReader(newTestFLV(10)), t.TempDir(), "test")
+	utils.Assert(err == nil && len(files) == 2 && filepath.Base(files[0]) == "test-0.h264" && filepath.Base(files[1]) == "test-1.aac")
+	data, err := os.ReadFile(files[0])
+	utils.Assert(err == nil && bytes.Equal(data, expected))
+}
+
+func TestOgg(t *testing.T) {
+	utils.Assert(oggCRC([]byte("123456789")) == 0x89A1897F)
+
+	output := &bytes.Buffer{}
+	writer, err := newStreamWriter(output, avformat.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdOPUS, testOpusHead, nil))
+	utils.Assert(err == nil)
+	// CELT 20ms单帧
+	for i := 0; i < 3; i++ {
+		utils.Assert(writer.writePacket(avformat.NewAudioPacket([]byte{0xFC, byte(i)}, int64(i*20), utils.AVCodecIdOPUS, 0, 1000)) == nil)
+	}
+
+	utils.Assert(writer.close() == nil)
+
+	var granules []int64
+	var types []byte
+	for data := output.Bytes(); len(data) > 0; {
+		utils.Assert(bytes.HasPrefix(data, []byte("OggS")))
+		size := 27 + int(data[26])
+		for _, lacing := range data[27:size] {
+			size += int(lacing)
+		}
+
+		page := append([]byte(nil), data[:size]...)
+		crc := binary.LittleEndian.Uint32(page[22:])
+		binary.LittleEndian.PutUint32(page[22:], 0)
+		utils.Assert(oggCRC(page) == crc && binary.LittleEndian.Uint32(page[18:]) == uint32(len(granules)))
+		granules = append(granules, int64(binary.LittleEndian.Uint64(page[6:])))
+		types = append(types, page[5])
+		data = data[size:]
+	}
+
+	utils.Assert(len(granules) == 5 && types[0] == oggHeaderTypeBOS && types[4] == oggHeaderTypeEOS)
+	utils.Assert(granules[1] == 0 && granules[2] == 960 && granules[4] == 2880)
+	utils.Assert(opusPacketSamples([]byte{0x03, 0x3}) == 3*480 && opusPacketSamples([]byte{0x79}) == 2*960)
+}
+
+func TestWAVAndIVF(t *testing.T) {
+	// 大端PCM转换为小端, 关闭时回填长度
+	file, err := os.Create(filepath.Join(t.TempDir(), "test.wav"))
+	utils.Assert(err == nil)
+	defer file.Close()
+	stream := avformat.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdPCMS16BE, nil, nil)
+	stream.SampleRate, stream.Channels = 8000, 1
+	writer, err := newStreamWriter(file, stream)
+	utils.Assert(err == nil)
+	utils.Assert(writer.writePacket(avformat.NewAudioPacket([]byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6}, 0, utils.AVCodecIdPCMS16BE, 0, 1000)) == nil)
+	utils.Assert(writer.close() == nil)
+
+	data, err := os.ReadFile(file.Name())
+	utils.Assert(err == nil && len(data) == 44+6)
+	utils.Assert(binary.LittleEndian.Uint32(data[4:]) == 36+6 && binary.LittleEndian.Uint32(data[40:]) == 6)
+	utils.Assert(binary.LittleEndian.Uint32(data[24:]) == 8000 && binary.LittleEndian.Uint16(data[34:]) == 16)
+	utils.Assert(bytes.Equal(data[44:], []byte{0x2, 0x1, 0x4, 0x3, 0x6, 0x5}))
+
+	// AV1帧插入temporal delimiter, 关闭时回填帧数
+	file, err = os.Create(filepath.Join(t.TempDir(), "test.ivf"))
+	utils.Assert(err == nil)
+	defer file.Close()
+	writer, err = newStreamWriter(file, avformat.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdAV1, nil, nil))
+	utils.Assert(err == nil)
+	for i := 0; i < 2; i++ {
+		utils.Assert(writer.writePacket(avformat.NewVideoPacket([]byte{0x32, 0x1, byte(i)}, int64(i*40), int64(i*40), i == 0, avformat.PacketTypeAVCC, utils.AVCodecIdAV1, 0, 1000)) == nil)
+	}
+
+	utils.Assert(writer.close() == nil)
+	data, err = os.ReadFile(file.Name())
+	utils.Assert(err == nil && len(data) == 32+2*(12+5))
+	utils.Assert(string(data[:4]) == "DKIF" && string(data[8:12]) == "AV01" && binary.LittleEndian.Uint32(data[24:]) == 2)
+	frame := data[32+12+5:]
+	utils.Assert(binary.LittleEndian.Uint32(frame) == 5 && binary.LittleEndian.Uint64(frame[4:]) == 40)
+	utils.Assert(bytes.Equal(frame[12:], []byte{0x12, 0x0, 0x32, 0x1, 0x1}))
+}
+
+func TestExtractorUnsupportedTrack(t *testing.T) {
+	// H.264和Speex, Speex不能提取
+	newFLV := func(video bool) []byte {
+		output := &bytes.Buffer{}
+		writer := flv.NewWriter(output)
+		if video {
+			_, err := writer.AddTrack(flvtest.NewVideoStream())
+			utils.Assert(err == nil)
+		}
+
+		speex := avformat.NewAVStream(utils.AVMediaTypeAudio, 1, utils.AVCodecIdSPEEX, nil, nil)
+		speex.SampleRate, speex.SampleSize, speex.Channels = 16000, 16, 1
+		_, err := writer.AddTrack(speex)
+		utils.Assert(err == nil)
+		utils.Assert(writer.WriteHeader() == nil)
+		for i := 0; i < 10; i++ {
+			if video {
+				frame := []byte{0, 0, 0, 2, 0x41, byte(i)}
+				if i%5 == 0 {
+					frame[4] = 0x65
+				}
+
+				utils.Assert(writer.WritePacket(avformat.NewVideoPacket(frame, int64(i*40), int64(i*40), i%5 == 0, avformat.PacketTypeAVCC, utils.AVCodecIdH264, 0, 1000)) == nil)
+			}
+
+			utils.Assert(writer.WritePacket(avformat.NewAudioPacket([]byte{0xAA, byte(i)}, int64(i*40), utils.AVCodecIdSPEEX, 1, 1000)) == nil)
+		}
+
+		utils.Assert(writer.Flush() == nil)
+		return output.Bytes()
+	}
+
+	outputs := make(map[string]*testOutput)
+	create := func(stream *avformat.AVStream, ext string) (io.WriteCloser, error) {
+		outputs[ext] = &testOutput{}
+		return outputs[ext], nil
+	}
+
+	extractor := NewExtractor(create)
+	_, err := extractor.Write(newFLV(true))
+	utils.Assert(err == nil)
+	utils.Assert(extractor.Close() == nil)
+	utils.Assert(len(outputs) == 1 && outputs["h264"].closed && outputs["h264"].Len() > 0)
+	utils.Assert(len(extractor.Skipped()) == 1 && extractor.Skipped()[0] == 1)
+
+	// 没有可以提取的track
+	extractor = NewExtractor(create)
+	_, err = extractor.Write(newFLV(false))
+	utils.Assert(err == nil)
+	utils.Assert(extractor.Close() != nil)
+}
@@ -0,0 +1,125 @@
+package es
+
+import (
+	"encoding/binary"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"io"
+)
+
+const (
+	ivfHeaderSize      = 32
+	ivfFrameHeaderSize = 12
+)
+
+// ivfWriter 将VP9/AV1帧写入IVF, 时间基为毫秒. AV1帧没有temporal delimiter时插入
+type ivfWriter struct {
+	writer  io.Writer
+	stream  *avformat.AVStream
+	start   int64 // 文件头的位置, 输出不支持Seek时为-1
+	frames  uint32
+	started bool
+	buffer  []byte
+}
+
+func (w *ivfWriter) update(stream *avformat.AVStream) error {
+	w.stream = stream
+	return nil
+}
+
+// writeHeader 第一帧前写入文件头, VP9的sequence header不包含分辨率时从关键帧中解析
+func (w *ivfWriter) writeHeader(packet *avformat.AVPacket) error {
+	var width, height int
+	if w.stream.CodecParameters != nil {
+		width, height = w.stream.CodecParameters.Width(), w.stream.CodecParameters.Height()
+	}
+
+	if width == 0 && utils.AVCodecIdVP9 == w.stream.CodecID && packet.Key {
+		width, height, _ = flv.ParseVP9FrameSize(packet.Data)
+	}
+
+	fourcc := "VP90"
+	if utils.AVCodecIdAV1 == w.stream.CodecID {
+		fourcc = "AV01"
+	}
+
+	// signature(32) version(16) header_size(16) fourcc(32) width(16) height(16) rate(32) scale(32) frame_count(32) unused(32)
+	header := append(make([]byte, 0, ivfHeaderSize), "DKIF"...)
+	header = binary.LittleEndian.AppendUint16(header, 0)
+	header = binary.LittleEndian.AppendUint16(header, ivfHeaderSize)
+	header = append(header, fourcc...)
+	header = binary.LittleEndian.AppendUint16(header, uint16(width))
+	header = binary.LittleEndian.AppendUint16(header, uint16(height))
+	header = binary.LittleEndian.AppendUint32(header, 1000)
+	header = binary.LittleEndian.AppendUint32(header, 1)
+	header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+
+	w.start = position(w.writer)
+	_, err := w.writer.Write(header)
+	return err
+}
+
+func (w *ivfWriter) writePacket(packet *avformat.AVPacket) error {
+	if !w.started {
+		if err := w.writeHeader(packet); err != nil {
+			return err
+		}
+
+		w.started = true
+	}
+
+	// frame_size(32) timestamp(64)
+	w.buffer = append(w.buffer[:0], 0, 0, 0, 0)
+	w.buffer = binary.LittleEndian.AppendUint64(w.buffer, uint64(packet.ConvertPts(1000)))
+	// OBU_TEMPORAL_DELIMITER, has_size_field=1, obu_size=0
+	if utils.AVCodecIdAV1 == w.stream.CodecID && (len(packet.Data) == 0 || packet.Data[0]>>3&0xF != 2) {
+		w.buffer = append(w.buffer, 0x12, 0x00)
+	}
+
+	w.buffer = append(w.buffer, packet.Data...)
+	binary.LittleEndian.PutUint32(w.buffer, uint32(len(w.buffer)-ivfFrameHeaderSize))
+	w.frames++
+	_, err := w.writer.Write(w.buffer)
+	return err
+}
+
+// close 回填帧数
+func (w *ivfWriter) close() error {
+	if !w.started || w.start < 0 {
+		return nil
+	}
+
+	return patch(w.writer, w.start+24, binary.LittleEndian.AppendUint32(nil, w.frames))
+}
+
+// position 返回输出的当前位置, 不支持Seek时返回-1
+func position(writer io.Writer) int64 {
+	if seeker, ok := writer.(io.Seeker); ok {
+		if offset, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			return offset
+		}
+	}
+
+	return -1
+}
+
+// patch 在offset处写入data, 之后回到原来的位置
+func patch(writer io.Writer, offset int64, data []byte) error {
+	seeker, ok := writer.(io.WriteSeeker)
+	if !ok {
+		return nil
+	}
+
+	current, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	} else if _, err = seeker.Seek(offset, io.SeekStart); err != nil {
+		return err
+	} else if _, err = seeker.Write(data); err != nil {
+		return err
+	}
+
+	_, err = seeker.Seek(current, io.SeekStart)
+	return err
+}
@@ -0,0 +1,188 @@
+package es
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/flv"
+	"io"
+)
+
+const (
+	oggHeaderTypeBOS = 0x02
+	oggHeaderTypeEOS = 0x04
+
+	// oggMaxPacketSize 一个page最多255个lacing值
+	oggMaxPacketSize = 255*255 - 1
+)
+
+var oggCRCTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+
+		table[i] = crc
+	}
+
+	return table
+}()
+
+// oggCRC Ogg page的CRC32, 多项式0x04C11DB7, 初始值0, 不反转
+func oggCRC(data []byte) uint32 {
+	var crc uint32
+	for _, b := range data {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^b]
+	}
+
+	return crc
+}
+
+// opusPacketSamples 根据TOC计算Opus包的48kHz采样数, RFC 6716 3.1
+func opusPacketSamples(packet []byte) int64 {
+	if len(packet) == 0 {
+		return 0
+	}
+
+	toc := packet[0]
+	config := toc >> 3
+	var frameSize int64
+	switch {
+	case config < 12:
+		// SILK 10/20/40/60ms
+		frameSize = []int64{480, 960, 1920, 2880}[config&0x3]
+	case config < 16:
+		// Hybrid 10/20ms
+		frameSize = []int64{480, 960}[config&0x1]
+	default:
+		// CELT 2.5/5/10/20ms
+		frameSize = []int64{120, 240, 480, 960}[config&0x3]
+	}
+
+	switch toc & 0x3 {
+	case 0:
+		return frameSize
+	case 1, 2:
+		return 2 * frameSize
+	}
+
+	if len(packet) < 2 {
+		return 0
+	}
+
+	return int64(packet[1]&0x3F) * frameSize
+}
+
+// oggWriter 将Opus包写入Ogg, RFC 7845. 每个page一个包, 最后一个包等到close时写入并标记EOS.
+// 流中途OpusHead变化时开始新的逻辑流(chained stream)
+type oggWriter struct {
+	writer   io.Writer
+	serial   uint32
+	head     []byte
+	sequence uint32
+	granule  int64
+	started  bool
+	pending  []byte // 等待写入的最后一个包
+	buffer   []byte
+}
+
+func (w *oggWriter) update(stream *avformat.AVStream) error {
+	if _, err := flv.ParseOpusHead(stream.Data); err != nil {
+		return err
+	}
+
+	// 结束当前逻辑流
+	if w.started {
+		if err := w.close(); err != nil {
+			return err
+		}
+
+		w.serial++
+		w.sequence, w.granule, w.started = 0, 0, false
+	}
+
+	w.head = append(w.head[:0], stream.Data...)
+	return nil
+}
+
+// writePage 写入只包含一个完整包的page
+func (w *oggWriter) writePage(packet []byte, headerType byte, granule int64) error {
+	if len(packet) > oggMaxPacketSize {
+		return fmt.Errorf("opus packet size %d exceeds ogg page size", len(packet))
+	}
+
+	// capture_pattern(32) version(8) header_type(8) granule_position(64) serial_number(32) page_sequence(32) checksum(32) page_segments(8)
+	dst := append(w.buffer[:0], "OggS"...)
+	dst = append(dst, 0, headerType)
+	dst = binary.LittleEndian.AppendUint64(dst, uint64(granule))
+	dst = binary.LittleEndian.AppendUint32(dst, w.serial)
+	dst = binary.LittleEndian.AppendUint32(dst, w.sequence)
+	dst = append(dst, 0, 0, 0, 0)
+	// 包长度为255的整数倍时, 以0结束
+	segments := len(packet)/255 + 1
+	dst = append(dst, byte(segments))
+	for i := 0; i < segments-1; i++ {
+		dst = append(dst, 255)
+	}
+
+	dst = append(dst, byte(len(packet)%255))
+	dst = append(dst, packet...)
+	binary.LittleEndian.PutUint32(dst[22:], oggCRC(dst))
+
+	w.buffer = dst
+	w.sequence++
+	_, err := w.writer.Write(dst)
+	return err
+}
+
+// writeHeaders 写入OpusHead和OpusTags, 各占一个page
+func (w *oggWriter) writeHeaders() error {
+	if err := w.writePage(w.head, oggHeaderTypeBOS, 0); err != nil {
+		return err
+	}
+
+	// vendor_string_length(32) vendor_string user_comment_list_length(32)
+	vendor := "lkmio/flv"
+	tags := append([]byte(nil), "OpusTags"...)
+	tags = binary.LittleEndian.AppendUint32(tags, uint32(len(vendor)))
+	tags = append(tags, vendor...)
+	tags = binary.LittleEndian.AppendUint32(tags, 0)
+	return w.writePage(tags, 0, 0)
+}
+
+func (w *oggWriter) writePacket(packet *avformat.AVPacket) error {
+	if !w.started {
+		if err := w.writeHeaders(); err != nil {
+			return err
+		}
+
+		w.started = true
+	} else if err := w.flushPending(0); err != nil {
+		return err
+	}
+
+	w.pending = append(w.pending[:0], packet.Data...)
+	return nil
+}
+
+// flushPending 写入等待的包, granule_position为该包结束时的采样数, 包含pre-skip
+func (w *oggWriter) flushPending(headerType byte) error {
+	w.granule += opusPacketSamples(w.pending)
+	err := w.writePage(w.pending, headerType, w.granule)
+	w.pending = w.pending[:0]
+	return err
+}
+
+func (w *oggWriter) close() error {
+	if !w.started {
+		return nil
+	}
+
+	return w.flushPending(oggHeaderTypeEOS)
+}
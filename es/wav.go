@@ -0,0 +1,134 @@
+package es
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"io"
+)
+
+const (
+	waveFormatPCM   = 1
+	waveFormatALaw  = 6
+	waveFormatMULaw = 7
+)
+
+// wavWriter 将PCM和G.711写入WAV, 大端PCM转换为小端. 输出不支持Seek时, RIFF和data的长度为0xFFFFFFFF
+type wavWriter struct {
+	writer        io.Writer
+	stream        *avformat.AVStream
+	format        uint16
+	bitsPerSample int
+	channels      int
+	sampleRate    int
+	start         int64 // 文件头的位置, 输出不支持Seek时为-1
+	headerSize    int
+	size          int64 // data chunk的长度
+	started       bool
+	buffer        []byte
+}
+
+func (w *wavWriter) update(stream *avformat.AVStream) error {
+	format, bits := uint16(waveFormatPCM), 16
+	switch stream.CodecID {
+	case utils.AVCodecIdPCMU8:
+		bits = 8
+	case utils.AVCodecIdPCMALAW:
+		format, bits = waveFormatALaw, 8
+	case utils.AVCodecIdPCMMULAW:
+		format, bits = waveFormatMULaw, 8
+	}
+
+	channels, sampleRate := stream.Channels, stream.SampleRate
+	if channels <= 0 {
+		channels = 1
+	}
+
+	if sampleRate <= 0 {
+		return fmt.Errorf("invalid sample rate of audio track %d", stream.Index)
+	} else if w.started && (format != w.format || bits != w.bitsPerSample || channels != w.channels || sampleRate != w.sampleRate) {
+		return fmt.Errorf("wav format of track %d can not be changed", stream.Index)
+	}
+
+	w.stream = stream
+	w.format, w.bitsPerSample, w.channels, w.sampleRate = format, bits, channels, sampleRate
+	return nil
+}
+
+func (w *wavWriter) writeHeader() error {
+	blockAlign := w.channels * w.bitsPerSample / 8
+	// PCM使用16字节的fmt chunk, 其他格式使用带cbSize的WAVEFORMATEX
+	fmtSize := 16
+	if waveFormatPCM != w.format {
+		fmtSize = 18
+	}
+
+	header := append([]byte(nil), "RIFF\xFF\xFF\xFF\xFFWAVEfmt "...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(fmtSize))
+	// wFormatTag(16) nChannels(16) nSamplesPerSec(32) nAvgBytesPerSec(32) nBlockAlign(16) wBitsPerSample(16)
+	header = binary.LittleEndian.AppendUint16(header, w.format)
+	header = binary.LittleEndian.AppendUint16(header, uint16(w.channels))
+	header = binary.LittleEndian.AppendUint32(header, uint32(w.sampleRate))
+	header = binary.LittleEndian.AppendUint32(header, uint32(w.sampleRate*blockAlign))
+	header = binary.LittleEndian.AppendUint16(header, uint16(blockAlign))
+	header = binary.LittleEndian.AppendUint16(header, uint16(w.bitsPerSample))
+	if fmtSize == 18 {
+		header = append(header, 0, 0)
+	}
+
+	header = append(header, "data\xFF\xFF\xFF\xFF"...)
+	w.start, w.headerSize = position(w.writer), len(header)
+	_, err := w.writer.Write(header)
+	return err
+}
+
+func (w *wavWriter) writePacket(packet *avformat.AVPacket) error {
+	if !w.started {
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+
+		w.started = true
+	}
+
+	data := packet.Data
+	if utils.AVCodecIdPCMS16BE == w.stream.CodecID {
+		w.buffer = append(w.buffer[:0], data...)
+		for i := 0; i+1 < len(w.buffer); i += 2 {
+			w.buffer[i], w.buffer[i+1] = w.buffer[i+1], w.buffer[i]
+		}
+
+		data = w.buffer
+	}
+
+	w.size += int64(len(data))
+	_, err := w.writer.Write(data)
+	return err
+}
+
+// close data chunk长度为奇数时补齐, 回填RIFF和data的长度
+func (w *wavWriter) close() error {
+	if !w.started {
+		return nil
+	}
+
+	size := w.size
+	if size%2 == 1 {
+		if _, err := w.writer.Write([]byte{0}); err != nil {
+			return err
+		}
+
+		size++
+	}
+
+	if w.start < 0 || int64(w.headerSize)+size-8 > 0xFFFFFFFF {
+		return nil
+	}
+
+	if err := patch(w.writer, w.start+4, binary.LittleEndian.AppendUint32(nil, uint32(int64(w.headerSize)+size-8))); err != nil {
+		return err
+	}
+
+	return patch(w.writer, w.start+int64(w.headerSize)-4, binary.LittleEndian.AppendUint32(nil, uint32(w.size)))
+}
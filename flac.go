@@ -0,0 +1,56 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	FLACMetadataBlockStreamInfo = 0
+)
+
+// FLACStreamInfo FLAC STREAMINFO元数据块
+type FLACStreamInfo struct {
+	MinBlockSize  int
+	MaxBlockSize  int
+	MinFrameSize  int
+	MaxFrameSize  int
+	SampleRate    int
+	Channels      int
+	BitsPerSample int
+	TotalSamples  uint64
+}
+
+// ParseFLACStreamInfo 解析FLAC头中的STREAMINFO, 数据可以以"fLaC"标记开头
+func ParseFLACStreamInfo(data []byte) (*FLACStreamInfo, error) {
+	data = bytes.TrimPrefix(data, []byte("fLaC"))
+	// last-metadata-block(1) block_type(7) length(24)
+	if len(data) < 4 || data[0]&0x7F != FLACMetadataBlockStreamInfo {
+		return nil, fmt.Errorf("flac streaminfo not found")
+	}
+
+	data = data[4:]
+	if len(data) < 18 {
+		return nil, fmt.Errorf("invalid flac streaminfo")
+	}
+
+	// sample_rate(20) channels-1(3) bits_per_sample-1(5) total_samples(36)
+	bits := binary.BigEndian.Uint64(data[10:])
+	info := &FLACStreamInfo{
+		MinBlockSize:  int(binary.BigEndian.Uint16(data)),
+		MaxBlockSize:  int(binary.BigEndian.Uint16(data[2:])),
+		MinFrameSize:  int(data[4])<<16 | int(data[5])<<8 | int(data[6]),
+		MaxFrameSize:  int(data[7])<<16 | int(data[8])<<8 | int(data[9]),
+		SampleRate:    int(bits >> 44),
+		Channels:      int(bits>>41&0x7) + 1,
+		BitsPerSample: int(bits>>36&0x1F) + 1,
+		TotalSamples:  bits & 0xFFFFFFFFF,
+	}
+
+	if info.SampleRate == 0 {
+		return nil, fmt.Errorf("invalid flac sample rate")
+	}
+
+	return info, nil
+}
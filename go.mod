@@ -1,5 +1,8 @@
 module github.com/lkmio/flv
 
-require github.com/lkmio/avformat v0.0.2
+require (
+	github.com/gorilla/websocket v1.5.0
+	github.com/lkmio/avformat v0.0.2
+)
 
 go 1.19
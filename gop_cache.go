@@ -0,0 +1,257 @@
+package flv
+
+import (
+	"bytes"
+	"github.com/lkmio/avformat/bufio"
+	"io"
+	"net"
+)
+
+// GOPCache 缓存flv头, onMetaData, 最新的音视频sequence header和最近的GOP, 新的订阅者从关键帧开始播放.
+// 通过Write输入Muxer/Writer输出的flv流, 或者通过WriteTag输入解析好的tag. 缓存期间持有tag的引用. 非线程安全.
+type GOPCache struct {
+	MaxDuration uint32 // 缓存的最大时长(毫秒), 0不限制
+	MaxBytes    int    // 缓存的最大字节数, 0不限制
+	GOPCount    int    // 保留的GOP数, 小于等于1只保留当前GOP
+
+	flag                *TypeFlag
+	metadata            *TagBuffer
+	audioSequenceHeader *TagBuffer
+	videoSequenceHeader *TagBuffer
+	gops                [][]*TagBuffer // 有视频时每个GOP以关键帧开头, 纯音频流只有一组
+	size                int
+	hasVideo            bool
+
+	splitter tagSplitter
+}
+
+// SetHeader 设置flv头的音视频标记, 不设置时根据收到的tag生成
+func (c *GOPCache) SetHeader(audio, video bool) {
+	flag := TypeFlag(0)
+	flag.Marshal(audio, video)
+	c.flag = &flag
+	c.hasVideo = c.hasVideo || video
+}
+
+// Write 输入flv流, 可以是flv文件的任意分片
+func (c *GOPCache) Write(p []byte) (int, error) {
+	err := c.splitter.split(p, func(flag TypeFlag) {
+		c.SetHeader(flag.ExistAudio(), flag.ExistVideo())
+	}, func(tag *TagBuffer) {
+		c.WriteTag(tag)
+		tag.Release()
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// replace 替换缓存的tag, 释放旧的引用
+func replace(dst **TagBuffer, tag *TagBuffer) {
+	tag.Retain()
+	if *dst != nil {
+		(*dst).Release()
+	}
+
+	*dst = tag
+}
+
+// WriteTag 缓存tag, 调用方仍然持有自己的引用
+func (c *GOPCache) WriteTag(tag *TagBuffer) {
+	if TagTypeScriptData == tag.Type {
+		if scriptData, err := UnmarshalScriptData(tag.Payload(), tag.Timestamp); err == nil && ScriptDataNameOnMetaData == scriptData.Name {
+			replace(&c.metadata, tag)
+			return
+		}
+	} else if tag.SequenceHeader {
+		// 编码器信息变化后, 缓存的帧不能使用新的sequence header解码
+		if TagTypeVideoData == tag.Type {
+			c.hasVideo = true
+			if c.videoSequenceHeader != nil && !bytes.Equal(c.videoSequenceHeader.Payload(), tag.Payload()) {
+				c.clear()
+			}
+
+			replace(&c.videoSequenceHeader, tag)
+		} else {
+			if c.audioSequenceHeader != nil && !bytes.Equal(c.audioSequenceHeader.Payload(), tag.Payload()) {
+				c.clear()
+			}
+
+			replace(&c.audioSequenceHeader, tag)
+		}
+
+		return
+	}
+
+	if TagTypeVideoData == tag.Type {
+		c.hasVideo = true
+	}
+
+	if tag.Key {
+		c.gops = append(c.gops, []*TagBuffer{tag})
+		if len(c.gops) > bufio.MaxInt(c.GOPCount, 1) {
+			c.removeFirstGOP()
+		}
+	} else if len(c.gops) > 0 {
+		c.gops[len(c.gops)-1] = append(c.gops[len(c.gops)-1], tag)
+	} else if !c.hasVideo {
+		c.gops = append(c.gops, []*TagBuffer{tag})
+	} else {
+		// 丢弃第一个关键帧之前的帧
+		return
+	}
+
+	tag.Retain()
+	c.size += len(tag.Data)
+	c.trim()
+}
+
+// trim 超出时长或大小限制时, 丢弃最旧的GOP. 当前GOP超出限制时, 纯音频流丢弃最旧的tag, 视频流丢弃整个GOP等待下一个关键帧
+func (c *GOPCache) trim() {
+	for c.exceeded() {
+		if len(c.gops) > 1 {
+			c.removeFirstGOP()
+		} else if !c.hasVideo && len(c.gops[0]) > 1 {
+			c.size -= len(c.gops[0][0].Data)
+			c.gops[0][0].Release()
+			c.gops[0][0] = nil
+			c.gops[0] = c.gops[0][1:]
+		} else {
+			c.clear()
+		}
+	}
+}
+
+func (c *GOPCache) exceeded() bool {
+	if len(c.gops) == 0 {
+		return false
+	} else if c.MaxBytes > 0 && c.size > c.MaxBytes {
+		return true
+	}
+
+	return c.MaxDuration > 0 && c.Duration() > c.MaxDuration
+}
+
+func (c *GOPCache) removeFirstGOP() {
+	for _, tag := range c.gops[0] {
+		c.size -= len(tag.Data)
+		tag.Release()
+	}
+
+	c.gops[0] = nil
+	c.gops = c.gops[1:]
+}
+
+// clear 清空缓存的GOP, 保留flv头, onMetaData和sequence header
+func (c *GOPCache) clear() {
+	for i, gop := range c.gops {
+		for _, tag := range gop {
+			tag.Release()
+		}
+
+		c.gops[i] = nil
+	}
+
+	c.gops = c.gops[:0]
+	c.size = 0
+}
+
+// Duration 返回缓存的GOP时长(毫秒)
+func (c *GOPCache) Duration() uint32 {
+	if len(c.gops) == 0 {
+		return 0
+	}
+
+	gop := c.gops[len(c.gops)-1]
+	first, last := c.gops[0][0].Timestamp, gop[len(gop)-1].Timestamp
+	if last < first {
+		return 0
+	}
+
+	return last - first
+}
+
+// Size 返回缓存的GOP字节数
+func (c *GOPCache) Size() int {
+	return c.size
+}
+
+// GOPs 返回缓存的GOP数量
+func (c *GOPCache) GOPs() int {
+	return len(c.gops)
+}
+
+// Ready 是否可以输出给新的订阅者. 有视频时需要缓存到关键帧
+func (c *GOPCache) Ready() bool {
+	return len(c.gops) > 0 || (!c.hasVideo && (c.audioSequenceHeader != nil || c.metadata != nil))
+}
+
+// Tags 按发送顺序返回onMetaData, sequence header和缓存的GOP, 没有增加引用计数
+func (c *GOPCache) Tags() []*TagBuffer {
+	var tags []*TagBuffer
+	for _, tag := range []*TagBuffer{c.metadata, c.videoSequenceHeader, c.audioSequenceHeader} {
+		if tag != nil {
+			tags = append(tags, tag)
+		}
+	}
+
+	for _, gop := range c.gops {
+		tags = append(tags, gop...)
+	}
+
+	return tags
+}
+
+// Header 返回flv头和PreviousTagSize0
+func (c *GOPCache) Header() []byte {
+	header := make([]byte, 13)
+	if c.flag != nil {
+		MarshalHeader(header, c.flag.ExistAudio(), c.flag.ExistVideo())
+	} else {
+		MarshalHeader(header, c.audioSequenceHeader != nil, c.hasVideo)
+	}
+
+	return header
+}
+
+// Buffers 返回新订阅者的起始数据: flv头, onMetaData, sequence header和缓存的GOP. 不拷贝缓存的tag
+func (c *GOPCache) Buffers() net.Buffers {
+	tags := c.Tags()
+	buffers := make(net.Buffers, 0, len(tags)+1)
+	buffers = append(buffers, c.Header())
+	for _, tag := range tags {
+		buffers = append(buffers, tag.Data)
+	}
+
+	return buffers
+}
+
+// WriteTo 写入新订阅者的起始数据
+func (c *GOPCache) WriteTo(w io.Writer) (int64, error) {
+	buffers := c.Buffers()
+	return buffers.WriteTo(w)
+}
+
+// Reset 清空所有缓存并释放tag, 用于推流端重连
+func (c *GOPCache) Reset() {
+	c.clear()
+	for _, tag := range []*TagBuffer{c.metadata, c.videoSequenceHeader, c.audioSequenceHeader} {
+		if tag != nil {
+			tag.Release()
+		}
+	}
+
+	maxDuration, maxBytes, count := c.MaxDuration, c.MaxBytes, c.GOPCount
+	*c = GOPCache{MaxDuration: maxDuration, MaxBytes: maxBytes, GOPCount: count}
+}
+
+func NewGOPCache(maxDuration uint32, maxBytes, gopCount int) *GOPCache {
+	return &GOPCache{
+		MaxDuration: maxDuration,
+		MaxBytes:    maxBytes,
+		GOPCount:    gopCount,
+	}
+}
@@ -0,0 +1,82 @@
+package flv
+
+import (
+	"bytes"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv/internal/flvtest"
+	"testing"
+)
+
+func newTestGOPWriter(cache *GOPCache) *Writer {
+	writer := NewWriter(cache)
+	flvtest.AddTracks(writer)
+	utils.Assert(writer.WriteHeader() == nil)
+	return writer
+}
+
+func TestGOPCache(t *testing.T) {
+	cache := NewGOPCache(0, 0, 1)
+	writer := newTestGOPWriter(cache)
+	utils.Assert(!cache.Ready())
+
+	// 第一个关键帧之前的帧被丢弃
+	flvtest.WriteGOPs(writer, 5, 34)
+	utils.Assert(cache.Ready())
+	utils.Assert(cache.GOPs() == 1)
+	utils.Assert(cache.Duration() == 8*40)
+
+	output := &bytes.Buffer{}
+	_, err := cache.WriteTo(output)
+	utils.Assert(err == nil)
+
+	// 起始数据可以被完整解析, PreviousTagSize链由Demuxer校验
+	handler := &PacketCollector{}
+	demuxer := NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	n, err := demuxer.Input(output.Bytes())
+	utils.Assert(err == nil)
+	utils.Assert(n == output.Len()-4)
+	utils.Assert(demuxer.Metadata() != nil)
+	utils.Assert(len(handler.tracks) == 2)
+
+	// 从关键帧30开始, 最后一帧缓存在demuxer中
+	var video []*avformat.AVPacket
+	for _, packet := range handler.packets {
+		if utils.AVMediaTypeVideo == packet.MediaType {
+			video = append(video, packet)
+		}
+	}
+
+	utils.Assert(video[0].Key && video[0].Data[5] == 30)
+	utils.Assert(len(video) == 8)
+}
+
+func TestGOPCacheLimits(t *testing.T) {
+	// 保留3个GOP
+	cache := NewGOPCache(0, 0, 3)
+	writer := newTestGOPWriter(cache)
+	flvtest.WriteGOPs(writer, 0, 45)
+	utils.Assert(cache.GOPs() == 3)
+	utils.Assert(cache.Tags()[3].Key && cache.Tags()[3].Timestamp == 20*40)
+
+	// 超出时长丢弃最旧的GOP
+	cache.MaxDuration = 1000
+	flvtest.WriteGOPs(writer, 45, 5)
+	utils.Assert(cache.GOPs() == 2 && cache.Duration() <= 1000)
+
+	// 当前GOP超出大小, 等待下一个关键帧
+	cache.MaxBytes = 100
+	flvtest.WriteGOPs(writer, 50, 5)
+	utils.Assert(cache.GOPs() == 0 && cache.Size() == 0)
+	cache.MaxBytes = 0
+	flvtest.WriteGOPs(writer, 55, 10)
+	utils.Assert(cache.GOPs() == 1 && cache.Tags()[3].Timestamp == 60*40)
+
+	// sequence header变化后清空GOP
+	stream := writer.Muxer().Tracks.Get(1).GetStream()
+	stream.Data = []byte{0x11, 0x88}
+	utils.Assert(writer.WriteSequenceHeader(1, 2600) == nil)
+	utils.Assert(cache.GOPs() == 0)
+	utils.Assert(bytes.Equal(cache.audioSequenceHeader.Payload()[2:], []byte{0x11, 0x88}))
+}
@@ -0,0 +1,87 @@
+package hls
+
+import (
+	"fmt"
+	"strings"
+)
+
+type PlaylistType int
+
+const (
+	PlaylistTypeLive  = PlaylistType(0) // 滑动窗口, 只保留最近的分片
+	PlaylistTypeEvent = PlaylistType(1) // 保留所有分片, 播放器可以回看
+)
+
+// Segment 播放列表中的一个分片
+type Segment struct {
+	Name          string  // 存储中的名称
+	URI           string  // m3u8中的地址
+	Sequence      int     // media sequence number
+	Duration      float64 // 秒
+	Discontinuity bool    // 与上一个分片的时间戳或编码器不连续
+}
+
+// Playlist 媒体播放列表(RFC 8216)
+type Playlist struct {
+	Type                  PlaylistType
+	TargetDuration        int // 秒, 创建播放列表时确定, 之后不能改变(RFC 8216 6.2.1). 分片时长四舍五入后不能超过该值
+	MediaSequence         int // 第一个分片的序号
+	DiscontinuitySequence int // 滑出窗口的分片中EXT-X-DISCONTINUITY的数量
+	Segments              []*Segment
+	Ended                 bool
+}
+
+// Append 添加分片, 分片时长由调用方保证不超过目标时长
+func (p *Playlist) Append(segment *Segment) {
+	if len(p.Segments) == 0 {
+		p.MediaSequence = segment.Sequence
+	}
+
+	p.Segments = append(p.Segments, segment)
+}
+
+// Trim 滑动窗口, 保留最近的size个分片, 返回滑出的分片
+func (p *Playlist) Trim(size int) []*Segment {
+	if size <= 0 || len(p.Segments) <= size {
+		return nil
+	}
+
+	removed := p.Segments[:len(p.Segments)-size]
+	for _, segment := range removed {
+		if segment.Discontinuity {
+			p.DiscontinuitySequence++
+		}
+	}
+
+	p.Segments = append([]*Segment(nil), p.Segments[len(removed):]...)
+	p.MediaSequence = p.Segments[0].Sequence
+	return removed
+}
+
+func (p *Playlist) String() string {
+	builder := &strings.Builder{}
+	builder.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(builder, "#EXT-X-TARGETDURATION:%d\n", p.TargetDuration)
+	fmt.Fprintf(builder, "#EXT-X-MEDIA-SEQUENCE:%d\n", p.MediaSequence)
+	if p.DiscontinuitySequence > 0 {
+		fmt.Fprintf(builder, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", p.DiscontinuitySequence)
+	}
+
+	if PlaylistTypeEvent == p.Type {
+		builder.WriteString("#EXT-X-PLAYLIST-TYPE:EVENT\n")
+	}
+
+	for _, segment := range p.Segments {
+		if segment.Discontinuity {
+			builder.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+
+		fmt.Fprintf(builder, "#EXTINF:%.3f,\n%s\n", segment.Duration, segment.URI)
+	}
+
+	if p.Ended {
+		builder.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	return builder.String()
+}
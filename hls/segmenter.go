@@ -0,0 +1,251 @@
+// Package hls 将flv解析出的音视频帧切分为MPEG-TS分片并生成m3u8, 不依赖ffmpeg.
+package hls
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv/mpegts"
+	"math"
+	"path"
+	"sort"
+	"time"
+)
+
+const (
+	DefaultTargetDuration         = 6 * time.Second
+	DefaultPlaylistLength         = 5
+	DefaultDiscontinuityThreshold = 10 * time.Second
+)
+
+// Segmenter 实现Demuxer的Handler, 在视频关键帧处按目标时长切分TS分片, 没有视频时按时长切分.
+// EXT-X-TARGETDURATION在第一个分片开始时确定, GOP过长时在分片时长即将超过目标时长处切分, 此时分片不从关键帧开始.
+// 时间戳回退或跳变超过阈值, 以及编码器变化时结束当前分片, 从主track的下一个关键帧开始新的分片并添加EXT-X-DISCONTINUITY, 之前的帧丢弃.
+// 跳过Speex, PCM和G.711等TS不能承载的track, 没有可以切分的track时Close返回错误.
+// 分片保存为"name-序号.ts", 播放列表保存为"name.m3u8". 回调中的错误保存后由Err和Close返回. 非线程安全.
+type Segmenter struct {
+	TargetDuration         time.Duration // 分片的目标时长, 实际在达到目标时长后的第一个关键帧处切分
+	PlaylistLength         int           // 滑动窗口的分片数, 滑出的分片再经过一个窗口后删除
+	PlaylistType           PlaylistType
+	DiscontinuityThreshold time.Duration // 相邻两帧的时间戳差超过该值视为不连续
+
+	storage  Storage
+	name     string
+	muxer    *mpegts.Muxer
+	buffer   bytes.Buffer
+	playlist Playlist
+	expired  []*Segment
+	sequence int
+
+	primary       int // 决定切分位置的track, 优先使用视频
+	primaryVideo  bool
+	open          bool
+	start         int64 // 当前分片的开始时间, 毫秒
+	end           int64 // 主track最后一帧的结束时间
+	frameDuration int64
+	lastDts       map[int]int64
+	discontinuity bool
+	skipped       map[int]bool // 不支持的track
+	err           error
+}
+
+// Skipped 返回跳过的track索引
+func (s *Segmenter) Skipped() []int {
+	var skipped []int
+	for index := range s.skipped {
+		skipped = append(skipped, index)
+	}
+
+	sort.Ints(skipped)
+	return skipped
+}
+
+func (s *Segmenter) OnNewTrack(track avformat.Track) {
+	if s.err != nil {
+		return
+	}
+
+	stream := track.GetStream()
+	if err := s.muxer.AddTrack(stream); errors.Is(err, mpegts.ErrUnsupportedCodec) {
+		s.skipped[stream.Index] = true
+		return
+	} else if err != nil {
+		s.err = err
+		return
+	}
+
+	video := utils.AVMediaTypeVideo == stream.MediaType
+	if s.primary < 0 || (video && !s.primaryVideo) {
+		s.primary, s.primaryVideo = stream.Index, video
+	}
+}
+
+func (s *Segmenter) OnTrackComplete() {
+}
+
+func (s *Segmenter) OnTrackNotFind() {
+}
+
+func (s *Segmenter) OnPacket(packet *avformat.AVPacket) {
+	if s.err != nil || s.skipped[packet.Index] {
+		return
+	}
+
+	dts := packet.ConvertDts(1000)
+	if last, ok := s.lastDts[packet.Index]; ok && (dts < last || dts-last > s.DiscontinuityThreshold.Milliseconds()) {
+		if s.err = s.closeSegment(s.end); s.err != nil {
+			return
+		}
+
+		s.discontinuity = true
+		s.lastDts = make(map[int]int64)
+	} else if s.open && packet.Index == s.primary {
+		// 达到目标时长后在关键帧处切分, GOP过长时在这一帧结束超过最大时长前切分
+		cut := (packet.Key || !s.primaryVideo) && dts-s.start >= s.TargetDuration.Milliseconds()
+		if cut || dts+s.frameDuration-s.start >= s.maxDuration() {
+			if s.err = s.closeSegment(dts); s.err != nil {
+				return
+			}
+		}
+	}
+
+	if !s.open {
+		// 不连续后的分片从主track的关键帧开始
+		if s.discontinuity && (packet.Index != s.primary || (s.primaryVideo && !packet.Key)) {
+			return
+		}
+
+		// 目标时长在第一个分片开始时确定
+		if s.playlist.TargetDuration == 0 {
+			s.playlist.TargetDuration = int(math.Max(1, math.Ceil(s.TargetDuration.Seconds())))
+		}
+
+		s.open = true
+		s.start = dts
+		s.muxer.ResendTables()
+	}
+
+	if packet.Index == s.primary {
+		if last, ok := s.lastDts[packet.Index]; ok && dts > last {
+			s.frameDuration = dts - last
+		}
+
+		s.end = dts + s.frameDuration
+	}
+
+	s.lastDts[packet.Index] = dts
+	s.err = s.muxer.WritePacket(packet)
+}
+
+// OnCodecParametersChanged 编码器信息变化, 结束当前分片, 新的分片标记为不连续
+func (s *Segmenter) OnCodecParametersChanged(track avformat.Track, ts uint32) {
+	if s.err != nil || s.skipped[track.GetStream().Index] {
+		return
+	} else if s.err = s.closeSegment(s.end); s.err != nil {
+		return
+	}
+
+	s.discontinuity = true
+	s.err = s.muxer.UpdateTrack(track.GetStream())
+}
+
+func (s *Segmenter) OnSequenceEnd(track avformat.Track, ts uint32) {
+}
+
+// closeSegment 保存当前分片并更新播放列表, end为分片结束时间
+func (s *Segmenter) closeSegment(end int64) error {
+	if !s.open {
+		return nil
+	}
+
+	name := fmt.Sprintf("%s-%d.ts", s.name, s.sequence)
+	segment := &Segment{
+		Name:          name,
+		URI:           path.Base(name),
+		Sequence:      s.sequence,
+		Duration:      float64(end-s.start) / 1000,
+		Discontinuity: s.discontinuity,
+	}
+
+	s.open = false
+	s.discontinuity = false
+	s.sequence++
+	err := s.storage.WriteFile(name, s.buffer.Bytes())
+	s.buffer.Reset()
+	if err != nil {
+		return err
+	}
+
+	s.playlist.Append(segment)
+	if PlaylistTypeLive == s.PlaylistType {
+		s.expired = append(s.expired, s.playlist.Trim(s.PlaylistLength)...)
+		for len(s.expired) > s.PlaylistLength {
+			if err = s.storage.Remove(s.expired[0].Name); err != nil {
+				println(err.Error())
+			}
+
+			s.expired = s.expired[1:]
+		}
+	}
+
+	return s.writePlaylist()
+}
+
+// maxDuration 分片的最大时长, 毫秒. EXTINF四舍五入后不能超过目标时长
+func (s *Segmenter) maxDuration() int64 {
+	return int64(s.playlist.TargetDuration)*1000 + 500
+}
+
+func (s *Segmenter) writePlaylist() error {
+	s.playlist.Type = s.PlaylistType
+	return s.storage.WriteFile(s.PlaylistName(), []byte(s.playlist.String()))
+}
+
+// PlaylistName 播放列表在存储中的名称
+func (s *Segmenter) PlaylistName() string {
+	return s.name + ".m3u8"
+}
+
+// Playlist 返回当前的播放列表
+func (s *Segmenter) Playlist() *Playlist {
+	return &s.playlist
+}
+
+func (s *Segmenter) Err() error {
+	return s.err
+}
+
+// Close 输入结束, 保存最后一个分片并添加EXT-X-ENDLIST. 需要先调用Demuxer.Flush输出缓存的帧
+func (s *Segmenter) Close() error {
+	if s.err != nil {
+		return s.err
+	} else if s.primary < 0 && len(s.skipped) > 0 {
+		s.err = fmt.Errorf("no track can be segmented")
+		return s.err
+	} else if s.err = s.closeSegment(s.end); s.err != nil {
+		return s.err
+	}
+
+	s.playlist.Ended = true
+	s.err = s.writePlaylist()
+	return s.err
+}
+
+// NewSegmenter name为分片和播放列表的名称前缀, 可以包含目录
+func NewSegmenter(storage Storage, name string) *Segmenter {
+	segmenter := &Segmenter{
+		TargetDuration:         DefaultTargetDuration,
+		PlaylistLength:         DefaultPlaylistLength,
+		DiscontinuityThreshold: DefaultDiscontinuityThreshold,
+		storage:                storage,
+		name:                   name,
+		primary:                -1,
+		lastDts:                make(map[int]int64),
+		skipped:                make(map[int]bool),
+	}
+
+	segmenter.muxer = mpegts.NewMuxer(&segmenter.buffer)
+	return segmenter
+}
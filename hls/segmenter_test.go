@@ -0,0 +1,173 @@
+package hls
+
+import (
+	"bytes"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"github.com/lkmio/flv/internal/flvtest"
+	"github.com/lkmio/flv/mpegts"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testStorage struct {
+	files map[string][]byte
+}
+
+func (s *testStorage) WriteFile(name string, data []byte) error {
+	s.files[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *testStorage) Remove(name string) error {
+	delete(s.files, name)
+	return nil
+}
+
+// testTimestamp 第jump帧开始时间戳跳变到100秒
+func testTimestamp(jump int) func(i int) int64 {
+	return func(i int) int64 {
+		if i >= jump {
+			return 100000 + int64(i-jump)*40
+		}
+
+		return int64(i * 40)
+	}
+}
+
+// newTestFLV 生成60帧音视频flv流, 默认每10帧一个关键帧
+func newTestFLV(options flvtest.Options) []byte {
+	output := &bytes.Buffer{}
+	flvtest.WriteFLV(flv.NewWriter(output), 60, options)
+	return output.Bytes()
+}
+
+func runTestSegmenter(storage Storage, playlistType PlaylistType, playlistLength int, options flvtest.Options) *Segmenter {
+	segmenter := NewSegmenter(storage, "live/test")
+	segmenter.TargetDuration = time.Second
+	segmenter.PlaylistType = playlistType
+	segmenter.PlaylistLength = playlistLength
+
+	demuxer := flv.NewDemuxer(true)
+	demuxer.SetHandler(segmenter)
+	_, err := demuxer.Input(newTestFLV(options))
+	utils.Assert(err == nil)
+	demuxer.Flush()
+	demuxer.Close()
+	utils.Assert(segmenter.Close() == nil)
+	return segmenter
+}
+
+func TestSegmenter(t *testing.T) {
+	// 第30帧的关键帧处达到1秒切分, 第40帧时间戳跳变切分并标记不连续
+	storage := &testStorage{files: make(map[string][]byte)}
+	runTestSegmenter(storage, PlaylistTypeEvent, 1, flvtest.Options{Timestamp: testTimestamp(40)})
+	expected := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:EVENT\n" +
+		"#EXTINF:1.200,\ntest-0.ts\n#EXTINF:0.400,\ntest-1.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:0.800,\ntest-2.ts\n#EXT-X-ENDLIST\n"
+	utils.Assert(string(storage.files["live/test.m3u8"]) == expected)
+
+	// 每个分片从PAT开始
+	for _, name := range []string{"live/test-0.ts", "live/test-1.ts", "live/test-2.ts"} {
+		data := storage.files[name]
+		utils.Assert(len(data) > 0 && len(data)%mpegts.PacketSize == 0)
+		utils.Assert(data[0] == 0x47 && data[1]&0x1F == 0 && data[2] == mpegts.PIDPAT)
+	}
+
+	// 滑动窗口, 滑出的分片经过一个窗口后删除
+	storage = &testStorage{files: make(map[string][]byte)}
+	segmenter := runTestSegmenter(storage, PlaylistTypeLive, 1, flvtest.Options{Timestamp: testTimestamp(40)})
+	playlist := string(storage.files["live/test.m3u8"])
+	utils.Assert(strings.Contains(playlist, "#EXT-X-MEDIA-SEQUENCE:2\n") && !strings.Contains(playlist, "DISCONTINUITY-SEQUENCE"))
+	utils.Assert(strings.HasSuffix(playlist, "#EXT-X-DISCONTINUITY\n#EXTINF:0.800,\ntest-2.ts\n#EXT-X-ENDLIST\n"))
+	utils.Assert(len(storage.files) == 3 && storage.files["live/test-0.ts"] == nil && storage.files["live/test-1.ts"] != nil)
+	utils.Assert(len(segmenter.Playlist().Segments) == 1)
+
+	// 不连续的分片滑出后递增EXT-X-DISCONTINUITY-SEQUENCE
+	segmenter.Playlist().Append(&Segment{URI: "test-3.ts", Sequence: 3, Duration: 1})
+	segmenter.Playlist().Trim(1)
+	utils.Assert(strings.Contains(segmenter.Playlist().String(), "#EXT-X-DISCONTINUITY-SEQUENCE:1\n"))
+}
+
+func TestSegmenterKeyframes(t *testing.T) {
+	// 第45帧时间戳跳变, 丢弃45-49帧, 从第50帧的关键帧开始不连续的分片
+	storage := &testStorage{files: make(map[string][]byte)}
+	segmenter := runTestSegmenter(storage, PlaylistTypeEvent, 1, flvtest.Options{Timestamp: testTimestamp(45)})
+	utils.Assert(strings.HasSuffix(segmenter.Playlist().String(), "#EXTINF:1.200,\ntest-0.ts\n#EXTINF:0.600,\ntest-1.ts\n#EXT-X-DISCONTINUITY\n#EXTINF:0.400,\ntest-2.ts\n#EXT-X-ENDLIST\n"))
+
+	// GOP为2秒, 超过目标时长时不等待关键帧, 目标时长保持不变
+	storage = &testStorage{files: make(map[string][]byte)}
+	segmenter = runTestSegmenter(storage, PlaylistTypeEvent, 1, flvtest.Options{GOP: 50})
+	utils.Assert(strings.Contains(segmenter.Playlist().String(), "#EXT-X-TARGETDURATION:1\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:EVENT\n#EXTINF:1.480,\ntest-0.ts\n#EXTINF:0.920,\ntest-1.ts\n"))
+}
+
+func TestSegmenterUnsupportedTrack(t *testing.T) {
+	// H.264和G.711, 跳过G.711继续切分视频
+	newFLV := func(video bool) []byte {
+		output := &bytes.Buffer{}
+		writer := flv.NewWriter(output)
+		if video {
+			_, err := writer.AddTrack(flvtest.NewVideoStream())
+			utils.Assert(err == nil)
+		}
+
+		alaw := avformat.NewAVStream(utils.AVMediaTypeAudio, 1, utils.AVCodecIdPCMALAW, nil, nil)
+		alaw.SampleRate, alaw.SampleSize, alaw.Channels = 8000, 16, 1
+		_, err := writer.AddTrack(alaw)
+		utils.Assert(err == nil)
+		utils.Assert(writer.WriteHeader() == nil)
+		for i := 0; i < 30; i++ {
+			if video {
+				frame := []byte{0, 0, 0, 2, 0x41, byte(i)}
+				if i%10 == 0 {
+					frame[4] = 0x65
+				}
+
+				utils.Assert(writer.WritePacket(avformat.NewVideoPacket(frame, int64(i*40), int64(i*40), i%10 == 0, avformat.PacketTypeAVCC, utils.AVCodecIdH264, 0, 1000)) == nil)
+			}
+
+			utils.Assert(writer.WritePacket(avformat.NewAudioPacket([]byte{0xD5, byte(i)}, int64(i*40), utils.AVCodecIdPCMALAW, 1, 1000)) == nil)
+		}
+
+		utils.Assert(writer.Flush() == nil)
+		return output.Bytes()
+	}
+
+	segment := func(data []byte) (*Segmenter, *testStorage) {
+		storage := &testStorage{files: make(map[string][]byte)}
+		segmenter := NewSegmenter(storage, "live/test")
+		segmenter.TargetDuration = time.Second
+		demuxer := flv.NewDemuxer(true)
+		demuxer.SetHandler(segmenter)
+		_, err := demuxer.Input(data)
+		utils.Assert(err == nil)
+		demuxer.Flush()
+		demuxer.Close()
+		return segmenter, storage
+	}
+
+	segmenter, storage := segment(newFLV(true))
+	utils.Assert(segmenter.Close() == nil && segmenter.Err() == nil)
+	utils.Assert(len(segmenter.Skipped()) == 1 && segmenter.Skipped()[0] == 1)
+	utils.Assert(strings.HasSuffix(string(storage.files["live/test.m3u8"]), "#EXTINF:1.200,\ntest-0.ts\n#EXT-X-ENDLIST\n"))
+
+	// 没有可以切分的track
+	segmenter, _ = segment(newFLV(false))
+	utils.Assert(segmenter.Close() != nil)
+}
+
+func TestDirStorage(t *testing.T) {
+	storage := NewDirStorage(t.TempDir())
+	utils.Assert(storage.WriteFile("live/test.m3u8", []byte("#EXTM3U\n")) == nil)
+	utils.Assert(storage.WriteFile("live/test.m3u8", []byte("#EXTM3U\n#EXT-X-ENDLIST\n")) == nil)
+	data, err := os.ReadFile(filepath.Join(storage.Dir, "live", "test.m3u8"))
+	utils.Assert(err == nil && string(data) == "#EXTM3U\n#EXT-X-ENDLIST\n")
+
+	utils.Assert(storage.Remove("live/test.m3u8") == nil)
+	utils.Assert(storage.Remove("live/test.m3u8") == nil)
+	_, err = os.Stat(filepath.Join(storage.Dir, "live", "test.m3u8"))
+	utils.Assert(os.IsNotExist(err))
+}
@@ -0,0 +1,51 @@
+package hls
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Storage 分片和m3u8的存储, name为相对路径
+type Storage interface {
+	// WriteFile 写入完整的文件, 已经存在时覆盖. m3u8会被反复覆盖, 实现需要保证读取方不会读到写了一半的文件
+	WriteFile(name string, data []byte) error
+
+	// Remove 删除滑出播放列表的分片
+	Remove(name string) error
+}
+
+// DirStorage 保存到本地目录
+type DirStorage struct {
+	Dir string
+}
+
+// WriteFile 先写入临时文件再重命名, 替换是原子的
+func (d *DirStorage) WriteFile(name string, data []byte) error {
+	path := filepath.Join(d.Dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	} else if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+func (d *DirStorage) Remove(name string) error {
+	err := os.Remove(filepath.Join(d.Dir, filepath.FromSlash(name)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func NewDirStorage(dir string) *DirStorage {
+	return &DirStorage{Dir: dir}
+}
@@ -0,0 +1,250 @@
+package httpflv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/bufio"
+	"github.com/lkmio/flv"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrStalled = errors.New("stream stalled")
+)
+
+// ReconnectHandler Client的Handler可选实现该接口, 在每次重连前回调
+type ReconnectHandler interface {
+	// OnReconnect attempt为连续失败的次数, err为断开的原因
+	OnReconnect(attempt int, err error)
+}
+
+// Client HTTP-FLV拉流客户端, 将拉取的flv流输入Demuxer, 通过avformat.OnUnpackStreamHandler回调track和音视频帧.
+// 连接断开, 超时或者卡住时自动重连, 重连后复用原来的track, 时间戳接着断开前的时间戳递增.
+type Client struct {
+	URL            string
+	HTTPClient     *http.Client  // nil使用http.DefaultClient
+	ConnectTimeout time.Duration // 建立连接到收到响应头的超时时间
+	StallTimeout   time.Duration // 超过该时间没有收到数据视为卡住, 断开重连
+	RetryInterval  time.Duration // 重连间隔
+	MaxRetries     int           // 连续重连失败的最大次数, 0不限制. 收到数据后重新计数
+	MaxJump        uint32        // 重连后时间戳和断开前相差超过该值(毫秒)时重新计算偏移
+
+	demuxer *flv.Demuxer
+	handler avformat.OnUnpackStreamHandler
+
+	pending       []byte
+	headerWritten bool      // flv头只输入Demuxer一次
+	resync        bool      // 重连后等待第一个音视频帧计算时间戳偏移
+	started       bool      // 已经输出音视频帧
+	offset        uint32    // 时间戳偏移, 按uint32回绕相加
+	last          uint32    // 输出的最大时间戳
+	lastTs        [2]uint32 // 音频和视频上一帧的时间戳
+	seen          [2]bool
+	delta         [2]uint32 // 音频和视频最近的帧间隔
+}
+
+// Demuxer 返回内部的Demuxer, 用于获取Metadata和VideoInfo
+func (c *Client) Demuxer() *flv.Demuxer {
+	return c.demuxer
+}
+
+// Run 拉流直到ctx取消或者超过最大重连次数, 返回最后一次的错误
+func (c *Client) Run(ctx context.Context) error {
+	var failures int
+	for {
+		received, err := c.pull(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if received {
+			failures = 0
+		}
+
+		failures++
+		if c.MaxRetries > 0 && failures > c.MaxRetries {
+			return err
+		} else if handler, ok := c.handler.(ReconnectHandler); ok {
+			handler.OnReconnect(failures, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.RetryInterval):
+		}
+	}
+}
+
+// pull 拉取一次flv流, 返回是否收到过tag
+func (c *Client) pull(parent context.Context) (bool, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	// 连接超时和卡住检测共用一个定时器, 每次收到数据重置
+	var stalled atomic.Bool
+	timer := time.AfterFunc(c.ConnectTimeout, func() {
+		stalled.Store(true)
+		cancel()
+	})
+	defer timer.Stop()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return false, err
+	}
+
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		if stalled.Load() {
+			err = fmt.Errorf("connect timeout: %w", ErrStalled)
+		}
+
+		return false, err
+	}
+
+	defer response.Body.Close()
+	if http.StatusOK != response.StatusCode {
+		return false, fmt.Errorf("unexpected status %s", response.Status)
+	}
+
+	timer.Reset(c.StallTimeout)
+	c.pending = c.pending[:0]
+	c.resync = c.started
+
+	var headerParsed, received bool
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := response.Body.Read(buffer)
+		if n > 0 {
+			timer.Reset(c.StallTimeout)
+			c.pending = append(c.pending, buffer[:n]...)
+		}
+
+		// 解析flv头, 重连后的flv头不再输入Demuxer
+		if !headerParsed && len(c.pending) >= 9 {
+			if _, err := flv.UnmarshalHeader(c.pending); err != nil {
+				return received, err
+			} else if !c.headerWritten {
+				if _, err = c.demuxer.Input(c.pending[:9]); err != nil {
+					return received, err
+				}
+
+				c.headerWritten = true
+			}
+
+			c.pending = c.pending[:copy(c.pending, c.pending[9:])]
+			headerParsed = true
+		}
+
+		if headerParsed {
+			tags, err := c.input()
+			if err != nil {
+				return received, err
+			}
+
+			received = received || tags > 0
+		}
+
+		if err != nil {
+			if stalled.Load() {
+				err = ErrStalled
+			}
+
+			return received, err
+		}
+	}
+}
+
+// input 将完整的tag修正时间戳后输入Demuxer, 返回输入的tag数
+func (c *Client) input() (int, error) {
+	var n, tags int
+	for n+flv.TagHeaderSize <= len(c.pending) {
+		size := flv.TagHeaderSize + int(bufio.Uint24(c.pending[n+5:]))
+		if n+size > len(c.pending) {
+			break
+		}
+
+		tag := c.pending[n : n+size]
+		c.rewriteTimestamp(tag)
+		if _, err := c.demuxer.Input(tag); err != nil {
+			return tags, err
+		}
+
+		n += size
+		tags++
+	}
+
+	c.pending = c.pending[:copy(c.pending, c.pending[n:])]
+	return tags, nil
+}
+
+// rewriteTimestamp 修改tag头中的时间戳, 保证重连前后的时间戳连续
+func (c *Client) rewriteTimestamp(tag []byte) {
+	tagType := flv.TagType(tag[4] & 0x1F)
+	ts := bufio.Uint24(tag[8:]) | uint32(tag[11])<<24
+	_, sequenceHeader := flv.TagFlags(tagType, tag[flv.TagHeaderSize:])
+	frame := (flv.TagTypeAudioData == tagType || flv.TagTypeVideoData == tagType) && !sequenceHeader
+
+	var index int
+	if flv.TagTypeVideoData == tagType {
+		index = 1
+	}
+
+	if frame && c.resync {
+		// 重连后的第一帧, 时间戳没有回退也没有跳变时保持原来的偏移
+		c.resync = false
+		if out := ts + c.offset; int32(out-c.last) <= 0 || out-c.last > c.MaxJump {
+			delta := c.delta[index]
+			if delta == 0 {
+				delta = 1
+			}
+
+			c.offset = c.last + delta - ts
+		}
+	}
+
+	out := ts + c.offset
+	if c.resync {
+		// 重连后第一帧之前的onMetaData和sequence header
+		out = c.last
+	} else if frame {
+		if c.seen[index] && int32(out-c.lastTs[index]) > 0 {
+			c.delta[index] = out - c.lastTs[index]
+		}
+
+		if !c.started || int32(out-c.last) > 0 {
+			c.last = out
+		}
+
+		c.lastTs[index] = out
+		c.seen[index] = true
+		c.started = true
+	}
+
+	bufio.PutUint24(tag[8:], out&0xFFFFFF)
+	tag[11] = byte(out >> 24)
+}
+
+func NewClient(url string, handler avformat.OnUnpackStreamHandler) *Client {
+	demuxer := flv.NewDemuxer(true)
+	demuxer.SetHandler(handler)
+
+	return &Client{
+		URL:            url,
+		HTTPClient:     http.DefaultClient,
+		ConnectTimeout: 10 * time.Second,
+		StallTimeout:   10 * time.Second,
+		RetryInterval:  time.Second,
+		MaxJump:        10 * 1000,
+		demuxer:        demuxer,
+		handler:        handler,
+	}
+}
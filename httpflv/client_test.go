@@ -0,0 +1,119 @@
+package httpflv
+
+import (
+	"context"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"github.com/lkmio/flv/internal/flvtest"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type reconnectCollector struct {
+	packetCollector
+	reconnects chan error
+}
+
+func (r *reconnectCollector) OnReconnect(attempt int, err error) {
+	r.reconnects <- err
+}
+
+// waitSubscriber 等待拉流客户端订阅
+func waitSubscriber(broadcaster *flv.Broadcaster) {
+	for broadcaster.Subscribers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitEOF 等待推流结束导致的重连, 忽略流不存在的重连
+func (r *reconnectCollector) waitEOF() {
+	for err := range r.reconnects {
+		if err == io.EOF {
+			return
+		}
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	streams := NewStreams()
+	server := httptest.NewServer(NewHandler(streams))
+	defer server.Close()
+
+	broadcaster := flv.NewBroadcaster(nil, 0)
+	utils.Assert(streams.Add("test", broadcaster) == nil)
+	writer := newTestWriter(broadcaster)
+	flvtest.WriteGOPs(writer, 0, 15)
+
+	handler := &reconnectCollector{reconnects: make(chan error, 1024)}
+	client := NewClient(server.URL+"/test.flv", handler)
+	client.RetryInterval = 10 * time.Millisecond
+	// 没有设置HTTPClient时使用http.DefaultClient
+	client.HTTPClient = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- client.Run(ctx)
+	}()
+
+	// 从关键帧10开始, 推流结束后重连
+	waitSubscriber(broadcaster)
+	flvtest.WriteGOPs(writer, 15, 15)
+	streams.Remove("test")
+	broadcaster.Close()
+	handler.waitEOF()
+
+	// 推流端重新推流, 时间戳从0开始, 从关键帧20开始播放
+	broadcaster = flv.NewBroadcaster(nil, 0)
+	writer = newTestWriter(broadcaster)
+	flvtest.WriteGOPs(writer, 0, 25)
+	utils.Assert(streams.Add("test", broadcaster) == nil)
+	waitSubscriber(broadcaster)
+	flvtest.WriteGOPs(writer, 25, 15)
+	streams.Remove("test")
+	broadcaster.Close()
+	handler.waitEOF()
+
+	cancel()
+	utils.Assert(<-done == context.Canceled)
+	utils.Assert(len(handler.tracks) == 2)
+
+	// 10-29和20-39帧, 重连前后时间戳连续. 每个track最后一帧缓存在demuxer中
+	var video, audio []int64
+	for _, packet := range handler.packets {
+		if utils.AVMediaTypeVideo == packet.MediaType {
+			video = append(video, packet.Dts)
+		} else {
+			audio = append(audio, packet.Dts)
+		}
+	}
+
+	utils.Assert(len(video) == 39 && len(audio) == 39)
+	for i := range video {
+		utils.Assert(video[i] == int64(400+i*40) && audio[i] == video[i])
+	}
+}
+
+func TestClientStalled(t *testing.T) {
+	// 只发送flv头后不再发送数据
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := make([]byte, 13)
+		flv.MarshalHeader(header, true, true)
+		w.Write(header)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	handler := &reconnectCollector{reconnects: make(chan error, 1024)}
+	client := NewClient(server.URL, handler)
+	client.StallTimeout = 50 * time.Millisecond
+	client.RetryInterval = time.Millisecond
+	client.MaxRetries = 2
+
+	utils.Assert(client.Run(context.Background()) == ErrStalled)
+	utils.Assert(len(handler.reconnects) == 2)
+	utils.Assert(<-handler.reconnects == ErrStalled)
+}
@@ -0,0 +1,135 @@
+// Package httpflv 提供HTTP-FLV直播的服务端和拉流客户端.
+// 推流端通过flv.NewWriterWithMuxer将Muxer输出写入flv.Broadcaster, 再注册到Registry, Handler为每个请求创建一个订阅者.
+package httpflv
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	ContentType = "video/x-flv"
+)
+
+// Handler HTTP-FLV播放的http.Handler. 默认请求路径去掉前导/和.flv后缀作为流名称, 例如/live/test.flv对应live/test.
+// 查询参数audio=0/video=0过滤音频或视频, 同时修改flv头的TypeFlag. 播放从GOP缓存的关键帧或者下一个关键帧开始,
+// 只播放音频时从下一个音频帧开始.
+type Handler struct {
+	Registry    Registry
+	AllowOrigin string                       // CORS允许的源, 为空时不设置CORS响应头
+	StreamName  func(r *http.Request) string // 自定义流名称解析
+}
+
+// streamName 返回请求的流名称
+func (h *Handler) streamName(r *http.Request) string {
+	if h.StreamName != nil {
+		return h.StreamName(r)
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".flv")
+}
+
+func (h *Handler) setCORS(w http.ResponseWriter) {
+	if h.AllowOrigin == "" {
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", h.AllowOrigin)
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Range, Content-Type")
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.setCORS(w)
+	if http.MethodOptions == r.Method {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	} else if http.MethodGet != r.Method && http.MethodHead != r.Method {
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	audio, video := query.Get("audio") != "0", query.Get("video") != "0"
+	if !audio && !video {
+		http.Error(w, "audio and video are both disabled", http.StatusBadRequest)
+		return
+	}
+
+	broadcaster := h.Registry.Find(h.streamName(r))
+	if broadcaster == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	subscriber, err := broadcaster.SubscribeTracks(audio, video)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	defer subscriber.Close()
+
+	// 不设置Content-Length, 使用chunked传输
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if http.MethodHead == r.Method {
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	if _, err = w.Write(subscriber.Header()); err != nil {
+		return
+	} else if flusher != nil {
+		flusher.Flush()
+	}
+
+	// 客户端断开时唤醒阻塞的Read
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			subscriber.Close()
+		case <-done:
+		}
+	}()
+
+	var buffers net.Buffers
+	for {
+		tags, err := subscriber.Read()
+		if err != nil {
+			// 推流结束或客户端断开
+			if err != io.EOF && err != io.ErrClosedPipe {
+				println(err.Error())
+			}
+
+			return
+		}
+
+		buffers = buffers[:0]
+		for _, tag := range tags {
+			buffers = append(buffers, tag.Data)
+		}
+
+		vector := buffers
+		_, err = vector.WriteTo(w)
+		for _, tag := range tags {
+			tag.Release()
+		}
+
+		if err != nil {
+			return
+		} else if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func NewHandler(registry Registry) *Handler {
+	return &Handler{Registry: registry, AllowOrigin: "*"}
+}
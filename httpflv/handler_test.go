@@ -0,0 +1,144 @@
+package httpflv
+
+import (
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"github.com/lkmio/flv/internal/flvtest"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type packetCollector struct {
+	avformat.OnUnpackStreamLogger
+	tracks  []avformat.Track
+	packets []*avformat.AVPacket
+}
+
+func (p *packetCollector) OnNewTrack(track avformat.Track) {
+	p.tracks = append(p.tracks, track)
+}
+
+func (p *packetCollector) OnTrackComplete() {
+}
+
+func (p *packetCollector) OnPacket(packet *avformat.AVPacket) {
+	clone := *packet
+	clone.Data = make([]byte, len(packet.Data))
+	copy(clone.Data, packet.Data)
+	p.packets = append(p.packets, &clone)
+}
+
+func demux(data []byte) *packetCollector {
+	handler := &packetCollector{}
+	demuxer := flv.NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	_, err := demuxer.Input(data)
+	utils.Assert(err == nil)
+	return handler
+}
+
+// newTestWriter 创建写入Broadcaster的音视频流
+func newTestWriter(broadcaster *flv.Broadcaster) *flv.Writer {
+	writer := flv.NewWriter(broadcaster)
+	flvtest.AddTracks(writer)
+	utils.Assert(writer.WriteHeader() == nil)
+	return writer
+}
+
+// play 请求直播流, 写入后续帧并结束推流, 返回收到的数据
+func play(t *testing.T, url string, broadcaster *flv.Broadcaster, writer *flv.Writer) (*http.Response, []byte) {
+	response, err := http.Get(url)
+	utils.Assert(err == nil)
+	defer response.Body.Close()
+
+	done := make(chan []byte)
+	go func() {
+		data, err := io.ReadAll(response.Body)
+		utils.Assert(err == nil)
+		done <- data
+	}()
+
+	// 响应头返回时已经订阅
+	flvtest.WriteGOPs(writer, 15, 20)
+	broadcaster.Close()
+	return response, <-done
+}
+
+func TestHandler(t *testing.T) {
+	streams := NewStreams()
+	server := httptest.NewServer(NewHandler(streams))
+	defer server.Close()
+
+	// 流不存在
+	response, err := http.Get(server.URL + "/live/test.flv")
+	utils.Assert(err == nil)
+	response.Body.Close()
+	utils.Assert(response.StatusCode == http.StatusNotFound)
+
+	broadcaster := flv.NewBroadcaster(nil, 0)
+	utils.Assert(streams.Add("live/test", broadcaster) == nil)
+	utils.Assert(streams.Add("live/test", broadcaster) != nil)
+	writer := newTestWriter(broadcaster)
+	flvtest.WriteGOPs(writer, 0, 15)
+
+	// CORS预检
+	request, _ := http.NewRequest(http.MethodOptions, server.URL+"/live/test.flv", nil)
+	response, err = http.DefaultClient.Do(request)
+	utils.Assert(err == nil)
+	response.Body.Close()
+	utils.Assert(response.StatusCode == http.StatusNoContent)
+	utils.Assert(response.Header.Get("Access-Control-Allow-Origin") == "*")
+
+	// 音视频都被过滤
+	response, err = http.Get(server.URL + "/live/test.flv?audio=0&video=0")
+	utils.Assert(err == nil)
+	response.Body.Close()
+	utils.Assert(response.StatusCode == http.StatusBadRequest)
+
+	response, data := play(t, server.URL+"/live/test.flv", broadcaster, writer)
+	utils.Assert(response.StatusCode == http.StatusOK)
+	utils.Assert(response.Header.Get("Content-Type") == ContentType)
+	utils.Assert(response.Header.Get("Access-Control-Allow-Origin") == "*")
+	utils.Assert(len(response.TransferEncoding) == 1 && response.TransferEncoding[0] == "chunked")
+
+	// 从缓存的关键帧10开始, 每个track最后一帧缓存在demuxer中
+	handler := demux(data)
+	utils.Assert(data[4] == 0x5)
+	utils.Assert(len(handler.tracks) == 2)
+	utils.Assert(handler.packets[0].Key && handler.packets[0].Data[5] == 10)
+	utils.Assert(len(handler.packets) == 25*2-2)
+}
+
+func TestHandlerTrackFilter(t *testing.T) {
+	streams := NewStreams()
+	server := httptest.NewServer(NewHandler(streams))
+	defer server.Close()
+
+	broadcaster := flv.NewBroadcaster(nil, 0)
+	utils.Assert(streams.Add("test", broadcaster) == nil)
+	writer := newTestWriter(broadcaster)
+	flvtest.WriteGOPs(writer, 0, 15)
+
+	// 只输出音频, flv头只有音频标记
+	_, data := play(t, server.URL+"/test.flv?video=0", broadcaster, writer)
+	utils.Assert(data[4] == 0x4)
+
+	handler := demux(data)
+	utils.Assert(len(handler.tracks) == 1)
+	utils.Assert(utils.AVMediaTypeAudio == handler.tracks[0].GetStream().MediaType)
+	utils.Assert(len(handler.packets) == 25-1)
+	utils.Assert(handler.packets[0].Data[1] == 10)
+	utils.Assert(streams.Remove("test") == broadcaster)
+	utils.Assert(streams.Find("test") == nil)
+
+	// 没有缓存关键帧时只输出音频, 不等待视频关键帧, 从下一个音频帧15开始
+	broadcaster = flv.NewBroadcaster(nil, 0)
+	utils.Assert(streams.Add("test", broadcaster) == nil)
+	_, data = play(t, server.URL+"/test.flv?video=0", broadcaster, newTestWriter(broadcaster))
+	handler = demux(data)
+	utils.Assert(len(handler.tracks) == 1 && len(handler.packets) == 20-1)
+	utils.Assert(handler.packets[0].Data[1] == 15)
+}
@@ -0,0 +1,51 @@
+package httpflv
+
+import (
+	"fmt"
+	"github.com/lkmio/flv"
+	"sync"
+)
+
+// Registry 按流名称查找直播流, 没有找到返回nil
+type Registry interface {
+	Find(name string) *flv.Broadcaster
+}
+
+// Streams 基于map的Registry, 线程安全
+type Streams struct {
+	mutex   sync.RWMutex
+	streams map[string]*flv.Broadcaster
+}
+
+// Add 添加直播流, 流名称已经存在时返回错误
+func (s *Streams) Add(name string, broadcaster *flv.Broadcaster) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.streams[name]; ok {
+		return fmt.Errorf("stream %s already exists", name)
+	}
+
+	s.streams[name] = broadcaster
+	return nil
+}
+
+// Remove 删除并返回直播流, 调用方负责关闭
+func (s *Streams) Remove(name string) *flv.Broadcaster {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	broadcaster := s.streams[name]
+	delete(s.streams, name)
+	return broadcaster
+}
+
+func (s *Streams) Find(name string) *flv.Broadcaster {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.streams[name]
+}
+
+func NewStreams() *Streams {
+	return &Streams{streams: make(map[string]*flv.Broadcaster)}
+}
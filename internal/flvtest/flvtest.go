@@ -0,0 +1,113 @@
+// Package flvtest 各个包的测试共用的H.264/AAC编码器信息和音视频帧.
+// 不依赖flv包, flv包自身的测试也可以使用.
+package flvtest
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+)
+
+var (
+	SPS, _ = hex.DecodeString("6764001facd9405005bb011000000300100000030300f18319a0") // 1280x720 high profile level 3.1
+	PPS, _ = hex.DecodeString("68ebe3cb22c0")
+	ASC    = []byte{0x12, 0x10} // AAC-LC 44100Hz 2通道
+)
+
+// PacketWriter flv.Writer实现该接口
+type PacketWriter interface {
+	WritePacket(packet *avformat.AVPacket) error
+}
+
+// Writer flv.Writer实现该接口
+type Writer interface {
+	PacketWriter
+	AddTrack(stream *avformat.AVStream) (int, error)
+}
+
+// NewVideoStream 索引为0的H.264 track, 时间基为毫秒
+func NewVideoStream() *avformat.AVStream {
+	codecData, err := avformat.NewAVCCodecData(SPS, PPS)
+	utils.Assert(err == nil)
+	stream := avformat.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdH264, codecData.MP4ExtraData(), codecData)
+	stream.Timebase = 1000
+	return stream
+}
+
+// NewAudioStream 索引为1的AAC track, 时间基为毫秒
+func NewAudioStream() *avformat.AVStream {
+	stream := avformat.NewAVStream(utils.AVMediaTypeAudio, 1, utils.AVCodecIdAAC, ASC, nil)
+	stream.Timebase = 1000
+	stream.SampleRate = 44100
+	stream.SampleSize = 16
+	stream.Channels = 2
+	return stream
+}
+
+// AddTracks 添加NewVideoStream和NewAudioStream
+func AddTracks(writer Writer) {
+	_, err := writer.AddTrack(NewVideoStream())
+	utils.Assert(err == nil)
+	_, err = writer.AddTrack(NewAudioStream())
+	utils.Assert(err == nil)
+}
+
+// Options WriteFrames生成的音视频帧
+type Options struct {
+	GOP             int               // 关键帧间隔, 0为10帧
+	FrameSize       int               // 视频帧去掉4字节长度后的大小, 至少2字节, 0为2字节
+	CompositionTime int64             // 视频帧的pts-dts
+	Timestamp       func(i int) int64 // 第i帧的dts, nil为i*40
+}
+
+// WriteFrames 写入第start帧到第start+count-1帧. 每帧写入一个AVCC格式的视频帧和相同时间戳的音频帧,
+// 视频帧的nalu header之后为帧序号, 音频帧为{0x21, 帧序号}
+func WriteFrames(writer PacketWriter, start, count int, options Options) {
+	gop, size := options.GOP, options.FrameSize
+	if gop == 0 {
+		gop = 10
+	}
+
+	if size == 0 {
+		size = 2
+	}
+
+	for i := start; i < start+count; i++ {
+		ts := int64(i * 40)
+		if options.Timestamp != nil {
+			ts = options.Timestamp(i)
+		}
+
+		frame := make([]byte, 4+size)
+		binary.BigEndian.PutUint32(frame, uint32(size))
+		frame[4], frame[5] = 0x41, byte(i)
+		if i%gop == 0 {
+			frame[4] = 0x65
+		}
+
+		packet := avformat.NewVideoPacket(frame, ts, ts+options.CompositionTime, i%gop == 0, avformat.PacketTypeAVCC, utils.AVCodecIdH264, 0, 1000)
+		utils.Assert(writer.WritePacket(packet) == nil)
+		utils.Assert(writer.WritePacket(avformat.NewAudioPacket([]byte{0x21, byte(i)}, ts, utils.AVCodecIdAAC, 1, 1000)) == nil)
+	}
+}
+
+// WriteGOPs 按默认参数写入第start帧到第start+count-1帧, 每10帧一个关键帧, 帧间隔40毫秒
+func WriteGOPs(writer PacketWriter, start, count int) {
+	WriteFrames(writer, start, count, Options{})
+}
+
+// FLVWriter flv.Writer实现该接口
+type FLVWriter interface {
+	Writer
+	WriteHeader() error
+	Flush() error
+}
+
+// WriteFLV 添加音视频track, 写入flv头和第0帧到第frames-1帧
+func WriteFLV(writer FLVWriter, frames int, options Options) {
+	AddTracks(writer)
+	utils.Assert(writer.WriteHeader() == nil)
+	WriteFrames(writer, 0, frames, options)
+	utils.Assert(writer.Flush() == nil)
+}
@@ -0,0 +1,129 @@
+package flv
+
+import (
+	"fmt"
+	"github.com/lkmio/flv/amf0"
+	"io"
+)
+
+const (
+	// DefaultKeyframeIndexSize Recorder在onMetaData中默认预留的关键帧数
+	DefaultKeyframeIndexSize = 1000
+
+	// keyframeEntrySize 一个关键帧在times和filepositions中的序列化长度, 两个AMF0 Number
+	keyframeEntrySize = 2 * 9
+	// paddingProperty onMetaData中填充预留空间的属性
+	paddingProperty = "padding"
+)
+
+// KeyframeIndex onMetaData中的关键帧索引(keyframes.times/filepositions), 播放器用于拖动.
+// 数值的序列化长度固定, 可以先使用占位的位置计算onMetaData的大小, 再填写实际的位置.
+type KeyframeIndex struct {
+	Times     []float64 // 关键帧的时间, 秒
+	Positions []int64   // 关键帧tag在文件中的位置, 不包含PreviousTagSize
+}
+
+// Add 添加一个关键帧
+func (k *KeyframeIndex) Add(time float64, position int64) {
+	k.Times = append(k.Times, time)
+	k.Positions = append(k.Positions, position)
+}
+
+func (k *KeyframeIndex) Len() int {
+	return len(k.Times)
+}
+
+// Object 生成onMetaData中的keyframes对象
+func (k *KeyframeIndex) Object() *amf0.Object {
+	times := make(amf0.StrictArray, len(k.Times))
+	positions := make(amf0.StrictArray, len(k.Positions))
+	for i := range k.Times {
+		times[i] = amf0.Number(k.Times[i])
+	}
+
+	for i := range k.Positions {
+		positions[i] = amf0.Number(k.Positions[i])
+	}
+
+	keyframes := &amf0.Object{}
+	keyframes.AddProperty("times", times)
+	keyframes.AddProperty("filepositions", positions)
+	return keyframes
+}
+
+// thin 均匀保留n个关键帧, 包含第一个关键帧
+func (k *KeyframeIndex) thin(n int) *KeyframeIndex {
+	thinned := &KeyframeIndex{}
+	for i := 0; i < n; i++ {
+		j := i * k.Len() / n
+		thinned.Add(k.Times[j], k.Positions[j])
+	}
+
+	return thinned
+}
+
+// ReserveKeyframeIndex 在onMetaData中添加空的关键帧索引, 并使用padding属性为count个关键帧预留空间.
+// 文件写完后由RewriteMetaData原地回填, 不需要移动之后的数据
+func ReserveKeyframeIndex(metaData *amf0.Object, count int) {
+	setProperty(metaData, "keyframes", (&KeyframeIndex{}).Object())
+	setProperty(metaData, paddingProperty, amf0.LongString(make([]byte, count*keyframeEntrySize)))
+}
+
+// RewriteMetaData 使用metaData原地替换file开头的onMetaData, 并写入filesize和关键帧索引, size为文件大小.
+// 新的onMetaData使用padding属性填充到原来的大小, 超过原来的大小时均匀减少关键帧, 原来的onMetaData需要由ReserveKeyframeIndex预留空间
+func RewriteMetaData(file io.ReadWriteSeeker, size int64, metaData *amf0.Object, index *KeyframeIndex) error {
+	// flv header(9) PreviousTagSize0(4) tag header(11)
+	var header [9 + TagHeaderSize]byte
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	} else if _, err = io.ReadFull(file, header[:]); err != nil {
+		return err
+	} else if header[0] != 'F' || header[1] != 'L' || header[2] != 'V' || TagType(header[13]) != TagTypeScriptData {
+		return fmt.Errorf("script data not found at the beginning of file")
+	}
+
+	setProperty(metaData, "filesize", amf0.Number(size))
+	setProperty(metaData, "keyframes", index.Object())
+	setProperty(metaData, paddingProperty, amf0.LongString(""))
+
+	data := amf0.Data{}
+	data.AddString("onMetaData")
+	data.Add(metaData)
+	reserved := int(header[14])<<16 | int(header[15])<<8 | int(header[16])
+	free := reserved - data.MarshalSize()
+	if free < 0 {
+		n := index.Len() - (-free+keyframeEntrySize-1)/keyframeEntrySize
+		if n < 0 {
+			return fmt.Errorf("metadata exceeds the reserved %d bytes", reserved)
+		}
+
+		setProperty(metaData, "keyframes", index.thin(n).Object())
+		free = reserved - data.MarshalSize()
+	}
+
+	setProperty(metaData, paddingProperty, amf0.LongString(make([]byte, free)))
+	buffer := make([]byte, reserved)
+	if n, err := data.Marshal(buffer); err != nil {
+		return err
+	} else if n != reserved {
+		return fmt.Errorf("metadata size %d does not match the reserved %d bytes", n, reserved)
+	}
+
+	if _, err := file.Seek(9+TagHeaderSize, io.SeekStart); err != nil {
+		return err
+	} else if _, err = file.Write(buffer); err != nil {
+		return err
+	}
+
+	_, err := file.Seek(0, io.SeekEnd)
+	return err
+}
+
+// setProperty 替换已有的属性, 不存在时添加
+func setProperty(object *amf0.Object, name string, value amf0.Element) {
+	if property := object.FindProperty(name); property != nil {
+		property.Value = value
+	} else {
+		object.AddProperty(name, value)
+	}
+}
@@ -0,0 +1,58 @@
+// Package mp4 实现flv与ISO BMFF(MP4)之间的转换, 不依赖ffmpeg.
+package mp4
+
+import (
+	"encoding/binary"
+)
+
+// startBox 写入box头, 返回box起始位置, 写完box内容后调用endBox回填大小
+func startBox(dst []byte, boxType string) ([]byte, int) {
+	offset := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+	return append(dst, boxType...), offset
+}
+
+// startFullBox 写入full box头
+func startFullBox(dst []byte, boxType string, version byte, flags uint32) ([]byte, int) {
+	dst, offset := startBox(dst, boxType)
+	return binary.BigEndian.AppendUint32(dst, uint32(version)<<24|flags&0xFFFFFF), offset
+}
+
+func endBox(dst []byte, offset int) []byte {
+	binary.BigEndian.PutUint32(dst[offset:], uint32(len(dst)-offset))
+	return dst
+}
+
+// appendBox 写入内容已知的box
+func appendBox(dst []byte, boxType string, payload ...[]byte) []byte {
+	dst, offset := startBox(dst, boxType)
+	for _, data := range payload {
+		dst = append(dst, data...)
+	}
+
+	return endBox(dst, offset)
+}
+
+// appendMatrix 单位矩阵
+func appendMatrix(dst []byte) []byte {
+	for _, value := range []uint32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000} {
+		dst = binary.BigEndian.AppendUint32(dst, value)
+	}
+
+	return dst
+}
+
+// appendDescriptor 写入MPEG-4描述符, 长度固定使用4字节编码
+func appendDescriptor(dst []byte, tag byte, payload ...[]byte) []byte {
+	var size int
+	for _, data := range payload {
+		size += len(data)
+	}
+
+	dst = append(dst, tag, byte(size>>21)|0x80, byte(size>>14)|0x80, byte(size>>7)|0x80, byte(size&0x7F))
+	for _, data := range payload {
+		dst = append(dst, data...)
+	}
+
+	return dst
+}
@@ -0,0 +1,183 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"github.com/lkmio/flv/amf0"
+	"io"
+)
+
+// countingWriter 只统计写入的字节数
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// flvCompatible flv可以封装该track的编码器, 例如Opus和16/24/32kHz的MP3不能封装
+func flvCompatible(stream *avformat.AVStream) bool {
+	if utils.AVMediaTypeVideo == stream.MediaType {
+		_, err := flv.NewVideoData(stream.CodecID)
+		return err == nil
+	}
+
+	_, err := flv.NewAudioData(stream.CodecID, stream.SampleRate, stream.SampleSize, stream.Channels)
+	return err == nil
+}
+
+// ConvertToFLV 将progressive MP4转换为flv. 使用第一个flv可以封装的视频和音频track, 跳过其他track, onMetaData中包含时长, 分辨率
+// 和关键帧索引(keyframes.times/filepositions), 播放器可以直接拖动. 关键帧位置通过不读取帧数据的预写入计算.
+func ConvertToFLV(dst io.Writer, src io.ReadSeeker) error {
+	reader, err := NewReader(src)
+	if err != nil {
+		return err
+	}
+
+	// flv只支持一个视频和一个音频track
+	var selected []int
+	var video *readerTrack
+	var hasAudio bool
+	for i, t := range reader.tracks {
+		if !flvCompatible(t.stream) {
+			continue
+		} else if utils.AVMediaTypeVideo == t.stream.MediaType && video == nil {
+			video = t
+			selected = append(selected, i)
+		} else if utils.AVMediaTypeAudio == t.stream.MediaType && !hasAudio {
+			hasAudio = true
+			selected = append(selected, i)
+		}
+	}
+
+	metadata := &amf0.Object{}
+	metadata.AddNumberProperty("duration", reader.Duration().Seconds())
+	var index flv.KeyframeIndex
+	if video != nil {
+		if video.stream.CodecParameters != nil && video.stream.CodecParameters.Width() > 0 {
+			metadata.AddNumberProperty("width", float64(video.stream.CodecParameters.Width()))
+			metadata.AddNumberProperty("height", float64(video.stream.CodecParameters.Height()))
+		} else if video.width > 0 {
+			metadata.AddNumberProperty("width", float64(video.width))
+			metadata.AddNumberProperty("height", float64(video.height))
+		}
+
+		// 关键帧数量确定, 预写入时使用占位值, 序列化后的大小不变
+		for _, s := range video.samples {
+			if s.key {
+				index.Add(float64(s.dts+video.offset)/float64(video.timescale), 0)
+			}
+		}
+	}
+
+	metadata.AddNumberProperty("filesize", 0)
+	metadata.AddProperty("keyframes", index.Object())
+
+	// 预写入, 计算每个关键帧tag的位置和文件大小
+	counter := &countingWriter{}
+	err = writeFLV(counter, reader, selected, metadata, func(packet *avformat.AVPacket, t *readerTrack, keyframe int) {
+		if t == video && packet.Key {
+			index.Positions[keyframe] = counter.n + 4
+		}
+	})
+
+	if err != nil {
+		return err
+	}
+
+	metadata.FindProperty("keyframes").Value = index.Object()
+	metadata.FindProperty("filesize").Value = amf0.Number(counter.n)
+	reader.cursors = make([]int, len(reader.tracks))
+	return writeFLV(dst, reader, selected, metadata, nil)
+}
+
+// writeFLV 按dts顺序写入选中的track. onPacket不为nil时为预写入, 不读取帧数据
+func writeFLV(dst io.Writer, reader *Reader, selected []int, metadata *amf0.Object, onPacket func(packet *avformat.AVPacket, t *readerTrack, keyframe int)) error {
+	writer := flv.NewWriterWithMuxer(dst, flv.NewMuxer(metadata))
+	index := make(map[int]int)
+	for _, i := range selected {
+		stream := *reader.tracks[i].stream
+		n, err := writer.AddTrack(&stream)
+		if err != nil {
+			return err
+		}
+
+		index[i] = n
+	}
+
+	if err := writer.WriteHeader(); err != nil {
+		return err
+	}
+
+	var keyframe int
+	var empty []byte
+	for {
+		var packet *avformat.AVPacket
+		var track int
+		if onPacket == nil {
+			var err error
+			if packet, err = reader.ReadPacket(); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			track = packet.Index
+		} else {
+			i, s := reader.next(reader.cursors)
+			if i < 0 {
+				break
+			}
+
+			// 只需要帧大小
+			if len(empty) < s.size {
+				empty = make([]byte, s.size)
+			}
+
+			t := reader.tracks[i]
+			dts := s.dts + t.offset
+			if utils.AVMediaTypeVideo == t.stream.MediaType {
+				packet = avformat.NewVideoPacket(empty[:s.size], dts, dts+s.cts, s.key, avformat.PacketTypeAVCC, t.stream.CodecID, i, t.timescale)
+			} else {
+				packet = avformat.NewAudioPacket(empty[:s.size], dts, t.stream.CodecID, i, t.timescale)
+			}
+
+			track = i
+		}
+
+		n, ok := index[track]
+		if !ok {
+			avformat.FreePacket(packet)
+			continue
+		}
+
+		t := reader.tracks[track]
+		if onPacket != nil {
+			onPacket(packet, t, keyframe)
+		}
+
+		if utils.AVMediaTypeVideo == t.stream.MediaType && packet.Key {
+			keyframe++
+		}
+
+		packet.Index = n
+		err := writer.WritePacket(packet)
+		avformat.FreePacket(packet)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 最后一个tag的PreviousTagSize, 不关闭dst
+	var prevTagSize [4]byte
+	binary.BigEndian.PutUint32(prevTagSize[:], writer.Muxer().PrevTagSize())
+	if _, err := dst.Write(prevTagSize[:]); err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
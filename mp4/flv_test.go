@@ -0,0 +1,231 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"github.com/lkmio/flv/amf0"
+	"github.com/lkmio/flv/internal/flvtest"
+	"testing"
+)
+
+type testCollector struct {
+	packets []*avformat.AVPacket
+}
+
+func (c *testCollector) OnNewTrack(track avformat.Track) {
+}
+
+func (c *testCollector) OnTrackComplete() {
+}
+
+func (c *testCollector) OnTrackNotFind() {
+}
+
+func (c *testCollector) OnPacket(packet *avformat.AVPacket) {
+	clone := *packet
+	clone.Data = append([]byte(nil), packet.Data...)
+	c.packets = append(c.packets, &clone)
+}
+
+// appendTestSampleTables 每个chunk一帧, 所有帧时长和composition offset相同
+func appendTestSampleTables(entry []byte, offsets []int64, sizes []int, duration, cts uint32, keyInterval int) func(dst []byte) []byte {
+	return func(dst []byte) []byte {
+		dst = appendStsd(dst, entry)
+		fullBox := func(boxType string, values ...uint32) {
+			box, offset := startFullBox(dst, boxType, 0, 0)
+			for _, value := range values {
+				box = binary.BigEndian.AppendUint32(box, value)
+			}
+
+			dst = endBox(box, offset)
+		}
+
+		count := uint32(len(sizes))
+		fullBox("stts", 1, count, duration)
+		if cts > 0 {
+			fullBox("ctts", 1, count, cts)
+		}
+
+		if keyInterval > 1 {
+			var keys []uint32
+			for i := 0; i < len(sizes); i += keyInterval {
+				keys = append(keys, uint32(i+1))
+			}
+
+			fullBox("stss", append([]uint32{uint32(len(keys))}, keys...)...)
+		}
+
+		fullBox("stsc", 1, 1, 1, 1)
+		stsz := []uint32{0, count}
+		stco := []uint32{count}
+		for i, size := range sizes {
+			stsz = append(stsz, uint32(size))
+			stco = append(stco, uint32(offsets[i]))
+		}
+
+		fullBox("stsz", stsz...)
+		fullBox("stco", stco...)
+		return dst
+	}
+}
+
+// newTestMP4 生成H.264和AAC的MP4, 视频帧间隔40毫秒, 每10帧一个关键帧, composition offset为80毫秒,
+// 编辑列表去掉视频开头的80毫秒延迟
+func newTestMP4(frames int) []byte {
+	video, err := newTrack(flvtest.NewVideoStream(), 1)
+	utils.Assert(err == nil)
+	audio, err := newTrack(flvtest.NewAudioStream(), 2)
+	utils.Assert(err == nil)
+
+	var mdat []byte
+	var videoOffsets, audioOffsets []int64
+	var videoSizes, audioSizes []int
+	for i := 0; i < frames; i++ {
+		frame := make([]byte, 4+300)
+		frame[2], frame[3], frame[4], frame[5] = 0x1, 0x2C, 0x41, byte(i)
+		if i%10 == 0 {
+			frame[4] = 0x65
+		}
+
+		videoOffsets, videoSizes = append(videoOffsets, int64(len(mdat))), append(videoSizes, len(frame))
+		mdat = append(mdat, frame...)
+		audioOffsets, audioSizes = append(audioOffsets, int64(len(mdat))), append(audioSizes, 2)
+		mdat = append(mdat, 0x21, byte(i))
+	}
+
+	build := func(base int64) []byte {
+		shift := func(offsets []int64) []int64 {
+			shifted := make([]int64, len(offsets))
+			for i, offset := range offsets {
+				shifted[i] = offset + base
+			}
+
+			return shifted
+		}
+
+		duration := int64(frames * 40)
+		moov, offset := startBox(nil, "moov")
+		moov = appendMvhd(moov, duration, 3)
+		// segment_duration(32) media_time(32) media_rate(32)
+		elst, elstOffset := startFullBox(nil, "elst", 0, 0)
+		elst = binary.BigEndian.AppendUint32(elst, 1)
+		elst = binary.BigEndian.AppendUint32(elst, uint32(duration))
+		elst = binary.BigEndian.AppendUint32(elst, 80*90)
+		elst = binary.BigEndian.AppendUint32(elst, 0x10000)
+		edts := appendBox(nil, "edts", endBox(elst, elstOffset))
+		videoStbl := appendTestSampleTables(video.entry, shift(videoOffsets), videoSizes, 40*90, 80*90, 10)
+		moov = video.appendTrak(moov, duration, duration*90, edts, videoStbl)
+
+		audioStbl := appendTestSampleTables(audio.entry, shift(audioOffsets), audioSizes, 40*441/10, 0, 1)
+		moov = audio.appendTrak(moov, duration, duration*441/10, nil, audioStbl)
+		moov = endBox(moov, offset)
+
+		file := appendBox(nil, "ftyp", []byte("isom\x00\x00\x02\x00isomiso2avc1mp41"))
+		file = append(file, moov...)
+		return appendBox(file, "mdat", mdat)
+	}
+
+	// mdat在moov之后, 偏移量不影响moov的大小
+	file := build(0)
+	return build(int64(len(file) - len(mdat)))
+}
+
+func TestReader(t *testing.T) {
+	reader, err := NewReader(bytes.NewReader(newTestMP4(20)))
+	utils.Assert(err == nil)
+	streams := reader.Streams()
+	utils.Assert(len(streams) == 2 && streams[0].CodecID == utils.AVCodecIdH264 && streams[1].CodecID == utils.AVCodecIdAAC)
+	utils.Assert(streams[1].SampleRate == 44100 && streams[1].Channels == 2 && bytes.Equal(streams[1].Data, flvtest.ASC))
+	utils.Assert(reader.Duration().Milliseconds() == 800)
+
+	// 编辑列表使视频的第一帧在0时刻显示, 音频整体后移80毫秒与视频同步
+	var counts [2]int
+	var last int64
+	for i := 0; i < 40; i++ {
+		packet, err := reader.ReadPacket()
+		utils.Assert(err == nil)
+		dts := packet.ConvertDts(1000)
+		utils.Assert(dts >= last)
+		last = dts
+
+		n := counts[packet.Index]
+		counts[packet.Index]++
+		if packet.Index == 0 {
+			utils.Assert(dts == int64(n*40) && packet.ConvertPts(1000) == int64(n*40+80))
+			utils.Assert(packet.Key == (n%10 == 0) && len(packet.Data) == 304 && packet.Data[5] == byte(n))
+		} else {
+			utils.Assert(dts == int64(n*40+80) && bytes.Equal(packet.Data, []byte{0x21, byte(n)}))
+		}
+	}
+
+	_, err = reader.ReadPacket()
+	utils.Assert(err != nil)
+	utils.Assert(len(reader.Skipped()) == 0)
+}
+
+func TestReaderUnsupportedTrack(t *testing.T) {
+	// 音频sample entry改为不支持的AMR
+	file := newTestMP4(20)
+	utils.Assert(bytes.Count(file, []byte("mp4a")) == 1)
+	file = bytes.Replace(file, []byte("mp4a"), []byte("samr"), 1)
+
+	reader, err := NewReader(bytes.NewReader(file))
+	utils.Assert(err == nil)
+	streams := reader.Streams()
+	utils.Assert(len(streams) == 1 && streams[0].CodecID == utils.AVCodecIdH264)
+	skipped := reader.Skipped()
+	utils.Assert(len(skipped) == 1 && errors.Is(skipped[0], ErrUnsupportedCodec))
+
+	for i := 0; i < 20; i++ {
+		packet, err := reader.ReadPacket()
+		utils.Assert(err == nil && packet.Index == 0)
+	}
+}
+
+func TestConvertToFLV(t *testing.T) {
+	output := &bytes.Buffer{}
+	utils.Assert(ConvertToFLV(output, bytes.NewReader(newTestMP4(20))) == nil)
+	data := output.Bytes()
+
+	collector := &testCollector{}
+	demuxer := flv.NewDemuxer(true)
+	demuxer.SetHandler(collector)
+	_, err := demuxer.Input(data)
+	utils.Assert(err == nil)
+	demuxer.Flush()
+	utils.Assert(len(collector.packets) == 40)
+
+	// 关键帧索引指向视频关键帧tag
+	metadata := amf0.ToObject(demuxer.Metadata().Get(1))
+	size, _ := amf0.ToNumber(metadata.FindProperty("filesize").Value)
+	utils.Assert(int(size) == len(data))
+	keyframes := amf0.ToObject(metadata.FindProperty("keyframes").Value)
+	times := keyframes.FindProperty("times").Value.(amf0.StrictArray)
+	positions := keyframes.FindProperty("filepositions").Value.(amf0.StrictArray)
+	utils.Assert(len(times) == 2 && len(positions) == 2)
+	for i := range positions {
+		position, _ := amf0.ToNumber(positions[i])
+		ts, _ := amf0.ToNumber(times[i])
+		tag := data[int(position):]
+		utils.Assert(ts == float64(i)*0.4)
+		utils.Assert(flv.TagType(tag[0]) == flv.TagTypeVideoData && tag[11] == 0x17 && tag[12] == 1)
+		utils.Assert(int(tag[4])<<16|int(tag[5])<<8|int(tag[6]) == i*400)
+	}
+}
+
+func TestFLVCompatible(t *testing.T) {
+	utils.Assert(flvCompatible(flvtest.NewVideoStream()) && flvCompatible(flvtest.NewAudioStream()))
+
+	// Opus和16kHz的MP3不能封装为flv, ConvertToFLV选择其他track
+	opus := avformat.NewAVStream(utils.AVMediaTypeAudio, 2, utils.AVCodecIdOPUS, nil, nil)
+	opus.SampleRate, opus.Channels = 48000, 2
+	mp3 := avformat.NewAVStream(utils.AVMediaTypeAudio, 3, utils.AVCodecIdMP3, nil, nil)
+	mp3.SampleRate, mp3.SampleSize, mp3.Channels = 16000, 16, 2
+	utils.Assert(!flvCompatible(opus) && !flvCompatible(mp3))
+	mp3.SampleRate = 44100
+	utils.Assert(flvCompatible(mp3))
+}
@@ -0,0 +1,335 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"io"
+	"time"
+)
+
+const (
+	// defaultAudioFragmentDuration 纯音频流未设置分片时长时的默认值
+	defaultAudioFragmentDuration = time.Second
+
+	sampleFlagsSync    = 0x02000000 // sample_depends_on=2
+	sampleFlagsNonSync = 0x01010000 // sample_depends_on=1, sample_is_non_sync_sample=1
+)
+
+// fragmentSample 分片中的一帧, 时间使用track时间刻度
+type fragmentSample struct {
+	dts      int64
+	cts      int32 // composition offset
+	duration int64
+	offset   int // 在track分片数据中的位置
+	size     int
+	key      bool
+}
+
+// fragmentTrack 缓存一个track当前分片的帧, 最后一帧等下一帧到达后才能确定时长
+type fragmentTrack struct {
+	*track
+	samples []fragmentSample
+	data    []byte
+}
+
+// ready 时长已经确定的帧数
+func (t *fragmentTrack) ready() int {
+	if len(t.samples) == 0 {
+		return 0
+	}
+
+	return len(t.samples) - 1
+}
+
+// complete 使用最后一帧的预估时长完成所有帧, 没有预估时长时使用上一帧的时长
+func (t *fragmentTrack) complete() {
+	if n := len(t.samples); n > 0 && t.samples[n-1].duration <= 0 && n > 1 {
+		t.samples[n-1].duration = t.samples[n-2].duration
+	}
+}
+
+// remove 删除已经写入分片的前n帧
+func (t *fragmentTrack) remove(n int) {
+	if n == 0 {
+		return
+	} else if n == len(t.samples) {
+		t.samples = t.samples[:0]
+		t.data = t.data[:0]
+		return
+	}
+
+	offset := t.samples[n].offset
+	t.data = t.data[:copy(t.data, t.data[offset:])]
+	t.samples = t.samples[:copy(t.samples, t.samples[n:])]
+	for i := range t.samples {
+		t.samples[i].offset -= offset
+	}
+}
+
+// FragmentedMuxer 将flv解析出的音视频帧封装为fMP4(CMAF), 支持H.264, H.265, AV1, VP9, AAC, MP3和Opus.
+// 写入第一帧前输出初始化分片(ftyp+moov), 之后在视频关键帧处切分媒体分片, 没有视频时按时长切分.
+// 媒体分片中每个track单独一个moof+mdat, 符合CMAF每个分片只包含一个track的要求.
+// writer的每次Write都是一个完整的初始化分片或媒体分片, 可以直接用于MSE或LL-HLS/DASH. 非线程安全.
+type FragmentedMuxer struct {
+	FragmentDuration time.Duration // 分片的最小时长, 0时视频每个GOP一个分片, 纯音频流每秒一个分片
+
+	writer      io.Writer
+	tracks      []*fragmentTrack
+	primary     *fragmentTrack // 决定切分位置的track, 优先使用视频
+	sequence    uint32
+	initWritten bool
+	buffer      []byte
+}
+
+// AddTrack 添加track, 需要在写入第一帧前完成. MP4不能承载的编码器返回ErrUnsupportedCodec
+func (m *FragmentedMuxer) AddTrack(stream *avformat.AVStream) error {
+	if m.initWritten {
+		return fmt.Errorf("tracks must be added before writing packets")
+	}
+
+	t, err := newTrack(stream, uint32(len(m.tracks)+1))
+	if err != nil {
+		return err
+	}
+
+	ft := &fragmentTrack{track: t}
+	m.tracks = append(m.tracks, ft)
+	if m.primary == nil || (utils.AVMediaTypeVideo == stream.MediaType && utils.AVMediaTypeVideo != m.primary.stream.MediaType) {
+		m.primary = ft
+	}
+
+	return nil
+}
+
+// UpdateTrack 流中途的sequence header变化. 输出缓存的帧后重新生成sample entry, 下一个媒体分片前重新输出初始化分片
+func (m *FragmentedMuxer) UpdateTrack(stream *avformat.AVStream) error {
+	t := m.findTrack(stream.Index)
+	if t == nil {
+		return fmt.Errorf("track %d not found", stream.Index)
+	} else if err := m.Flush(); err != nil {
+		return err
+	}
+
+	m.initWritten = false
+	return t.update(stream)
+}
+
+func (m *FragmentedMuxer) findTrack(index int) *fragmentTrack {
+	for _, t := range m.tracks {
+		if t.stream.Index == index {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// InitSegment 返回初始化分片
+func (m *FragmentedMuxer) InitSegment() []byte {
+	// major_brand(32) minor_version(32) compatible_brands
+	dst := appendBox(nil, "ftyp", []byte("iso6\x00\x00\x00\x00iso6iso5cmfcmp41"))
+	dst, moov := startBox(dst, "moov")
+	dst = appendMvhd(dst, 0, uint32(len(m.tracks)+1))
+	for _, t := range m.tracks {
+		entry := t.entry
+		dst = t.appendTrak(dst, 0, 0, nil, func(dst []byte) []byte {
+			return appendEmptySampleTables(appendStsd(dst, entry))
+		})
+	}
+
+	var mvex int
+	dst, mvex = startBox(dst, "mvex")
+	for _, t := range m.tracks {
+		// track_ID(32) default_sample_description_index(32) default_sample_duration(32) default_sample_size(32) default_sample_flags(32)
+		trex, offset := startFullBox(dst, "trex", 0, 0)
+		trex = binary.BigEndian.AppendUint32(trex, t.id)
+		trex = binary.BigEndian.AppendUint32(trex, 1)
+		dst = endBox(append(trex, make([]byte, 12)...), offset)
+	}
+
+	dst = endBox(dst, mvex)
+	return endBox(dst, moov)
+}
+
+// appendEmptySampleTables fMP4的sample信息在moof中, moov中的sample表为空
+func appendEmptySampleTables(dst []byte) []byte {
+	for _, boxType := range []string{"stts", "stsc", "stco"} {
+		box, offset := startFullBox(dst, boxType, 0, 0)
+		dst = endBox(append(box, 0, 0, 0, 0), offset)
+	}
+
+	// sample_size(32) sample_count(32)
+	box, offset := startFullBox(dst, "stsz", 0, 0)
+	return endBox(append(box, 0, 0, 0, 0, 0, 0, 0, 0), offset)
+}
+
+// WritePacket 写入一帧, 视频可以是AVCC或AnnexB格式. 数据会被拷贝, 返回后可以释放packet
+func (m *FragmentedMuxer) WritePacket(packet *avformat.AVPacket) error {
+	t := m.findTrack(packet.Index)
+	if t == nil {
+		return fmt.Errorf("track %d not found", packet.Index)
+	}
+
+	// 获取到VP9的分辨率后重新输出初始化分片
+	if utils.AVMediaTypeVideo == t.stream.MediaType && packet.Key && t.updateFrameSize(packet.Data) && m.initWritten {
+		if err := m.Flush(); err != nil {
+			return err
+		}
+
+		m.initWritten = false
+	}
+
+	if !m.initWritten {
+		if _, err := m.writer.Write(m.InitSegment()); err != nil {
+			return err
+		}
+
+		m.initWritten = true
+	}
+
+	dts := convertTs(packet.Dts, packet.Timebase, t.timescale)
+	pts := convertTs(packet.Pts, packet.Timebase, t.timescale)
+	video := utils.AVMediaTypeVideo == t.stream.MediaType
+	if !video {
+		pts = dts
+	}
+
+	// 新的一帧确定了上一帧的时长
+	if n := len(t.samples); n > 0 {
+		if duration := dts - t.samples[n-1].dts; duration >= 0 {
+			t.samples[n-1].duration = duration
+		}
+	}
+
+	offset := len(t.data)
+	if video && avformat.PacketTypeAnnexB == packet.PacketType {
+		t.data = appendAVCC(t.data, packet.Data, t.lengthSize)
+	} else {
+		t.data = append(t.data, packet.Data...)
+	}
+
+	t.samples = append(t.samples, fragmentSample{
+		dts:      dts,
+		cts:      int32(pts - dts),
+		duration: convertTs(packet.Duration, packet.Timebase, t.timescale),
+		offset:   offset,
+		size:     len(t.data) - offset,
+		key:      packet.Key || !video,
+	})
+
+	// 主track的关键帧前切分, 之前的帧组成一个分片
+	if t == m.primary && (packet.Key || !video) && m.fragmentFull(dts) {
+		return m.writeFragment(false)
+	}
+
+	return nil
+}
+
+// fragmentFull 主track在dts之前缓存的帧是否达到分片时长
+func (m *FragmentedMuxer) fragmentFull(dts int64) bool {
+	t := m.primary
+	if t.ready() == 0 {
+		return false
+	}
+
+	duration := m.FragmentDuration
+	if duration <= 0 && utils.AVMediaTypeVideo != t.stream.MediaType {
+		duration = defaultAudioFragmentDuration
+	}
+
+	return dts-t.samples[0].dts >= int64(duration)*int64(t.timescale)/int64(time.Second)
+}
+
+// writeFragment 输出时长已经确定的帧, all为true时输出所有帧
+func (m *FragmentedMuxer) writeFragment(all bool) error {
+	counts := make([]int, len(m.tracks))
+	var total int
+	for i, t := range m.tracks {
+		if all {
+			t.complete()
+			counts[i] = len(t.samples)
+		} else {
+			counts[i] = t.ready()
+		}
+
+		total += counts[i]
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	// 每个track单独一个moof+mdat, 一次写出
+	dst := m.buffer[:0]
+	for i, t := range m.tracks {
+		if counts[i] > 0 {
+			dst = m.appendFragment(dst, t, counts[i])
+		}
+	}
+
+	m.buffer = dst
+	_, err := m.writer.Write(m.buffer)
+	return err
+}
+
+// appendFragment 将track的前count帧封装为一个moof+mdat
+func (m *FragmentedMuxer) appendFragment(dst []byte, t *fragmentTrack, count int) []byte {
+	m.sequence++
+	var moof, mfhd, traf, box int
+	dst, moof = startBox(dst, "moof")
+	dst, mfhd = startFullBox(dst, "mfhd", 0, 0)
+	dst = endBox(binary.BigEndian.AppendUint32(dst, m.sequence), mfhd)
+
+	dst, traf = startBox(dst, "traf")
+	// default-base-is-moof
+	dst, box = startFullBox(dst, "tfhd", 0, 0x020000)
+	dst = endBox(binary.BigEndian.AppendUint32(dst, t.id), box)
+
+	dst, box = startFullBox(dst, "tfdt", 1, 0)
+	dst = endBox(binary.BigEndian.AppendUint64(dst, uint64(t.samples[0].dts)), box)
+
+	// data-offset, sample-duration, sample-size, sample-flags, sample-composition-time-offset
+	dst, box = startFullBox(dst, "trun", 1, 0x000F01)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(count))
+	// data_offset在moof大小确定后回填
+	dataOffset := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+	for _, sample := range t.samples[:count] {
+		flags := uint32(sampleFlagsNonSync)
+		if sample.key {
+			flags = sampleFlagsSync
+		}
+
+		dst = binary.BigEndian.AppendUint32(dst, uint32(sample.duration))
+		dst = binary.BigEndian.AppendUint32(dst, uint32(sample.size))
+		dst = binary.BigEndian.AppendUint32(dst, flags)
+		dst = binary.BigEndian.AppendUint32(dst, uint32(sample.cts))
+	}
+
+	dst = endBox(dst, box)
+	dst = endBox(dst, traf)
+	dst = endBox(dst, moof)
+	binary.BigEndian.PutUint32(dst[dataOffset:], uint32(len(dst)-moof+8))
+
+	var mdat int
+	dst, mdat = startBox(dst, "mdat")
+	size := t.samples[count-1].offset + t.samples[count-1].size
+	dst = append(dst, t.data[:size]...)
+	t.remove(count)
+	return endBox(dst, mdat)
+}
+
+// Flush 输出所有缓存的帧, 输入结束时调用
+func (m *FragmentedMuxer) Flush() error {
+	if !m.initWritten {
+		return nil
+	}
+
+	return m.writeFragment(true)
+}
+
+func NewFragmentedMuxer(writer io.Writer) *FragmentedMuxer {
+	return &FragmentedMuxer{writer: writer}
+}
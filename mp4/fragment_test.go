@@ -0,0 +1,130 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"github.com/lkmio/flv/internal/flvtest"
+	"testing"
+)
+
+// newTestFLV 生成音视频flv流, 每10帧一个关键帧, 视频帧大小为300字节
+func newTestFLV(frames int) []byte {
+	output := &bytes.Buffer{}
+	flvtest.WriteFLV(flv.NewWriter(output), frames, flvtest.Options{FrameSize: 300, CompositionTime: 80})
+	return output.Bytes()
+}
+
+type testBox struct {
+	boxType string
+	offset  int // box在输入中的位置
+	data    []byte
+}
+
+func readTestBoxes(data []byte) []testBox {
+	var boxes []testBox
+	for offset := 0; offset < len(data); {
+		utils.Assert(offset+8 <= len(data))
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		utils.Assert(size >= 8 && offset+size <= len(data))
+		boxes = append(boxes, testBox{string(data[offset+4 : offset+8]), offset, data[offset+8 : offset+size]})
+		offset += size
+	}
+
+	return boxes
+}
+
+// findTestBox 按路径查找box内容, 跳过full box头和sample entry等固定字段由调用方处理
+func findTestBox(data []byte, path ...string) []byte {
+	for _, boxType := range path {
+		var found []byte
+		for _, box := range readTestBoxes(data) {
+			if box.boxType == boxType {
+				found = box.data
+				break
+			}
+		}
+
+		if found == nil {
+			return nil
+		}
+
+		data = found
+		switch boxType {
+		case "stsd":
+			data = data[8:]
+		case "avc1":
+			data = data[78:]
+		case "mp4a":
+			data = data[28:]
+		}
+	}
+
+	return data
+}
+
+func TestFragmentedRemux(t *testing.T) {
+	output := &bytes.Buffer{}
+	utils.Assert(RemuxFragmented(output, bytes.NewReader(newTestFLV(20))) == nil)
+
+	boxes := readTestBoxes(output.Bytes())
+	utils.Assert(len(boxes) == 10 && boxes[0].boxType == "ftyp" && boxes[1].boxType == "moov")
+	utils.Assert(bytes.Contains(boxes[0].data, []byte("cmfc")))
+
+	// sample entry
+	traks := readTestBoxes(boxes[1].data)
+	utils.Assert(len(traks) == 4 && traks[1].boxType == "trak" && traks[2].boxType == "trak" && traks[3].boxType == "mvex")
+	avcC := findTestBox(traks[1].data, "mdia", "minf", "stbl", "stsd", "avc1", "avcC")
+	utils.Assert(avcC != nil && bytes.Contains(avcC, flvtest.SPS) && bytes.Contains(avcC, flvtest.PPS))
+	mdhd := findTestBox(traks[2].data, "mdia", "mdhd")
+	utils.Assert(binary.BigEndian.Uint32(mdhd[12:]) == 44100)
+	esds := findTestBox(traks[2].data, "mdia", "minf", "stbl", "stsd", "mp4a", "esds")
+	utils.Assert(esds != nil && bytes.HasSuffix(esds, []byte{0x05, 0x80, 0x80, 0x80, 0x02, 0x12, 0x10, 0x06, 0x80, 0x80, 0x80, 0x01, 0x02}))
+
+	// 每个GOP一个媒体分片, 其中每个track一个moof+mdat
+	var videoSamples, audioSamples int
+	for i := 2; i < len(boxes); i += 2 {
+		moof, mdat := boxes[i], boxes[i+1]
+		utils.Assert(moof.boxType == "moof" && mdat.boxType == "mdat")
+		utils.Assert(binary.BigEndian.Uint32(findTestBox(moof.data, "mfhd")[4:]) == uint32(i/2))
+
+		children := readTestBoxes(moof.data)
+		utils.Assert(len(children) == 2 && children[1].boxType == "traf")
+		for _, traf := range children[1:] {
+
+			trackID := binary.BigEndian.Uint32(findTestBox(traf.data, "tfhd")[4:])
+			baseTime := binary.BigEndian.Uint64(findTestBox(traf.data, "tfdt")[4:])
+			trun := findTestBox(traf.data, "trun")
+			count := int(binary.BigEndian.Uint32(trun[4:]))
+			dataOffset := int(binary.BigEndian.Uint32(trun[8:]))
+			sample := output.Bytes()[moof.offset+dataOffset:]
+
+			for j := 0; j < count; j++ {
+				entry := trun[12+j*16:]
+				duration, size, flags, cts := binary.BigEndian.Uint32(entry), int(binary.BigEndian.Uint32(entry[4:])), binary.BigEndian.Uint32(entry[8:]), binary.BigEndian.Uint32(entry[12:])
+				if trackID == 1 {
+					// 关键帧从新的分片开始, 时间刻度90kHz
+					index := videoSamples
+					utils.Assert(j != 0 || index%10 == 0)
+					utils.Assert(baseTime == uint64(index-j)*40*90)
+					utils.Assert(duration == 40*90 && cts == 80*90 && size == 4+300)
+					utils.Assert((flags == sampleFlagsSync) == (index%10 == 0))
+					utils.Assert(sample[4] == 0x65 || sample[4] == 0x41)
+					utils.Assert(sample[5] == byte(index))
+					videoSamples++
+				} else {
+					index := audioSamples
+					utils.Assert(baseTime == uint64(index-j)*40*441/10)
+					utils.Assert(duration == 40*441/10 && cts == 0 && size == 2 && flags == sampleFlagsSync)
+					utils.Assert(sample[1] == byte(index))
+					audioSamples++
+				}
+
+				sample = sample[size:]
+			}
+		}
+	}
+
+	utils.Assert(videoSamples == 20 && audioSamples == 20)
+}
@@ -0,0 +1,492 @@
+package mp4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"io"
+	"math"
+	"os"
+)
+
+// muxerSample 一帧的sample表信息, dts为写入MP4的时间, 等于之前所有帧的时长之和
+type muxerSample struct {
+	dts      int64
+	cts      int32
+	duration int64
+	size     uint32
+	key      bool
+}
+
+// muxerChunk mdat中同一个track连续存放的帧
+type muxerChunk struct {
+	offset      int64 // 在mdat数据中的位置
+	count       uint32
+	description uint32 // sample entry的索引, 从1开始
+}
+
+// muxerTrack 缓存一个track的sample表
+type muxerTrack struct {
+	*track
+	entries     [][]byte // 编码器参数变化后会有多个sample entry
+	samples     []muxerSample
+	chunks      []muxerChunk
+	frameLength int64 // AAC每帧的采样数, 其他编码器为0
+	preSkip     int64 // 解码后丢弃的采样数, Opus的pre-skip或AAC的priming
+}
+
+// updateAudioParameters 使用sequence header计算AAC的帧时长和priming, Opus的pre-skip
+func (t *muxerTrack) updateAudioParameters() {
+	t.frameLength, t.preSkip = 0, 0
+	switch t.stream.CodecID {
+	case utils.AVCodecIdAAC:
+		if asc, err := flv.ParseAudioSpecificConfig(t.stream.Data); err == nil && asc.SampleRate > 0 {
+			// SBR的输出采样率是核心采样率的两倍, 每帧的输出采样数也是两倍
+			t.frameLength = int64(asc.FrameLength) * int64(t.timescale) / int64(asc.SampleRate)
+			// flv中没有编码器的priming信息, 使用常见的一帧(1024个采样)
+			t.preSkip = t.frameLength
+		}
+	case utils.AVCodecIdOPUS:
+		if head, err := flv.ParseOpusHead(t.stream.Data); err == nil {
+			t.preSkip = int64(head.PreSkip)
+		}
+	}
+}
+
+// duration 所有帧的总时长, track时间刻度
+func (t *muxerTrack) duration() int64 {
+	if n := len(t.samples); n > 0 {
+		return t.samples[n-1].dts + t.samples[n-1].duration - t.samples[0].dts
+	}
+
+	return 0
+}
+
+// mediaTime 编辑列表中播放开始的media time. 视频跳过B帧造成的composition延迟, 音频跳过Opus的pre-skip和AAC的priming
+func (t *muxerTrack) mediaTime() int64 {
+	if utils.AVMediaTypeVideo != t.stream.MediaType {
+		if t.preSkip < t.duration() {
+			return t.preSkip
+		}
+
+		return 0
+	}
+
+	minCts := int64(math.MaxInt64)
+	for _, sample := range t.samples {
+		if pts := sample.dts - t.samples[0].dts + int64(sample.cts); pts < minCts {
+			minCts = pts
+		}
+	}
+
+	return minCts
+}
+
+// Muxer 将flv解析出的音视频帧封装为progressive MP4, moov位于mdat之前(faststart), 可以边下载边播放.
+// 帧数据先写入临时文件, Flush时根据sample表生成moov, 依次输出ftyp, moov和mdat. sample表使用flv的时间戳和composition
+// offset, 支持可变帧率. AAC按每帧固定采样数计算时长, 与时间戳的偏差超过半帧时才使用时间戳, 避免毫秒时间戳的舍入误差累积.
+// 非线程安全.
+type Muxer struct {
+	TempDir string // 临时文件目录, 为空时使用系统临时目录
+
+	writer io.Writer
+	tracks []*muxerTrack
+	file   *os.File
+	buffer *bufio.Writer
+	size   int64 // mdat数据大小
+	last   *muxerTrack
+	data   []byte
+}
+
+// AddTrack 添加track, 需要在写入第一帧前完成. MP4不能承载的编码器返回ErrUnsupportedCodec
+func (m *Muxer) AddTrack(stream *avformat.AVStream) error {
+	if m.file != nil {
+		return fmt.Errorf("tracks must be added before writing packets")
+	}
+
+	t, err := newTrack(stream, uint32(len(m.tracks)+1))
+	if err != nil {
+		return err
+	}
+
+	mt := &muxerTrack{track: t, entries: [][]byte{t.entry}}
+	mt.updateAudioParameters()
+	m.tracks = append(m.tracks, mt)
+	return nil
+}
+
+// UpdateTrack 流中途的sequence header变化, 之后的帧使用新的sample entry. 时间刻度保持不变
+func (m *Muxer) UpdateTrack(stream *avformat.AVStream) error {
+	t := m.findTrack(stream.Index)
+	if t == nil {
+		return fmt.Errorf("track %d not found", stream.Index)
+	}
+
+	timescale := t.timescale
+	if err := t.update(stream); err != nil {
+		return err
+	}
+
+	t.timescale = timescale
+	t.updateAudioParameters()
+	if !bytes.Equal(t.entry, t.entries[len(t.entries)-1]) {
+		t.entries = append(t.entries, t.entry)
+	}
+
+	return nil
+}
+
+func (m *Muxer) findTrack(index int) *muxerTrack {
+	for _, t := range m.tracks {
+		if t.stream.Index == index {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// WritePacket 写入一帧, 视频可以是AVCC或AnnexB格式. 数据会被写入临时文件, 返回后可以释放packet
+func (m *Muxer) WritePacket(packet *avformat.AVPacket) error {
+	t := m.findTrack(packet.Index)
+	if t == nil {
+		return fmt.Errorf("track %d not found", packet.Index)
+	}
+
+	if m.file == nil {
+		file, err := os.CreateTemp(m.TempDir, "mp4-*.mdat")
+		if err != nil {
+			return err
+		}
+
+		m.file = file
+		m.buffer = bufio.NewWriterSize(file, 1024*1024)
+	}
+
+	video := utils.AVMediaTypeVideo == t.stream.MediaType
+	// 第一个关键帧之前没有帧使用当前的sample entry, 直接替换
+	if video && packet.Key && t.updateFrameSize(packet.Data) {
+		t.entries[len(t.entries)-1] = t.entry
+	}
+
+	data := packet.Data
+	if video && avformat.PacketTypeAnnexB == packet.PacketType {
+		m.data = appendAVCC(m.data[:0], packet.Data, t.lengthSize)
+		data = m.data
+	}
+
+	if _, err := m.buffer.Write(data); err != nil {
+		return err
+	}
+
+	dts := convertTs(packet.Dts, packet.Timebase, t.timescale)
+	cts := int64(0)
+	if video {
+		cts = convertTs(packet.Pts, packet.Timebase, t.timescale) - dts
+	}
+
+	// 新的一帧确定了上一帧的时长
+	if n := len(t.samples); n > 0 {
+		prev := &t.samples[n-1]
+		// AAC与时间戳的偏差小于半帧时使用固定时长, 否则使用时间戳重新同步
+		prev.duration = dts - prev.dts
+		if t.frameLength > 0 && 2*prev.duration > t.frameLength && 2*prev.duration < 3*t.frameLength {
+			prev.duration = t.frameLength
+		} else if prev.duration < 0 {
+			prev.duration = 0
+		}
+
+		dts = prev.dts + prev.duration
+	}
+
+	description := uint32(len(t.entries))
+	if n := len(t.chunks); m.last != t || n == 0 || t.chunks[n-1].description != description {
+		t.chunks = append(t.chunks, muxerChunk{offset: m.size, description: description})
+	}
+
+	t.chunks[len(t.chunks)-1].count++
+	t.samples = append(t.samples, muxerSample{
+		dts:      dts,
+		cts:      int32(cts),
+		duration: convertTs(packet.Duration, packet.Timebase, t.timescale),
+		size:     uint32(len(data)),
+		key:      packet.Key || !video,
+	})
+
+	m.last = t
+	m.size += int64(len(data))
+	return nil
+}
+
+// appendMoov 写入moov, base为mdat数据在文件中的位置
+func (m *Muxer) appendMoov(dst []byte, base int64, co64 bool) []byte {
+	// 各track的播放开始时间, 毫秒. 最早的track从0时刻开始, 其他track使用空编辑延迟
+	starts := make([]int64, len(m.tracks))
+	start := int64(math.MaxInt64)
+	for i, t := range m.tracks {
+		if len(t.samples) == 0 {
+			continue
+		}
+
+		starts[i] = convertTs(t.samples[0].dts, t.timescale, MovieTimescale)
+		if utils.AVMediaTypeVideo == t.stream.MediaType {
+			starts[i] = convertTs(t.samples[0].dts+t.mediaTime(), t.timescale, MovieTimescale)
+		}
+
+		if starts[i] < start {
+			start = starts[i]
+		}
+	}
+
+	durations := make([]int64, len(m.tracks))
+	var duration int64
+	for i, t := range m.tracks {
+		if len(t.samples) > 0 {
+			durations[i] = starts[i] - start + convertTs(t.duration()-t.mediaTime(), t.timescale, MovieTimescale)
+		}
+
+		if durations[i] > duration {
+			duration = durations[i]
+		}
+	}
+
+	dst, moov := startBox(dst, "moov")
+	dst = appendMvhd(dst, duration, uint32(len(m.tracks)+1))
+	for i, t := range m.tracks {
+		var edts []byte
+		if len(t.samples) > 0 {
+			edts = t.appendEdts(starts[i]-start, durations[i]-(starts[i]-start))
+		}
+
+		dst = t.appendTrak(dst, durations[i], t.duration(), edts, func(dst []byte) []byte {
+			return t.appendSampleTables(dst, base, co64)
+		})
+	}
+
+	return endBox(dst, moov)
+}
+
+// appendEdts 写入编辑列表, delay和duration为mvhd时间刻度. 不需要延迟和跳过时返回nil
+func (t *muxerTrack) appendEdts(delay, duration int64) []byte {
+	mediaTime := t.mediaTime()
+	if delay <= 0 && mediaTime == 0 {
+		return nil
+	}
+
+	// segment_duration(32) media_time(32) media_rate_integer(16) media_rate_fraction(16), version 1的时间为64位
+	version := durationVersion(delay + duration)
+	elst, offset := startFullBox(nil, "elst", version, 0)
+	if delay > 0 {
+		elst = binary.BigEndian.AppendUint32(elst, 2)
+		elst = appendTime(elst, version, delay)
+		elst = appendTime(elst, version, -1)
+		elst = binary.BigEndian.AppendUint32(elst, 0x10000)
+	} else {
+		elst = binary.BigEndian.AppendUint32(elst, 1)
+	}
+
+	elst = appendTime(elst, version, duration)
+	elst = appendTime(elst, version, mediaTime)
+	elst = binary.BigEndian.AppendUint32(elst, 0x10000)
+	return appendBox(nil, "edts", endBox(elst, offset))
+}
+
+// appendSampleTables 写入stsd, stts, ctts, stss, stsc, stsz和stco/co64, 连续相同的值合并为一项
+func (t *muxerTrack) appendSampleTables(dst []byte, base int64, co64 bool) []byte {
+	dst = appendStsd(dst, t.entries...)
+	if len(t.samples) == 0 {
+		return appendEmptySampleTables(dst)
+	}
+
+	// sample_count(32) sample_delta(32)
+	var box, count int
+	dst, box = startFullBox(dst, "stts", 0, 0)
+	dst, count = append(dst, 0, 0, 0, 0), len(dst)
+	var entries uint32
+	for i := 0; i < len(t.samples); {
+		j := i + 1
+		for j < len(t.samples) && t.samples[j].duration == t.samples[i].duration {
+			j++
+		}
+
+		dst = binary.BigEndian.AppendUint32(dst, uint32(j-i))
+		dst = binary.BigEndian.AppendUint32(dst, uint32(t.samples[i].duration))
+		entries++
+		i = j
+	}
+
+	binary.BigEndian.PutUint32(dst[count:], entries)
+	dst = endBox(dst, box)
+
+	// sample_count(32) sample_offset(32), 有负数时使用version 1
+	var hasCts, negativeCts bool
+	for _, sample := range t.samples {
+		hasCts = hasCts || sample.cts != 0
+		negativeCts = negativeCts || sample.cts < 0
+	}
+
+	if hasCts {
+		var version byte
+		if negativeCts {
+			version = 1
+		}
+
+		dst, box = startFullBox(dst, "ctts", version, 0)
+		dst, count = append(dst, 0, 0, 0, 0), len(dst)
+		entries = 0
+		for i := 0; i < len(t.samples); {
+			j := i + 1
+			for j < len(t.samples) && t.samples[j].cts == t.samples[i].cts {
+				j++
+			}
+
+			dst = binary.BigEndian.AppendUint32(dst, uint32(j-i))
+			dst = binary.BigEndian.AppendUint32(dst, uint32(t.samples[i].cts))
+			entries++
+			i = j
+		}
+
+		binary.BigEndian.PutUint32(dst[count:], entries)
+		dst = endBox(dst, box)
+	}
+
+	// 音频所有帧都是同步帧, 不需要stss
+	if utils.AVMediaTypeVideo == t.stream.MediaType {
+		dst, box = startFullBox(dst, "stss", 0, 0)
+		dst, count = append(dst, 0, 0, 0, 0), len(dst)
+		entries = 0
+		for i, sample := range t.samples {
+			if sample.key {
+				dst = binary.BigEndian.AppendUint32(dst, uint32(i+1))
+				entries++
+			}
+		}
+
+		binary.BigEndian.PutUint32(dst[count:], entries)
+		dst = endBox(dst, box)
+	}
+
+	// first_chunk(32) samples_per_chunk(32) sample_description_index(32)
+	dst, box = startFullBox(dst, "stsc", 0, 0)
+	dst, count = append(dst, 0, 0, 0, 0), len(dst)
+	entries = 0
+	for i, chunk := range t.chunks {
+		if i > 0 && chunk.count == t.chunks[i-1].count && chunk.description == t.chunks[i-1].description {
+			continue
+		}
+
+		dst = binary.BigEndian.AppendUint32(dst, uint32(i+1))
+		dst = binary.BigEndian.AppendUint32(dst, chunk.count)
+		dst = binary.BigEndian.AppendUint32(dst, chunk.description)
+		entries++
+	}
+
+	binary.BigEndian.PutUint32(dst[count:], entries)
+	dst = endBox(dst, box)
+
+	// sample_size(32) sample_count(32) entry_size(32)...
+	dst, box = startFullBox(dst, "stsz", 0, 0)
+	dst = append(dst, 0, 0, 0, 0)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(t.samples)))
+	for _, sample := range t.samples {
+		dst = binary.BigEndian.AppendUint32(dst, sample.size)
+	}
+
+	dst = endBox(dst, box)
+
+	if co64 {
+		dst, box = startFullBox(dst, "co64", 0, 0)
+	} else {
+		dst, box = startFullBox(dst, "stco", 0, 0)
+	}
+
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(t.chunks)))
+	for _, chunk := range t.chunks {
+		if co64 {
+			dst = binary.BigEndian.AppendUint64(dst, uint64(base+chunk.offset))
+		} else {
+			dst = binary.BigEndian.AppendUint32(dst, uint32(base+chunk.offset))
+		}
+	}
+
+	return endBox(dst, box)
+}
+
+// Flush 输入结束, 输出ftyp, moov和mdat. 之后释放临时文件, Muxer不能再使用
+func (m *Muxer) Flush() error {
+	if m.file == nil {
+		return nil
+	}
+
+	defer m.Close()
+	if err := m.buffer.Flush(); err != nil {
+		return err
+	}
+
+	// 最后一帧没有时长时使用上一帧的时长
+	for _, t := range m.tracks {
+		if n := len(t.samples); n > 0 && t.samples[n-1].duration <= 0 {
+			if t.frameLength > 0 {
+				t.samples[n-1].duration = t.frameLength
+			} else if n > 1 {
+				t.samples[n-1].duration = t.samples[n-2].duration
+			}
+		}
+	}
+
+	// major_brand(32) minor_version(32) compatible_brands
+	header := appendBox(nil, "ftyp", []byte("isom\x00\x00\x02\x00isomiso2avc1mp41"))
+
+	// 超过4G时mdat使用64位大小
+	mdatHeaderSize := int64(8)
+	if m.size+8 > math.MaxUint32 {
+		mdatHeaderSize = 16
+	}
+
+	// chunk偏移量的宽度固定, moov的大小与偏移量的值无关
+	co64 := false
+	base := int64(len(header)) + int64(len(m.appendMoov(nil, 0, co64))) + mdatHeaderSize
+	if base+m.size > math.MaxUint32 {
+		co64 = true
+		base = int64(len(header)) + int64(len(m.appendMoov(nil, 0, co64))) + mdatHeaderSize
+	}
+
+	header = m.appendMoov(header, base, co64)
+	if mdatHeaderSize == 16 {
+		header = binary.BigEndian.AppendUint32(header, 1)
+		header = append(header, "mdat"...)
+		header = binary.BigEndian.AppendUint64(header, uint64(m.size+16))
+	} else {
+		header = binary.BigEndian.AppendUint32(header, uint32(m.size+8))
+		header = append(header, "mdat"...)
+	}
+
+	if _, err := m.writer.Write(header); err != nil {
+		return err
+	} else if _, err = m.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(m.writer, m.file)
+	return err
+}
+
+// Close 删除临时文件. 转换失败时调用, 不输出任何数据
+func (m *Muxer) Close() error {
+	if m.file == nil {
+		return nil
+	}
+
+	file := m.file
+	m.file = nil
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func NewMuxer(writer io.Writer) *Muxer {
+	return &Muxer{writer: writer}
+}
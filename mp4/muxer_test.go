@@ -0,0 +1,185 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"github.com/lkmio/flv/internal/flvtest"
+	"io"
+	"testing"
+)
+
+func TestRemux(t *testing.T) {
+	output := &bytes.Buffer{}
+	utils.Assert(Remux(output, bytes.NewReader(newTestFLV(20))) == nil)
+
+	// faststart, moov在mdat之前
+	boxes := readTestBoxes(output.Bytes())
+	utils.Assert(len(boxes) == 3 && boxes[0].boxType == "ftyp" && boxes[1].boxType == "moov" && boxes[2].boxType == "mdat")
+
+	// 视频的composition延迟使用编辑列表修正. AAC跳过1024个采样的priming, 音频提前约23毫秒, 读取时整体后移
+	reader, err := NewReader(bytes.NewReader(output.Bytes()))
+	utils.Assert(err == nil)
+	utils.Assert(reader.Duration().Milliseconds() == 800)
+	var counts [2]int
+	for i := 0; i < 40; i++ {
+		packet, err := reader.ReadPacket()
+		utils.Assert(err == nil)
+		n := counts[packet.Index]
+		counts[packet.Index]++
+		if packet.Index == 0 {
+			utils.Assert(packet.ConvertDts(1000) == int64(n*40+23) && packet.ConvertPts(1000) == int64(n*40+103))
+			utils.Assert(packet.Key == (n%10 == 0) && len(packet.Data) == 304 && packet.Data[5] == byte(n))
+		} else {
+			utils.Assert(packet.ConvertDts(1000) == int64(n*40) && bytes.Equal(packet.Data, []byte{0x21, byte(n)}))
+		}
+	}
+
+	_, err = reader.ReadPacket()
+	utils.Assert(err != nil)
+}
+
+// failingReader 读取完数据后返回错误
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestRemuxError(t *testing.T) {
+	// 读取失败和解析失败时不输出任何数据
+	output := &bytes.Buffer{}
+	utils.Assert(Remux(output, &failingReader{data: newTestFLV(20)}) == io.ErrUnexpectedEOF)
+	utils.Assert(output.Len() == 0)
+
+	data := newTestFLV(20)
+	data[0] = 'X'
+	remuxer := NewRemuxer(NewMuxer(output))
+	_, err := remuxer.Write(data)
+	utils.Assert(err != nil && remuxer.Close() == err && output.Len() == 0)
+}
+
+func TestRemuxUnsupportedTrack(t *testing.T) {
+	// H.264和G.711, 跳过G.711继续转换视频
+	newFLV := func(video bool) []byte {
+		output := &bytes.Buffer{}
+		writer := flv.NewWriter(output)
+		if video {
+			_, err := writer.AddTrack(flvtest.NewVideoStream())
+			utils.Assert(err == nil)
+		}
+
+		alaw := avformat.NewAVStream(utils.AVMediaTypeAudio, 1, utils.AVCodecIdPCMALAW, nil, nil)
+		alaw.SampleRate, alaw.SampleSize, alaw.Channels = 8000, 16, 1
+		_, err := writer.AddTrack(alaw)
+		utils.Assert(err == nil)
+		utils.Assert(writer.WriteHeader() == nil)
+		for i := 0; i < 10; i++ {
+			if video {
+				frame := []byte{0, 0, 0, 2, 0x41, byte(i)}
+				if i%5 == 0 {
+					frame[4] = 0x65
+				}
+
+				utils.Assert(writer.WritePacket(avformat.NewVideoPacket(frame, int64(i*40), int64(i*40), i%5 == 0, avformat.PacketTypeAVCC, utils.AVCodecIdH264, 0, 1000)) == nil)
+			}
+
+			utils.Assert(writer.WritePacket(avformat.NewAudioPacket([]byte{0xD5, byte(i)}, int64(i*40), utils.AVCodecIdPCMALAW, 1, 1000)) == nil)
+		}
+
+		utils.Assert(writer.Flush() == nil)
+		return output.Bytes()
+	}
+
+	output := &bytes.Buffer{}
+	remuxer := NewRemuxer(NewMuxer(output))
+	_, err := remuxer.Write(newFLV(true))
+	utils.Assert(err == nil)
+	utils.Assert(remuxer.Close() == nil)
+	utils.Assert(len(remuxer.Skipped()) == 1 && remuxer.Skipped()[0] == 1)
+
+	reader, err := NewReader(bytes.NewReader(output.Bytes()))
+	utils.Assert(err == nil)
+	var packets int
+	for packet, err := reader.ReadPacket(); err == nil; packet, err = reader.ReadPacket() {
+		utils.Assert(packet.Index == 0 && packet.Data[5] == byte(packets))
+		packets++
+	}
+
+	utils.Assert(packets == 10)
+
+	// fMP4只有视频track
+	output = &bytes.Buffer{}
+	remuxer = NewRemuxer(NewFragmentedMuxer(output))
+	_, err = remuxer.Write(newFLV(true))
+	utils.Assert(err == nil)
+	utils.Assert(remuxer.Close() == nil)
+	utils.Assert(len(remuxer.Skipped()) == 1)
+	boxes := readTestBoxes(output.Bytes())
+	traks := readTestBoxes(boxes[1].data)
+	utils.Assert(len(boxes) == 6 && len(traks) == 3 && traks[1].boxType == "trak" && traks[2].boxType == "mvex")
+
+	// 没有可以转换的track
+	output = &bytes.Buffer{}
+	utils.Assert(Remux(output, bytes.NewReader(newFLV(false))) != nil && output.Len() == 0)
+	utils.Assert(RemuxFragmented(output, bytes.NewReader(newFLV(false))) != nil && output.Len() == 0)
+}
+
+func TestMuxerTimestamps(t *testing.T) {
+	output := &bytes.Buffer{}
+	muxer := NewMuxer(output)
+	muxer.TempDir = t.TempDir()
+	utils.Assert(muxer.AddTrack(flvtest.NewVideoStream()) == nil)
+	utils.Assert(muxer.AddTrack(flvtest.NewAudioStream()) == nil)
+
+	// 可变帧率的AnnexB视频, 毫秒时间戳抖动的AAC
+	videoTs := []int64{0, 40, 80, 113, 146, 179, 229}
+	for i, ts := range videoTs {
+		frame := []byte{0, 0, 0, 1, 0x41, byte(i)}
+		if i == 0 {
+			frame[4] = 0x65
+		}
+
+		utils.Assert(muxer.WritePacket(avformat.NewVideoPacket(frame, ts, ts, i == 0, avformat.PacketTypeAnnexB, utils.AVCodecIdH264, 0, 1000)) == nil)
+	}
+
+	for i := 0; i < 10; i++ {
+		ts := int64(i) * 1024 * 1000 / 44100
+		utils.Assert(muxer.WritePacket(avformat.NewAudioPacket([]byte{0x21, byte(i)}, ts, utils.AVCodecIdAAC, 1, 1000)) == nil)
+	}
+
+	utils.Assert(muxer.Flush() == nil)
+	moov := readTestBoxes(output.Bytes())[1].data
+	traks := readTestBoxes(moov)
+	utils.Assert(len(traks) == 3 && findTestBox(traks[1].data, "edts") == nil)
+
+	// sample_count(32) sample_delta(32)
+	stts := findTestBox(traks[1].data, "mdia", "minf", "stbl", "stts")
+	expected := []uint32{3, 2, 40 * 90, 3, 33 * 90, 2, 50 * 90}
+	utils.Assert(int(binary.BigEndian.Uint32(stts[4:])) == len(expected)/2)
+	for i, value := range expected[1:] {
+		utils.Assert(binary.BigEndian.Uint32(stts[8+i*4:]) == value)
+	}
+
+	// AnnexB转换为AVCC
+	stsz := findTestBox(traks[1].data, "mdia", "minf", "stbl", "stsz")
+	utils.Assert(binary.BigEndian.Uint32(stsz[12:]) == 6)
+
+	// 所有音频帧的时长都是1024个采样
+	stts = findTestBox(traks[2].data, "mdia", "minf", "stbl", "stts")
+	utils.Assert(binary.BigEndian.Uint32(stts[4:]) == 1 && binary.BigEndian.Uint32(stts[8:]) == 10 && binary.BigEndian.Uint32(stts[12:]) == 1024)
+
+	// 编辑列表跳过AAC的priming: entry_count(32) segment_duration(32) media_time(32)
+	elst := findTestBox(traks[2].data, "edts", "elst")
+	utils.Assert(elst != nil && binary.BigEndian.Uint32(elst[4:]) == 1 && binary.BigEndian.Uint32(elst[12:]) == 1024)
+}
@@ -0,0 +1,702 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"io"
+	"time"
+)
+
+// sample sample表中的一帧, 时间使用track时间刻度
+type sample struct {
+	offset int64
+	size   int
+	dts    int64
+	cts    int64 // composition offset
+	key    bool
+}
+
+// readerTrack 从moov解析出的track
+type readerTrack struct {
+	stream    *avformat.AVStream
+	timescale int
+	offset    int64 // 编辑列表和负时间戳修正, 加到dts和pts上
+	width     int
+	height    int
+	samples   []sample
+}
+
+// Reader 读取progressive MP4(moov中包含完整的sample表), 按dts交错输出音视频帧.
+// 支持H.264, H.265, AV1, VP9, AAC, MP3和Opus, 其他track被忽略, 通过Skipped获取. 非线程安全.
+type Reader struct {
+	reader    io.ReadSeeker
+	tracks    []*readerTrack
+	timescale int     // mvhd时间刻度
+	duration  int64   // mvhd时长
+	cursors   []int   // 每个track下一帧的位置
+	skipped   []error // 不支持的track
+}
+
+// readBoxes 遍历data中的box
+func readBoxes(data []byte, cb func(boxType string, payload []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return fmt.Errorf("invalid box header")
+		}
+
+		size := uint64(binary.BigEndian.Uint32(data))
+		boxType := string(data[4:8])
+		header := uint64(8)
+		if size == 1 {
+			if len(data) < 16 {
+				return fmt.Errorf("invalid box header")
+			}
+
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		} else if size == 0 {
+			size = uint64(len(data))
+		}
+
+		if size < header || size > uint64(len(data)) {
+			return fmt.Errorf("invalid %s box size %d", boxType, size)
+		} else if err := cb(boxType, data[header:size]); err != nil {
+			return err
+		}
+
+		data = data[size:]
+	}
+
+	return nil
+}
+
+// findBox 按路径查找box, 返回box内容
+func findBox(data []byte, path ...string) []byte {
+	for _, boxType := range path {
+		var found []byte
+		_ = readBoxes(data, func(t string, payload []byte) error {
+			if found == nil && t == boxType {
+				found = payload
+			}
+
+			return nil
+		})
+
+		if found == nil {
+			return nil
+		}
+
+		data = found
+	}
+
+	return data
+}
+
+// readMoov 查找顶层的moov, mdat等其他box被跳过
+func readMoov(reader io.ReadSeeker) ([]byte, error) {
+	var header [16]byte
+	for {
+		if _, err := io.ReadFull(reader, header[:8]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("moov not found")
+		} else if err != nil {
+			return nil, err
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[:]))
+		headerSize := int64(8)
+		if size == 1 {
+			if _, err := io.ReadFull(reader, header[8:]); err != nil {
+				return nil, err
+			}
+
+			size, headerSize = int64(binary.BigEndian.Uint64(header[8:])), 16
+		} else if size == 0 {
+			if string(header[4:8]) != "moov" {
+				return nil, fmt.Errorf("moov not found")
+			}
+
+			return io.ReadAll(reader)
+		}
+
+		if size < headerSize {
+			return nil, fmt.Errorf("invalid %s box size %d", header[4:8], size)
+		} else if string(header[4:8]) == "moov" {
+			moov := make([]byte, size-headerSize)
+			_, err := io.ReadFull(reader, moov)
+			return moov, err
+		} else if _, err := reader.Seek(size-headerSize, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseMvhd 返回时间刻度和时长
+func parseMvhd(data []byte) (int, int64, error) {
+	if len(data) >= 32 && data[0] == 1 {
+		return int(binary.BigEndian.Uint32(data[20:])), int64(binary.BigEndian.Uint64(data[24:])), nil
+	} else if len(data) >= 20 && data[0] == 0 {
+		return int(binary.BigEndian.Uint32(data[12:])), int64(binary.BigEndian.Uint32(data[16:])), nil
+	}
+
+	return 0, 0, fmt.Errorf("invalid mvhd")
+}
+
+// parseTrak 解析track, 不支持的track返回nil
+func (r *Reader) parseTrak(trak []byte) (*readerTrack, error) {
+	mdia := findBox(trak, "mdia")
+	hdlr := findBox(mdia, "hdlr")
+	if len(hdlr) < 12 {
+		return nil, fmt.Errorf("invalid hdlr")
+	}
+
+	var mediaType utils.AVMediaType
+	switch string(hdlr[8:12]) {
+	case "vide":
+		mediaType = utils.AVMediaTypeVideo
+	case "soun":
+		mediaType = utils.AVMediaTypeAudio
+	default:
+		return nil, nil
+	}
+
+	// mdhd与mvhd的时间刻度位置相同
+	timescale, _, err := parseMvhd(findBox(mdia, "mdhd"))
+	if err != nil {
+		return nil, err
+	} else if timescale <= 0 {
+		return nil, fmt.Errorf("invalid timescale %d", timescale)
+	}
+
+	stbl := findBox(mdia, "minf", "stbl")
+	stsd := findBox(stbl, "stsd")
+	if len(stsd) < 8 {
+		return nil, fmt.Errorf("invalid stsd")
+	}
+
+	// 只使用第一个sample entry
+	t := &readerTrack{timescale: timescale}
+	err = readBoxes(stsd[8:], func(format string, entry []byte) error {
+		if t.stream != nil {
+			return nil
+		} else if utils.AVMediaTypeVideo == mediaType {
+			return t.parseVideoEntry(format, entry)
+		}
+
+		return t.parseAudioEntry(format, entry)
+	})
+
+	if errors.Is(err, ErrUnsupportedCodec) {
+		r.skipped = append(r.skipped, err)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if t.stream == nil {
+		return nil, nil
+	}
+
+	t.stream.Timebase = timescale
+	if err = t.parseSampleTables(stbl); err != nil {
+		return nil, err
+	}
+
+	t.parseEditList(findBox(trak, "edts", "elst"), r.timescale)
+	return t, nil
+}
+
+func (t *readerTrack) parseVideoEntry(format string, entry []byte) error {
+	var id utils.AVCodecID
+	var configType string
+	switch format {
+	case "avc1", "avc3":
+		id, configType = utils.AVCodecIdH264, "avcC"
+	case "hvc1", "hev1":
+		id, configType = utils.AVCodecIdH265, "hvcC"
+	case "av01":
+		id, configType = utils.AVCodecIdAV1, "av1C"
+	case "vp09":
+		id, configType = utils.AVCodecIdVP9, "vpcC"
+	default:
+		return fmt.Errorf("%w: video sample entry %s", ErrUnsupportedCodec, format)
+	}
+
+	if len(entry) < 78 {
+		return fmt.Errorf("invalid %s sample entry", format)
+	}
+
+	t.width = int(binary.BigEndian.Uint16(entry[24:]))
+	t.height = int(binary.BigEndian.Uint16(entry[26:]))
+	// vpcC为full box, flv中的record同样包含version和flags
+	record := findBox(entry[78:], configType)
+	if record == nil {
+		return fmt.Errorf("%s not found", configType)
+	}
+
+	record = append([]byte(nil), record...)
+	var codecData avformat.CodecData
+	var err error
+	switch id {
+	case utils.AVCodecIdH264:
+		codecData, err = avformat.ParseAVCDecoderConfigurationRecord(record)
+	case utils.AVCodecIdH265:
+		codecData, err = avformat.ParseHEVCDecoderConfigurationRecord(record)
+	default:
+		var info *flv.VideoInfo
+		if info, err = flv.ParseVideoInfo(id, record); err == nil {
+			if info.Width == 0 {
+				info.Width, info.Height = t.width, t.height
+			}
+
+			codecData = &flv.VideoCodecData{Info: info, Record: record}
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	t.stream = avformat.NewAVStream(utils.AVMediaTypeVideo, 0, id, record, codecData)
+	return nil
+}
+
+func (t *readerTrack) parseAudioEntry(format string, entry []byte) error {
+	if len(entry) < 28 {
+		return fmt.Errorf("invalid %s sample entry", format)
+	}
+
+	// QuickTime的version 1/2 sound sample description有额外字段
+	config := entry[28:]
+	switch binary.BigEndian.Uint16(entry[8:]) {
+	case 1:
+		config = skip(entry, 44)
+	case 2:
+		config = skip(entry, 64)
+	}
+
+	audioConfig := avformat.AudioConfig{
+		Channels:   int(binary.BigEndian.Uint16(entry[16:])),
+		SampleSize: int(binary.BigEndian.Uint16(entry[18:])),
+		SampleRate: int(binary.BigEndian.Uint32(entry[24:]) >> 16),
+	}
+
+	if audioConfig.SampleRate == 0 {
+		audioConfig.SampleRate = t.timescale
+	}
+
+	var id utils.AVCodecID
+	var data []byte
+	switch format {
+	case "mp4a":
+		objectType, specificInfo, err := parseESDS(findBox(config, "esds"))
+		if err != nil {
+			return err
+		}
+
+		switch objectType {
+		case ObjectTypeAAC, 0x66, 0x67, 0x68:
+			asc, err := flv.ParseAudioSpecificConfig(specificInfo)
+			if err != nil {
+				return err
+			}
+
+			id, data = utils.AVCodecIdAAC, append([]byte(nil), specificInfo...)
+			audioConfig.SampleRate, audioConfig.Channels = asc.OutputSampleRate(), asc.OutputChannels()
+		case ObjectTypeMP3, 0x69:
+			id = utils.AVCodecIdMP3
+		default:
+			return fmt.Errorf("%w: mp4a object type 0x%x", ErrUnsupportedCodec, objectType)
+		}
+	case ".mp3":
+		id = utils.AVCodecIdMP3
+	case "Opus":
+		dOps := findBox(config, "dOps")
+		if len(dOps) < 11 {
+			return fmt.Errorf("invalid dOps")
+		}
+
+		id, data = utils.AVCodecIdOPUS, opusHead(dOps)
+		audioConfig.SampleRate, audioConfig.Channels = flv.OpusSampleRate, int(dOps[1])
+	default:
+		return fmt.Errorf("%w: audio sample entry %s", ErrUnsupportedCodec, format)
+	}
+
+	if audioConfig.SampleSize == 0 {
+		audioConfig.SampleSize = 16
+	}
+
+	t.stream = avformat.NewAVStream(utils.AVMediaTypeAudio, 0, id, data, nil)
+	t.stream.AudioConfig = audioConfig
+	return nil
+}
+
+// readDescriptor 读取MPEG-4描述符, 返回tag, 内容和剩余数据
+func readDescriptor(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, nil, fmt.Errorf("invalid descriptor")
+	}
+
+	tag := data[0]
+	var size int
+	i := 1
+	for ; i < len(data) && i <= 4; i++ {
+		size = size<<7 | int(data[i]&0x7F)
+		if data[i]&0x80 == 0 {
+			i++
+			break
+		}
+	}
+
+	if i+size > len(data) {
+		return 0, nil, nil, fmt.Errorf("invalid descriptor size %d", size)
+	}
+
+	return tag, data[i : i+size], data[i+size:], nil
+}
+
+// skip 跳过n个字节, 不足时返回空
+func skip(data []byte, n int) []byte {
+	if n > len(data) {
+		return nil
+	}
+
+	return data[n:]
+}
+
+// parseESDS 返回objectTypeIndication和DecoderSpecificInfo
+func parseESDS(esds []byte) (byte, []byte, error) {
+	if len(esds) < 4 {
+		return 0, nil, fmt.Errorf("esds not found")
+	}
+
+	tag, es, _, err := readDescriptor(esds[4:])
+	if err != nil {
+		return 0, nil, err
+	} else if tag != 0x03 || len(es) < 3 {
+		return 0, nil, fmt.Errorf("invalid es descriptor")
+	}
+
+	// ES_ID(16) streamDependenceFlag(1) URL_Flag(1) OCRstreamFlag(1) streamPriority(5)
+	flags := es[2]
+	es = es[3:]
+	if flags&0x80 != 0 {
+		es = skip(es, 2)
+	}
+
+	if flags&0x40 != 0 && len(es) > 0 {
+		es = skip(es, 1+int(es[0]))
+	}
+
+	if flags&0x20 != 0 {
+		es = skip(es, 2)
+	}
+
+	for len(es) > 0 {
+		tag, payload, rest, err := readDescriptor(es)
+		if err != nil {
+			return 0, nil, err
+		} else if tag != 0x04 {
+			es = rest
+			continue
+		} else if len(payload) < 13 {
+			return 0, nil, fmt.Errorf("invalid decoder config descriptor")
+		}
+
+		var specificInfo []byte
+		if len(payload) > 13 {
+			if tag, info, _, err := readDescriptor(payload[13:]); err == nil && tag == 0x05 {
+				specificInfo = info
+			}
+		}
+
+		return payload[0], specificInfo, nil
+	}
+
+	return 0, nil, fmt.Errorf("decoder config descriptor not found")
+}
+
+// opusHead 将OpusSpecificBox转换为OpusHead, 与flv中Opus的sequence header一致
+func opusHead(dOps []byte) []byte {
+	head := append([]byte("OpusHead"), 1, dOps[1])
+	head = binary.LittleEndian.AppendUint16(head, binary.BigEndian.Uint16(dOps[2:]))
+	head = binary.LittleEndian.AppendUint32(head, binary.BigEndian.Uint32(dOps[4:]))
+	head = binary.LittleEndian.AppendUint16(head, binary.BigEndian.Uint16(dOps[8:]))
+	return append(head, dOps[10:]...)
+}
+
+// parseSampleTables 展开stts, ctts, stss, stsc, stsz和stco/co64
+func (t *readerTrack) parseSampleTables(stbl []byte) error {
+	stsz := findBox(stbl, "stsz")
+	if len(stsz) < 12 {
+		return fmt.Errorf("invalid stsz")
+	}
+
+	sampleSize := int(binary.BigEndian.Uint32(stsz[4:]))
+	count := int(binary.BigEndian.Uint32(stsz[8:]))
+	if sampleSize == 0 && len(stsz) < 12+4*count {
+		return fmt.Errorf("invalid stsz")
+	}
+
+	t.samples = make([]sample, count)
+	for i := range t.samples {
+		t.samples[i].size = sampleSize
+		if sampleSize == 0 {
+			t.samples[i].size = int(binary.BigEndian.Uint32(stsz[12+4*i:]))
+		}
+	}
+
+	// dts
+	stts := findBox(stbl, "stts")
+	var dts int64
+	var index int
+	for _, entry := range tableEntries(stts, 8) {
+		n, delta := int(binary.BigEndian.Uint32(entry)), int64(binary.BigEndian.Uint32(entry[4:]))
+		for ; n > 0 && index < count; n-- {
+			t.samples[index].dts = dts
+			dts += delta
+			index++
+		}
+	}
+
+	if index < count {
+		return fmt.Errorf("stts has %d samples, expected %d", index, count)
+	}
+
+	// composition offset, version 0按有符号处理, 兼容写入负值的文件
+	index = 0
+	for _, entry := range tableEntries(findBox(stbl, "ctts"), 8) {
+		n, offset := int(binary.BigEndian.Uint32(entry)), int64(int32(binary.BigEndian.Uint32(entry[4:])))
+		for ; n > 0 && index < count; n-- {
+			t.samples[index].cts = offset
+			index++
+		}
+	}
+
+	// 没有stss时所有帧都是关键帧
+	if stss := findBox(stbl, "stss"); stss == nil {
+		for i := range t.samples {
+			t.samples[i].key = true
+		}
+	} else {
+		for _, entry := range tableEntries(stss, 4) {
+			if n := int(binary.BigEndian.Uint32(entry)); n > 0 && n <= count {
+				t.samples[n-1].key = true
+			}
+		}
+	}
+
+	// chunk偏移
+	var chunks []int64
+	if stco := findBox(stbl, "stco"); stco != nil {
+		for _, entry := range tableEntries(stco, 4) {
+			chunks = append(chunks, int64(binary.BigEndian.Uint32(entry)))
+		}
+	} else {
+		for _, entry := range tableEntries(findBox(stbl, "co64"), 8) {
+			chunks = append(chunks, int64(binary.BigEndian.Uint64(entry)))
+		}
+	}
+
+	// first_chunk(32) samples_per_chunk(32) sample_description_index(32)
+	stsc := tableEntries(findBox(stbl, "stsc"), 12)
+	index = 0
+	for i, entry := range stsc {
+		first := int(binary.BigEndian.Uint32(entry))
+		perChunk := int(binary.BigEndian.Uint32(entry[4:]))
+		last := len(chunks) + 1
+		if i+1 < len(stsc) {
+			last = int(binary.BigEndian.Uint32(stsc[i+1]))
+		}
+
+		for chunk := first; chunk < last && chunk > 0 && chunk <= len(chunks); chunk++ {
+			offset := chunks[chunk-1]
+			for n := 0; n < perChunk && index < count; n++ {
+				t.samples[index].offset = offset
+				offset += int64(t.samples[index].size)
+				index++
+			}
+		}
+	}
+
+	if index < count {
+		return fmt.Errorf("stsc/stco has %d samples, expected %d", index, count)
+	}
+
+	return nil
+}
+
+// tableEntries 返回full box中固定大小的表项
+func tableEntries(box []byte, size int) [][]byte {
+	if len(box) < 8 {
+		return nil
+	}
+
+	count := int(binary.BigEndian.Uint32(box[4:]))
+	data := box[8:]
+	if count > len(data)/size {
+		count = len(data) / size
+	}
+
+	entries := make([][]byte, count)
+	for i := range entries {
+		entries[i] = data[i*size : (i+1)*size]
+	}
+
+	return entries
+}
+
+// parseEditList 使用编辑列表修正时间戳, 支持开头的空编辑(延迟)和第一个编辑的media_time(例如B帧延迟和AAC priming)
+func (t *readerTrack) parseEditList(elst []byte, movieTimescale int) {
+	if len(elst) < 8 || movieTimescale <= 0 {
+		return
+	}
+
+	version := elst[0]
+	size := 12
+	if version == 1 {
+		size = 20
+	}
+
+	var delay int64
+	for _, entry := range tableEntries(elst, size) {
+		var duration, mediaTime int64
+		if version == 1 {
+			duration, mediaTime = int64(binary.BigEndian.Uint64(entry)), int64(binary.BigEndian.Uint64(entry[8:]))
+		} else {
+			duration, mediaTime = int64(binary.BigEndian.Uint32(entry)), int64(int32(binary.BigEndian.Uint32(entry[4:])))
+		}
+
+		if mediaTime == -1 {
+			delay += convertTs(duration, movieTimescale, t.timescale)
+			continue
+		}
+
+		t.offset = delay - mediaTime
+		return
+	}
+}
+
+// Streams 返回所有支持的track, Index为track的序号
+func (r *Reader) Streams() []*avformat.AVStream {
+	streams := make([]*avformat.AVStream, len(r.tracks))
+	for i, t := range r.tracks {
+		streams[i] = t.stream
+	}
+
+	return streams
+}
+
+// Duration 返回mvhd中的时长
+func (r *Reader) Duration() time.Duration {
+	if r.timescale <= 0 {
+		return 0
+	}
+
+	return time.Duration(r.duration) * time.Second / time.Duration(r.timescale)
+}
+
+// next 返回dts最小的下一帧, 所有帧都已经读取时返回-1
+func (r *Reader) next(cursors []int) (int, *sample) {
+	selected := -1
+	var selectedSample *sample
+	for i, t := range r.tracks {
+		if cursors[i] >= len(t.samples) {
+			continue
+		}
+
+		s := &t.samples[cursors[i]]
+		if selected < 0 {
+			selected, selectedSample = i, s
+			continue
+		}
+
+		other := r.tracks[selected]
+		if (s.dts+t.offset)*int64(other.timescale) < (selectedSample.dts+other.offset)*int64(t.timescale) {
+			selected, selectedSample = i, s
+		}
+	}
+
+	if selected >= 0 {
+		cursors[selected]++
+	}
+
+	return selected, selectedSample
+}
+
+// ReadPacket 按dts顺序读取下一帧, 结束时返回io.EOF. 时间戳使用track的时间刻度, 视频为AVCC格式
+func (r *Reader) ReadPacket() (*avformat.AVPacket, error) {
+	index, s := r.next(r.cursors)
+	if index < 0 {
+		return nil, io.EOF
+	}
+
+	data := make([]byte, s.size)
+	if _, err := r.reader.Seek(s.offset, io.SeekStart); err != nil {
+		return nil, err
+	} else if _, err = io.ReadFull(r.reader, data); err != nil {
+		return nil, err
+	}
+
+	t := r.tracks[index]
+	dts := s.dts + t.offset
+	if utils.AVMediaTypeVideo == t.stream.MediaType {
+		return avformat.NewVideoPacket(data, dts, dts+s.cts, s.key, avformat.PacketTypeAVCC, t.stream.CodecID, index, t.timescale), nil
+	}
+
+	return avformat.NewAudioPacket(data, dts, t.stream.CodecID, index, t.timescale), nil
+}
+
+// Skipped 返回因编码器不支持被忽略的track, 每个track一个包装了ErrUnsupportedCodec的错误
+func (r *Reader) Skipped() []error {
+	return r.skipped
+}
+
+func NewReader(reader io.ReadSeeker) (*Reader, error) {
+	moov, err := readMoov(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{reader: reader}
+	if r.timescale, r.duration, err = parseMvhd(findBox(moov, "mvhd")); err != nil {
+		return nil, err
+	}
+
+	err = readBoxes(moov, func(boxType string, payload []byte) error {
+		if boxType != "trak" {
+			return nil
+		}
+
+		t, err := r.parseTrak(payload)
+		if err == nil && t != nil {
+			t.stream.Index = len(r.tracks)
+			r.tracks = append(r.tracks, t)
+		}
+
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	} else if len(r.tracks) == 0 {
+		return nil, fmt.Errorf("no supported track found")
+	}
+
+	// 编辑列表修正后的负时间戳整体后移
+	var earliest time.Duration
+	for _, t := range r.tracks {
+		if len(t.samples) > 0 {
+			if start := time.Duration(t.samples[0].dts+t.offset) * time.Second / time.Duration(t.timescale); start < earliest {
+				earliest = start
+			}
+		}
+	}
+
+	for _, t := range r.tracks {
+		t.offset += int64((-earliest*time.Duration(t.timescale) + time.Second - 1) / time.Second)
+	}
+
+	r.cursors = make([]int, len(r.tracks))
+	return r, nil
+}
@@ -0,0 +1,158 @@
+package mp4
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/flv"
+	"io"
+	"sort"
+)
+
+// PacketMuxer 接收Remuxer解析出的track和帧
+type PacketMuxer interface {
+	// AddTrack 不能承载的编码器返回ErrUnsupportedCodec, Remuxer跳过该track
+	AddTrack(stream *avformat.AVStream) error
+
+	UpdateTrack(stream *avformat.AVStream) error
+
+	WritePacket(packet *avformat.AVPacket) error
+
+	Flush() error
+}
+
+// Remuxer 将flv流转换为MP4. 通过Write输入flv流的任意分片, 输入结束后调用Close输出缓存的帧.
+// 跳过Speex, PCM和G.711等MP4不能承载的track, 没有可以转换的track时Close返回错误.
+type Remuxer struct {
+	demuxer *flv.Demuxer
+	muxer   PacketMuxer
+	tracks  int
+	skipped map[int]bool // 不支持的track
+	err     error
+}
+
+// Skipped 返回跳过的track索引
+func (r *Remuxer) Skipped() []int {
+	var skipped []int
+	for index := range r.skipped {
+		skipped = append(skipped, index)
+	}
+
+	sort.Ints(skipped)
+	return skipped
+}
+
+func (r *Remuxer) OnNewTrack(track avformat.Track) {
+	if r.err != nil {
+		return
+	}
+
+	stream := track.GetStream()
+	if err := r.muxer.AddTrack(stream); errors.Is(err, ErrUnsupportedCodec) {
+		r.skipped[stream.Index] = true
+	} else if err != nil {
+		r.err = err
+	} else {
+		r.tracks++
+	}
+}
+
+func (r *Remuxer) OnTrackComplete() {
+}
+
+func (r *Remuxer) OnTrackNotFind() {
+}
+
+func (r *Remuxer) OnPacket(packet *avformat.AVPacket) {
+	if r.err == nil && !r.skipped[packet.Index] {
+		r.err = r.muxer.WritePacket(packet)
+	}
+}
+
+// OnCodecParametersChanged 流中途的sequence header变化, 更新sample entry
+func (r *Remuxer) OnCodecParametersChanged(track avformat.Track, ts uint32) {
+	if r.err == nil && !r.skipped[track.GetStream().Index] {
+		r.err = r.muxer.UpdateTrack(track.GetStream())
+	}
+}
+
+func (r *Remuxer) OnSequenceEnd(track avformat.Track, ts uint32) {
+}
+
+// Write 输入flv流
+func (r *Remuxer) Write(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	if _, err := r.demuxer.Input(p); err != nil {
+		r.err = err
+		return 0, err
+	} else if r.err != nil {
+		return 0, r.err
+	}
+
+	return len(p), nil
+}
+
+// Close 输入结束, 输出demuxer和muxer缓存的帧. 出错时不输出, 如果muxer实现了io.Closer, 调用Close释放资源
+func (r *Remuxer) Close() error {
+	if r.err == nil {
+		r.demuxer.Flush()
+	}
+
+	if r.err == nil && r.tracks == 0 {
+		r.err = fmt.Errorf("no track can be remuxed")
+	}
+
+	if r.err == nil {
+		r.err = r.muxer.Flush()
+	} else if closer, ok := r.muxer.(io.Closer); ok {
+		closer.Close()
+	}
+
+	r.demuxer.Close()
+	return r.err
+}
+
+// abort 读取输入失败, 不输出缓存的帧, 释放资源
+func (r *Remuxer) abort(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+
+	r.Close()
+}
+
+func NewRemuxer(muxer PacketMuxer) *Remuxer {
+	remuxer := &Remuxer{
+		demuxer: flv.NewDemuxer(true),
+		muxer:   muxer,
+		skipped: make(map[int]bool),
+	}
+
+	remuxer.demuxer.SetHandler(remuxer)
+	return remuxer
+}
+
+// RemuxFragmented 将src中的flv流转换为fMP4写入dst, 每个GOP一个分片
+func RemuxFragmented(dst io.Writer, src io.Reader) error {
+	remuxer := NewRemuxer(NewFragmentedMuxer(dst))
+	if _, err := io.Copy(remuxer, src); err != nil {
+		remuxer.abort(err)
+		return err
+	}
+
+	return remuxer.Close()
+}
+
+// Remux 将src中的flv流转换为moov在前的MP4写入dst
+func Remux(dst io.Writer, src io.Reader) error {
+	remuxer := NewRemuxer(NewMuxer(dst))
+	if _, err := io.Copy(remuxer, src); err != nil {
+		remuxer.abort(err)
+		return err
+	}
+
+	return remuxer.Close()
+}
@@ -0,0 +1,376 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"math"
+)
+
+const (
+	// MovieTimescale mvhd和tkhd使用的时间刻度
+	MovieTimescale = 1000
+	// VideoTimescale 视频track的时间刻度
+	VideoTimescale = 90000
+
+	// ObjectTypeAAC ObjectTypeMP3 esds中的objectTypeIndication
+	ObjectTypeAAC = 0x40
+	ObjectTypeMP3 = 0x6B
+)
+
+// ErrUnsupportedCodec MP4不能承载的编码器
+var ErrUnsupportedCodec = errors.New("unsupported codec")
+
+// track 一个音视频track的sample entry和时间刻度
+type track struct {
+	stream     *avformat.AVStream
+	id         uint32 // track_ID, 从1开始
+	timescale  int
+	lengthSize int // AVCC的长度前缀字节数
+	width      int
+	height     int
+	entry      []byte // stsd中的sample entry
+}
+
+func newTrack(stream *avformat.AVStream, id uint32) (*track, error) {
+	t := &track{id: id}
+	return t, t.update(stream)
+}
+
+// update 使用sequence header生成sample entry
+func (t *track) update(stream *avformat.AVStream) error {
+	t.stream = stream
+	t.lengthSize = 4
+	if utils.AVMediaTypeVideo == stream.MediaType {
+		return t.updateVideo()
+	}
+
+	return t.updateAudio()
+}
+
+func (t *track) updateVideo() error {
+	stream := t.stream
+	if len(stream.Data) == 0 {
+		return fmt.Errorf("video track %d has no sequence header", stream.Index)
+	}
+
+	t.timescale = VideoTimescale
+	t.width, t.height = 0, 0
+	if stream.CodecParameters != nil {
+		t.width, t.height = stream.CodecParameters.Width(), stream.CodecParameters.Height()
+	}
+
+	// 没有CodecParameters的AV1 track从record的sequence header获取分辨率, VP9的record中没有分辨率, 由updateFrameSize获取
+	if t.width == 0 {
+		if info, err := flv.ParseVideoInfo(stream.CodecID, stream.Data); err == nil {
+			t.width, t.height = info.Width, info.Height
+		}
+	}
+
+	return t.updateVideoEntry()
+}
+
+// updateFrameSize 分辨率未知时使用VP9关键帧帧头中的分辨率重新生成sample entry, 分辨率更新时返回true
+func (t *track) updateFrameSize(frame []byte) bool {
+	if t.width > 0 || utils.AVCodecIdVP9 != t.stream.CodecID {
+		return false
+	}
+
+	width, height, err := flv.ParseVP9FrameSize(frame)
+	if err != nil || width == 0 {
+		return false
+	}
+
+	t.width, t.height = width, height
+	return t.updateVideoEntry() == nil
+}
+
+func (t *track) updateVideoEntry() error {
+	stream := t.stream
+	var format string
+	var config []byte
+	switch stream.CodecID {
+	case utils.AVCodecIdH264:
+		if len(stream.Data) > 4 {
+			t.lengthSize = int(stream.Data[4]&0x3) + 1
+		}
+
+		format, config = "avc1", appendBox(nil, "avcC", stream.Data)
+	case utils.AVCodecIdH265:
+		if len(stream.Data) > 21 {
+			t.lengthSize = int(stream.Data[21]&0x3) + 1
+		}
+
+		format, config = "hvc1", appendBox(nil, "hvcC", stream.Data)
+	case utils.AVCodecIdAV1:
+		format, config = "av01", appendBox(nil, "av1C", stream.Data)
+	case utils.AVCodecIdVP9:
+		// flv中的VPCodecConfigurationRecord包含full box的version和flags
+		format, config = "vp09", appendBox(nil, "vpcC", stream.Data)
+	default:
+		return fmt.Errorf("%w %s", ErrUnsupportedCodec, stream.CodecID)
+	}
+
+	// SampleEntry: reserved(6) data_reference_index(2)
+	// VisualSampleEntry: pre_defined(2) reserved(2) pre_defined(12) width(2) height(2) horizresolution(4) vertresolution(4)
+	// reserved(4) frame_count(2) compressorname(32) depth(2) pre_defined(2)
+	entry, offset := startBox(nil, format)
+	entry = append(entry, 0, 0, 0, 0, 0, 0, 0, 1)
+	entry = append(entry, make([]byte, 16)...)
+	entry = binary.BigEndian.AppendUint16(entry, uint16(t.width))
+	entry = binary.BigEndian.AppendUint16(entry, uint16(t.height))
+	entry = binary.BigEndian.AppendUint32(entry, 0x00480000)
+	entry = binary.BigEndian.AppendUint32(entry, 0x00480000)
+	entry = append(entry, 0, 0, 0, 0, 0, 1)
+	entry = append(entry, make([]byte, 32)...)
+	entry = append(entry, 0, 0x18, 0xFF, 0xFF)
+	entry = append(entry, config...)
+	t.entry = endBox(entry, offset)
+	return nil
+}
+
+func (t *track) updateAudio() error {
+	stream := t.stream
+	format := "mp4a"
+	channels := stream.Channels
+	sampleRate := stream.SampleRate
+	var config []byte
+
+	switch stream.CodecID {
+	case utils.AVCodecIdAAC:
+		asc, err := flv.ParseAudioSpecificConfig(stream.Data)
+		if err != nil {
+			return err
+		}
+
+		sampleRate, channels = asc.OutputSampleRate(), asc.OutputChannels()
+		config = appendESDS(nil, ObjectTypeAAC, stream.Data)
+	case utils.AVCodecIdMP3:
+		config = appendESDS(nil, ObjectTypeMP3, nil)
+	case utils.AVCodecIdOPUS:
+		head, err := flv.ParseOpusHead(stream.Data)
+		if err != nil {
+			return err
+		}
+
+		format, sampleRate, channels = "Opus", flv.OpusSampleRate, head.Channels
+		config = appendDOps(nil, stream.Data)
+	default:
+		return fmt.Errorf("%w %s", ErrUnsupportedCodec, stream.CodecID)
+	}
+
+	if sampleRate <= 0 {
+		return fmt.Errorf("invalid sample rate of audio track %d", stream.Index)
+	} else if channels <= 0 {
+		channels = 2
+	}
+
+	t.timescale = sampleRate
+	// samplerate为16.16定点数, 超出范围时填0
+	entrySampleRate := sampleRate
+	if entrySampleRate > 0xFFFF {
+		entrySampleRate = 0
+	}
+
+	// SampleEntry: reserved(6) data_reference_index(2)
+	// AudioSampleEntry: reserved(8) channelcount(2) samplesize(2) pre_defined(2) reserved(2) samplerate(4)
+	entry, offset := startBox(nil, format)
+	entry = append(entry, 0, 0, 0, 0, 0, 0, 0, 1)
+	entry = append(entry, make([]byte, 8)...)
+	entry = binary.BigEndian.AppendUint16(entry, uint16(channels))
+	entry = append(entry, 0, 16, 0, 0, 0, 0)
+	entry = binary.BigEndian.AppendUint32(entry, uint32(entrySampleRate)<<16)
+	entry = append(entry, config...)
+	t.entry = endBox(entry, offset)
+	return nil
+}
+
+// appendESDS ISO/IEC 14496-1 ES_Descriptor
+func appendESDS(dst []byte, objectType byte, specificInfo []byte) []byte {
+	// objectTypeIndication(8) streamType(6) upStream(1) reserved(1) bufferSizeDB(24) maxBitrate(32) avgBitrate(32)
+	decoderConfig := []byte{objectType, 0x15, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	if specificInfo != nil {
+		decoderConfig = appendDescriptor(decoderConfig, 0x05, specificInfo)
+	}
+
+	// ES_ID(16) flags(8)
+	es := appendDescriptor(nil, 0x03, []byte{0, 0, 0}, appendDescriptor(nil, 0x04, decoderConfig), appendDescriptor(nil, 0x06, []byte{0x02}))
+	dst, offset := startFullBox(dst, "esds", 0, 0)
+	dst = append(dst, es...)
+	return endBox(dst, offset)
+}
+
+// appendDOps 将OpusHead转换为OpusSpecificBox, 多字节字段从小端转为大端, 去掉magic signature
+func appendDOps(dst []byte, head []byte) []byte {
+	dst, offset := startBox(dst, "dOps")
+	// Version(8) OutputChannelCount(8) PreSkip(16) InputSampleRate(32) OutputGain(16) ChannelMappingFamily(8)
+	dst = append(dst, 0, head[9])
+	dst = binary.BigEndian.AppendUint16(dst, binary.LittleEndian.Uint16(head[10:]))
+	dst = binary.BigEndian.AppendUint32(dst, binary.LittleEndian.Uint32(head[12:]))
+	dst = binary.BigEndian.AppendUint16(dst, binary.LittleEndian.Uint16(head[16:]))
+	dst = append(dst, head[18])
+	// StreamCount(8) CoupledCount(8) ChannelMapping(8*OutputChannelCount)
+	if head[18] != 0 {
+		dst = append(dst, head[19:]...)
+	}
+
+	return endBox(dst, offset)
+}
+
+// appendTrak 写入trak, duration为mvhd时间刻度, mediaDuration为track时间刻度, edts为编辑列表, 可以为nil.
+// stbl写入stsd和sample表
+func (t *track) appendTrak(dst []byte, duration, mediaDuration int64, edts []byte, stbl func(dst []byte) []byte) []byte {
+	video := utils.AVMediaTypeVideo == t.stream.MediaType
+	dst, trak := startBox(dst, "trak")
+
+	// creation_time(32) modification_time(32) track_ID(32) reserved(32) duration(32) reserved(64)
+	// layer(16) alternate_group(16) volume(16) reserved(16) matrix(288) width(32) height(32)
+	// version 1的creation_time, modification_time和duration为64位
+	var tkhd int
+	version := durationVersion(duration)
+	dst, tkhd = startFullBox(dst, "tkhd", version, 0x3)
+	dst = appendTime(dst, version, 0)
+	dst = appendTime(dst, version, 0)
+	dst = binary.BigEndian.AppendUint32(dst, t.id)
+	dst = append(dst, 0, 0, 0, 0)
+	dst = appendTime(dst, version, duration)
+	dst = append(dst, make([]byte, 12)...)
+	if video {
+		dst = append(dst, 0, 0)
+	} else {
+		dst = append(dst, 1, 0)
+	}
+
+	dst = append(dst, 0, 0)
+	dst = appendMatrix(dst)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(t.width)<<16)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(t.height)<<16)
+	dst = endBox(dst, tkhd)
+	dst = append(dst, edts...)
+
+	var mdia, mdhd, hdlr, minf int
+	dst, mdia = startBox(dst, "mdia")
+	// creation_time(32) modification_time(32) timescale(32) duration(32) language(16) pre_defined(16)
+	version = durationVersion(mediaDuration)
+	dst, mdhd = startFullBox(dst, "mdhd", version, 0)
+	dst = appendTime(dst, version, 0)
+	dst = appendTime(dst, version, 0)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(t.timescale))
+	dst = appendTime(dst, version, mediaDuration)
+	// und
+	dst = append(dst, 0x55, 0xC4, 0, 0)
+	dst = endBox(dst, mdhd)
+
+	// pre_defined(32) handler_type(32) reserved(96) name
+	dst, hdlr = startFullBox(dst, "hdlr", 0, 0)
+	dst = append(dst, 0, 0, 0, 0)
+	if video {
+		dst = append(dst, "vide"...)
+		dst = append(dst, make([]byte, 12)...)
+		dst = append(dst, "VideoHandler\x00"...)
+	} else {
+		dst = append(dst, "soun"...)
+		dst = append(dst, make([]byte, 12)...)
+		dst = append(dst, "SoundHandler\x00"...)
+	}
+
+	dst = endBox(dst, hdlr)
+
+	dst, minf = startBox(dst, "minf")
+	if video {
+		// graphicsmode(16) opcolor(48)
+		header, offset := startFullBox(dst, "vmhd", 0, 0x1)
+		dst = endBox(append(header, 0, 0, 0, 0, 0, 0, 0, 0), offset)
+	} else {
+		// balance(16) reserved(16)
+		header, offset := startFullBox(dst, "smhd", 0, 0)
+		dst = endBox(append(header, 0, 0, 0, 0), offset)
+	}
+
+	// 媒体数据在同一文件中
+	url, _ := startFullBox(nil, "url ", 0, 0x1)
+	dref, offset := startFullBox(nil, "dref", 0, 0)
+	dref = endBox(append(binary.BigEndian.AppendUint32(dref, 1), endBox(url, 0)...), offset)
+	dst = appendBox(dst, "dinf", dref)
+
+	var stblOffset int
+	dst, stblOffset = startBox(dst, "stbl")
+	dst = stbl(dst)
+	dst = endBox(dst, stblOffset)
+
+	dst = endBox(dst, minf)
+	dst = endBox(dst, mdia)
+	return endBox(dst, trak)
+}
+
+// appendStsd 写入sample description, 编码器变化时有多个sample entry
+func appendStsd(dst []byte, entries ...[]byte) []byte {
+	dst, offset := startFullBox(dst, "stsd", 0, 0)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(entries)))
+	for _, entry := range entries {
+		dst = append(dst, entry...)
+	}
+
+	return endBox(dst, offset)
+}
+
+// appendMvhd 写入mvhd, nextTrackID为下一个可用的track_ID
+func appendMvhd(dst []byte, duration int64, nextTrackID uint32) []byte {
+	// creation_time(32) modification_time(32) timescale(32) duration(32) rate(32) volume(16) reserved(80)
+	// matrix(288) pre_defined(192) next_track_ID(32)
+	version := durationVersion(duration)
+	dst, offset := startFullBox(dst, "mvhd", version, 0)
+	dst = appendTime(dst, version, 0)
+	dst = appendTime(dst, version, 0)
+	dst = binary.BigEndian.AppendUint32(dst, MovieTimescale)
+	dst = appendTime(dst, version, duration)
+	dst = append(dst, 0, 1, 0, 0, 1, 0)
+	dst = append(dst, make([]byte, 10)...)
+	dst = appendMatrix(dst)
+	dst = append(dst, make([]byte, 24)...)
+	dst = binary.BigEndian.AppendUint32(dst, nextTrackID)
+	return endBox(dst, offset)
+}
+
+// durationVersion 时长超过32位时使用version 1
+func durationVersion(duration int64) byte {
+	if duration > math.MaxUint32 {
+		return 1
+	}
+
+	return 0
+}
+
+// appendTime 写入时间或时长, version 1为64位
+func appendTime(dst []byte, version byte, value int64) []byte {
+	if version == 1 {
+		return binary.BigEndian.AppendUint64(dst, uint64(value))
+	}
+
+	return binary.BigEndian.AppendUint32(dst, uint32(value))
+}
+
+// appendAVCC 将AnnexB格式的帧转换为长度前缀格式
+func appendAVCC(dst []byte, data []byte, lengthSize int) []byte {
+	flv.SplitAnnexB(data, func(nalu []byte) {
+		for i := lengthSize - 1; i >= 0; i-- {
+			dst = append(dst, byte(len(nalu)>>(8*i)))
+		}
+
+		dst = append(dst, nalu...)
+	})
+
+	return dst
+}
+
+// convertTs 转换时间刻度, 使用整数运算避免浮点误差
+func convertTs(ts int64, src, dst int) int64 {
+	if src == dst {
+		return ts
+	}
+
+	return ts * int64(dst) / int64(src)
+}
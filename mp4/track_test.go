@@ -0,0 +1,88 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv/internal/flvtest"
+	"math"
+	"testing"
+)
+
+var (
+	testAV1Record   = []byte{0x81, 0x08, 0x0C, 0x00, 0x0A, 0x11, 0x04, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x7B, 0x00, 0x00, 0x08, 0x55, 0x77, 0xF8, 0x6E, 0x00} // 1920x1080
+	testVP9Record   = []byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x1F, 0x80, 0x02, 0x02, 0x02, 0x00, 0x00}
+	testVP9KeyFrame = []byte{0x82, 0x49, 0x83, 0x42, 0x40, 0x27, 0xF0, 0x16, 0x70, 0x00} // 640x360
+)
+
+// readTestEntrySize 读取初始化分片或moov中第一个track的sample entry的分辨率
+func readTestEntrySize(moov []byte) (int, int) {
+	stsd := findTestBox(moov, "trak", "mdia", "minf", "stbl", "stsd")
+	entry := readTestBoxes(stsd)[0].data
+	return int(binary.BigEndian.Uint16(entry[24:])), int(binary.BigEndian.Uint16(entry[26:]))
+}
+
+func TestVideoEntrySize(t *testing.T) {
+	// 没有CodecParameters的AV1 track, 分辨率来自record
+	stream := avformat.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdAV1, testAV1Record, nil)
+	av1, err := newTrack(stream, 1)
+	utils.Assert(err == nil && av1.width == 1920 && av1.height == 1080)
+
+	// VP9的分辨率来自第一个关键帧
+	for _, fragmented := range []bool{false, true} {
+		output := &bytes.Buffer{}
+		stream = avformat.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdVP9, testVP9Record, nil)
+		stream.Timebase = 1000
+		var writer interface {
+			WritePacket(packet *avformat.AVPacket) error
+			Flush() error
+		}
+
+		if fragmented {
+			muxer := NewFragmentedMuxer(output)
+			utils.Assert(muxer.AddTrack(stream) == nil)
+			writer = muxer
+		} else {
+			muxer := NewMuxer(output)
+			muxer.TempDir = t.TempDir()
+			utils.Assert(muxer.AddTrack(stream) == nil)
+			writer = muxer
+		}
+
+		for i := 0; i < 3; i++ {
+			packet := avformat.NewVideoPacket(testVP9KeyFrame, int64(i*40), int64(i*40), true, avformat.PacketTypeAVCC, utils.AVCodecIdVP9, 0, 1000)
+			utils.Assert(writer.WritePacket(packet) == nil)
+		}
+
+		utils.Assert(writer.Flush() == nil)
+		boxes := readTestBoxes(output.Bytes())
+		utils.Assert(boxes[1].boxType == "moov")
+		width, height := readTestEntrySize(boxes[1].data)
+		utils.Assert(width == 640 && height == 360)
+	}
+}
+
+func TestLongDuration(t *testing.T) {
+	// 时长超过32位时mvhd, tkhd, mdhd和elst使用version 1
+	duration := int64(math.MaxUint32) + 1000
+	timescale, parsed, err := parseMvhd(findTestBox(appendMvhd(nil, duration, 2), "mvhd"))
+	utils.Assert(err == nil && timescale == MovieTimescale && parsed == duration)
+
+	audio := &muxerTrack{}
+	audio.track, err = newTrack(flvtest.NewAudioStream(), 1)
+	utils.Assert(err == nil)
+	trak := audio.appendTrak(nil, duration, duration*44, audio.appendEdts(duration, duration), appendEmptySampleTables)
+	tkhd := findTestBox(trak, "trak", "tkhd")
+	utils.Assert(len(tkhd) == 96 && tkhd[0] == 1 && int64(binary.BigEndian.Uint64(tkhd[28:])) == duration)
+	timescale, parsed, err = parseMvhd(findTestBox(trak, "trak", "mdia", "mdhd"))
+	utils.Assert(err == nil && timescale == 44100 && parsed == duration*44)
+
+	reader := &readerTrack{timescale: MovieTimescale}
+	reader.parseEditList(findTestBox(trak, "trak", "edts", "elst"), MovieTimescale)
+	utils.Assert(reader.offset == duration)
+
+	// 32位以内使用version 0
+	tkhd = findTestBox(audio.appendTrak(nil, 1000, 44100, nil, appendEmptySampleTables), "trak", "tkhd")
+	utils.Assert(len(tkhd) == 84 && tkhd[0] == 0)
+}
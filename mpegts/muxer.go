@@ -0,0 +1,404 @@
+// Package mpegts 将flv解析出的音视频帧封装为MPEG-TS, 不依赖ffmpeg.
+package mpegts
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"io"
+)
+
+const (
+	PacketSize = 188
+
+	PIDPAT        = 0x0000
+	PIDPMT        = 0x1000
+	PIDFirstTrack = 0x0100
+
+	StreamTypeMPEG1Audio = 0x03
+	StreamTypeMPEG2Audio = 0x04
+	StreamTypeAAC        = 0x0F
+	StreamTypeH264       = 0x1B
+	StreamTypeH265       = 0x24
+
+	// pcrDelay PTS/DTS相对PCR的延迟(90kHz), 700毫秒
+	pcrDelay = 63000
+	// tableInterval 纯音频流PAT/PMT的发送间隔(90kHz)
+	tableInterval = 45000
+)
+
+var (
+	// ErrUnsupportedCodec TS不能承载的编码器
+	ErrUnsupportedCodec = errors.New("unsupported codec")
+
+	audH264 = []byte{0x0, 0x0, 0x0, 0x1, 0x9, 0xF0}
+	audH265 = []byte{0x0, 0x0, 0x0, 0x1, 0x46, 0x1, 0x50}
+
+	startCode = []byte{0x0, 0x0, 0x0, 0x1}
+)
+
+// elementaryStream 一个track对应的TS流
+type elementaryStream struct {
+	stream     *avformat.AVStream
+	pid        uint16
+	streamType byte
+	streamID   byte // PES stream id, 视频0xE0, 音频0xC0
+	cc         byte
+
+	lengthSize    int    // AVCC的长度前缀字节数
+	parameterSets []byte // AnnexB格式的vps/sps/pps, 关键帧前插入
+	adts          []byte // AAC的ADTS头模板
+}
+
+// Muxer 将H.264, H.265, AAC和MP3帧封装为MPEG-TS. 视频关键帧前插入AUD和参数集, AAC添加ADTS头,
+// 每个视频关键帧前发送PAT/PMT, PCR由视频流携带, 没有视频时由音频流携带. 非线程安全.
+type Muxer struct {
+	writer  io.Writer
+	streams []*elementaryStream
+	pcr     *elementaryStream
+
+	patCC, pmtCC  byte
+	version       byte // PMT版本号, track变化时递增
+	tablesWritten bool
+	lastTables    int64
+
+	buffer []byte // 一帧的TS包
+	frame  []byte // 转换后的ES数据
+}
+
+// AddTrack 添加track, 需要在写入第一帧前完成. TS不能承载的编码器返回ErrUnsupportedCodec
+func (m *Muxer) AddTrack(stream *avformat.AVStream) error {
+	if m.tablesWritten {
+		return fmt.Errorf("tracks must be added before writing packets")
+	}
+
+	es := &elementaryStream{pid: PIDFirstTrack + uint16(len(m.streams))}
+	if err := es.update(stream); err != nil {
+		return err
+	}
+
+	// 优先使用第一个视频流携带PCR
+	m.streams = append(m.streams, es)
+	if m.pcr == nil || (utils.AVMediaTypeVideo == stream.MediaType && utils.AVMediaTypeVideo != m.pcr.stream.MediaType) {
+		m.pcr = es
+	}
+
+	return nil
+}
+
+// UpdateTrack 流中途的编码器信息变化, 编码器切换时递增PMT版本号并重新发送PAT/PMT
+func (m *Muxer) UpdateTrack(stream *avformat.AVStream) error {
+	es := m.findStream(stream.Index)
+	if es == nil {
+		return fmt.Errorf("track %d not found", stream.Index)
+	}
+
+	streamType := es.streamType
+	if err := es.update(stream); err != nil {
+		return err
+	} else if streamType != es.streamType {
+		m.version = (m.version + 1) & 0x1F
+		m.tablesWritten = false
+	}
+
+	return nil
+}
+
+// ResendTables 下一帧前发送PAT/PMT, 用于切分HLS分片等需要从任意位置开始解码的场景
+func (m *Muxer) ResendTables() {
+	m.tablesWritten = false
+}
+
+func (m *Muxer) findStream(index int) *elementaryStream {
+	for _, es := range m.streams {
+		if es.stream.Index == index {
+			return es
+		}
+	}
+
+	return nil
+}
+
+// update 使用track的编码器信息更新TS流参数
+func (es *elementaryStream) update(stream *avformat.AVStream) error {
+	es.stream = stream
+	es.parameterSets = nil
+	es.adts = nil
+
+	switch stream.CodecID {
+	case utils.AVCodecIdH264, utils.AVCodecIdH265:
+		es.streamType, es.streamID = StreamTypeH264, 0xE0
+		if utils.AVCodecIdH265 == stream.CodecID {
+			es.streamType = StreamTypeH265
+		}
+
+		var err error
+		es.lengthSize, es.parameterSets, err = flv.ParseParameterSets(stream)
+		return err
+	case utils.AVCodecIdAAC:
+		es.streamType, es.streamID = StreamTypeAAC, 0xC0
+		if stream.HasADTSHeader {
+			return nil
+		}
+
+		var err error
+		es.adts, err = flv.NewADTSHeader(stream.Data)
+		return err
+	case utils.AVCodecIdMP3:
+		es.streamType, es.streamID = StreamTypeMPEG1Audio, 0xC0
+		if stream.SampleRate > 0 && stream.SampleRate < 32000 {
+			es.streamType = StreamTypeMPEG2Audio
+		}
+	default:
+		return fmt.Errorf("%w %s", ErrUnsupportedCodec, stream.CodecID)
+	}
+
+	return nil
+}
+
+// WritePacket 写入一帧, 视频可以是AVCC或AnnexB格式
+func (m *Muxer) WritePacket(packet *avformat.AVPacket) error {
+	es := m.findStream(packet.Index)
+	if es == nil {
+		return fmt.Errorf("track %d not found", packet.Index)
+	}
+
+	dts := packet.ConvertDts(90000) + pcrDelay
+	pts := packet.ConvertPts(90000) + pcrDelay
+	video := utils.AVMediaTypeVideo == es.stream.MediaType
+
+	m.buffer = m.buffer[:0]
+	if !m.tablesWritten || (video && packet.Key) || (m.pcr == es && !video && dts-m.lastTables >= tableInterval) {
+		m.writeTables()
+		m.tablesWritten = true
+		m.lastTables = dts
+	}
+
+	if video {
+		m.frame = es.annexB(m.frame[:0], packet)
+	} else if es.adts != nil {
+		m.frame = flv.AppendADTS(m.frame[:0], es.adts, packet.Data)
+	} else {
+		m.frame = append(m.frame[:0], packet.Data...)
+	}
+
+	m.writePES(es, m.frame, pts, dts, video, video && packet.Key)
+	_, err := m.writer.Write(m.buffer)
+	return err
+}
+
+// annexB 转换为AnnexB格式, 添加AUD, 关键帧没有参数集时插入参数集
+func (es *elementaryStream) annexB(dst []byte, packet *avformat.AVPacket) []byte {
+	id := es.stream.CodecID
+	if utils.AVCodecIdH265 == id {
+		dst = append(dst, audH265...)
+	} else {
+		dst = append(dst, audH264...)
+	}
+
+	var nalus [][]byte
+	collect := func(nalu []byte) {
+		nalus = append(nalus, nalu)
+	}
+
+	if avformat.PacketTypeAnnexB == packet.PacketType {
+		flv.SplitAnnexB(packet.Data, collect)
+	} else {
+		flv.SplitAVCC(packet.Data, es.lengthSize, collect)
+	}
+
+	if packet.Key {
+		var found bool
+		for _, nalu := range nalus {
+			naluType := flv.NalUnitType(id, nalu)
+			if (utils.AVCodecIdH265 == id && flv.HEVCNalSPS == naluType) || (utils.AVCodecIdH264 == id && flv.H264NalSPS == naluType) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			dst = append(dst, es.parameterSets...)
+		}
+	}
+
+	for _, nalu := range nalus {
+		naluType := flv.NalUnitType(id, nalu)
+		if (utils.AVCodecIdH265 == id && flv.HEVCNalAUD == naluType) || (utils.AVCodecIdH264 == id && flv.H264NalAUD == naluType) {
+			continue
+		}
+
+		dst = append(dst, startCode...)
+		dst = append(dst, nalu...)
+	}
+
+	return dst
+}
+
+// writePES 将一帧封装为PES并拆分为TS包
+func (m *Muxer) writePES(es *elementaryStream, data []byte, pts, dts int64, video, key bool) {
+	var header [19]byte
+	header[2] = 1
+	header[3] = es.streamID
+	header[6] = 0x80
+	n := 9
+	if pts != dts {
+		header[7] = 0xC0
+		header[8] = 10
+		putTimestamp(header[9:], 0x3, pts)
+		putTimestamp(header[14:], 0x1, dts)
+		n += 10
+	} else {
+		header[7] = 0x80
+		header[8] = 5
+		putTimestamp(header[9:], 0x2, pts)
+		n += 5
+	}
+
+	// 视频PES长度可以为0
+	if size := n - 6 + len(data); !video || size <= 0xFFFF {
+		if size > 0xFFFF {
+			size = 0
+		}
+
+		binary.BigEndian.PutUint16(header[4:], uint16(size))
+	}
+
+	payload := append(header[:n:n], data...)
+	for first := true; len(payload) > 0; first = false {
+		var packet [PacketSize]byte
+		packet[0] = 0x47
+		packet[1] = byte(es.pid >> 8 & 0x1F)
+		packet[2] = byte(es.pid)
+		if first {
+			packet[1] |= 0x40
+		}
+
+		// 自适应字段: PCR和随机访问标记
+		var adaptation []byte
+		if first && (m.pcr == es || key) {
+			adaptation = make([]byte, 2, 8)
+			if key {
+				adaptation[1] |= 0x40
+			}
+
+			if m.pcr == es {
+				adaptation[1] |= 0x10
+				adaptation = appendPCR(adaptation, dts-pcrDelay)
+			}
+		}
+
+		space := PacketSize - 4 - len(adaptation)
+		if len(payload) < space {
+			// 使用自适应字段填充
+			if adaptation == nil {
+				adaptation = make([]byte, 1, 2)
+				if space-len(payload) > 1 {
+					adaptation = append(adaptation, 0)
+				}
+			}
+
+			for len(adaptation)+len(payload) < PacketSize-4 {
+				adaptation = append(adaptation, 0xFF)
+			}
+		}
+
+		packet[3] = 0x10 | es.cc
+		es.cc = (es.cc + 1) & 0xF
+		offset := 4
+		if adaptation != nil {
+			packet[3] |= 0x20
+			adaptation[0] = byte(len(adaptation) - 1)
+			offset += copy(packet[offset:], adaptation)
+		}
+
+		size := copy(packet[offset:], payload)
+		payload = payload[size:]
+		m.buffer = append(m.buffer, packet[:]...)
+	}
+}
+
+// putTimestamp 写入PES头中的33位PTS/DTS
+func putTimestamp(dst []byte, prefix byte, ts int64) {
+	ts &= 0x1FFFFFFFF
+	dst[0] = prefix<<4 | byte(ts>>29)&0x0E | 1
+	dst[1] = byte(ts >> 22)
+	dst[2] = byte(ts>>14) | 1
+	dst[3] = byte(ts >> 7)
+	dst[4] = byte(ts<<1) | 1
+}
+
+// appendPCR PCR base为33位90kHz时钟, extension为0
+func appendPCR(dst []byte, pcr int64) []byte {
+	if pcr < 0 {
+		pcr = 0
+	}
+
+	pcr &= 0x1FFFFFFFF
+	return append(dst, byte(pcr>>25), byte(pcr>>17), byte(pcr>>9), byte(pcr>>1), byte(pcr&1)<<7|0x7E, 0)
+}
+
+// writeTables 写入PAT和PMT
+func (m *Muxer) writeTables() {
+	// program 1 -> PMT
+	pat := []byte{0x0, 0x1, 0xC1, 0x0, 0x0, 0x0, 0x1, byte(0xE0 | PIDPMT>>8), byte(PIDPMT & 0xFF)}
+	m.writeSection(PIDPAT, &m.patCC, 0x00, pat)
+
+	var pcrPID uint16 = 0x1FFF
+	if m.pcr != nil {
+		pcrPID = m.pcr.pid
+	}
+
+	pmt := []byte{0x0, 0x1, 0xC1 | m.version<<1, 0x0, 0x0, byte(0xE0 | pcrPID>>8), byte(pcrPID), 0xF0, 0x0}
+	for _, es := range m.streams {
+		pmt = append(pmt, es.streamType, byte(0xE0|es.pid>>8), byte(es.pid), 0xF0, 0x0)
+	}
+
+	m.writeSection(PIDPMT, &m.pmtCC, 0x02, pmt)
+}
+
+// writeSection 写入一个PSI section, body从transport_stream_id/program_number开始
+func (m *Muxer) writeSection(pid uint16, cc *byte, tableID byte, body []byte) {
+	var packet [PacketSize]byte
+	packet[0] = 0x47
+	packet[1] = 0x40 | byte(pid>>8&0x1F)
+	packet[2] = byte(pid)
+	packet[3] = 0x10 | *cc
+	*cc = (*cc + 1) & 0xF
+
+	// pointer_field, table_id, section_length
+	section := packet[5:5]
+	length := len(body) + 4
+	section = append(section, tableID, 0xB0|byte(length>>8), byte(length))
+	section = append(section, body...)
+	section = binary.BigEndian.AppendUint32(section, crc32(section))
+	for i := 5 + len(section); i < PacketSize; i++ {
+		packet[i] = 0xFF
+	}
+
+	m.buffer = append(m.buffer, packet[:]...)
+}
+
+// crc32 MPEG-2 CRC32, 多项式0x04C11DB7, 不反转
+func crc32(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
+
+func NewMuxer(writer io.Writer) *Muxer {
+	return &Muxer{writer: writer}
+}
@@ -0,0 +1,196 @@
+package mpegts
+
+import (
+	"bytes"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"github.com/lkmio/flv/internal/flvtest"
+	"testing"
+)
+
+// newTestFLV 生成音视频flv流, 每10帧一个关键帧, 视频帧大小为300字节
+func newTestFLV(frames int) []byte {
+	output := &bytes.Buffer{}
+	flvtest.WriteFLV(flv.NewWriter(output), frames, flvtest.Options{FrameSize: 300, CompositionTime: 80})
+	return output.Bytes()
+}
+
+type testPES struct {
+	pid  uint16
+	data []byte
+	key  bool
+	pcr  bool
+}
+
+// parseTS 校验TS包和PSI, 返回每个PES和PMT中的流类型
+func parseTS(data []byte) ([]*testPES, map[uint16]byte) {
+	utils.Assert(len(data)%PacketSize == 0)
+	counters := make(map[uint16]byte)
+	streamTypes := make(map[uint16]byte)
+	var pes []*testPES
+	current := make(map[uint16]*testPES)
+
+	for offset := 0; offset < len(data); offset += PacketSize {
+		packet := data[offset : offset+PacketSize]
+		utils.Assert(packet[0] == 0x47)
+		pid := uint16(packet[1]&0x1F)<<8 | uint16(packet[2])
+		start := packet[1]&0x40 != 0
+
+		// 连续计数器
+		cc := packet[3] & 0xF
+		if last, ok := counters[pid]; ok {
+			utils.Assert(cc == (last+1)&0xF)
+		}
+
+		counters[pid] = cc
+		payload := packet[4:]
+		var random, pcr bool
+		if packet[3]&0x20 != 0 {
+			length := int(payload[0])
+			if length > 0 {
+				random = payload[1]&0x40 != 0
+				pcr = payload[1]&0x10 != 0
+			}
+
+			payload = payload[1+length:]
+		}
+
+		if PIDPAT == pid || PIDPMT == pid {
+			utils.Assert(start && payload[0] == 0)
+			section := payload[1:]
+			length := int(section[1]&0xF)<<8 | int(section[2])
+			utils.Assert(crc32(section[:3+length]) == 0)
+			if PIDPMT == pid {
+				for i := 12; i+5 <= 3+length-4; i += 5 {
+					streamTypes[uint16(section[i+1]&0x1F)<<8|uint16(section[i+2])] = section[i]
+				}
+			}
+
+			continue
+		}
+
+		if start {
+			current[pid] = &testPES{pid: pid, key: random, pcr: pcr}
+			pes = append(pes, current[pid])
+		}
+
+		current[pid].data = append(current[pid].data, payload...)
+	}
+
+	return pes, streamTypes
+}
+
+func readTimestamp(data []byte) int64 {
+	return int64(data[0]>>1&0x7)<<30 | int64(data[1])<<22 | int64(data[2]>>1)<<15 | int64(data[3])<<7 | int64(data[4]>>1)
+}
+
+func TestRemux(t *testing.T) {
+	output := &bytes.Buffer{}
+	utils.Assert(Remux(output, bytes.NewReader(newTestFLV(20))) == nil)
+
+	pes, streamTypes := parseTS(output.Bytes())
+	utils.Assert(len(streamTypes) == 2 && streamTypes[PIDFirstTrack] == StreamTypeH264 && streamTypes[PIDFirstTrack+1] == StreamTypeAAC)
+
+	var video, audio []*testPES
+	for _, p := range pes {
+		utils.Assert(bytes.HasPrefix(p.data, []byte{0, 0, 1}))
+		if PIDFirstTrack == p.pid {
+			video = append(video, p)
+		} else {
+			audio = append(audio, p)
+		}
+	}
+
+	// 包括demuxer缓存的最后一帧
+	utils.Assert(len(video) == 20 && len(audio) == 20)
+
+	for i, p := range video {
+		utils.Assert(p.pcr && p.key == (i%10 == 0))
+		// PTS和DTS, 90kHz
+		utils.Assert(p.data[7] == 0xC0)
+		utils.Assert(readTimestamp(p.data[9:]) == int64(i*40+80)*90+pcrDelay)
+		utils.Assert(readTimestamp(p.data[14:]) == int64(i*40)*90+pcrDelay)
+
+		// AUD, 关键帧前插入SPS和PPS
+		es := p.data[19:]
+		utils.Assert(bytes.HasPrefix(es, audH264))
+		es = es[len(audH264):]
+		if i%10 == 0 {
+			parameterSets := append(append(append([]byte{0, 0, 0, 1}, flvtest.SPS...), 0, 0, 0, 1), flvtest.PPS...)
+			utils.Assert(bytes.HasPrefix(es, parameterSets))
+			es = es[len(parameterSets):]
+		}
+
+		utils.Assert(len(es) == 4+300 && bytes.HasPrefix(es, []byte{0, 0, 0, 1}) && es[5] == byte(i))
+	}
+
+	for i, p := range audio {
+		// 音频PES长度和ADTS帧长度
+		utils.Assert(!p.pcr && int(p.data[4])<<8|int(p.data[5]) == 3+5+7+2)
+		utils.Assert(readTimestamp(p.data[9:]) == int64(i*40)*90+pcrDelay)
+		adts := p.data[14:]
+		header, err := utils.ReadADtsFixedHeader(adts)
+		utils.Assert(err == nil && header.FrameLength() == 7+2 && header.Channel() == 2)
+		utils.Assert(adts[8] == byte(i))
+	}
+}
+
+func TestRemuxUnsupportedTrack(t *testing.T) {
+	// H.264和G.711, G.711不能封装为TS
+	newFLV := func(video bool) []byte {
+		output := &bytes.Buffer{}
+		writer := flv.NewWriter(output)
+		if video {
+			_, err := writer.AddTrack(flvtest.NewVideoStream())
+			utils.Assert(err == nil)
+		}
+
+		alaw := avformat.NewAVStream(utils.AVMediaTypeAudio, 1, utils.AVCodecIdPCMALAW, nil, nil)
+		alaw.SampleRate, alaw.SampleSize, alaw.Channels = 8000, 16, 1
+		_, err := writer.AddTrack(alaw)
+		utils.Assert(err == nil)
+		utils.Assert(writer.WriteHeader() == nil)
+		for i := 0; i < 10; i++ {
+			if video {
+				frame := []byte{0, 0, 0, 2, 0x41, byte(i)}
+				if i%5 == 0 {
+					frame[4] = 0x65
+				}
+
+				utils.Assert(writer.WritePacket(avformat.NewVideoPacket(frame, int64(i*40), int64(i*40), i%5 == 0, avformat.PacketTypeAVCC, utils.AVCodecIdH264, 0, 1000)) == nil)
+			}
+
+			utils.Assert(writer.WritePacket(avformat.NewAudioPacket([]byte{0xD5, byte(i)}, int64(i*40), utils.AVCodecIdPCMALAW, 1, 1000)) == nil)
+		}
+
+		utils.Assert(writer.Flush() == nil)
+		return output.Bytes()
+	}
+
+	output := &bytes.Buffer{}
+	remuxer := NewRemuxer(output)
+	_, err := remuxer.Write(newFLV(true))
+	utils.Assert(err == nil)
+	utils.Assert(remuxer.Close() == nil)
+	utils.Assert(len(remuxer.Skipped()) == 1 && remuxer.Skipped()[0] == 1)
+
+	pes, streamTypes := parseTS(output.Bytes())
+	utils.Assert(len(streamTypes) == 1 && streamTypes[PIDFirstTrack] == StreamTypeH264 && len(pes) == 10)
+
+	// 没有可以转换的track
+	utils.Assert(Remux(&bytes.Buffer{}, bytes.NewReader(newFLV(false))) != nil)
+}
+
+func TestRemuxError(t *testing.T) {
+	// 解析失败后不输出demuxer缓存的最后一帧
+	output := &bytes.Buffer{}
+	remuxer := NewRemuxer(output)
+	_, err := remuxer.Write(newTestFLV(20))
+	utils.Assert(err == nil)
+	size := output.Len()
+
+	// 保留的音频格式12, 解析失败
+	_, err = remuxer.Write([]byte{0, 0, 0, 0, byte(flv.TagTypeAudioData), 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0xC0})
+	utils.Assert(err != nil && remuxer.Close() == err && output.Len() == size)
+}
@@ -0,0 +1,131 @@
+package mpegts
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/flv"
+	"io"
+	"sort"
+)
+
+// Remuxer 将flv流转换为MPEG-TS. 通过Write输入flv流的任意分片, 输入结束后调用Close输出缓存的最后一帧.
+// 跳过Speex, PCM和G.711等TS不能承载的track, 没有可以转换的track时Close返回错误.
+type Remuxer struct {
+	demuxer *flv.Demuxer
+	muxer   *Muxer
+	skipped map[int]bool // 不支持的track
+	err     error
+}
+
+// Muxer 返回输出使用的TS Muxer
+func (r *Remuxer) Muxer() *Muxer {
+	return r.muxer
+}
+
+// Skipped 返回跳过的track索引
+func (r *Remuxer) Skipped() []int {
+	var skipped []int
+	for index := range r.skipped {
+		skipped = append(skipped, index)
+	}
+
+	sort.Ints(skipped)
+	return skipped
+}
+
+func (r *Remuxer) OnNewTrack(track avformat.Track) {
+	if r.err != nil {
+		return
+	}
+
+	stream := track.GetStream()
+	if err := r.muxer.AddTrack(stream); errors.Is(err, ErrUnsupportedCodec) {
+		r.skipped[stream.Index] = true
+	} else {
+		r.err = err
+	}
+}
+
+func (r *Remuxer) OnTrackComplete() {
+}
+
+func (r *Remuxer) OnTrackNotFind() {
+}
+
+func (r *Remuxer) OnPacket(packet *avformat.AVPacket) {
+	if r.err == nil && !r.skipped[packet.Index] {
+		r.err = r.muxer.WritePacket(packet)
+	}
+}
+
+// OnCodecParametersChanged 流中途的sequence header变化, 更新参数集或ADTS头
+func (r *Remuxer) OnCodecParametersChanged(track avformat.Track, ts uint32) {
+	if r.err == nil && !r.skipped[track.GetStream().Index] {
+		r.err = r.muxer.UpdateTrack(track.GetStream())
+	}
+}
+
+func (r *Remuxer) OnSequenceEnd(track avformat.Track, ts uint32) {
+}
+
+// Write 输入flv流
+func (r *Remuxer) Write(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	if _, err := r.demuxer.Input(p); err != nil {
+		r.err = err
+		return 0, err
+	} else if r.err != nil {
+		return 0, r.err
+	}
+
+	return len(p), nil
+}
+
+// Close 输入结束, 输出demuxer缓存的帧. 出错时不输出
+func (r *Remuxer) Close() error {
+	if r.err == nil {
+		r.demuxer.Flush()
+	}
+
+	r.demuxer.Close()
+	if r.err == nil && len(r.muxer.streams) == 0 {
+		r.err = fmt.Errorf("no track can be remuxed")
+	}
+
+	return r.err
+}
+
+// abort 读取输入失败, 不输出缓存的帧
+func (r *Remuxer) abort(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+
+	r.Close()
+}
+
+func NewRemuxer(writer io.Writer) *Remuxer {
+	remuxer := &Remuxer{
+		demuxer: flv.NewDemuxer(true),
+		muxer:   NewMuxer(writer),
+		skipped: make(map[int]bool),
+	}
+
+	remuxer.demuxer.SetHandler(remuxer)
+	return remuxer
+}
+
+// Remux 将src中的flv流转换为MPEG-TS写入dst
+func Remux(dst io.Writer, src io.Reader) error {
+	remuxer := NewRemuxer(dst)
+	if _, err := io.Copy(remuxer, src); err != nil {
+		remuxer.abort(err)
+		return err
+	}
+
+	return remuxer.Close()
+}
@@ -14,7 +14,6 @@ var (
 	SupportedCodecs = map[utils.AVCodecID]interface{}{
 		utils.AVCodecIdPCMU8:      SoundFormatPCMLittle,
 		utils.AVCodecIdPCMS16LE:   SoundFormatPCMLittle,
-		utils.AVCodecIdPCMS16BE:   SoundFormatPCMLittle,
 		utils.AVCodecIdADPCMSWF:   SoundFormatADPCM,
 		utils.AVCodecIdMP3:        SoundFormatMP3,
 		utils.AVCodecIdNELLYMOSER: SoundFormatNELLYMOSER8KHZMono,
@@ -41,6 +40,29 @@ type Muxer struct {
 	AudioData   AudioData
 	VideoData   VideoData
 	prevTagSize uint32
+
+	UpdateSequenceHeader bool           // AnnexB输入的带内参数集发生变化时, 是否输出新的sequence header
+	videoParameterSets   *parameterSets // 当前视频sequence header使用的参数集
+	videoBuffer          []byte         // AnnexB转AVCC的缓冲区
+
+	capabilities *Capabilities
+	restricted   bool
+}
+
+// SetCapabilities 按对端声明的增强RTMP能力限制输出, 之后添加或切换到对端不支持的视频编码器时返回错误.
+// capabilities为nil表示对端是传统播放器, 只允许传统flv的编码器.
+func (m *Muxer) SetCapabilities(capabilities *Capabilities) {
+	m.capabilities = capabilities
+	m.restricted = true
+}
+
+// checkVideoCodec 检查对端是否支持视频编码器
+func (m *Muxer) checkVideoCodec(id VideoCodecID) error {
+	if m.restricted && !m.capabilities.SupportsVideo(id) {
+		return fmt.Errorf("video codec %s is not supported by peer", fourCCString(uint32(id)))
+	}
+
+	return nil
 }
 
 func (m *Muxer) AddTrack(stream *avformat.AVStream) (int, error) {
@@ -69,8 +91,8 @@ func (m *Muxer) AddAudioTrack(stream *avformat.AVStream) (int, error) {
 		m.metaData.AddNumberProperty("audiocodecid", float64(m.AudioData.SoundFormat))
 	}
 
-	if m.metaData.FindProperty("audiosamplerate") == nil {
-		m.metaData.AddNumberProperty("audiosamplerate", float64(m.AudioData.Rate))
+	if m.metaData.FindProperty("audiosamplerate") == nil && stream.SampleRate > 0 {
+		m.metaData.AddNumberProperty("audiosamplerate", float64(stream.SampleRate))
 	}
 
 	return index, nil
@@ -80,6 +102,15 @@ func (m *Muxer) AddVideoTrack(stream *avformat.AVStream) (int, error) {
 	data, err := NewVideoData(stream.CodecID)
 	if err != nil {
 		return -1, err
+	} else if err = m.checkVideoCodec(data.CodecID); err != nil {
+		return -1, err
+	}
+
+	// AnnexB格式的编码器信息, 转换为decoder configuration record
+	if stream.CodecParameters == nil && IsAnnexB(stream.Data) {
+		if err = annexBExtraData2Record(stream); err != nil {
+			return -1, err
+		}
 	}
 
 	index, err := m.BaseMuxer.AddTrack(&avformat.SimpleTrack{Stream: stream})
@@ -133,15 +164,35 @@ func (m *Muxer) WriteHeader(dst []byte) int {
 	return totalWritten
 }
 
+// ComputeHeaderSize 计算WriteHeader需要的缓冲区大小
+func (m *Muxer) ComputeHeaderSize() int {
+	size := 9 + TagHeaderSize + amf0.MarshalSize(amf0.String("onMetaData")) + amf0.MarshalSize(m.metaData)
+	for _, track := range m.Tracks.Tracks {
+		if extraData := sequenceHeaderData(track.GetStream()); len(extraData) > 0 {
+			size += TagHeaderSize + MaxVideoDataHeaderSize + len(extraData)
+		}
+	}
+
+	return size
+}
+
+// sequenceHeaderData 返回写入sequence header的编码器信息, 视频为AVCC格式
+func sequenceHeaderData(stream *avformat.AVStream) []byte {
+	extraData := stream.Data
+	if len(extraData) > 0 && utils.AVMediaTypeVideo == stream.MediaType && stream.CodecParameters != nil {
+		extraData = stream.CodecParameters.MP4ExtraData()
+	}
+
+	return extraData
+}
+
 func (m *Muxer) writeSequenceHeader(dst []byte) int {
 	var totalWritten int
 
 	for _, track := range m.Tracks.Tracks {
-		extraData := track.GetStream().Data
+		extraData := sequenceHeaderData(track.GetStream())
 		if len(extraData) == 0 {
 			continue
-		} else if utils.AVMediaTypeVideo == track.GetStream().MediaType {
-			extraData = track.GetStream().CodecParameters.MP4ExtraData()
 		}
 
 		//	track := s.muxer.Tracks.Get(packet.Index)
@@ -177,6 +228,111 @@ func (m *Muxer) Input(dst []byte, mediaType utils.AVMediaType, size int, dts, pt
 	}
 }
 
+// sequenceHeader 使用track当前的编码器信息更新tag头中的编码器ID, 返回sequence header的负载
+func (m *Muxer) sequenceHeader(index int) (*avformat.AVStream, []byte, error) {
+	if index < 0 || index >= m.Tracks.Size() {
+		return nil, nil, fmt.Errorf("invalid track index %d", index)
+	}
+
+	stream := m.Tracks.Get(index).GetStream()
+	if err := m.updateCodec(stream); err != nil {
+		return nil, nil, err
+	}
+
+	extraData := sequenceHeaderData(stream)
+	if len(extraData) == 0 {
+		return nil, nil, fmt.Errorf("track %d has no sequence header", index)
+	}
+
+	return stream, extraData, nil
+}
+
+// WriteSequenceHeader 写入track当前编码器信息的sequence header tag, 用于流中途的分辨率或编码器切换.
+// 编码器变化时, 同时更新tag头中的编码器ID.
+func (m *Muxer) WriteSequenceHeader(dst []byte, index int, ts uint32) (int, error) {
+	stream, extraData, err := m.sequenceHeader(index)
+	if err != nil {
+		return 0, err
+	} else if size := TagHeaderSize + MaxVideoDataHeaderSize + len(extraData); len(dst) < size {
+		return 0, fmt.Errorf("dst buffer too small, need %d bytes", size)
+	}
+
+	n := m.Input(dst, stream.MediaType, len(extraData), int64(ts), int64(ts), true, 0)
+	copy(dst[n:], extraData)
+	return n + len(extraData), nil
+}
+
+// WriteSequenceEnd 写入视频序列结束tag, 只支持AVC和增强flv编码器
+func (m *Muxer) WriteSequenceEnd(dst []byte, index int, ts uint32) (int, error) {
+	if index < 0 || index >= m.Tracks.Size() {
+		return 0, fmt.Errorf("invalid track index %d", index)
+	} else if utils.AVMediaTypeVideo != m.Tracks.Get(index).GetStream().MediaType || m.VideoData.CodecID < VideoCodecIDAVC {
+		return 0, fmt.Errorf("sequence end is not supported for track %d", index)
+	} else if len(dst) < TagHeaderSize+5 {
+		return 0, fmt.Errorf("dst buffer too small, need %d bytes", TagHeaderSize+5)
+	}
+
+	n := m.VideoData.MarshalSequenceEnd(dst[TagHeaderSize:])
+	return m.WriteTag(dst, TagTypeVideoData, uint32(n), ts) + n, nil
+}
+
+// updateCodec 使用track当前的编码器信息更新tag头
+func (m *Muxer) updateCodec(stream *avformat.AVStream) error {
+	if utils.AVMediaTypeVideo == stream.MediaType {
+		data, err := NewVideoData(stream.CodecID)
+		if err != nil {
+			return err
+		} else if err = m.checkVideoCodec(data.CodecID); err != nil {
+			return err
+		}
+
+		// AnnexB输入重新从track的编码器信息初始化参数集
+		m.VideoData = *data
+		m.videoParameterSets = nil
+	} else if utils.AVMediaTypeAudio == stream.MediaType {
+		data, err := NewAudioData(stream.CodecID, stream.SampleRate, stream.SampleSize, stream.Channels)
+		if err != nil {
+			return err
+		}
+
+		m.AudioData = *data
+	}
+
+	return nil
+}
+
+// WriteScriptData 写入完整的脚本tag(包含tag头), payload为nil时只写入名称
+func (m *Muxer) WriteScriptData(dst []byte, name string, payload amf0.Element, ts uint32) (int, error) {
+	data := amf0.Data{}
+	data.AddString(name)
+	if payload != nil {
+		data.Add(payload)
+	}
+
+	if size := TagHeaderSize + data.MarshalSize(); len(dst) < size {
+		return 0, fmt.Errorf("dst buffer too small, need %d bytes", size)
+	}
+
+	n, err := data.Marshal(dst[TagHeaderSize:])
+	if err != nil {
+		return 0, err
+	}
+
+	return m.WriteTag(dst, TagTypeScriptData, uint32(n), ts) + n, nil
+}
+
+func (m *Muxer) WriteCuePoint(dst []byte, cuePoint *CuePoint, ts uint32) (int, error) {
+	return m.WriteScriptData(dst, ScriptDataNameOnCuePoint, cuePoint.Object(), ts)
+}
+
+func (m *Muxer) WriteTextData(dst []byte, textData *TextData, ts uint32) (int, error) {
+	return m.WriteScriptData(dst, ScriptDataNameOnTextData, textData.Object(), ts)
+}
+
+func (m *Muxer) WriteCaptionInfo(dst []byte, captionInfo *CaptionInfo, ts uint32) (int, error) {
+	return m.WriteScriptData(dst, ScriptDataNameOnCaptionInfo, captionInfo.Object(), ts)
+}
+
 func (m *Muxer) WriteTag(dst []byte, tag TagType, dataSize, timestamp uint32) int {
 	binary.BigEndian.PutUint32(dst, m.prevTagSize)
 	dst[4] = byte(tag)
@@ -0,0 +1,121 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/lkmio/avformat/utils"
+)
+
+const (
+	H264NalSlice    = 1
+	H264NalIDRSlice = 5
+	H264NalSEI      = 6
+	H264NalSPS      = 7
+	H264NalPPS      = 8
+	H264NalAUD      = 9
+
+	HEVCNalVPS = 32
+	HEVCNalSPS = 33
+	HEVCNalPPS = 34
+	HEVCNalAUD = 35
+)
+
+// IsAnnexB 判断数据是否以start code开头
+func IsAnnexB(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x0, 0x0, 0x1}) || bytes.HasPrefix(data, []byte{0x0, 0x0, 0x0, 0x1})
+}
+
+// SplitAnnexB 按start code切分AnnexB数据, 回调的nalu不包含start code
+func SplitAnnexB(data []byte, cb func(nalu []byte)) {
+	var start = -1
+	length := len(data)
+
+	for i := 0; i+2 < length; {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			i++
+			continue
+		}
+
+		if start >= 0 {
+			// 去掉4字节start code的前导0和trailing_zero_8bits
+			end := i
+			for end > start && data[end-1] == 0 {
+				end--
+			}
+
+			if end > start {
+				cb(data[start:end])
+			}
+		}
+
+		i += 3
+		start = i
+	}
+
+	if start >= 0 && start < length {
+		cb(data[start:])
+	}
+}
+
+// SplitAVCC 按长度前缀切分AVCC数据
+func SplitAVCC(data []byte, lengthSize int, cb func(nalu []byte)) {
+	for offset := 0; offset+lengthSize <= len(data); {
+		var size int
+		for i := 0; i < lengthSize; i++ {
+			size = size<<8 | int(data[offset+i])
+		}
+
+		offset += lengthSize
+		if size == 0 || offset+size > len(data) {
+			return
+		}
+
+		cb(data[offset : offset+size])
+		offset += size
+	}
+}
+
+// NalUnitType 返回nalu类型
+func NalUnitType(id utils.AVCodecID, nalu []byte) int {
+	if len(nalu) == 0 {
+		return -1
+	} else if utils.AVCodecIdH265 == id {
+		return int(nalu[0] >> 1 & 0x3F)
+	}
+
+	return int(nalu[0] & 0x1F)
+}
+
+// RemoveEmulationPrevention 去除防竞争字节(0x000003), 返回RBSP
+func RemoveEmulationPrevention(data []byte) []byte {
+	if bytes.Index(data, []byte{0x0, 0x0, 0x3}) < 0 {
+		return data
+	}
+
+	rbsp := make([]byte, 0, len(data))
+	var zeros int
+	for _, b := range data {
+		if zeros >= 2 && b == 0x3 {
+			zeros = 0
+			continue
+		}
+
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+
+		rbsp = append(rbsp, b)
+	}
+
+	return rbsp
+}
+
+// appendAVCCNalu 追加4字节长度前缀的nalu
+func appendAVCCNalu(dst []byte, nalu []byte) []byte {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(nalu)))
+	dst = append(dst, size[:]...)
+	return append(dst, nalu...)
+}
@@ -0,0 +1,43 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	OpusSampleRate = 48000 // opus解码输出固定为48k
+)
+
+// OpusHead RFC 7845 5.1 ID头
+type OpusHead struct {
+	Version         int
+	Channels        int
+	PreSkip         int
+	InputSampleRate int // 编码前的原始采样率, 仅供参考
+	OutputGain      int
+	MappingFamily   int
+}
+
+// ParseOpusHead 解析OpusHead
+func ParseOpusHead(data []byte) (*OpusHead, error) {
+	if len(data) < 19 || !bytes.HasPrefix(data, []byte("OpusHead")) {
+		return nil, fmt.Errorf("invalid opus head")
+	}
+
+	head := &OpusHead{
+		Version:         int(data[8]),
+		Channels:        int(data[9]),
+		PreSkip:         int(binary.LittleEndian.Uint16(data[10:])),
+		InputSampleRate: int(binary.LittleEndian.Uint32(data[12:])),
+		OutputGain:      int(int16(binary.LittleEndian.Uint16(data[16:]))),
+		MappingFamily:   int(data[18]),
+	}
+
+	if head.Channels == 0 {
+		return nil, fmt.Errorf("invalid opus channel count")
+	}
+
+	return head, nil
+}
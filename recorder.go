@@ -0,0 +1,273 @@
+package flv
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv/amf0"
+	"io"
+	"time"
+)
+
+// RecordFile 录制文件, 关闭前需要读取和回填文件头中的onMetaData. *os.File满足该接口
+type RecordFile interface {
+	io.ReadWriteSeeker
+	io.Closer
+}
+
+// recordOutput 带缓冲的输出, 统计写入的字节数. 不实现io.Closer, Writer.Close不会关闭文件
+type recordOutput struct {
+	*bufio.Writer
+	n int64
+}
+
+func (o *recordOutput) Write(p []byte) (int, error) {
+	n, err := o.Writer.Write(p)
+	o.n += int64(n)
+	return n, err
+}
+
+// recordSegment 正在录制的文件
+type recordSegment struct {
+	file      RecordFile
+	output    *recordOutput
+	writer    *Writer
+	base      int64 // 第一帧的时间戳, 毫秒
+	end       int64 // 主track最后一帧的结束时间, 相对base
+	boundary  time.Time
+	keyframes KeyframeIndex
+}
+
+// Recorder 实现Demuxer的Handler, 将直播流录制为多个flv文件. 达到最大时长, 最大大小或墙钟边界后, 在下一个视频关键帧处
+// 切分(没有视频时在任意音频帧处切分). 每个文件从关键帧开始, 包含flv头, onMetaData和sequence header, 时间戳从0开始.
+// 创建文件时在onMetaData中为关键帧索引预留空间, 文件关闭时原地回填duration, filesize和关键帧索引(keyframes.times/filepositions).
+// 回调中的错误保存后由Err和Close返回. 非线程安全.
+type Recorder struct {
+	MaxDuration       time.Duration  // 单个文件的最大时长, 0表示不限制
+	MaxSize           int64          // 单个文件的最大字节数, 0表示不限制
+	Interval          time.Duration  // 按墙钟边界切分, 边界为每天0点加整数倍Interval, 例如24*time.Hour每天0点切分. 0表示不按墙钟切分
+	Location          *time.Location // 墙钟边界使用的时区, nil时使用本地时区
+	KeyframeIndexSize int            // onMetaData中为关键帧索引预留的关键帧数, 关键帧更多时均匀减少
+
+	create        func(sequence int, start time.Time) (RecordFile, error)
+	now           func() time.Time
+	streams       []*avformat.AVStream
+	primary       int // 决定切分位置的track, 优先使用视频
+	primaryVideo  bool
+	segment       *recordSegment
+	sequence      int
+	lastDts       int64 // 主track上一帧的时间戳, 毫秒
+	frameDuration int64
+	err           error
+}
+
+func (r *Recorder) OnNewTrack(track avformat.Track) {
+	if r.err != nil {
+		return
+	} else if r.segment != nil {
+		r.err = fmt.Errorf("tracks must be added before writing packets")
+		return
+	}
+
+	stream := track.GetStream()
+	video := utils.AVMediaTypeVideo == stream.MediaType
+	if r.primary < 0 || (video && !r.primaryVideo) {
+		r.primary, r.primaryVideo = stream.Index, video
+	}
+
+	r.streams = append(r.streams, stream)
+}
+
+func (r *Recorder) OnTrackComplete() {
+}
+
+func (r *Recorder) OnTrackNotFind() {
+}
+
+func (r *Recorder) OnPacket(packet *avformat.AVPacket) {
+	if r.err != nil {
+		return
+	}
+
+	dts := packet.ConvertDts(1000)
+	keyframe := packet.Index == r.primary && (packet.Key || !r.primaryVideo)
+	if r.segment == nil {
+		// 丢弃第一个关键帧之前的帧
+		if !keyframe {
+			return
+		} else if r.err = r.openSegment(dts); r.err != nil {
+			return
+		}
+	} else if keyframe && r.rotate(dts) {
+		if r.err = r.closeSegment(); r.err != nil {
+			return
+		} else if r.err = r.openSegment(dts); r.err != nil {
+			return
+		}
+	}
+
+	s := r.segment
+	clone := *packet
+	clone.Timebase = 1000
+	clone.Dts = dts - s.base
+	clone.Pts = packet.ConvertPts(1000) - s.base
+	// 关键帧之后到达的音频可能早于关键帧
+	if clone.Dts < 0 {
+		clone.Pts -= clone.Dts
+		clone.Dts = 0
+	}
+
+	if r.err = s.writer.WritePacket(&clone); r.err != nil {
+		return
+	}
+
+	if packet.Index == r.primary {
+		if r.primaryVideo && packet.Key {
+			// WritePacket可能在关键帧前写入其他tag, 关键帧tag是最后一个tag
+			s.keyframes.Add(float64(clone.Dts)/1000, s.output.n-int64(s.writer.Muxer().PrevTagSize()))
+		}
+
+		if last := r.lastDts; dts > last && last >= s.base {
+			r.frameDuration = dts - last
+		}
+
+		s.end = clone.Dts + r.frameDuration
+		r.lastDts = dts
+	}
+}
+
+// OnCodecParametersChanged 编码器信息变化, 在当前文件中写入新的sequence header, 之后的文件使用新的编码器信息
+func (r *Recorder) OnCodecParametersChanged(track avformat.Track, ts uint32) {
+	if r.err != nil || r.segment == nil {
+		return
+	}
+
+	for i, stream := range r.streams {
+		if stream.Index == track.GetStream().Index {
+			rebased := int64(ts) - r.segment.base
+			if rebased < 0 {
+				rebased = 0
+			}
+
+			r.err = r.segment.writer.WriteSequenceHeader(i, uint32(rebased))
+			return
+		}
+	}
+}
+
+func (r *Recorder) OnSequenceEnd(track avformat.Track, ts uint32) {
+}
+
+// rotate 主track的关键帧处是否需要切换文件
+func (r *Recorder) rotate(dts int64) bool {
+	s := r.segment
+	return (r.MaxDuration > 0 && dts-s.base >= r.MaxDuration.Milliseconds()) ||
+		(r.MaxSize > 0 && s.output.n >= r.MaxSize) ||
+		(r.Interval > 0 && !r.now().Before(s.boundary))
+}
+
+// nextBoundary 返回t之后的第一个墙钟边界, 边界不跨过第二天0点
+func (r *Recorder) nextBoundary(t time.Time) time.Time {
+	location := r.Location
+	if location == nil {
+		location = time.Local
+	}
+
+	t = t.In(location)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+	next := day.AddDate(0, 0, 1)
+	if boundary := day.Add((t.Sub(day)/r.Interval + 1) * r.Interval); boundary.Before(next) {
+		return boundary
+	}
+
+	return next
+}
+
+// openSegment 创建新的文件并写入flv头, onMetaData和sequence header
+func (r *Recorder) openSegment(dts int64) error {
+	now := r.now()
+	file, err := r.create(r.sequence, now)
+	if err != nil {
+		return err
+	}
+
+	r.sequence++
+	// duration和filesize占位, 关闭时回填
+	metaData := &amf0.Object{}
+	metaData.AddNumberProperty("duration", 0)
+	metaData.AddNumberProperty("filesize", 0)
+	for _, stream := range r.streams {
+		if utils.AVMediaTypeVideo == stream.MediaType && stream.CodecParameters != nil && stream.CodecParameters.Width() > 0 {
+			metaData.AddNumberProperty("width", float64(stream.CodecParameters.Width()))
+			metaData.AddNumberProperty("height", float64(stream.CodecParameters.Height()))
+		}
+	}
+
+	ReserveKeyframeIndex(metaData, r.KeyframeIndexSize)
+
+	s := &recordSegment{
+		file:   file,
+		output: &recordOutput{Writer: bufio.NewWriterSize(file, 64*1024)},
+		base:   dts,
+	}
+
+	if r.Interval > 0 {
+		s.boundary = r.nextBoundary(now)
+	}
+
+	r.segment = s
+	s.writer = NewWriterWithMuxer(s.output, NewMuxer(metaData))
+	for _, stream := range r.streams {
+		if _, err = s.writer.AddTrack(stream); err != nil {
+			return err
+		}
+	}
+
+	return s.writer.WriteHeader()
+}
+
+// closeSegment 写入最后一个PreviousTagSize, 原地回填onMetaData后关闭文件
+func (r *Recorder) closeSegment() error {
+	s := r.segment
+	if s == nil {
+		return nil
+	}
+
+	r.segment = nil
+	err := s.writer.Close()
+	if err == nil {
+		metaData := s.writer.Muxer().MetaData()
+		metaData.FindProperty("duration").Value = amf0.Number(float64(s.end) / 1000)
+		err = RewriteMetaData(s.file, s.output.n, metaData, &s.keyframes)
+	}
+
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (r *Recorder) Err() error {
+	return r.err
+}
+
+// Close 输入结束, 关闭当前文件. 需要先调用Demuxer.Flush输出缓存的帧
+func (r *Recorder) Close() error {
+	if err := r.closeSegment(); r.err == nil {
+		r.err = err
+	}
+
+	return r.err
+}
+
+// NewRecorder create创建第sequence个文件, start为文件开始录制的墙钟时间
+func NewRecorder(create func(sequence int, start time.Time) (RecordFile, error)) *Recorder {
+	return &Recorder{
+		KeyframeIndexSize: DefaultKeyframeIndexSize,
+		create:            create,
+		now:               time.Now,
+		primary:           -1,
+	}
+}
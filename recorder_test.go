@@ -0,0 +1,156 @@
+package flv
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv/amf0"
+	"github.com/lkmio/flv/internal/flvtest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// runTestRecorder 录制第5帧到第64帧, 第一个关键帧为第10帧, 返回录制的文件
+func runTestRecorder(t *testing.T, recorder *Recorder) [][]byte {
+	input := &bytes.Buffer{}
+	writer := NewWriter(input)
+	flvtest.AddTracks(writer)
+	utils.Assert(writer.WriteHeader() == nil)
+	flvtest.WriteGOPs(writer, 5, 60)
+
+	dir := t.TempDir()
+	var paths []string
+	recorder.create = func(sequence int, start time.Time) (RecordFile, error) {
+		utils.Assert(sequence == len(paths))
+		paths = append(paths, filepath.Join(dir, fmt.Sprintf("%d.flv", sequence)))
+		return os.Create(paths[sequence])
+	}
+
+	demuxer := NewDemuxer(true)
+	demuxer.SetHandler(recorder)
+	_, err := demuxer.Input(input.Bytes())
+	utils.Assert(err == nil)
+	demuxer.Flush()
+	demuxer.Close()
+	utils.Assert(recorder.Close() == nil)
+
+	var files [][]byte
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		utils.Assert(err == nil)
+		files = append(files, data)
+	}
+
+	return files
+}
+
+// checkTestRecording 校验文件从关键帧开始, 时间戳从0开始, onMetaData中的时长, 文件大小和关键帧索引正确
+func checkTestRecording(data []byte, first, frames int) {
+	collector := &PacketCollector{}
+	demuxer := NewDemuxer(false)
+	demuxer.SetHandler(collector)
+	_, err := demuxer.Input(data)
+	utils.Assert(err == nil)
+	demuxer.Flush()
+
+	var video int
+	for _, packet := range collector.packets {
+		if packet.Index != 0 {
+			continue
+		}
+
+		utils.Assert(packet.Dts == int64(video*40) && packet.Data[5] == byte(first+video))
+		utils.Assert(packet.Key == ((first+video)%10 == 0))
+		video++
+	}
+
+	utils.Assert(video == frames && collector.packets[0].Key)
+
+	metaData := amf0.ToObject(demuxer.Metadata().Get(1))
+	duration, _ := amf0.ToNumber(metaData.FindProperty("duration").Value)
+	size, _ := amf0.ToNumber(metaData.FindProperty("filesize").Value)
+	utils.Assert(duration == float64(frames*40)/1000 && int(size) == len(data))
+
+	keyframes := amf0.ToObject(metaData.FindProperty("keyframes").Value)
+	times := keyframes.FindProperty("times").Value.(amf0.StrictArray)
+	positions := keyframes.FindProperty("filepositions").Value.(amf0.StrictArray)
+	utils.Assert(len(times) == (frames+9)/10 && len(positions) == len(times))
+	for i := range positions {
+		position, _ := amf0.ToNumber(positions[i])
+		ts, _ := amf0.ToNumber(times[i])
+		tag := data[int(position):]
+		utils.Assert(ts == float64(i*400)/1000)
+		utils.Assert(TagType(tag[0]) == TagTypeVideoData && tag[11] == 0x17 && tag[12] == 1)
+		utils.Assert(int(tag[4])<<16|int(tag[5])<<8|int(tag[6]) == i*400)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	// 达到1秒后的第一个关键帧切分
+	recorder := NewRecorder(nil)
+	recorder.MaxDuration = time.Second
+	files := runTestRecorder(t, recorder)
+	utils.Assert(len(files) == 2)
+	checkTestRecording(files[0], 10, 30)
+	checkTestRecording(files[1], 40, 25)
+
+	// 每个关键帧切分
+	recorder = NewRecorder(nil)
+	recorder.MaxSize = 1
+	files = runTestRecorder(t, recorder)
+	utils.Assert(len(files) == 6)
+	checkTestRecording(files[0], 10, 10)
+	checkTestRecording(files[5], 60, 5)
+
+	// 墙钟每次读取前进1分钟, 11点后的第一个关键帧切分
+	clock := time.Date(2026, 10, 19, 10, 57, 0, 0, time.UTC)
+	recorder = NewRecorder(nil)
+	recorder.Interval = time.Hour
+	recorder.Location = time.UTC
+	recorder.now = func() time.Time {
+		clock = clock.Add(time.Minute)
+		return clock
+	}
+
+	files = runTestRecorder(t, recorder)
+	utils.Assert(len(files) == 2)
+	checkTestRecording(files[0], 10, 20)
+	checkTestRecording(files[1], 30, 35)
+
+	// 边界不跨过第二天0点
+	recorder.Interval = 7 * time.Hour
+	utils.Assert(recorder.nextBoundary(time.Date(2026, 10, 19, 22, 30, 0, 0, time.UTC)).Equal(time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)))
+	utils.Assert(recorder.nextBoundary(time.Date(2026, 10, 19, 7, 0, 0, 0, time.UTC)).Equal(time.Date(2026, 10, 19, 14, 0, 0, 0, time.UTC)))
+}
+
+func TestRecorderKeyframeIndex(t *testing.T) {
+	// 预留2个关键帧, 6个关键帧均匀减少到2个, 原地回填不改变文件大小
+	recorder := NewRecorder(nil)
+	recorder.KeyframeIndexSize = 2
+	files := runTestRecorder(t, recorder)
+	utils.Assert(len(files) == 1)
+
+	demuxer := NewDemuxer(false)
+	demuxer.SetHandler(&PacketCollector{})
+	_, err := demuxer.Input(files[0])
+	utils.Assert(err == nil)
+
+	metaData := amf0.ToObject(demuxer.Metadata().Get(1))
+	size, _ := amf0.ToNumber(metaData.FindProperty("filesize").Value)
+	utils.Assert(int(size) == len(files[0]))
+
+	keyframes := amf0.ToObject(metaData.FindProperty("keyframes").Value)
+	times := keyframes.FindProperty("times").Value.(amf0.StrictArray)
+	positions := keyframes.FindProperty("filepositions").Value.(amf0.StrictArray)
+	utils.Assert(len(times) == 2 && len(positions) == 2)
+	for i, expected := range []int{0, 1200} {
+		ts, _ := amf0.ToNumber(times[i])
+		position, _ := amf0.ToNumber(positions[i])
+		tag := files[0][int(position):]
+		utils.Assert(ts == float64(expected)/1000)
+		utils.Assert(TagType(tag[0]) == TagTypeVideoData && tag[11] == 0x17)
+		utils.Assert(int(tag[4])<<16|int(tag[5])<<8|int(tag[6]) == expected)
+	}
+}
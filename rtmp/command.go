@@ -0,0 +1,258 @@
+package rtmp
+
+import (
+	"fmt"
+	"github.com/lkmio/flv"
+	"github.com/lkmio/flv/amf0"
+)
+
+// NetConnection和NetStream命令
+const (
+	CommandConnect       = "connect"
+	CommandResult        = "_result"
+	CommandError         = "_error"
+	CommandCreateStream  = "createStream"
+	CommandReleaseStream = "releaseStream"
+	CommandFCPublish     = "FCPublish"
+	CommandFCUnpublish   = "FCUnpublish"
+	CommandPublish       = "publish"
+	CommandPlay          = "play"
+	CommandDeleteStream  = "deleteStream"
+	CommandCloseStream   = "closeStream"
+	CommandOnStatus      = "onStatus"
+)
+
+// onStatus的level和code
+const (
+	StatusLevelStatus = "status"
+	StatusLevelError  = "error"
+
+	StatusConnectSuccess     = "NetConnection.Connect.Success"
+	StatusConnectRejected    = "NetConnection.Connect.Rejected"
+	StatusPublishStart       = "NetStream.Publish.Start"
+	StatusPublishBadName     = "NetStream.Publish.BadName"
+	StatusUnpublishSuccess   = "NetStream.Unpublish.Success"
+	StatusPlayStart          = "NetStream.Play.Start"
+	StatusPlayReset          = "NetStream.Play.Reset"
+	StatusPlayStreamNotFound = "NetStream.Play.StreamNotFound"
+)
+
+// Command AMF0命令消息: 命令名, 事务id, 命令对象和参数. 命令对象为nil时编码为Null
+type Command struct {
+	Name          string
+	TransactionID float64
+	Object        *amf0.Object
+	Arguments     []amf0.Element
+}
+
+// Marshal 编码为AMF0命令消息的payload
+func (c *Command) Marshal() ([]byte, error) {
+	data := amf0.Data{}
+	data.AddString(c.Name)
+	data.AddNumber(c.TransactionID)
+	if c.Object != nil {
+		data.Add(c.Object)
+	} else {
+		data.Add(amf0.Null{})
+	}
+
+	for _, argument := range c.Arguments {
+		data.Add(argument)
+	}
+
+	payload := make([]byte, data.MarshalSize())
+	if _, err := data.Marshal(payload); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// Message 编码为指定消息流上的命令消息
+func (c *Command) Message(streamID uint32) (*Message, error) {
+	payload, err := c.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{Type: MessageTypeCommandAMF0, StreamID: streamID, Payload: payload}, nil
+}
+
+// Argument 返回第index个参数, 不存在返回nil
+func (c *Command) Argument(index int) amf0.Element {
+	if index >= len(c.Arguments) {
+		return nil
+	}
+
+	return c.Arguments[index]
+}
+
+// StringArgument 返回第index个字符串参数
+func (c *Command) StringArgument(index int) (string, bool) {
+	return amf0.ToString(c.Argument(index))
+}
+
+// NumberArgument 返回第index个数字参数
+func (c *Command) NumberArgument(index int) (float64, bool) {
+	return amf0.ToNumber(c.Argument(index))
+}
+
+// UnmarshalCommand 解析AMF0命令消息, AMF3命令消息需要先去掉第一个字节
+func UnmarshalCommand(payload []byte) (*Command, error) {
+	data := amf0.Data{}
+	if err := data.Unmarshal(payload); err != nil {
+		return nil, err
+	} else if data.Size() < 2 {
+		return nil, fmt.Errorf("invalid command message")
+	}
+
+	name, ok := amf0.ToString(data.Get(0))
+	if !ok {
+		return nil, fmt.Errorf("invalid command name")
+	}
+
+	// 部分客户端的onStatus等命令没有事务id
+	command := &Command{Name: name}
+	index := 1
+	if id, ok := amf0.ToNumber(data.Get(1)); ok {
+		command.TransactionID = id
+		index++
+	}
+
+	if index < data.Size() {
+		command.Object = amf0.ToObject(data.Get(index))
+		index++
+	}
+
+	for ; index < data.Size(); index++ {
+		command.Arguments = append(command.Arguments, data.Get(index))
+	}
+
+	return command, nil
+}
+
+// ConnectParameters connect命令对象中的常用属性
+type ConnectParameters struct {
+	App            string
+	FlashVer       string
+	TcURL          string
+	SwfURL         string
+	PageURL        string
+	ObjectEncoding float64
+	Capabilities   *flv.Capabilities // 增强RTMP能力, 传统客户端为nil
+	Object         *amf0.Object      // 完整的命令对象
+}
+
+// ParseConnectParameters 解析connect命令的命令对象
+func ParseConnectParameters(command *Command) (*ConnectParameters, error) {
+	if CommandConnect != command.Name || command.Object == nil {
+		return nil, fmt.Errorf("invalid connect command")
+	}
+
+	parameters := &ConnectParameters{Object: command.Object}
+	stringProperty := func(name string) string {
+		if property := command.Object.FindProperty(name); property != nil {
+			value, _ := amf0.ToString(property.Value)
+			return value
+		}
+
+		return ""
+	}
+
+	parameters.App = stringProperty("app")
+	parameters.FlashVer = stringProperty("flashVer")
+	parameters.TcURL = stringProperty("tcUrl")
+	parameters.SwfURL = stringProperty("swfUrl")
+	parameters.PageURL = stringProperty("pageUrl")
+	if property := command.Object.FindProperty("objectEncoding"); property != nil {
+		parameters.ObjectEncoding, _ = amf0.ToNumber(property.Value)
+	}
+
+	parameters.Capabilities = flv.UnmarshalCapabilities(command.Object)
+
+	return parameters, nil
+}
+
+// NewConnectCommand 创建connect命令, 事务id固定为1
+func NewConnectCommand(app, tcURL string) *Command {
+	object := &amf0.Object{}
+	object.AddStringProperty("app", app)
+	object.AddStringProperty("type", "nonprivate")
+	object.AddStringProperty("flashVer", "FMLE/3.0 (compatible; FMSc/1.0)")
+	object.AddStringProperty("tcUrl", tcURL)
+	return &Command{Name: CommandConnect, TransactionID: 1, Object: object}
+}
+
+// NewResultCommand 创建_result响应
+func NewResultCommand(transactionID float64, object *amf0.Object, arguments ...amf0.Element) *Command {
+	return &Command{Name: CommandResult, TransactionID: transactionID, Object: object, Arguments: arguments}
+}
+
+// NewErrorCommand 创建_error响应, 参数为状态对象
+func NewErrorCommand(transactionID float64, code, description string) *Command {
+	return &Command{Name: CommandError, TransactionID: transactionID, Arguments: []amf0.Element{NewStatusObject(StatusLevelError, code, description)}}
+}
+
+// NewConnectResult 创建connect成功的响应
+func NewConnectResult(transactionID, objectEncoding float64) *Command {
+	properties := &amf0.Object{}
+	properties.AddStringProperty("fmsVer", "FMS/3,0,1,123")
+	properties.AddNumberProperty("capabilities", 31)
+
+	information := NewStatusObject(StatusLevelStatus, StatusConnectSuccess, "Connection succeeded.")
+	information.AddNumberProperty("objectEncoding", objectEncoding)
+	return NewResultCommand(transactionID, properties, information)
+}
+
+// NewCreateStreamCommand 创建createStream命令
+func NewCreateStreamCommand(transactionID float64) *Command {
+	return &Command{Name: CommandCreateStream, TransactionID: transactionID}
+}
+
+// NewPublishCommand 创建publish命令, publishType为live/record/append
+func NewPublishCommand(name, publishType string) *Command {
+	return &Command{Name: CommandPublish, Arguments: []amf0.Element{amf0.String(name), amf0.String(publishType)}}
+}
+
+// NewPlayCommand 创建play命令, start为-2时先播放直播流, 没有直播流时播放录制的流
+func NewPlayCommand(name string, start float64) *Command {
+	return &Command{Name: CommandPlay, Arguments: []amf0.Element{amf0.String(name), amf0.Number(start)}}
+}
+
+// NewDeleteStreamCommand 创建deleteStream命令
+func NewDeleteStreamCommand(streamID uint32) *Command {
+	return &Command{Name: CommandDeleteStream, Arguments: []amf0.Element{amf0.Number(streamID)}}
+}
+
+// NewStatusObject 创建onStatus和_error使用的状态对象
+func NewStatusObject(level, code, description string) *amf0.Object {
+	object := &amf0.Object{}
+	object.AddStringProperty("level", level)
+	object.AddStringProperty("code", code)
+	object.AddStringProperty("description", description)
+	return object
+}
+
+// NewOnStatusCommand 创建onStatus命令
+func NewOnStatusCommand(level, code, description string) *Command {
+	return &Command{Name: CommandOnStatus, Arguments: []amf0.Element{NewStatusObject(level, code, description)}}
+}
+
+// ParseStatus 返回onStatus/_error命令中状态对象的level和code
+func ParseStatus(command *Command) (string, string, bool) {
+	object := amf0.ToObject(command.Argument(0))
+	if object == nil {
+		return "", "", false
+	}
+
+	var level, code string
+	if property := object.FindProperty("level"); property != nil {
+		level, _ = amf0.ToString(property.Value)
+	}
+
+	if property := object.FindProperty("code"); property != nil {
+		code, _ = amf0.ToString(property.Value)
+	}
+
+	return level, code, true
+}
@@ -0,0 +1,407 @@
+package rtmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	DefaultChunkSize = 128
+	MaxChunkSize     = 0xFFFFFF
+	DefaultWindow    = 2500000
+
+	extendedTimestamp = 0xFFFFFF
+	maxMessageSize    = 0xFFFFFF
+)
+
+// chunkStream 一个chunk stream的消息头状态
+type chunkStream struct {
+	timestamp uint32 // 当前消息的绝对时间戳
+	delta     uint32 // 最近一次消息头中的时间戳字段, fmt0为绝对时间戳
+	length    int
+	typeID    MessageType
+	streamID  uint32
+	extended  bool // 最近的消息头使用了扩展时间戳, 后续fmt3的chunk也携带扩展时间戳
+	used      bool
+	deltaSet  bool // 写入时已经发送过fmt1/fmt2, 新消息可以使用fmt3
+
+	payload []byte // 读取中的消息
+}
+
+// Conn RTMP chunk stream连接, 握手完成后使用. 读取时自动处理Set Chunk Size, Abort, Window Acknowledgement Size
+// 和Ping请求, 并按窗口大小回复Acknowledgement. 读取只能在一个协程中进行, 写入是线程安全的.
+type Conn struct {
+	reader *bufio.Reader
+
+	readChunkSize  int
+	readStreams    map[int]*chunkStream
+	bytesRead      uint32
+	lastAck        uint32
+	peerWindow     uint32 // 对端要求的确认窗口大小
+	peerBandwidth  uint32
+	header         [18]byte
+	extendedBuffer [4]byte
+
+	mutex          sync.Mutex
+	writer         *bufio.Writer
+	writeChunkSize int
+	writeStreams   map[int]*chunkStream
+}
+
+// ReadChunkSize 返回对端的chunk大小
+func (c *Conn) ReadChunkSize() int {
+	return c.readChunkSize
+}
+
+// PeerBandwidth 返回对端通过Set Peer Bandwidth设置的带宽
+func (c *Conn) PeerBandwidth() uint32 {
+	return c.peerBandwidth
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.bytesRead += uint32(n)
+	return n, err
+}
+
+func (c *Conn) readFull(p []byte) error {
+	_, err := io.ReadFull(c, p)
+	return err
+}
+
+// readChunk 读取一个chunk, 消息完整时返回消息
+func (c *Conn) readChunk() (*Message, error) {
+	// basic header
+	if err := c.readFull(c.header[:1]); err != nil {
+		return nil, err
+	}
+
+	fmtType := c.header[0] >> 6
+	csid := int(c.header[0] & 0x3F)
+	if csid == 0 {
+		if err := c.readFull(c.header[:1]); err != nil {
+			return nil, err
+		}
+
+		csid = 64 + int(c.header[0])
+	} else if csid == 1 {
+		if err := c.readFull(c.header[:2]); err != nil {
+			return nil, err
+		}
+
+		csid = 64 + int(c.header[0]) + int(c.header[1])*256
+	}
+
+	stream := c.readStreams[csid]
+	if stream == nil {
+		if fmtType != 0 {
+			return nil, fmt.Errorf("chunk stream %d must start with fmt0", csid)
+		}
+
+		stream = &chunkStream{}
+		c.readStreams[csid] = stream
+	}
+
+	// message header
+	headerSize := [4]int{11, 7, 3, 0}[fmtType]
+	if err := c.readFull(c.header[:headerSize]); err != nil {
+		return nil, err
+	}
+
+	if fmtType < 3 {
+		stream.delta = uint32(c.header[0])<<16 | uint32(c.header[1])<<8 | uint32(c.header[2])
+		stream.extended = stream.delta == extendedTimestamp
+		if fmtType < 2 {
+			stream.length = int(c.header[3])<<16 | int(c.header[4])<<8 | int(c.header[5])
+			stream.typeID = MessageType(c.header[6])
+		}
+
+		if fmtType == 0 {
+			stream.streamID = binary.LittleEndian.Uint32(c.header[7:])
+		}
+	}
+
+	if stream.extended {
+		if err := c.readFull(c.extendedBuffer[:]); err != nil {
+			return nil, err
+		}
+
+		// fmt3的扩展时间戳和消息头中的一致, 不更新
+		if fmtType < 3 {
+			stream.delta = binary.BigEndian.Uint32(c.extendedBuffer[:])
+		}
+	}
+
+	// 新消息开始, fmt3的新消息沿用上一个时间戳增量
+	if fmtType < 3 || stream.payload == nil {
+		if fmtType == 0 {
+			stream.timestamp = stream.delta
+		} else {
+			stream.timestamp += stream.delta
+		}
+
+		if stream.length > maxMessageSize {
+			return nil, fmt.Errorf("message size %d exceeds limit", stream.length)
+		}
+
+		stream.payload = make([]byte, 0, stream.length)
+	}
+
+	size := stream.length - len(stream.payload)
+	if size > c.readChunkSize {
+		size = c.readChunkSize
+	}
+
+	offset := len(stream.payload)
+	stream.payload = stream.payload[:offset+size]
+	if err := c.readFull(stream.payload[offset:]); err != nil {
+		return nil, err
+	} else if len(stream.payload) < stream.length {
+		return nil, nil
+	}
+
+	message := &Message{
+		Type:          stream.typeID,
+		Timestamp:     stream.timestamp,
+		StreamID:      stream.streamID,
+		ChunkStreamID: csid,
+		Payload:       stream.payload,
+	}
+
+	stream.payload = nil
+	return message, nil
+}
+
+// ReadMessage 读取一个完整的消息. 协议控制消息和Ping请求在内部处理, 不返回给调用方
+func (c *Conn) ReadMessage() (*Message, error) {
+	for {
+		message, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+
+		// 按对端的窗口大小回复确认
+		if c.peerWindow > 0 && c.bytesRead-c.lastAck >= c.peerWindow {
+			c.lastAck = c.bytesRead
+			if err = c.WriteMessage(newUint32Message(MessageTypeAcknowledgement, c.bytesRead)); err != nil {
+				return nil, err
+			}
+		}
+
+		if message == nil {
+			continue
+		}
+
+		handled, err := c.handleProtocolMessage(message)
+		if err != nil {
+			return nil, err
+		} else if !handled {
+			return message, nil
+		}
+	}
+}
+
+func (c *Conn) handleProtocolMessage(message *Message) (bool, error) {
+	switch message.Type {
+	case MessageTypeSetChunkSize, MessageTypeAbort, MessageTypeAcknowledgement, MessageTypeWindowAckSize, MessageTypeSetPeerBandwidth:
+		if len(message.Payload) < 4 {
+			return true, fmt.Errorf("invalid protocol control message %d", message.Type)
+		}
+	case MessageTypeUserControl:
+		if len(message.Payload) >= 6 && UserControlPingRequest == binary.BigEndian.Uint16(message.Payload) {
+			return true, c.WriteMessage(NewUserControlMessage(UserControlPingResponse, binary.BigEndian.Uint32(message.Payload[2:])))
+		}
+
+		return false, nil
+	default:
+		return false, nil
+	}
+
+	value := binary.BigEndian.Uint32(message.Payload)
+	switch message.Type {
+	case MessageTypeSetChunkSize:
+		// 最高位必须为0
+		size := int(value & 0x7FFFFFFF)
+		if size < 1 || size > MaxChunkSize {
+			return true, fmt.Errorf("invalid chunk size %d", size)
+		}
+
+		c.readChunkSize = size
+	case MessageTypeAbort:
+		if stream := c.readStreams[int(value)]; stream != nil {
+			stream.payload = nil
+		}
+	case MessageTypeWindowAckSize:
+		c.peerWindow = value
+	case MessageTypeSetPeerBandwidth:
+		c.peerBandwidth = value
+	}
+
+	return true, nil
+}
+
+// WriteMessage 将消息拆分为chunk写出. 同一个chunk stream上的消息头尽量使用压缩格式
+func (c *Conn) WriteMessage(message *Message) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.writeMessage(message)
+}
+
+func (c *Conn) writeMessage(message *Message) error {
+	if len(message.Payload) > maxMessageSize {
+		return fmt.Errorf("message size %d exceeds limit", len(message.Payload))
+	}
+
+	csid := message.ChunkStreamID
+	if csid < 2 {
+		csid = defaultChunkStreamID(message.Type)
+	}
+
+	stream := c.writeStreams[csid]
+	if stream == nil {
+		stream = &chunkStream{}
+		c.writeStreams[csid] = stream
+	}
+
+	// 选择消息头格式, 时间戳回退或者stream id变化时使用fmt0
+	var fmtType byte
+	var delta uint32
+	length := len(message.Payload)
+	if stream.used && stream.streamID == message.StreamID && message.Timestamp >= stream.timestamp {
+		delta = message.Timestamp - stream.timestamp
+		fmtType = 1
+		if stream.typeID == message.Type && stream.length == length {
+			fmtType = 2
+			if stream.deltaSet && stream.delta == delta {
+				fmtType = 3
+			}
+		}
+	}
+
+	if fmtType == 0 {
+		delta = message.Timestamp
+	}
+
+	if fmtType < 3 {
+		stream.extended = delta >= extendedTimestamp
+		stream.deltaSet = fmtType > 0
+	}
+
+	stream.used = true
+	stream.timestamp = message.Timestamp
+	stream.delta = delta
+	stream.length = length
+	stream.typeID = message.Type
+	stream.streamID = message.StreamID
+
+	// 后续的chunk使用fmt3
+	for offset := 0; ; fmtType = 3 {
+		if err := c.writeChunkHeader(stream, csid, fmtType); err != nil {
+			return err
+		}
+
+		size := length - offset
+		if size > c.writeChunkSize {
+			size = c.writeChunkSize
+		}
+
+		if _, err := c.writer.Write(message.Payload[offset : offset+size]); err != nil {
+			return err
+		} else if offset += size; offset >= length {
+			break
+		}
+	}
+
+	return c.writer.Flush()
+}
+
+func (c *Conn) writeChunkHeader(stream *chunkStream, csid int, fmtType byte) error {
+	var header [18]byte
+	var n int
+
+	// basic header
+	if csid < 64 {
+		header[0] = fmtType<<6 | byte(csid)
+		n = 1
+	} else if csid < 64+256 {
+		header[0] = fmtType << 6
+		header[1] = byte(csid - 64)
+		n = 2
+	} else {
+		header[0] = fmtType<<6 | 1
+		binary.LittleEndian.PutUint16(header[1:], uint16(csid-64))
+		n = 3
+	}
+
+	if fmtType < 3 {
+		timestamp := stream.delta
+		if stream.extended {
+			timestamp = extendedTimestamp
+		}
+
+		header[n], header[n+1], header[n+2] = byte(timestamp>>16), byte(timestamp>>8), byte(timestamp)
+		n += 3
+		if fmtType < 2 {
+			header[n], header[n+1], header[n+2] = byte(stream.length>>16), byte(stream.length>>8), byte(stream.length)
+			header[n+3] = byte(stream.typeID)
+			n += 4
+		}
+
+		if fmtType == 0 {
+			binary.LittleEndian.PutUint32(header[n:], stream.streamID)
+			n += 4
+		}
+	}
+
+	if stream.extended {
+		binary.BigEndian.PutUint32(header[n:], stream.delta)
+		n += 4
+	}
+
+	_, err := c.writer.Write(header[:n])
+	return err
+}
+
+// SetChunkSize 通知对端并修改发送的chunk大小
+func (c *Conn) SetChunkSize(size int) error {
+	if size < 1 || size > MaxChunkSize {
+		return fmt.Errorf("invalid chunk size %d", size)
+	}
+
+	// 后续的消息在修改后才能写出
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.writeMessage(newUint32Message(MessageTypeSetChunkSize, uint32(size))); err != nil {
+		return err
+	}
+
+	c.writeChunkSize = size
+	return nil
+}
+
+// SetWindowAckSize 要求对端每收到size字节回复一次确认
+func (c *Conn) SetWindowAckSize(size uint32) error {
+	return c.WriteMessage(newUint32Message(MessageTypeWindowAckSize, size))
+}
+
+// SetPeerBandwidth 设置对端的输出带宽, limitType 0-硬限制/1-软限制/2-动态
+func (c *Conn) SetPeerBandwidth(size uint32, limitType byte) error {
+	message := newUint32Message(MessageTypeSetPeerBandwidth, size)
+	message.Payload = append(message.Payload, limitType)
+	return c.WriteMessage(message)
+}
+
+// NewConn 在握手完成的连接上创建chunk stream
+func NewConn(rw io.ReadWriter) *Conn {
+	return &Conn{
+		reader:         bufio.NewReaderSize(rw, 64*1024),
+		readChunkSize:  DefaultChunkSize,
+		readStreams:    make(map[int]*chunkStream),
+		writer:         bufio.NewWriterSize(rw, 64*1024),
+		writeChunkSize: DefaultChunkSize,
+		writeStreams:   make(map[int]*chunkStream),
+	}
+}
@@ -0,0 +1,208 @@
+package rtmp
+
+import (
+	"bytes"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"github.com/lkmio/flv/amf0"
+	"github.com/lkmio/flv/internal/flvtest"
+	"net"
+	"testing"
+)
+
+type packetCollector struct {
+	avformat.OnUnpackStreamLogger
+	tracks  []avformat.Track
+	packets []*avformat.AVPacket
+}
+
+func (p *packetCollector) OnNewTrack(track avformat.Track) {
+	p.tracks = append(p.tracks, track)
+}
+
+func (p *packetCollector) OnTrackComplete() {
+}
+
+func (p *packetCollector) OnPacket(packet *avformat.AVPacket) {
+	clone := *packet
+	clone.Data = make([]byte, len(packet.Data))
+	copy(clone.Data, packet.Data)
+	p.packets = append(p.packets, &clone)
+}
+
+// newTestWriter 创建音视频流的flv.Writer
+func newTestWriter(output interface{ Write([]byte) (int, error) }) *flv.Writer {
+	writer := flv.NewWriter(output)
+	flvtest.AddTracks(writer)
+	return writer
+}
+
+func TestHandshake(t *testing.T) {
+	for _, complex := range []bool{false, true} {
+		client, server := net.Pipe()
+		done := make(chan error)
+		go func() {
+			done <- ServerHandshake(server)
+		}()
+
+		utils.Assert(ClientHandshake(client, complex) == nil)
+		utils.Assert(<-done == nil)
+		client.Close()
+		server.Close()
+	}
+
+	// 复杂握手的digest可以被校验
+	c1 := newRandomPacket(clientVersion)
+	digest := signPacket(c1, GenuineFPKey[:30])
+	offset := findDigest(c1, GenuineFPKey[:30])
+	utils.Assert(offset >= 12 && bytes.Equal(c1[offset:offset+digestSize], digest))
+	c1[offset] ^= 0xFF
+	utils.Assert(findDigest(c1, GenuineFPKey[:30]) < 0)
+}
+
+func TestChunkStream(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	writer, reader := NewConn(client), NewConn(server)
+	messages := []*Message{
+		{Type: MessageTypeCommandAMF0, Payload: []byte{}},
+		{Type: MessageTypeAudio, Timestamp: 10, StreamID: 1, Payload: bytes.Repeat([]byte{1}, 128)},
+		{Type: MessageTypeAudio, Timestamp: 30, StreamID: 1, Payload: bytes.Repeat([]byte{2}, 128)},
+		// 相同的长度, 类型和时间戳增量, 新消息使用fmt3
+		{Type: MessageTypeAudio, Timestamp: 50, StreamID: 1, Payload: bytes.Repeat([]byte{3}, 128)},
+		{Type: MessageTypeVideo, Timestamp: 0xFFFFFF + 5, StreamID: 1, Payload: bytes.Repeat([]byte{4}, 1000)},
+		{Type: MessageTypeVideo, Timestamp: 0xFFFFFF + 45, StreamID: 1, Payload: bytes.Repeat([]byte{5}, 70000)},
+		// 时间戳回退
+		{Type: MessageTypeVideo, Timestamp: 100, StreamID: 1, Payload: bytes.Repeat([]byte{6}, 129)},
+		{Type: MessageTypeDataAMF0, Timestamp: 100, StreamID: 1, ChunkStreamID: 70, Payload: []byte{7}},
+		{Type: MessageTypeDataAMF0, Timestamp: 100, StreamID: 2, ChunkStreamID: 400, Payload: bytes.Repeat([]byte{8}, 300)},
+	}
+
+	go func() {
+		// 对端每收到1000字节回复确认
+		utils.Assert(writer.SetWindowAckSize(1000) == nil)
+		utils.Assert(writer.SetChunkSize(100) == nil)
+		for _, message := range messages {
+			utils.Assert(writer.WriteMessage(message) == nil)
+		}
+
+		utils.Assert(writer.SetChunkSize(4096) == nil)
+		for _, message := range messages {
+			utils.Assert(writer.WriteMessage(message) == nil)
+		}
+
+		utils.Assert(writer.WriteMessage(NewUserControlMessage(UserControlPingRequest, 1234)) == nil)
+	}()
+
+	acks := make(chan *Message, 1)
+	go func() {
+		// 读取对端的确认和ping响应
+		for {
+			message, err := writer.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			acks <- message
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		for _, expected := range messages {
+			message, err := reader.ReadMessage()
+			utils.Assert(err == nil)
+			utils.Assert(message.Type == expected.Type && message.Timestamp == expected.Timestamp && message.StreamID == expected.StreamID)
+			utils.Assert(bytes.Equal(message.Payload, expected.Payload))
+			if expected.ChunkStreamID > 0 {
+				utils.Assert(message.ChunkStreamID == expected.ChunkStreamID)
+			}
+		}
+	}
+
+	utils.Assert(reader.ReadChunkSize() == 4096)
+	utils.Assert(reader.lastAck > 0)
+
+	// ping请求由Conn自动响应
+	go func() {
+		_, _ = reader.ReadMessage()
+	}()
+
+	response := <-acks
+	utils.Assert(response.Type == MessageTypeUserControl)
+	utils.Assert(bytes.Equal(response.Payload, []byte{0x0, 0x7, 0x0, 0x0, 0x4, 0xD2}))
+}
+
+func TestTagConversion(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// play会话: Writer输出的flv流转换为RTMP消息
+	go func() {
+		conn := NewConn(client)
+		utils.Assert(conn.SetChunkSize(4096) == nil)
+
+		// 推流端的@setDataFrame和聚合消息
+		metadata := &amf0.Data{}
+		metadata.AddString("@setDataFrame")
+		metadata.AddString("onMetaData")
+		object := &amf0.Object{}
+		object.AddNumberProperty("width", 1280)
+		metadata.Add(object)
+		payload := make([]byte, metadata.MarshalSize())
+		_, err := metadata.Marshal(payload)
+		utils.Assert(err == nil)
+		utils.Assert(conn.WriteMessage(&Message{Type: MessageTypeDataAMF0, StreamID: 1, Payload: payload}) == nil)
+
+		writer := newTestWriter(NewTagWriter(conn, 1))
+		utils.Assert(writer.WriteHeader() == nil)
+		flvtest.WriteGOPs(writer, 0, 20)
+
+		// 两个音频帧的聚合消息, 时间戳相对第一个子消息
+		aggregate := &bytes.Buffer{}
+		muxer := flv.NewMuxer(nil)
+		for i := 0; i < 2; i++ {
+			tag := make([]byte, flv.TagHeaderSize+2)
+			muxer.WriteTag(tag, flv.TagTypeAudioData, 2, uint32(5000+i*40))
+			tag[15], tag[16] = 0xAF, 0x1
+			aggregate.Write(tag[4:])
+			aggregate.Write([]byte{0, 0, 0, 13})
+		}
+
+		utils.Assert(conn.WriteMessage(&Message{Type: MessageTypeAggregate, Timestamp: 800, StreamID: 1, Payload: aggregate.Bytes()}) == nil)
+		client.Close()
+	}()
+
+	handler := &packetCollector{}
+	demuxer := flv.NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	input := NewTagInput(demuxer)
+	conn := NewConn(server)
+	for {
+		message, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+
+		utils.Assert(message.StreamID == 1)
+		utils.Assert(input.Input(message) == nil)
+	}
+
+	width, _ := amf0.ToNumber(amf0.ToObject(demuxer.Metadata().Get(1)).FindProperty("width").Value)
+	utils.Assert(width == 1280)
+	utils.Assert(len(handler.tracks) == 2)
+
+	// 0-19帧和聚合消息中的第一帧, 每个track最后一帧缓存在demuxer中
+	var audio []*avformat.AVPacket
+	for _, packet := range handler.packets {
+		if utils.AVMediaTypeAudio == packet.MediaType {
+			audio = append(audio, packet)
+		}
+	}
+
+	utils.Assert(len(handler.packets) == 20*2)
+	utils.Assert(len(audio) == 21 && audio[20].Dts == 800)
+}
@@ -0,0 +1,180 @@
+package rtmp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	Version       = 3
+	HandshakeSize = 1536
+
+	digestSize = 32
+)
+
+var (
+	// GenuineFPKey 客户端的HMAC密钥, 前30字节用于C1的digest
+	GenuineFPKey = []byte{
+		'G', 'e', 'n', 'u', 'i', 'n', 'e', ' ', 'A', 'd', 'o', 'b', 'e', ' ',
+		'F', 'l', 'a', 's', 'h', ' ', 'P', 'l', 'a', 'y', 'e', 'r', ' ', '0', '0', '1',
+		0xF0, 0xEE, 0xC2, 0x4A, 0x80, 0x68, 0xBE, 0xE8, 0x2E, 0x00, 0xD0, 0xD1, 0x02, 0x9E, 0x7E, 0x57,
+		0x6E, 0xEC, 0x5D, 0x2D, 0x29, 0x80, 0x6F, 0xAB, 0x93, 0xB8, 0xE6, 0x36, 0xCF, 0xEB, 0x31, 0xAE,
+	}
+
+	// GenuineFMSKey 服务端的HMAC密钥, 前36字节用于S1的digest
+	GenuineFMSKey = []byte{
+		'G', 'e', 'n', 'u', 'i', 'n', 'e', ' ', 'A', 'd', 'o', 'b', 'e', ' ',
+		'F', 'l', 'a', 's', 'h', ' ', 'M', 'e', 'd', 'i', 'a', ' ',
+		'S', 'e', 'r', 'v', 'e', 'r', ' ', '0', '0', '1',
+		0xF0, 0xEE, 0xC2, 0x4A, 0x80, 0x68, 0xBE, 0xE8, 0x2E, 0x00, 0xD0, 0xD1, 0x02, 0x9E, 0x7E, 0x57,
+		0x6E, 0xEC, 0x5D, 0x2D, 0x29, 0x80, 0x6F, 0xAB, 0x93, 0xB8, 0xE6, 0x36, 0xCF, 0xEB, 0x31, 0xAE,
+	}
+
+	clientVersion = []byte{0x0C, 0x00, 0x0D, 0x0E}
+	serverVersion = []byte{0x04, 0x05, 0x00, 0x01}
+)
+
+func hmacSHA256(key []byte, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, d := range data {
+		h.Write(d)
+	}
+
+	return h.Sum(nil)
+}
+
+// digestOffset 返回C1/S1中digest的位置. scheme0的digest块在key块之前, scheme1在之后
+func digestOffset(data []byte, scheme int) int {
+	base := 8
+	if scheme == 1 {
+		base = 772
+	}
+
+	return (int(data[base])+int(data[base+1])+int(data[base+2])+int(data[base+3]))%728 + base + 4
+}
+
+// computeDigest 计算去掉digest后的C1/S1的HMAC
+func computeDigest(data []byte, offset int, key []byte) []byte {
+	return hmacSHA256(key, data[:offset], data[offset+digestSize:])
+}
+
+// findDigest 依次按两种scheme校验digest, 返回digest的位置, 没有找到返回-1
+func findDigest(data []byte, key []byte) int {
+	for _, scheme := range []int{0, 1} {
+		offset := digestOffset(data, scheme)
+		if hmac.Equal(data[offset:offset+digestSize], computeDigest(data, offset, key)) {
+			return offset
+		}
+	}
+
+	return -1
+}
+
+// newRandomPacket 生成C1/S1, time为0, version为空时是简单握手
+func newRandomPacket(version []byte) []byte {
+	packet := make([]byte, HandshakeSize)
+	_, _ = rand.Read(packet[8:])
+	copy(packet[4:8], version)
+	return packet
+}
+
+// signPacket 在scheme0的位置写入digest
+func signPacket(packet []byte, key []byte) []byte {
+	offset := digestOffset(packet, 0)
+	digest := computeDigest(packet, offset, key)
+	copy(packet[offset:], digest)
+	return digest
+}
+
+// newResponsePacket 生成复杂握手的C2/S2: 随机数据加上以对端digest派生的密钥计算的HMAC
+func newResponsePacket(peerDigest []byte, key []byte) []byte {
+	packet := make([]byte, HandshakeSize)
+	_, _ = rand.Read(packet)
+	digest := hmacSHA256(hmacSHA256(key, peerDigest), packet[:HandshakeSize-digestSize])
+	copy(packet[HandshakeSize-digestSize:], digest)
+	return packet
+}
+
+// ServerHandshake 服务端握手. C1的version不为0且digest校验通过时使用复杂握手, 否则使用简单握手
+func ServerHandshake(rw io.ReadWriter) error {
+	c0c1 := make([]byte, 1+HandshakeSize)
+	if _, err := io.ReadFull(rw, c0c1); err != nil {
+		return err
+	} else if Version != c0c1[0] {
+		return fmt.Errorf("unsupported rtmp version %d", c0c1[0])
+	}
+
+	c1 := c0c1[1:]
+	offset := -1
+	if binary.BigEndian.Uint32(c1[4:]) != 0 {
+		offset = findDigest(c1, GenuineFPKey[:30])
+	}
+
+	response := make([]byte, 0, 1+2*HandshakeSize)
+	response = append(response, Version)
+	if offset < 0 {
+		// 简单握手, S2回显C1
+		response = append(response, newRandomPacket(nil)...)
+		response = append(response, c1...)
+	} else {
+		s1 := newRandomPacket(serverVersion)
+		signPacket(s1, GenuineFMSKey[:36])
+		response = append(response, s1...)
+		response = append(response, newResponsePacket(c1[offset:offset+digestSize], GenuineFMSKey)...)
+	}
+
+	if _, err := rw.Write(response); err != nil {
+		return err
+	}
+
+	// C2不做校验, 部分客户端不按规范回复
+	c2 := make([]byte, HandshakeSize)
+	_, err := io.ReadFull(rw, c2)
+	return err
+}
+
+// ClientHandshake 客户端握手, complex为true时使用复杂握手并校验S1和S2
+func ClientHandshake(rw io.ReadWriter, complex bool) error {
+	var c1, c1Digest []byte
+	if complex {
+		c1 = newRandomPacket(clientVersion)
+		c1Digest = signPacket(c1, GenuineFPKey[:30])
+	} else {
+		c1 = newRandomPacket(nil)
+	}
+
+	if _, err := rw.Write(append([]byte{Version}, c1...)); err != nil {
+		return err
+	}
+
+	s0s1s2 := make([]byte, 1+2*HandshakeSize)
+	if _, err := io.ReadFull(rw, s0s1s2); err != nil {
+		return err
+	} else if Version != s0s1s2[0] {
+		return fmt.Errorf("unsupported rtmp version %d", s0s1s2[0])
+	}
+
+	s1, s2 := s0s1s2[1:1+HandshakeSize], s0s1s2[1+HandshakeSize:]
+	c2 := s1
+	if complex {
+		offset := findDigest(s1, GenuineFMSKey[:36])
+		if offset < 0 {
+			return fmt.Errorf("invalid s1 digest")
+		}
+
+		expected := hmacSHA256(hmacSHA256(GenuineFMSKey, c1Digest), s2[:HandshakeSize-digestSize])
+		if !bytes.Equal(expected, s2[HandshakeSize-digestSize:]) {
+			return fmt.Errorf("invalid s2 digest")
+		}
+
+		c2 = newResponsePacket(s1[offset:offset+digestSize], GenuineFPKey)
+	}
+
+	_, err := rw.Write(c2)
+	return err
+}
@@ -0,0 +1,133 @@
+// Package rtmp 实现RTMP握手, chunk stream, NetConnection/NetStream命令, 服务端会话和RTMP消息与flv tag之间的转换.
+package rtmp
+
+import (
+	"encoding/binary"
+	"github.com/lkmio/flv"
+)
+
+type MessageType byte
+
+const (
+	MessageTypeSetChunkSize     = MessageType(1)
+	MessageTypeAbort            = MessageType(2)
+	MessageTypeAcknowledgement  = MessageType(3)
+	MessageTypeUserControl      = MessageType(4)
+	MessageTypeWindowAckSize    = MessageType(5)
+	MessageTypeSetPeerBandwidth = MessageType(6)
+	MessageTypeAudio            = MessageType(8)
+	MessageTypeVideo            = MessageType(9)
+	MessageTypeDataAMF3         = MessageType(15)
+	MessageTypeSharedObjectAMF3 = MessageType(16)
+	MessageTypeCommandAMF3      = MessageType(17)
+	MessageTypeDataAMF0         = MessageType(18)
+	MessageTypeSharedObjectAMF0 = MessageType(19)
+	MessageTypeCommandAMF0      = MessageType(20)
+	MessageTypeAggregate        = MessageType(22)
+)
+
+// 常用的chunk stream id
+const (
+	ChunkStreamProtocol = 2
+	ChunkStreamCommand  = 3
+	ChunkStreamAudio    = 4
+	ChunkStreamData     = 5
+	ChunkStreamVideo    = 6
+)
+
+// User Control事件
+const (
+	UserControlStreamBegin      = uint16(0)
+	UserControlStreamEOF        = uint16(1)
+	UserControlStreamDry        = uint16(2)
+	UserControlSetBufferLength  = uint16(3)
+	UserControlStreamIsRecorded = uint16(4)
+	UserControlPingRequest      = uint16(6)
+	UserControlPingResponse     = uint16(7)
+)
+
+// Message RTMP消息, 时间戳单位毫秒
+type Message struct {
+	Type          MessageType
+	Timestamp     uint32
+	StreamID      uint32
+	ChunkStreamID int // 发送时使用的chunk stream id, 0按消息类型选择
+	Payload       []byte
+}
+
+// defaultChunkStreamID 按消息类型选择chunk stream id
+func defaultChunkStreamID(messageType MessageType) int {
+	switch messageType {
+	case MessageTypeSetChunkSize, MessageTypeAbort, MessageTypeAcknowledgement, MessageTypeUserControl, MessageTypeWindowAckSize, MessageTypeSetPeerBandwidth:
+		return ChunkStreamProtocol
+	case MessageTypeAudio:
+		return ChunkStreamAudio
+	case MessageTypeVideo:
+		return ChunkStreamVideo
+	case MessageTypeDataAMF0, MessageTypeDataAMF3:
+		return ChunkStreamData
+	default:
+		return ChunkStreamCommand
+	}
+}
+
+// NewUserControlMessage 创建User Control消息, 事件数据为一个或多个uint32
+func NewUserControlMessage(event uint16, values ...uint32) *Message {
+	payload := make([]byte, 2+4*len(values))
+	binary.BigEndian.PutUint16(payload, event)
+	for i, value := range values {
+		binary.BigEndian.PutUint32(payload[2+i*4:], value)
+	}
+
+	return &Message{Type: MessageTypeUserControl, Payload: payload}
+}
+
+func newUint32Message(messageType MessageType, value uint32) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, value)
+	return &Message{Type: messageType, Payload: payload}
+}
+
+// TagType 返回音视频和AMF0数据消息对应的flv tag类型, 其他消息返回0
+func (m *Message) TagType() flv.TagType {
+	switch m.Type {
+	case MessageTypeAudio:
+		return flv.TagTypeAudioData
+	case MessageTypeVideo:
+		return flv.TagTypeVideoData
+	case MessageTypeDataAMF0:
+		return flv.TagTypeScriptData
+	}
+
+	return 0
+}
+
+// Tag 返回消息对应的flv tag头
+func (m *Message) Tag() flv.Tag {
+	return flv.Tag{
+		Type:      m.TagType(),
+		DataSize:  len(m.Payload),
+		Timestamp: m.Timestamp,
+		StreamID:  int(m.StreamID),
+	}
+}
+
+// NewTagMessage 创建flv tag对应的RTMP消息, 不拷贝payload
+func NewTagMessage(tag flv.Tag, payload []byte) *Message {
+	var messageType MessageType
+	switch tag.Type {
+	case flv.TagTypeAudioData:
+		messageType = MessageTypeAudio
+	case flv.TagTypeVideoData:
+		messageType = MessageTypeVideo
+	default:
+		messageType = MessageTypeDataAMF0
+	}
+
+	return &Message{
+		Type:      messageType,
+		Timestamp: tag.Timestamp,
+		StreamID:  uint32(tag.StreamID),
+		Payload:   payload,
+	}
+}
@@ -0,0 +1,359 @@
+package rtmp
+
+import (
+	"fmt"
+	"github.com/lkmio/flv"
+	"github.com/lkmio/flv/amf0"
+	"io"
+	"sync"
+	"time"
+)
+
+// playStopTimeout 结束播放时等待来源WriteTo返回的时间
+var playStopTimeout = time.Second
+
+// ServerHandler 处理服务端会话的推流和拉流请求
+type ServerHandler interface {
+	// OnPublish 返回推流的flv流输出, 例如flv.Broadcaster. 输出实现了Close()时, 推流结束后调用
+	OnPublish(session *Session, app, name string) (io.Writer, error)
+
+	// OnPlay 返回播放的flv流来源, 例如flv.Subscriber. 来源实现了Close()时, 播放结束后调用, Close()需要使WriteTo返回.
+	// 没有实现Close()的来源, 播放结束时WriteTo没有及时返回会关闭连接
+	OnPlay(session *Session, app, name string) (io.WriterTo, error)
+}
+
+// ConnectHandler 可选接口, 校验connect命令, 返回错误时拒绝连接
+type ConnectHandler interface {
+	OnConnect(session *Session, parameters *ConnectParameters) error
+}
+
+type sessionState int
+
+const (
+	sessionStateInit = sessionState(iota)
+	sessionStateConnected
+	sessionStatePublishing
+	sessionStatePlaying
+)
+
+// Session 服务端会话, 处理connect, createStream, publish和play命令.
+// 推流的音视频消息转换为flv流写入OnPublish返回的输出, 播放时OnPlay返回的flv流转换为RTMP消息发送.
+type Session struct {
+	ChunkSize        int               // 发送的chunk大小
+	WindowAckSize    uint32            // 确认窗口和对端带宽
+	Capabilities     *flv.Capabilities // 向增强RTMP客户端声明的能力, nil不声明
+	RestrictPlayback bool              // 播放时按客户端connect命令中声明的能力限制或降级输出
+
+	rw         io.ReadWriter
+	conn       *Conn
+	handler    ServerHandler
+	state      sessionState
+	connect    *ConnectParameters
+	streamName string
+	streamID   uint32 // 最后创建的消息流id
+
+	sink  io.Writer
+	input *TagInput
+
+	mutex    sync.Mutex
+	source   io.WriterTo
+	playDone chan struct{}
+	playEnd  bool // 来源结束或者发送失败, 不是会话主动停止
+	playErr  error
+}
+
+// App 返回connect命令中的app
+func (s *Session) App() string {
+	if s.connect == nil {
+		return ""
+	}
+
+	return s.connect.App
+}
+
+// StreamName 返回publish或play的流名称
+func (s *Session) StreamName() string {
+	return s.streamName
+}
+
+// ConnectParameters 返回connect命令的参数, 连接前返回nil
+func (s *Session) ConnectParameters() *ConnectParameters {
+	return s.connect
+}
+
+// Conn 返回握手完成后的chunk stream连接
+func (s *Session) Conn() *Conn {
+	return s.conn
+}
+
+// Run 握手并处理消息, 直到连接断开或者出错. 对端关闭连接或播放的来源正常结束时返回nil
+func (s *Session) Run() error {
+	if err := ServerHandshake(s.rw); err != nil {
+		return err
+	}
+
+	s.conn = NewConn(s.rw)
+	defer s.close()
+	for {
+		message, err := s.conn.ReadMessage()
+		if err != nil {
+			s.mutex.Lock()
+			playEnd, playErr := s.playEnd, s.playErr
+			s.mutex.Unlock()
+
+			if playEnd {
+				return playErr
+			} else if err == io.EOF {
+				return nil
+			}
+
+			return err
+		}
+
+		if err = s.handleMessage(message); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Session) handleMessage(message *Message) error {
+	switch message.Type {
+	case MessageTypeCommandAMF3:
+		if len(message.Payload) < 1 {
+			return fmt.Errorf("invalid command message")
+		}
+
+		return s.handleCommand(message, message.Payload[1:])
+	case MessageTypeCommandAMF0:
+		return s.handleCommand(message, message.Payload)
+	case MessageTypeAudio, MessageTypeVideo, MessageTypeDataAMF0, MessageTypeDataAMF3, MessageTypeAggregate:
+		if sessionStatePublishing == s.state {
+			return s.input.Input(message)
+		}
+	}
+
+	return nil
+}
+
+func (s *Session) handleCommand(message *Message, payload []byte) error {
+	command, err := UnmarshalCommand(payload)
+	if err != nil {
+		return err
+	} else if sessionStateInit == s.state && CommandConnect != command.Name {
+		return fmt.Errorf("command %s before connect", command.Name)
+	}
+
+	switch command.Name {
+	case CommandConnect:
+		return s.onConnect(command)
+	case CommandCreateStream:
+		s.streamID++
+		return s.writeCommand(NewResultCommand(command.TransactionID, nil, amf0.Number(s.streamID)), 0)
+	case CommandReleaseStream, CommandFCPublish:
+		// 事务id为0时不需要响应
+		if command.TransactionID != 0 {
+			return s.writeCommand(NewResultCommand(command.TransactionID, nil, amf0.Undefined{}), 0)
+		}
+	case CommandPublish:
+		return s.onPublish(command, message.StreamID)
+	case CommandPlay:
+		return s.onPlay(command, message.StreamID)
+	case CommandDeleteStream, CommandCloseStream, CommandFCUnpublish:
+		return s.stop(message.StreamID)
+	}
+
+	return nil
+}
+
+func (s *Session) onConnect(command *Command) error {
+	if sessionStateInit != s.state {
+		return fmt.Errorf("duplicate connect command")
+	}
+
+	parameters, err := ParseConnectParameters(command)
+	if err != nil {
+		return err
+	}
+
+	s.connect = parameters
+	if handler, ok := s.handler.(ConnectHandler); ok {
+		if err = handler.OnConnect(s, parameters); err != nil {
+			_ = s.writeCommand(NewErrorCommand(command.TransactionID, StatusConnectRejected, err.Error()), 0)
+			return err
+		}
+	}
+
+	if err = s.conn.SetWindowAckSize(s.WindowAckSize); err != nil {
+		return err
+	} else if err = s.conn.SetPeerBandwidth(s.WindowAckSize, 2); err != nil {
+		return err
+	} else if err = s.conn.SetChunkSize(s.ChunkSize); err != nil {
+		return err
+	}
+
+	result := NewConnectResult(command.TransactionID, parameters.ObjectEncoding)
+	if s.Capabilities != nil && parameters.Capabilities != nil {
+		s.Capabilities.Marshal(result.Object)
+	}
+
+	s.state = sessionStateConnected
+	return s.writeCommand(result, 0)
+}
+
+func (s *Session) onPublish(command *Command, streamID uint32) error {
+	name, ok := command.StringArgument(0)
+	if !ok {
+		return fmt.Errorf("invalid publish command")
+	} else if sessionStateConnected != s.state {
+		return fmt.Errorf("publish in state %d", s.state)
+	}
+
+	s.streamName = name
+	sink, err := s.handler.OnPublish(s, s.App(), name)
+	if err != nil {
+		_ = s.writeCommand(NewOnStatusCommand(StatusLevelError, StatusPublishBadName, err.Error()), streamID)
+		return err
+	}
+
+	s.sink = sink
+	s.input = NewTagStream(sink)
+	s.state = sessionStatePublishing
+	if err = s.conn.WriteMessage(NewUserControlMessage(UserControlStreamBegin, streamID)); err != nil {
+		return err
+	}
+
+	return s.writeCommand(NewOnStatusCommand(StatusLevelStatus, StatusPublishStart, "Start publishing"), streamID)
+}
+
+func (s *Session) onPlay(command *Command, streamID uint32) error {
+	name, ok := command.StringArgument(0)
+	if !ok {
+		return fmt.Errorf("invalid play command")
+	} else if sessionStateConnected != s.state {
+		return fmt.Errorf("play in state %d", s.state)
+	}
+
+	s.streamName = name
+	source, err := s.handler.OnPlay(s, s.App(), name)
+	if err != nil {
+		_ = s.writeCommand(NewOnStatusCommand(StatusLevelError, StatusPlayStreamNotFound, err.Error()), streamID)
+		return err
+	}
+
+	if err = s.conn.WriteMessage(NewUserControlMessage(UserControlStreamBegin, streamID)); err != nil {
+		closeStream(source)
+		return err
+	} else if err = s.writeCommand(NewOnStatusCommand(StatusLevelStatus, StatusPlayReset, "Playing and resetting"), streamID); err != nil {
+		closeStream(source)
+		return err
+	} else if err = s.writeCommand(NewOnStatusCommand(StatusLevelStatus, StatusPlayStart, "Start playing"), streamID); err != nil {
+		closeStream(source)
+		return err
+	}
+
+	s.state = sessionStatePlaying
+	s.source = source
+	s.playDone = make(chan struct{})
+	go s.play(source, streamID)
+	return nil
+}
+
+// play 发送flv流. 来源结束或者发送失败时关闭连接, 结束Run
+func (s *Session) play(source io.WriterTo, streamID uint32) {
+	defer close(s.playDone)
+	writer := NewTagWriter(s.conn, streamID)
+	if s.RestrictPlayback {
+		writer.SetCapabilities(s.connect.Capabilities)
+	}
+
+	_, err := source.WriteTo(writer)
+
+	s.mutex.Lock()
+	stopped := s.source == nil
+	if !stopped {
+		s.playEnd = true
+		s.playErr = err
+	}
+	s.mutex.Unlock()
+
+	if stopped {
+		return
+	} else if err == nil {
+		_ = s.conn.WriteMessage(NewUserControlMessage(UserControlStreamEOF, streamID))
+	}
+
+	if closer, ok := s.rw.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+// stop 结束推流或播放, 连接保持在connected状态
+func (s *Session) stop(streamID uint32) error {
+	state := s.state
+	s.close()
+	if sessionStatePublishing == state {
+		return s.writeCommand(NewOnStatusCommand(StatusLevelStatus, StatusUnpublishSuccess, "Stop publishing"), streamID)
+	}
+
+	return nil
+}
+
+func (s *Session) close() {
+	switch s.state {
+	case sessionStatePublishing:
+		closeStream(s.sink)
+		s.sink = nil
+		s.input = nil
+	case sessionStatePlaying:
+		s.mutex.Lock()
+		source := s.source
+		s.source = nil
+		s.mutex.Unlock()
+
+		if source != nil {
+			closeStream(source)
+		}
+
+		// 来源没有实现Close()时WriteTo可能一直阻塞, 超时后关闭连接, 不再等待
+		select {
+		case <-s.playDone:
+		case <-time.After(playStopTimeout):
+			if closer, ok := s.rw.(io.Closer); ok {
+				_ = closer.Close()
+			}
+		}
+	default:
+		return
+	}
+
+	s.state = sessionStateConnected
+}
+
+func (s *Session) writeCommand(command *Command, streamID uint32) error {
+	message, err := command.Message(streamID)
+	if err != nil {
+		return err
+	}
+
+	return s.conn.WriteMessage(message)
+}
+
+// closeStream 关闭实现了Close()的推流输出或播放来源
+func closeStream(stream interface{}) {
+	if closer, ok := stream.(interface{ Close() }); ok {
+		closer.Close()
+	} else if closer, ok := stream.(io.Closer); ok {
+		_ = closer.Close()
+	}
+}
+
+// NewServerSession 在客户端连接上创建服务端会话, 调用Run开始处理
+func NewServerSession(rw io.ReadWriter, handler ServerHandler) *Session {
+	return &Session{
+		ChunkSize:        4096,
+		WindowAckSize:    DefaultWindow,
+		RestrictPlayback: true,
+		rw:               rw,
+		handler:          handler,
+	}
+}
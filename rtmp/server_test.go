@@ -0,0 +1,234 @@
+package rtmp
+
+import (
+	"fmt"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"github.com/lkmio/flv/amf0"
+	"github.com/lkmio/flv/internal/flvtest"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type testServerHandler struct {
+	broadcaster *flv.Broadcaster
+}
+
+func (h *testServerHandler) OnPublish(session *Session, app, name string) (io.Writer, error) {
+	if app != "live" || name != "test" {
+		return nil, fmt.Errorf("invalid stream %s/%s", app, name)
+	}
+
+	return h.broadcaster, nil
+}
+
+func (h *testServerHandler) OnPlay(session *Session, app, name string) (io.WriterTo, error) {
+	if app != "live" || name != "test" {
+		return nil, fmt.Errorf("stream %s/%s not found", app, name)
+	}
+
+	subscriber, err := h.broadcaster.Subscribe()
+	if err != nil {
+		return nil, err
+	}
+
+	return subscriber, nil
+}
+
+func writeTestCommand(conn *Conn, command *Command, streamID uint32) {
+	message, err := command.Message(streamID)
+	utils.Assert(err == nil)
+	utils.Assert(conn.WriteMessage(message) == nil)
+}
+
+// readTestCommand 跳过协议控制和User Control消息, 读取下一个命令
+func readTestCommand(conn *Conn) *Command {
+	for {
+		message, err := conn.ReadMessage()
+		utils.Assert(err == nil)
+		if MessageTypeCommandAMF0 != message.Type {
+			continue
+		}
+
+		command, err := UnmarshalCommand(message.Payload)
+		utils.Assert(err == nil)
+		return command
+	}
+}
+
+func readTestStatus(conn *Conn) string {
+	command := readTestCommand(conn)
+	utils.Assert(CommandOnStatus == command.Name)
+	_, code, ok := ParseStatus(command)
+	utils.Assert(ok)
+	return code
+}
+
+// dialTestSession 握手, connect并创建消息流
+func dialTestSession(handler ServerHandler) (*Conn, net.Conn, chan error) {
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- NewServerSession(server, handler).Run()
+		server.Close()
+	}()
+
+	utils.Assert(ClientHandshake(client, true) == nil)
+	conn := NewConn(client)
+	writeTestCommand(conn, NewConnectCommand("live", "rtmp://127.0.0.1/live"), 0)
+	result := readTestCommand(conn)
+	utils.Assert(CommandResult == result.Name && result.TransactionID == 1)
+	_, code, _ := ParseStatus(result)
+	utils.Assert(StatusConnectSuccess == code)
+	utils.Assert(conn.ReadChunkSize() == 4096)
+
+	writeTestCommand(conn, NewCreateStreamCommand(2), 0)
+	result = readTestCommand(conn)
+	streamID, _ := result.NumberArgument(0)
+	utils.Assert(CommandResult == result.Name && result.TransactionID == 2 && streamID == 1)
+	return conn, client, done
+}
+
+func TestCommand(t *testing.T) {
+	command := NewConnectCommand("live", "rtmp://127.0.0.1/live")
+	command.Object.AddNumberProperty("objectEncoding", 3)
+	(&flv.Capabilities{FourCCList: []string{"hvc1"}, CapsEx: flv.CapsExModEx}).Marshal(command.Object)
+	payload, err := command.Marshal()
+	utils.Assert(err == nil)
+
+	command, err = UnmarshalCommand(payload)
+	utils.Assert(err == nil)
+	parameters, err := ParseConnectParameters(command)
+	utils.Assert(err == nil)
+	utils.Assert(parameters.App == "live" && parameters.TcURL == "rtmp://127.0.0.1/live" && parameters.ObjectEncoding == 3)
+	utils.Assert(parameters.Capabilities.SupportsVideo(flv.VideoCodecIDHEVC) && parameters.Capabilities.SupportsCapsEx(flv.CapsExModEx))
+
+	// 命令对象为Null
+	payload, err = NewPlayCommand("test", -2).Marshal()
+	utils.Assert(err == nil)
+	command, err = UnmarshalCommand(payload)
+	utils.Assert(err == nil)
+	name, _ := command.StringArgument(0)
+	start, _ := command.NumberArgument(1)
+	utils.Assert(CommandPlay == command.Name && command.Object == nil && name == "test" && start == -2)
+	_, ok := command.StringArgument(2)
+	utils.Assert(!ok)
+
+	_, err = UnmarshalCommand([]byte{byte(amf0.DataTypeNumber)})
+	utils.Assert(err != nil)
+}
+
+func TestServerSession(t *testing.T) {
+	handler := &testServerHandler{broadcaster: flv.NewBroadcaster(nil, 0)}
+
+	// 推流
+	publisher, publisherConn, publishDone := dialTestSession(handler)
+	defer publisherConn.Close()
+	writeTestCommand(publisher, &Command{Name: CommandReleaseStream, TransactionID: 3, Arguments: []amf0.Element{amf0.String("test")}}, 0)
+	utils.Assert(CommandResult == readTestCommand(publisher).Name)
+	writeTestCommand(publisher, NewPublishCommand("test", "live"), 1)
+	utils.Assert(StatusPublishStart == readTestStatus(publisher))
+
+	writer := newTestWriter(NewTagWriter(publisher, 1))
+	utils.Assert(writer.WriteHeader() == nil)
+	flvtest.WriteGOPs(writer, 0, 20)
+
+	// ping响应说明之前的消息已经处理完成
+	utils.Assert(publisher.WriteMessage(NewUserControlMessage(UserControlPingRequest, 1)) == nil)
+	for {
+		message, err := publisher.ReadMessage()
+		utils.Assert(err == nil)
+		if MessageTypeUserControl == message.Type && UserControlPingResponse == uint16(message.Payload[1]) {
+			break
+		}
+	}
+
+	// 不存在的流
+	player, playerConn, playDone := dialTestSession(handler)
+	writeTestCommand(player, NewPlayCommand("missing", -2), 1)
+	utils.Assert(StatusPlayStreamNotFound == readTestStatus(player))
+	utils.Assert(<-playDone != nil)
+	playerConn.Close()
+
+	// 从缓存的GOP开始播放, 推流结束后收到Stream EOF
+	player, playerConn, playDone = dialTestSession(handler)
+	defer playerConn.Close()
+	writeTestCommand(player, NewPlayCommand("test", -2), 1)
+	utils.Assert(StatusPlayReset == readTestStatus(player))
+	utils.Assert(StatusPlayStart == readTestStatus(player))
+
+	go func() {
+		flvtest.WriteGOPs(writer, 20, 20)
+		writeTestCommand(publisher, NewDeleteStreamCommand(1), 0)
+		utils.Assert(StatusUnpublishSuccess == readTestStatus(publisher))
+		publisherConn.Close()
+	}()
+
+	collector := &packetCollector{}
+	demuxer := flv.NewDemuxer(true)
+	demuxer.SetHandler(collector)
+	input := NewTagInput(demuxer)
+	var eof bool
+	for {
+		message, err := player.ReadMessage()
+		if err != nil {
+			break
+		} else if MessageTypeUserControl == message.Type && UserControlStreamEOF == uint16(message.Payload[1]) {
+			eof = true
+			continue
+		}
+
+		utils.Assert(input.Input(message) == nil)
+	}
+
+	utils.Assert(eof)
+	utils.Assert(<-playDone == nil)
+	utils.Assert(<-publishDone == nil)
+	utils.Assert(len(collector.tracks) == 2)
+
+	// 10-39帧, 每个track最后一帧缓存在demuxer中
+	utils.Assert(len(collector.packets) == 30*2-2)
+	utils.Assert(collector.packets[0].Key && collector.packets[0].Dts == 400)
+}
+
+// blockingSource WriteTo一直阻塞, 没有实现Close()
+type blockingSource chan struct{}
+
+func (s blockingSource) WriteTo(w io.Writer) (int64, error) {
+	<-s
+	return 0, nil
+}
+
+type blockingServerHandler struct {
+	testServerHandler
+	source blockingSource
+}
+
+func (h *blockingServerHandler) OnPlay(session *Session, app, name string) (io.WriterTo, error) {
+	return h.source, nil
+}
+
+func TestServerSessionBlockingSource(t *testing.T) {
+	playStopTimeout = 10 * time.Millisecond
+	defer func() {
+		playStopTimeout = time.Second
+	}()
+
+	handler := &blockingServerHandler{source: make(blockingSource)}
+	defer close(handler.source)
+	player, playerConn, playDone := dialTestSession(handler)
+	defer playerConn.Close()
+	writeTestCommand(player, NewPlayCommand("test", -2), 1)
+	utils.Assert(StatusPlayReset == readTestStatus(player))
+	utils.Assert(StatusPlayStart == readTestStatus(player))
+
+	// 停止播放时WriteTo没有返回, 超时后关闭连接
+	writeTestCommand(player, NewDeleteStreamCommand(1), 0)
+	select {
+	case <-playDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session blocked on source")
+	}
+}
@@ -0,0 +1,222 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/lkmio/avformat/bufio"
+	"github.com/lkmio/flv"
+	"github.com/lkmio/flv/amf0"
+	"io"
+)
+
+var (
+	// setDataFrame 推流端发送元数据时在onMetaData之前添加的AMF0字符串
+	setDataFrame = []byte{0x02, 0x00, 0x0D, '@', 's', 'e', 't', 'D', 'a', 't', 'a', 'F', 'r', 'a', 'm', 'e'}
+)
+
+// TagInput 将publish会话收到的音视频, 数据和聚合消息转换为flv流, 输入Demuxer或者写入io.Writer
+type TagInput struct {
+	write         func(data []byte) error
+	buffer        []byte
+	prevTagSize   uint32
+	headerWritten bool
+}
+
+// Input 输入一个RTMP消息, 不是音视频或数据的消息被忽略
+func (t *TagInput) Input(message *Message) error {
+	if !t.headerWritten {
+		header := make([]byte, 9)
+		audio, video := headerFlags(message)
+		flv.MarshalHeader(header, audio, video)
+		if err := t.write(header); err != nil {
+			return err
+		}
+
+		t.headerWritten = true
+	}
+
+	switch message.Type {
+	case MessageTypeAudio, MessageTypeVideo:
+		return t.input(message.TagType(), message.Timestamp, message.Payload)
+	case MessageTypeDataAMF3:
+		// AMF3数据消息的第一个字节为0, 之后是AMF0编码
+		if len(message.Payload) < 1 || message.Payload[0] != 0 {
+			return nil
+		}
+
+		return t.inputData(message.Timestamp, message.Payload[1:])
+	case MessageTypeDataAMF0:
+		return t.inputData(message.Timestamp, message.Payload)
+	case MessageTypeAggregate:
+		return t.inputAggregate(message)
+	}
+
+	return nil
+}
+
+// headerFlags 推流端第一个消息是onMetaData时, 根据audiocodecid和videocodecid生成flv头的音视频标记, 否则音视频都存在
+func headerFlags(message *Message) (bool, bool) {
+	if MessageTypeDataAMF0 != message.Type {
+		return true, true
+	}
+
+	scriptData, err := flv.UnmarshalScriptData(message.Payload, message.Timestamp)
+	if err != nil || flv.ScriptDataNameOnMetaData != scriptData.Name {
+		return true, true
+	}
+
+	metadata := amf0.ToObject(scriptData.Payload())
+	if metadata == nil {
+		return true, true
+	}
+
+	audio, video := metadata.FindProperty("audiocodecid") != nil, metadata.FindProperty("videocodecid") != nil
+	if !audio && !video {
+		return true, true
+	}
+
+	return audio, video
+}
+
+// inputData 去掉@setDataFrame后输入数据消息
+func (t *TagInput) inputData(ts uint32, payload []byte) error {
+	return t.input(flv.TagTypeScriptData, ts, bytes.TrimPrefix(payload, setDataFrame))
+}
+
+// inputAggregate 拆分聚合消息, 子消息的时间戳相对第一个子消息偏移
+func (t *TagInput) inputAggregate(message *Message) error {
+	data := message.Payload
+	var first uint32
+	for n := 0; n < len(data); {
+		if n+flv.TagHeaderSizeWithoutPrevTagSize > len(data) {
+			return fmt.Errorf("invalid aggregate message")
+		}
+
+		tagType := flv.TagType(data[n] & 0x1F)
+		size := int(bufio.Uint24(data[n+1:]))
+		ts := bufio.Uint24(data[n+4:]) | uint32(data[n+7])<<24
+		if n == 0 {
+			first = ts
+		}
+
+		offset := n + flv.TagHeaderSizeWithoutPrevTagSize
+		if offset+size+4 > len(data) {
+			return fmt.Errorf("invalid aggregate message")
+		} else if err := t.input(tagType, message.Timestamp+ts-first, data[offset:offset+size]); err != nil {
+			return err
+		}
+
+		n = offset + size + 4
+	}
+
+	return nil
+}
+
+func (t *TagInput) input(tagType flv.TagType, ts uint32, payload []byte) error {
+	size := flv.TagHeaderSize + len(payload)
+	if cap(t.buffer) < size {
+		t.buffer = make([]byte, size)
+	}
+
+	tag := t.buffer[:size]
+	binary.BigEndian.PutUint32(tag, t.prevTagSize)
+	tag[4] = byte(tagType)
+	bufio.PutUint24(tag[5:], uint32(len(payload)))
+	bufio.PutUint24(tag[8:], ts&0xFFFFFF)
+	tag[11] = byte(ts >> 24)
+	bufio.PutUint24(tag[12:], 0)
+	copy(tag[flv.TagHeaderSize:], payload)
+
+	t.prevTagSize = uint32(flv.TagHeaderSizeWithoutPrevTagSize + len(payload))
+	return t.write(tag)
+}
+
+func NewTagInput(demuxer *flv.Demuxer) *TagInput {
+	return &TagInput{write: func(data []byte) error {
+		_, err := demuxer.Input(data)
+		return err
+	}}
+}
+
+// NewTagStream 转换后的flv流写入writer, 例如flv.Broadcaster或者文件, 每次写入一个完整的tag
+func NewTagStream(writer io.Writer) *TagInput {
+	return &TagInput{write: func(data []byte) error {
+		_, err := writer.Write(data)
+		return err
+	}}
+}
+
+// TagWriter 将flv流转换为RTMP消息发送给play会话, 可以作为flv.Writer或者flv.Subscriber.WriteTo的输出.
+// 输入可以是flv流的任意分片, 完整的tag不拷贝直接发送.
+type TagWriter struct {
+	conn         *Conn
+	streamID     uint32
+	pending      []byte
+	headerParsed bool
+	capabilities *flv.Capabilities
+	restricted   bool
+}
+
+// SetCapabilities 按播放端声明的增强RTMP能力限制或降级发送的音视频tag, nil表示传统播放器
+func (w *TagWriter) SetCapabilities(capabilities *flv.Capabilities) {
+	w.capabilities = capabilities
+	w.restricted = true
+}
+
+// WriteTag 发送一个tag, 设置了对端能力时不支持的tag被丢弃
+func (w *TagWriter) WriteTag(tagType flv.TagType, ts uint32, payload []byte) error {
+	if w.restricted {
+		var ok bool
+		if payload, ok = w.capabilities.FilterTag(tagType, payload); !ok {
+			return nil
+		}
+	}
+
+	message := NewTagMessage(flv.Tag{Type: tagType, Timestamp: ts}, payload)
+	message.StreamID = w.streamID
+	return w.conn.WriteMessage(message)
+}
+
+func (w *TagWriter) Write(p []byte) (int, error) {
+	data := p
+	if len(w.pending) > 0 {
+		w.pending = append(w.pending, p...)
+		data = w.pending
+	}
+
+	var n int
+	if !w.headerParsed {
+		if len(data) < 9 {
+			w.pending = append(w.pending[:0], data...)
+			return len(p), nil
+		} else if _, err := flv.UnmarshalHeader(data); err != nil {
+			return 0, err
+		}
+
+		w.headerParsed = true
+		n = 9
+	}
+
+	// PreviousTagSize + tag头 + tag数据
+	for n+flv.TagHeaderSize <= len(data) {
+		tag := flv.UnmarshalTag(data[n:])
+		if n+flv.TagHeaderSize+tag.DataSize > len(data) {
+			break
+		}
+
+		payload := data[n+flv.TagHeaderSize : n+flv.TagHeaderSize+tag.DataSize]
+		if err := w.WriteTag(tag.Type, tag.Timestamp, payload); err != nil {
+			return 0, err
+		}
+
+		n += flv.TagHeaderSize + tag.DataSize
+	}
+
+	w.pending = append(w.pending[:0], data[n:]...)
+	return len(p), nil
+}
+
+func NewTagWriter(conn *Conn, streamID uint32) *TagWriter {
+	return &TagWriter{conn: conn, streamID: streamID}
+}
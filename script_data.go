@@ -0,0 +1,242 @@
+package flv
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/lkmio/flv/amf0"
+)
+
+const (
+	ScriptDataNameOnMetaData       = "onMetaData"
+	ScriptDataNameOnCuePoint       = "onCuePoint"
+	ScriptDataNameOnTextData       = "onTextData"
+	ScriptDataNameOnCaptionInfo    = "onCaptionInfo"
+	ScriptDataNameOnFI             = "onFI"
+	ScriptDataNameRtmpSampleAccess = "|RtmpSampleAccess"
+	ScriptDataNameSetDataFrame     = "@setDataFrame"
+
+	CuePointTypeEvent      = "event"
+	CuePointTypeNavigation = "navigation"
+
+	CaptionTypeCEA608 = "608"
+	CaptionTypeCEA708 = "708"
+)
+
+// ScriptData 脚本tag, Name为第一个字符串元素, Data为其后的所有元素
+type ScriptData struct {
+	Name      string
+	Data      amf0.Data
+	Timestamp uint32
+}
+
+// Payload 返回Name后的第一个元素, 不存在返回nil
+func (s *ScriptData) Payload() amf0.Element {
+	if s.Data.Size() == 0 {
+		return nil
+	}
+
+	return s.Data.Get(0)
+}
+
+// Elements 返回包含名称在内的完整元素列表
+func (s *ScriptData) Elements() *amf0.Data {
+	data := &amf0.Data{}
+	data.AddString(s.Name)
+	for i := 0; i < s.Data.Size(); i++ {
+		data.Add(s.Data.Get(i))
+	}
+
+	return data
+}
+
+// Object 返回Name后的第一个Object或ECMAArray元素
+func (s *ScriptData) Object() *amf0.Object {
+	return amf0.ToObject(s.Payload())
+}
+
+// ScriptDataHandler Demuxer的Handler可选实现该接口, 接收所有脚本tag
+type ScriptDataHandler interface {
+	OnScriptData(data *ScriptData)
+}
+
+// MetaDataHandler Demuxer的Handler可选实现该接口, 接收流中途更新的onMetaData.
+// 首个onMetaData通过Demuxer.Metadata获取, 后续的onMetaData不会替换它, 只通过该接口通知.
+type MetaDataHandler interface {
+	OnMetaDataUpdate(metadata *amf0.Data, ts uint32)
+}
+
+// UnmarshalScriptData 解析脚本tag, 第一个元素必须是字符串
+func UnmarshalScriptData(data []byte, ts uint32) (*ScriptData, error) {
+	elements := amf0.Data{}
+	if err := elements.Unmarshal(data); err != nil {
+		return nil, err
+	} else if elements.Size() == 0 {
+		return nil, fmt.Errorf("empty script data")
+	}
+
+	name, ok := amf0.ToString(elements.Get(0))
+	if !ok {
+		return nil, fmt.Errorf("the first element of script data must be a string")
+	}
+
+	scriptData := &ScriptData{Name: name, Timestamp: ts}
+	for i := 1; i < elements.Size(); i++ {
+		scriptData.Data.Add(elements.Get(i))
+	}
+
+	// @setDataFrame包裹的元数据, 去掉外层名称
+	if ScriptDataNameSetDataFrame == name && scriptData.Data.Size() > 0 {
+		if inner, ok := amf0.ToString(scriptData.Data.Get(0)); ok {
+			unwrapped := &ScriptData{Name: inner, Timestamp: ts}
+			for i := 1; i < scriptData.Data.Size(); i++ {
+				unwrapped.Data.Add(scriptData.Data.Get(i))
+			}
+			return unwrapped, nil
+		}
+	}
+
+	return scriptData, nil
+}
+
+// CuePoint onCuePoint, 用于广告插入等事件标记
+type CuePoint struct {
+	Name       string
+	Time       float64 // 单位秒
+	Type       string  // event/navigation
+	Parameters *amf0.Object
+}
+
+// ParseCuePoint 从onCuePoint脚本tag中解析CuePoint
+func ParseCuePoint(data *ScriptData) (*CuePoint, error) {
+	if ScriptDataNameOnCuePoint != data.Name {
+		return nil, fmt.Errorf("not a cue point: %s", data.Name)
+	}
+
+	object := data.Object()
+	if object == nil {
+		return nil, fmt.Errorf("cue point without object")
+	}
+
+	cuePoint := &CuePoint{}
+	if property := object.FindProperty("name"); property != nil {
+		cuePoint.Name, _ = amf0.ToString(property.Value)
+	}
+
+	if property := object.FindProperty("time"); property != nil {
+		cuePoint.Time, _ = amf0.ToNumber(property.Value)
+	}
+
+	if property := object.FindProperty("type"); property != nil {
+		cuePoint.Type, _ = amf0.ToString(property.Value)
+	}
+
+	if property := object.FindProperty("parameters"); property != nil {
+		cuePoint.Parameters = amf0.ToObject(property.Value)
+	}
+
+	return cuePoint, nil
+}
+
+// Object 转换为onCuePoint的amf0对象
+func (c *CuePoint) Object() *amf0.Object {
+	object := &amf0.Object{}
+	object.AddStringProperty("name", c.Name)
+	object.AddNumberProperty("time", c.Time)
+	object.AddStringProperty("type", c.Type)
+
+	parameters := c.Parameters
+	if parameters == nil {
+		parameters = &amf0.Object{}
+	}
+
+	object.AddProperty("parameters", parameters)
+	return object
+}
+
+// TextData onTextData, 字幕文本
+type TextData struct {
+	Text     string
+	Language string
+	TrackID  int
+}
+
+func (t *TextData) Object() *amf0.Object {
+	object := &amf0.Object{}
+	object.AddStringProperty("text", t.Text)
+	if t.Language != "" {
+		object.AddStringProperty("language", t.Language)
+	}
+
+	object.AddNumberProperty("trackid", float64(t.TrackID))
+	return object
+}
+
+// ParseTextData 从onTextData脚本tag中解析TextData
+func ParseTextData(data *ScriptData) (*TextData, error) {
+	if ScriptDataNameOnTextData != data.Name {
+		return nil, fmt.Errorf("not a text data: %s", data.Name)
+	}
+
+	object := data.Object()
+	if object == nil {
+		return nil, fmt.Errorf("text data without object")
+	}
+
+	textData := &TextData{}
+	if property := object.FindProperty("text"); property != nil {
+		textData.Text, _ = amf0.ToString(property.Value)
+	}
+
+	if property := object.FindProperty("language"); property != nil {
+		textData.Language, _ = amf0.ToString(property.Value)
+	}
+
+	if property := object.FindProperty("trackid"); property != nil {
+		trackID, _ := amf0.ToNumber(property.Value)
+		textData.TrackID = int(trackID)
+	}
+
+	return textData, nil
+}
+
+// CaptionInfo onCaptionInfo, 携带CEA-608/708字幕字节, 序列化时使用base64编码
+type CaptionInfo struct {
+	Type string // 608/708
+	Data []byte
+}
+
+func (c *CaptionInfo) Object() *amf0.Object {
+	object := &amf0.Object{}
+	object.AddStringProperty("type", c.Type)
+	object.AddStringProperty("data", base64.StdEncoding.EncodeToString(c.Data))
+	return object
+}
+
+// ParseCaptionInfo 从onCaptionInfo脚本tag中解析CaptionInfo
+func ParseCaptionInfo(data *ScriptData) (*CaptionInfo, error) {
+	if ScriptDataNameOnCaptionInfo != data.Name {
+		return nil, fmt.Errorf("not a caption info: %s", data.Name)
+	}
+
+	object := data.Object()
+	if object == nil {
+		return nil, fmt.Errorf("caption info without object")
+	}
+
+	captionInfo := &CaptionInfo{}
+	if property := object.FindProperty("type"); property != nil {
+		captionInfo.Type, _ = amf0.ToString(property.Value)
+	}
+
+	if property := object.FindProperty("data"); property != nil {
+		str, _ := amf0.ToString(property.Value)
+		bytes, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return nil, err
+		}
+
+		captionInfo.Data = bytes
+	}
+
+	return captionInfo, nil
+}
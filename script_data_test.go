@@ -0,0 +1,101 @@
+package flv
+
+import (
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv/amf0"
+	"testing"
+)
+
+type ScriptDataCollector struct {
+	avformat.OnUnpackStreamLogger
+	scriptData []*ScriptData
+	updates    int
+}
+
+func (s *ScriptDataCollector) OnScriptData(data *ScriptData) {
+	s.scriptData = append(s.scriptData, data)
+}
+
+func (s *ScriptDataCollector) OnMetaDataUpdate(metadata *amf0.Data, ts uint32) {
+	s.updates++
+}
+
+func marshalTestScriptData(elements ...amf0.Element) []byte {
+	data := amf0.Data{}
+	for _, element := range elements {
+		data.Add(element)
+	}
+
+	buffer := make([]byte, data.MarshalSize())
+	n, err := data.Marshal(buffer)
+	utils.Assert(err == nil)
+	return buffer[:n]
+}
+
+func TestUnmarshalScriptData(t *testing.T) {
+	// @setDataFrame包裹的ECMA数组元数据
+	metaData := &amf0.Object{}
+	metaData.AddNumberProperty("width", 1280)
+	scriptData, err := UnmarshalScriptData(marshalTestScriptData(amf0.String(ScriptDataNameSetDataFrame), amf0.String(ScriptDataNameOnMetaData), amf0.ECMAArray{Object: metaData}), 40)
+	utils.Assert(err == nil)
+	utils.Assert(scriptData.Name == ScriptDataNameOnMetaData && scriptData.Timestamp == 40 && scriptData.Data.Size() == 1)
+	width, _ := amf0.ToNumber(scriptData.Object().FindProperty("width").Value)
+	utils.Assert(width == 1280)
+
+	elements := scriptData.Elements()
+	name, _ := amf0.ToString(elements.Get(0))
+	utils.Assert(elements.Size() == 2 && name == ScriptDataNameOnMetaData)
+
+	// 没有参数的脚本tag
+	scriptData, err = UnmarshalScriptData(marshalTestScriptData(amf0.String(ScriptDataNameRtmpSampleAccess)), 0)
+	utils.Assert(err == nil)
+	utils.Assert(scriptData.Payload() == nil && scriptData.Object() == nil)
+
+	// 第一个元素不是字符串, 空脚本tag
+	_, err = UnmarshalScriptData(marshalTestScriptData(amf0.Number(1)), 0)
+	utils.Assert(err != nil)
+	_, err = UnmarshalScriptData(nil, 0)
+	utils.Assert(err != nil)
+
+	_, err = ParseCuePoint(&ScriptData{Name: ScriptDataNameOnTextData})
+	utils.Assert(err != nil)
+	_, err = ParseCuePoint(&ScriptData{Name: ScriptDataNameOnCuePoint})
+	utils.Assert(err != nil)
+}
+
+func TestProcessScriptData(t *testing.T) {
+	metaData := &amf0.Object{}
+	metaData.AddNumberProperty("duration", 0)
+
+	// 首个onMetaData保存为Metadata, 后续的只通知Handler
+	handler := &ScriptDataCollector{}
+	demuxer := NewDemuxer(false)
+	demuxer.SetHandler(handler)
+	utils.Assert(demuxer.ProcessScriptData(marshalTestScriptData(amf0.String(ScriptDataNameOnMetaData), metaData), 0) == nil)
+	utils.Assert(demuxer.ProcessScriptData(marshalTestScriptData(amf0.String(ScriptDataNameOnMetaData), metaData), 1000) == nil)
+
+	cuePoint := &amf0.Object{}
+	cuePoint.AddStringProperty("name", "ad")
+	cuePoint.AddNumberProperty("time", 2)
+	cuePoint.AddStringProperty("type", CuePointTypeEvent)
+	utils.Assert(demuxer.ProcessScriptData(marshalTestScriptData(amf0.String(ScriptDataNameOnCuePoint), cuePoint), 2000) == nil)
+	textData := &TextData{Text: "hello", Language: "eng", TrackID: 1}
+	utils.Assert(demuxer.ProcessScriptData(marshalTestScriptData(amf0.String(ScriptDataNameOnTextData), textData.Object()), 2500) == nil)
+	utils.Assert(demuxer.ProcessScriptData(marshalTestScriptData(amf0.Boolean(true)), 3000) != nil)
+
+	utils.Assert(demuxer.Metadata() != nil && handler.updates == 1 && len(handler.scriptData) == 4)
+	parsedCuePoint, err := ParseCuePoint(handler.scriptData[2])
+	utils.Assert(err == nil)
+	utils.Assert(parsedCuePoint.Name == "ad" && parsedCuePoint.Time == 2 && parsedCuePoint.Type == CuePointTypeEvent)
+	utils.Assert(handler.scriptData[2].Timestamp == 2000)
+	parsedTextData, err := ParseTextData(handler.scriptData[3])
+	utils.Assert(err == nil)
+	utils.Assert(*parsedTextData == *textData && handler.scriptData[3].Timestamp == 2500)
+
+	// Handler不需要实现可选接口
+	demuxer = NewDemuxer(false)
+	demuxer.SetHandler(&avformat.OnUnpackStreamLogger{})
+	utils.Assert(demuxer.ProcessScriptData(marshalTestScriptData(amf0.String(ScriptDataNameOnCuePoint), cuePoint), 0) == nil)
+	utils.Assert(demuxer.Metadata() == nil)
+}
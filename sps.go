@@ -0,0 +1,493 @@
+package flv
+
+import (
+	"fmt"
+	"github.com/lkmio/avformat/bufio"
+	"github.com/lkmio/avformat/utils"
+)
+
+const (
+	maxShortTermRefPicSets = 64
+	maxLongTermRefPics     = 32
+)
+
+// readVUIAspectRatio 读取VUI中的aspect_ratio_info
+func readVUIAspectRatio(reader *bufio.BitsReader, info *VideoInfo) {
+	if reader.Read(1) == 0 {
+		return
+	}
+
+	idc := int(reader.Read(8))
+	if idc == 255 {
+		info.SARNum = int(reader.Read(16))
+		info.SARDen = int(reader.Read(16))
+	} else if idc < len(sampleAspectRatios) {
+		info.SARNum = sampleAspectRatios[idc][0]
+		info.SARDen = sampleAspectRatios[idc][1]
+	}
+}
+
+// readVUIVideoSignal 跳过overscan_info, video_signal_type和chroma_loc_info
+func readVUIVideoSignal(reader *bufio.BitsReader) {
+	// overscan_info_present_flag
+	if reader.Read(1) == 1 {
+		reader.Seek(1)
+	}
+
+	// video_signal_type_present_flag: video_format(3) video_full_range_flag(1) colour_description_present_flag(1)
+	if reader.Read(1) == 1 {
+		reader.Seek(4)
+		if reader.Read(1) == 1 {
+			reader.Seek(24)
+		}
+	}
+
+	// chroma_loc_info_present_flag
+	if reader.Read(1) == 1 {
+		readUE(reader)
+		readUE(reader)
+	}
+}
+
+// skipScalingList 跳过H264 scaling_list
+func skipScalingList(reader *bufio.BitsReader, size int) {
+	last, next := 8, 8
+	for i := 0; i < size; i++ {
+		if next != 0 {
+			next = (last + readSE(reader) + 256) % 256
+		}
+
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// ParseH264SPS 解析H264 SPS, 包含nalu header, 不包含start code
+func ParseH264SPS(sps []byte) (*VideoInfo, error) {
+	if len(sps) < 4 || NalUnitType(utils.AVCodecIdH264, sps) != H264NalSPS {
+		return nil, fmt.Errorf("invalid h264 sps")
+	}
+
+	reader := &bufio.BitsReader{Data: RemoveEmulationPrevention(sps[1:])}
+	info := &VideoInfo{ChromaFormat: ChromaFormat420, BitDepth: 8}
+	info.Profile = int(reader.Read(8))
+	// constraint_set_flags
+	reader.Seek(8)
+	info.Level = int(reader.Read(8))
+	// seq_parameter_set_id
+	readUE(reader)
+
+	var separateColourPlane bool
+	switch info.Profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		info.ChromaFormat = readUE(reader)
+		if info.ChromaFormat == ChromaFormat444 {
+			separateColourPlane = reader.Read(1) == 1
+		}
+
+		info.BitDepth = readUE(reader) + 8
+		// bit_depth_chroma_minus8, qpprime_y_zero_transform_bypass_flag
+		readUE(reader)
+		reader.Seek(1)
+
+		// seq_scaling_matrix_present_flag
+		if reader.Read(1) == 1 {
+			count := 8
+			if info.ChromaFormat == ChromaFormat444 {
+				count = 12
+			}
+
+			for i := 0; i < count; i++ {
+				if reader.Read(1) == 0 {
+					continue
+				} else if i < 6 {
+					skipScalingList(reader, 16)
+				} else {
+					skipScalingList(reader, 64)
+				}
+			}
+		}
+	}
+
+	// log2_max_frame_num_minus4
+	readUE(reader)
+	switch readUE(reader) {
+	case 0:
+		// log2_max_pic_order_cnt_lsb_minus4
+		readUE(reader)
+	case 1:
+		// delta_pic_order_always_zero_flag offset_for_non_ref_pic offset_for_top_to_bottom_field
+		reader.Seek(1)
+		readSE(reader)
+		readSE(reader)
+		count := readUE(reader)
+		if count > 255 {
+			return nil, fmt.Errorf("invalid h264 sps")
+		}
+
+		for i := 0; i < count; i++ {
+			readSE(reader)
+		}
+	}
+
+	// max_num_ref_frames, gaps_in_frame_num_value_allowed_flag
+	readUE(reader)
+	reader.Seek(1)
+
+	widthInMbs := readUE(reader) + 1
+	heightInMapUnits := readUE(reader) + 1
+	frameMbsOnly := int(reader.Read(1))
+	if frameMbsOnly == 0 {
+		// mb_adaptive_frame_field_flag
+		reader.Seek(1)
+	}
+
+	// direct_8x8_inference_flag
+	reader.Seek(1)
+
+	info.Width = widthInMbs * 16
+	info.Height = (2 - frameMbsOnly) * heightInMapUnits * 16
+
+	// frame_cropping_flag
+	if reader.Read(1) == 1 {
+		left, right, top, bottom := readUE(reader), readUE(reader), readUE(reader), readUE(reader)
+		cropUnitX, cropUnitY := 1, 2-frameMbsOnly
+		if info.ChromaFormat != ChromaFormatMonochrome && !separateColourPlane {
+			subWidth, subHeight := 2, 2
+			if info.ChromaFormat == ChromaFormat444 {
+				subWidth = 1
+			}
+			if info.ChromaFormat != ChromaFormat420 {
+				subHeight = 1
+			}
+
+			cropUnitX = subWidth
+			cropUnitY = subHeight * (2 - frameMbsOnly)
+		}
+
+		info.Width -= cropUnitX * (left + right)
+		info.Height -= cropUnitY * (top + bottom)
+	}
+
+	// vui_parameters_present_flag
+	if reader.Read(1) == 1 {
+		readVUIAspectRatio(reader, info)
+		readVUIVideoSignal(reader)
+
+		// timing_info_present_flag
+		if reader.Read(1) == 1 {
+			numUnitsInTick := reader.Read(32)
+			timeScale := reader.Read(32)
+			if numUnitsInTick > 0 {
+				// 每帧两个field
+				info.FrameRate = float64(timeScale) / float64(2*numUnitsInTick)
+			}
+		}
+	}
+
+	if overflow(reader) || info.Width <= 0 || info.Height <= 0 {
+		return nil, fmt.Errorf("invalid h264 sps")
+	}
+
+	return info, nil
+}
+
+// readHEVCProfileTierLevel 读取profile_tier_level, 返回general_profile_idc, general_tier_flag, general_level_idc
+func readHEVCProfileTierLevel(reader *bufio.BitsReader, maxSubLayersMinus1 int) (int, int, int) {
+	// general_profile_space(2) general_tier_flag(1) general_profile_idc(5)
+	reader.Seek(2)
+	tier := int(reader.Read(1))
+	profile := int(reader.Read(5))
+	// general_profile_compatibility_flags(32) progressive/interlaced/non_packed/frame_only(4) reserved(43) inbld(1)
+	reader.Seek(80)
+	level := int(reader.Read(8))
+
+	var profilePresent, levelPresent [8]bool
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		profilePresent[i] = reader.Read(1) == 1
+		levelPresent[i] = reader.Read(1) == 1
+	}
+
+	if maxSubLayersMinus1 > 0 {
+		// reserved_zero_2bits
+		reader.Seek(2 * (8 - maxSubLayersMinus1))
+	}
+
+	for i := 0; i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] {
+			reader.Seek(88)
+		}
+		if levelPresent[i] {
+			reader.Seek(8)
+		}
+	}
+
+	return profile, tier, level
+}
+
+// skipHEVCScalingListData 跳过scaling_list_data
+func skipHEVCScalingListData(reader *bufio.BitsReader) {
+	for sizeId := 0; sizeId < 4; sizeId++ {
+		step := 1
+		if sizeId == 3 {
+			step = 3
+		}
+
+		for matrixId := 0; matrixId < 6; matrixId += step {
+			// scaling_list_pred_mode_flag
+			if reader.Read(1) == 0 {
+				// scaling_list_pred_matrix_id_delta
+				readUE(reader)
+				continue
+			}
+
+			count := 64
+			if n := 1 << (4 + sizeId<<1); n < count {
+				count = n
+			}
+
+			if sizeId > 1 {
+				// scaling_list_dc_coef_minus8
+				readSE(reader)
+			}
+
+			for i := 0; i < count; i++ {
+				readSE(reader)
+			}
+		}
+	}
+}
+
+// skipHEVCShortTermRefPicSets 跳过SPS中的st_ref_pic_set
+func skipHEVCShortTermRefPicSets(reader *bufio.BitsReader, count int) error {
+	numDeltaPocs := make([]int, count)
+	for i := 0; i < count; i++ {
+		// inter_ref_pic_set_prediction_flag
+		if i != 0 && reader.Read(1) == 1 {
+			// delta_rps_sign(1) abs_delta_rps_minus1, SPS中参考前一个集合
+			reader.Seek(1)
+			readUE(reader)
+
+			for j := 0; j <= numDeltaPocs[i-1]; j++ {
+				usedByCurrPic := reader.Read(1) == 1
+				useDelta := true
+				if !usedByCurrPic {
+					useDelta = reader.Read(1) == 1
+				}
+
+				if usedByCurrPic || useDelta {
+					numDeltaPocs[i]++
+				}
+			}
+		} else {
+			negative, positive := readUE(reader), readUE(reader)
+			if negative+positive > 32 {
+				return fmt.Errorf("invalid hevc short term ref pic set")
+			}
+
+			for j := 0; j < negative+positive; j++ {
+				// delta_poc_minus1, used_by_curr_pic_flag
+				readUE(reader)
+				reader.Seek(1)
+			}
+
+			numDeltaPocs[i] = negative + positive
+		}
+
+		if overflow(reader) {
+			return fmt.Errorf("invalid hevc short term ref pic set")
+		}
+	}
+
+	return nil
+}
+
+// ParseHEVCSPS 解析H265 SPS, 包含nalu header, 不包含start code
+func ParseHEVCSPS(sps []byte) (*VideoInfo, error) {
+	info, _, err := parseHEVCSPS(sps)
+	return info, err
+}
+
+// parseHEVCSPS 解析H265 SPS, 额外返回色度位深
+func parseHEVCSPS(sps []byte) (*VideoInfo, int, error) {
+	if len(sps) < 4 || NalUnitType(utils.AVCodecIdH265, sps) != HEVCNalSPS {
+		return nil, 0, fmt.Errorf("invalid hevc sps")
+	}
+
+	reader := &bufio.BitsReader{Data: RemoveEmulationPrevention(sps[2:])}
+	info := &VideoInfo{}
+
+	// sps_video_parameter_set_id(4) sps_max_sub_layers_minus1(3) sps_temporal_id_nesting_flag(1)
+	reader.Seek(4)
+	maxSubLayersMinus1 := int(reader.Read(3))
+	reader.Seek(1)
+	info.Profile, info.Tier, info.Level = readHEVCProfileTierLevel(reader, maxSubLayersMinus1)
+
+	// sps_seq_parameter_set_id
+	readUE(reader)
+	info.ChromaFormat = readUE(reader)
+	if info.ChromaFormat == ChromaFormat444 {
+		// separate_colour_plane_flag
+		reader.Seek(1)
+	}
+
+	info.Width = readUE(reader)
+	info.Height = readUE(reader)
+
+	// conformance_window_flag
+	if reader.Read(1) == 1 {
+		left, right, top, bottom := readUE(reader), readUE(reader), readUE(reader), readUE(reader)
+		subWidth, subHeight := 1, 1
+		if info.ChromaFormat == ChromaFormat420 || info.ChromaFormat == ChromaFormat422 {
+			subWidth = 2
+		}
+		if info.ChromaFormat == ChromaFormat420 {
+			subHeight = 2
+		}
+
+		info.Width -= subWidth * (left + right)
+		info.Height -= subHeight * (top + bottom)
+	}
+
+	info.BitDepth = readUE(reader) + 8
+	chromaBitDepth := readUE(reader) + 8
+	log2MaxPocLsb := readUE(reader) + 4
+
+	// sps_sub_layer_ordering_info_present_flag
+	start := maxSubLayersMinus1
+	if reader.Read(1) == 1 {
+		start = 0
+	}
+
+	for i := start; i <= maxSubLayersMinus1; i++ {
+		// sps_max_dec_pic_buffering_minus1, sps_max_num_reorder_pics, sps_max_latency_increase_plus1
+		readUE(reader)
+		readUE(reader)
+		readUE(reader)
+	}
+
+	// log2_min_luma_coding_block_size_minus3 ... max_transform_hierarchy_depth_intra
+	for i := 0; i < 6; i++ {
+		readUE(reader)
+	}
+
+	// scaling_list_enabled_flag
+	if reader.Read(1) == 1 && reader.Read(1) == 1 {
+		skipHEVCScalingListData(reader)
+	}
+
+	// amp_enabled_flag, sample_adaptive_offset_enabled_flag
+	reader.Seek(2)
+	// pcm_enabled_flag
+	if reader.Read(1) == 1 {
+		// pcm_sample_bit_depth_luma_minus1(4) pcm_sample_bit_depth_chroma_minus1(4)
+		reader.Seek(8)
+		readUE(reader)
+		readUE(reader)
+		// pcm_loop_filter_disabled_flag
+		reader.Seek(1)
+	}
+
+	numShortTermRefPicSets := readUE(reader)
+	if numShortTermRefPicSets > maxShortTermRefPicSets {
+		return nil, 0, fmt.Errorf("invalid hevc sps")
+	} else if err := skipHEVCShortTermRefPicSets(reader, numShortTermRefPicSets); err != nil {
+		return nil, 0, err
+	}
+
+	// long_term_ref_pics_present_flag
+	if reader.Read(1) == 1 {
+		count := readUE(reader)
+		if count > maxLongTermRefPics {
+			return nil, 0, fmt.Errorf("invalid hevc sps")
+		}
+
+		// lt_ref_pic_poc_lsb_sps, used_by_curr_pic_lt_sps_flag
+		reader.Seek(count * (log2MaxPocLsb + 1))
+	}
+
+	// sps_temporal_mvp_enabled_flag, strong_intra_smoothing_enabled_flag
+	reader.Seek(2)
+
+	// vui_parameters_present_flag
+	if reader.Read(1) == 1 {
+		readVUIAspectRatio(reader, info)
+		readVUIVideoSignal(reader)
+		// neutral_chroma_indication_flag, field_seq_flag, frame_field_info_present_flag
+		reader.Seek(3)
+		// default_display_window_flag
+		if reader.Read(1) == 1 {
+			readUE(reader)
+			readUE(reader)
+			readUE(reader)
+			readUE(reader)
+		}
+
+		// vui_timing_info_present_flag
+		if reader.Read(1) == 1 {
+			numUnitsInTick := reader.Read(32)
+			timeScale := reader.Read(32)
+			if numUnitsInTick > 0 {
+				info.FrameRate = float64(timeScale) / float64(numUnitsInTick)
+			}
+		}
+	}
+
+	if overflow(reader) || info.Width <= 0 || info.Height <= 0 {
+		return nil, 0, fmt.Errorf("invalid hevc sps")
+	}
+
+	return info, chromaBitDepth, nil
+}
+
+// ParseHEVCVPSFrameRate 解析H265 VPS中的timing信息, 返回帧率, 没有timing信息返回0
+func ParseHEVCVPSFrameRate(vps []byte) (float64, error) {
+	if len(vps) < 4 || NalUnitType(utils.AVCodecIdH265, vps) != HEVCNalVPS {
+		return 0, fmt.Errorf("invalid hevc vps")
+	}
+
+	reader := &bufio.BitsReader{Data: RemoveEmulationPrevention(vps[2:])}
+	// vps_video_parameter_set_id(4) vps_base_layer_internal_flag(1) vps_base_layer_available_flag(1) vps_max_layers_minus1(6)
+	reader.Seek(12)
+	maxSubLayersMinus1 := int(reader.Read(3))
+	// vps_temporal_id_nesting_flag(1) vps_reserved_0xffff_16bits(16)
+	reader.Seek(17)
+	readHEVCProfileTierLevel(reader, maxSubLayersMinus1)
+
+	start := maxSubLayersMinus1
+	if reader.Read(1) == 1 {
+		start = 0
+	}
+
+	for i := start; i <= maxSubLayersMinus1; i++ {
+		readUE(reader)
+		readUE(reader)
+		readUE(reader)
+	}
+
+	maxLayerId := int(reader.Read(6))
+	numLayerSets := readUE(reader) + 1
+	if numLayerSets > 1024 {
+		return 0, fmt.Errorf("invalid hevc vps")
+	}
+
+	// layer_id_included_flag
+	reader.Seek((numLayerSets - 1) * (maxLayerId + 1))
+
+	var frameRate float64
+	// vps_timing_info_present_flag
+	if reader.Read(1) == 1 {
+		numUnitsInTick := reader.Read(32)
+		timeScale := reader.Read(32)
+		if numUnitsInTick > 0 {
+			frameRate = float64(timeScale) / float64(numUnitsInTick)
+		}
+	}
+
+	if overflow(reader) {
+		return 0, fmt.Errorf("invalid hevc vps")
+	}
+
+	return frameRate, nil
+}
@@ -8,6 +8,14 @@ import (
 
 type TagType int
 
+const (
+	TagHeaderSize                   = 15 // PreviousTagSize + tag头
+	TagHeaderSizeWithoutPrevTagSize = 11
+
+	MaxVideoDataHeaderSize = 8 // 增强flv: flags + FourCC + CompositionTime
+	MaxAudioDataHeaderSize = 2
+)
+
 const (
 	TagTypeAudioData  = TagType(8)
 	TagTypeVideoData  = TagType(9)
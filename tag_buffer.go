@@ -0,0 +1,184 @@
+package flv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/lkmio/avformat/bufio"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	minTagBufferPoolSize = 1 << 8
+	maxTagBufferPoolSize = 1 << 22
+)
+
+var (
+	// 按2的幂分级的tag缓冲区池
+	tagBufferPools [bits.UintSize]sync.Pool
+)
+
+func allocTagData(size int) []byte {
+	if size < minTagBufferPoolSize || size > maxTagBufferPoolSize {
+		return make([]byte, size)
+	}
+
+	index := bits.Len(uint(size - 1))
+	if data, ok := tagBufferPools[index].Get().(*[]byte); ok {
+		return (*data)[:size]
+	}
+
+	return make([]byte, size, 1<<index)
+}
+
+func freeTagData(data []byte) {
+	size := cap(data)
+	// 只回收分级大小的缓冲区
+	if size < minTagBufferPoolSize || size > maxTagBufferPoolSize || size&(size-1) != 0 {
+		return
+	}
+
+	data = data[:0]
+	tagBufferPools[bits.Len(uint(size-1))].Put(&data)
+}
+
+// TagBuffer 一个完整的tag: 11字节tag头, tag数据和该tag的PreviousTagSize.
+// PreviousTagSize跟随在tag之后, 任意tag子集按顺序拼接后PreviousTagSize链都是正确的, 可以在多个订阅者之间共享.
+// 创建时引用计数为1, 每个持有者Retain/Release一次, 引用计数为0时Data回收复用, 不能再访问.
+type TagBuffer struct {
+	Type           TagType
+	Timestamp      uint32
+	Key            bool // 视频关键帧
+	SequenceHeader bool // 音视频sequence header
+	Data           []byte
+
+	refs int32
+}
+
+// Size 返回tag数据大小, 不包含tag头和PreviousTagSize
+func (t *TagBuffer) Size() int {
+	return len(t.Data) - TagHeaderSizeWithoutPrevTagSize - 4
+}
+
+// Payload 返回tag数据
+func (t *TagBuffer) Payload() []byte {
+	return t.Data[TagHeaderSizeWithoutPrevTagSize : len(t.Data)-4]
+}
+
+func (t *TagBuffer) Retain() {
+	atomic.AddInt32(&t.refs, 1)
+}
+
+func (t *TagBuffer) Release() {
+	if refs := atomic.AddInt32(&t.refs, -1); refs == 0 {
+		freeTagData(t.Data)
+		t.Data = nil
+	} else if refs < 0 {
+		panic("tag buffer released too many times")
+	}
+}
+
+// NewTagBuffer 拷贝tag头(不包含PreviousTagSize)和tag数据, 解析关键帧和sequence header标记
+func NewTagBuffer(header, payload []byte) (*TagBuffer, error) {
+	if len(header) < TagHeaderSizeWithoutPrevTagSize {
+		return nil, fmt.Errorf("invalid tag header")
+	}
+
+	dataSize := int(bufio.Uint24(header[1:]))
+	if dataSize != len(payload) {
+		return nil, fmt.Errorf("tag data size %d does not match payload size %d", dataSize, len(payload))
+	}
+
+	data := allocTagData(TagHeaderSizeWithoutPrevTagSize + dataSize + 4)
+	copy(data, header[:TagHeaderSizeWithoutPrevTagSize])
+	copy(data[TagHeaderSizeWithoutPrevTagSize:], payload)
+	binary.BigEndian.PutUint32(data[len(data)-4:], uint32(TagHeaderSizeWithoutPrevTagSize+dataSize))
+
+	tag := &TagBuffer{
+		Type:      TagType(header[0] & 0x1F),
+		Timestamp: bufio.Uint24(header[4:]) | uint32(header[7])<<24,
+		Data:      data,
+		refs:      1,
+	}
+
+	tag.Key, tag.SequenceHeader = TagFlags(tag.Type, payload)
+	return tag, nil
+}
+
+// TagFlags 根据tag类型和tag数据返回是否是视频关键帧, 是否是sequence header
+func TagFlags(tagType TagType, payload []byte) (bool, bool) {
+	if len(payload) < 2 {
+		return false, false
+	}
+
+	if TagTypeVideoData == tagType {
+		frameType := int(payload[0] >> 4 & 0x7)
+		if payload[0]>>7 == 1 {
+			// 增强flv
+			pktType := PacketType(payload[0] & 0xF)
+			sequenceHeader := PacketTypeSequenceStart == pktType
+			return frameType == FrameTypeKeyFrame && !sequenceHeader && PacketTypeMetaData != pktType && PacketTypeSequenceEnd != pktType, sequenceHeader
+		} else if VideoCodecIDAVC == VideoCodecID(payload[0]&0xF) && payload[1] != 1 {
+			// AVC sequence header或end of sequence
+			return false, payload[1] == 0
+		}
+
+		return frameType == FrameTypeKeyFrame, false
+	} else if TagTypeAudioData == tagType {
+		format := SoundFormat(payload[0] >> 4)
+		if SoundFormatAAC == format {
+			return false, payload[1] == 0
+		} else if SoundFormatExHeader == format {
+			return false, AudioPacketTypeSequenceStart == PacketType(payload[0]&0xF)
+		}
+	}
+
+	return false, false
+}
+
+// tagSplitter 将flv流切分为TagBuffer, 输入可以是flv流的任意分片
+type tagSplitter struct {
+	pending      []byte
+	headerParsed bool
+}
+
+// split 解析flv头和完整的tag, 回调的tag引用计数为1, 由回调方负责释放
+func (s *tagSplitter) split(p []byte, onHeader func(flag TypeFlag), onTag func(tag *TagBuffer)) error {
+	s.pending = append(s.pending, p...)
+	data := s.pending
+	var n int
+
+	if !s.headerParsed {
+		if len(data) < 9 {
+			return nil
+		}
+
+		flag, err := UnmarshalHeader(data)
+		if err != nil {
+			return err
+		}
+
+		onHeader(*flag)
+		s.headerParsed = true
+		n = 9
+	}
+
+	for n+TagHeaderSize <= len(data) {
+		dataSize := int(bufio.Uint24(data[n+5:]))
+		if n+TagHeaderSize+dataSize > len(data) {
+			break
+		}
+
+		tag, err := NewTagBuffer(data[n+4:n+TagHeaderSize], data[n+TagHeaderSize:n+TagHeaderSize+dataSize])
+		if err != nil {
+			return err
+		}
+
+		onTag(tag)
+		n += TagHeaderSize + dataSize
+	}
+
+	s.pending = s.pending[:copy(s.pending, data[n:])]
+	return nil
+}
@@ -44,12 +44,15 @@ const (
 	// https://code.videolan.org/videolan/av1-mapping-specs/blob/master/ts-carriage.md#41-av1-video-descriptor
 	// https://aomediacodec.github.io/av1-mpeg2-ts/#av1-video-descriptor
 	PacketTypeMPEG2TSSequenceStart = PacketType(5)
+	VideoPacketTypeMultitrack      = PacketType(6)
+	VideoPacketTypeModEx           = PacketType(7)
 
 	AudioPacketTypeSequenceStart      = PacketType(0)
 	AudioPacketTypeCodedFrames        = PacketType(1)
 	AudioPacketTypeSequenceEnd        = PacketType(2)
 	AudioPacketTypeMultichannelConfig = PacketType(4)
 	AudioPacketTypeMultiTrack         = PacketType(5)
+	AudioPacketTypeModEx              = PacketType(7)
 )
 
 func AVCodecID2VideoCodecID(id utils.AVCodecID) (VideoCodecID, error) {
@@ -72,7 +75,8 @@ func VideoCodecID2AVCodecID(id VideoCodecID) (utils.AVCodecID, error) {
 }
 
 type VideoData struct {
-	CodecID VideoCodecID
+	CodecID    VideoCodecID
+	PacketType PacketType // Unmarshal解析出的包类型, 非AVC/增强flv为0xFF
 }
 
 // Unmarshal 解析视频tag, 返回视频帧数据(AVCC格式), 是否是SequenceHeader, FrameType, CompositionTime
@@ -147,6 +151,7 @@ func (v *VideoData) Unmarshal(data []byte) ([]byte, bool, int, int, error) {
 	}
 
 	v.CodecID = codecId
+	v.PacketType = pktType
 	return reader.RemainingBytes(), sequenceHeader, frameType, int(ct), nil
 }
 
@@ -198,6 +203,22 @@ func (v *VideoData) Marshal(dst []byte, ct uint32, frameType int, header bool) i
 	return n
 }
 
+// MarshalSequenceEnd 写入视频序列结束的tag body, AVC为AVCPacketType=2, 增强flv为PacketTypeSequenceEnd
+func (v *VideoData) MarshalSequenceEnd(dst []byte) int {
+	_ = dst[4]
+
+	if v.CodecID > VideoCodecIDAVC {
+		dst[0] = 1<<7 | FrameTypeKeyFrame<<4 | byte(PacketTypeSequenceEnd)
+		binary.BigEndian.PutUint32(dst[1:], uint32(v.CodecID))
+		return 5
+	}
+
+	dst[0] = FrameTypeKeyFrame<<4 | byte(v.CodecID)&0x0F
+	dst[1] = byte(PacketTypeSequenceEnd)
+	bufio.PutUint24(dst[2:], 0)
+	return 5
+}
+
 func NewVideoData(id utils.AVCodecID) (*VideoData, error) {
 	codecID, err := AVCodecID2VideoCodecID(id)
 	if err != nil {
@@ -0,0 +1,216 @@
+package flv
+
+import (
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/bufio"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv/amf0"
+	"math"
+)
+
+const (
+	ChromaFormatMonochrome = 0
+	ChromaFormat420        = 1
+	ChromaFormat422        = 2
+	ChromaFormat444        = 3
+)
+
+var (
+	// H264/H265 VUI aspect_ratio_idc对应的SAR, Table E-1
+	sampleAspectRatios = [17][2]int{{0, 0}, {1, 1}, {12, 11}, {10, 11}, {16, 11}, {40, 33}, {24, 11}, {20, 11}, {32, 11}, {80, 33}, {18, 11}, {15, 11}, {64, 33}, {160, 99}, {4, 3}, {3, 2}, {2, 1}}
+)
+
+// VideoInfo 从编码器信息中解析的视频参数
+type VideoInfo struct {
+	CodecID      utils.AVCodecID
+	Width        int     // 裁剪后的显示宽度
+	Height       int     // 裁剪后的显示高度
+	FrameRate    float64 // 码流中没有帧率信息为0
+	SARNum       int     // 像素宽高比, 未知为0
+	SARDen       int
+	Profile      int
+	Level        int // H264为level_idc, H265为general_level_idc, AV1为seq_level_idx
+	Tier         int // H265/AV1
+	BitDepth     int
+	ChromaFormat int // 0-单色/1-4:2:0/2-4:2:2/3-4:4:4
+}
+
+// CheckMetaData 使用码流参数校验onMetaData中的width/height/framerate, 不一致时返回错误
+func (v *VideoInfo) CheckMetaData(metadata *amf0.Object) error {
+	if metadata == nil {
+		return nil
+	}
+
+	number := func(name string) (float64, bool) {
+		if property := metadata.FindProperty(name); property != nil {
+			return amf0.ToNumber(property.Value)
+		}
+
+		return 0, false
+	}
+
+	if width, ok := number("width"); ok && v.Width > 0 && int(width) != v.Width {
+		return fmt.Errorf("metadata width %v does not match stream width %d", width, v.Width)
+	} else if height, ok := number("height"); ok && v.Height > 0 && int(height) != v.Height {
+		return fmt.Errorf("metadata height %v does not match stream height %d", height, v.Height)
+	} else if frameRate, ok := number("framerate"); ok && frameRate > 0 && v.FrameRate > 0 && math.Abs(frameRate-v.FrameRate) > 0.01*v.FrameRate {
+		return fmt.Errorf("metadata framerate %v does not match stream framerate %.3f", frameRate, v.FrameRate)
+	}
+
+	return nil
+}
+
+// ParseVideoInfo 解析sequence header中的decoder configuration record.
+// H264为AVCDecoderConfigurationRecord, H265为HEVCDecoderConfigurationRecord, AV1为AV1CodecConfigurationRecord, VP9为VPCodecConfigurationRecord.
+func ParseVideoInfo(id utils.AVCodecID, record []byte) (*VideoInfo, error) {
+	var info *VideoInfo
+	var err error
+
+	switch id {
+	case utils.AVCodecIdH264:
+		info, err = parseAVCRecordInfo(record)
+	case utils.AVCodecIdH265:
+		info, err = parseHEVCRecordInfo(record)
+	case utils.AVCodecIdAV1:
+		info, err = ParseAV1CodecConfigurationRecord(record)
+	case utils.AVCodecIdVP9:
+		info, err = ParseVPCodecConfigurationRecord(record)
+	default:
+		return nil, fmt.Errorf("unsupported codec: %s", id)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	info.CodecID = id
+	return info, nil
+}
+
+func parseAVCRecordInfo(record []byte) (*VideoInfo, error) {
+	// configurationVersion(8) AVCProfileIndication(8) profile_compatibility(8) AVCLevelIndication(8) lengthSizeMinusOne(8) numOfSequenceParameterSets(8)
+	if len(record) < 8 || record[5]&0x1F == 0 {
+		return nil, fmt.Errorf("invalid avc decoder configuration record")
+	}
+
+	size := int(record[6])<<8 | int(record[7])
+	if 8+size > len(record) {
+		return nil, fmt.Errorf("invalid avc decoder configuration record")
+	}
+
+	return ParseH264SPS(record[8 : 8+size])
+}
+
+func parseHEVCRecordInfo(record []byte) (*VideoInfo, error) {
+	if len(record) < 23 {
+		return nil, fmt.Errorf("invalid hevc decoder configuration record")
+	}
+
+	var vps, sps []byte
+	offset := 23
+	for i := 0; i < int(record[22]) && offset+3 <= len(record); i++ {
+		nalType := int(record[offset] & 0x3F)
+		count := int(record[offset+1])<<8 | int(record[offset+2])
+		offset += 3
+
+		for j := 0; j < count && offset+2 <= len(record); j++ {
+			size := int(record[offset])<<8 | int(record[offset+1])
+			offset += 2
+			if offset+size > len(record) {
+				return nil, fmt.Errorf("invalid hevc decoder configuration record")
+			}
+
+			if HEVCNalVPS == nalType && vps == nil {
+				vps = record[offset : offset+size]
+			} else if HEVCNalSPS == nalType && sps == nil {
+				sps = record[offset : offset+size]
+			}
+
+			offset += size
+		}
+	}
+
+	if sps == nil {
+		return nil, fmt.Errorf("hevc sps not found")
+	}
+
+	info, err := ParseHEVCSPS(sps)
+	if err != nil {
+		return nil, err
+	}
+
+	// sps中没有帧率, 使用vps的timing信息
+	if info.FrameRate == 0 && vps != nil {
+		if frameRate, err := ParseHEVCVPSFrameRate(vps); err == nil {
+			info.FrameRate = frameRate
+		}
+	}
+
+	return info, nil
+}
+
+// TrackVideoInfo 返回视频track的VideoInfo. Demuxer创建的AV1/VP9 track直接返回已解析的参数, 其他track解析track的sequence header
+func TrackVideoInfo(track avformat.Track) (*VideoInfo, error) {
+	stream := track.GetStream()
+	if codecData, ok := stream.CodecParameters.(*VideoCodecData); ok && codecData.Info != nil {
+		return codecData.Info, nil
+	}
+
+	return ParseVideoInfo(stream.CodecID, stream.Data)
+}
+
+// VideoCodecData avformat没有提供AV1/VP9的CodecData, 使用解析的视频参数实现
+type VideoCodecData struct {
+	Info   *VideoInfo
+	Record []byte // decoder configuration record
+}
+
+func (v *VideoCodecData) AnnexBExtraData() []byte {
+	return nil
+}
+
+func (v *VideoCodecData) MP4ExtraData() []byte {
+	return v.Record
+}
+
+func (v *VideoCodecData) Width() int {
+	return v.Info.Width
+}
+
+func (v *VideoCodecData) Height() int {
+	return v.Info.Height
+}
+
+func (v *VideoCodecData) SPS() [][]byte {
+	return nil
+}
+
+func (v *VideoCodecData) PPS() [][]byte {
+	return nil
+}
+
+// readUE 读取无符号指数哥伦布码
+func readUE(reader *bufio.BitsReader) int {
+	var zeros int
+	for zeros < 32 && reader.Read(1) == 0 {
+		zeros++
+	}
+
+	return int(1<<zeros - 1 + reader.Read(zeros))
+}
+
+// readSE 读取有符号指数哥伦布码
+func readSE(reader *bufio.BitsReader) int {
+	v := readUE(reader)
+	if v&0x1 == 1 {
+		return (v + 1) / 2
+	}
+
+	return -v / 2
+}
+
+// overflow 是否读取超出数据范围
+func overflow(reader *bufio.BitsReader) bool {
+	return reader.Offset > len(reader.Data)*8
+}
@@ -0,0 +1,148 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv/amf0"
+	"github.com/lkmio/flv/internal/flvtest"
+	"testing"
+)
+
+var (
+	// 1280x720 main profile level 3.1 25fps
+	testHEVCRecord, _ = hex.DecodeString("0101600000009000000000005df000fcfdf8f800000f03a00001001840010c01ffff01600000030090000003000003005d999809a10001002d42010101600000030090000003000003005da00280802d165999a4932b9a808080820000030002000003003210a2000100074401c172b46240")
+
+	// 1920x1080 main profile level 4.0 8bit 4:2:0, sequence header OBU带有30fps timing信息
+	testAV1Record = []byte{0x81, 0x08, 0x0C, 0x00, 0x0A, 0x11, 0x04, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x7B, 0x00, 0x00, 0x08, 0x55, 0x77, 0xF8, 0x6E, 0x00}
+
+	// profile 0 level 3.1 8bit 4:2:0
+	testVP9Record = []byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x1F, 0x82, 0x01, 0x01, 0x01, 0x00, 0x00}
+
+	// 640x360关键帧
+	testVP9KeyFrame = []byte{0x82, 0x49, 0x83, 0x42, 0x40, 0x27, 0xF0, 0x16, 0x70, 0x00}
+)
+
+func TestParseVideoInfo(t *testing.T) {
+	sps1080p, _ := hex.DecodeString("67640028acd940780227e5c044000003000400000300c83c60c658")
+	record, _, err := NewVideoCodecData(utils.AVCodecIdH264, nil, sps1080p, flvtest.PPS)
+	utils.Assert(err == nil)
+
+	cases := []struct {
+		id       utils.AVCodecID
+		record   []byte
+		expected VideoInfo
+	}{
+		{utils.AVCodecIdH264, flvtest.NewVideoStream().Data, VideoInfo{CodecID: utils.AVCodecIdH264, Width: 1280, Height: 720, FrameRate: 24, SARNum: 1, SARDen: 1, Profile: 100, Level: 31, BitDepth: 8, ChromaFormat: ChromaFormat420}},
+		// 1088裁剪为1080
+		{utils.AVCodecIdH264, record, VideoInfo{CodecID: utils.AVCodecIdH264, Width: 1920, Height: 1080, FrameRate: 25, SARNum: 1, SARDen: 1, Profile: 100, Level: 40, BitDepth: 8, ChromaFormat: ChromaFormat420}},
+		{utils.AVCodecIdH265, testHEVCRecord, VideoInfo{CodecID: utils.AVCodecIdH265, Width: 1280, Height: 720, FrameRate: 25, Profile: 1, Level: 93, BitDepth: 8, ChromaFormat: ChromaFormat420}},
+		{utils.AVCodecIdAV1, testAV1Record, VideoInfo{CodecID: utils.AVCodecIdAV1, Width: 1920, Height: 1080, FrameRate: 30, Level: 8, BitDepth: 8, ChromaFormat: ChromaFormat420}},
+		{utils.AVCodecIdVP9, testVP9Record, VideoInfo{CodecID: utils.AVCodecIdVP9, Level: 31, BitDepth: 8, ChromaFormat: ChromaFormat420}},
+	}
+
+	for _, c := range cases {
+		info, err := ParseVideoInfo(c.id, c.record)
+		if err != nil {
+			t.Fatalf("%s: %s", c.id, err.Error())
+		} else if *info != c.expected {
+			t.Fatalf("%s: expected %+v, got %+v", c.id, c.expected, *info)
+		}
+	}
+
+	width, height, err := ParseVP9FrameSize(testVP9KeyFrame)
+	utils.Assert(err == nil && width == 640 && height == 360)
+
+	_, err = ParseVideoInfo(utils.AVCodecIdH264, record[:12])
+	utils.Assert(err != nil)
+}
+
+func TestCheckMetaData(t *testing.T) {
+	info := &VideoInfo{Width: 1920, Height: 1080, FrameRate: 29.97}
+	metadata := &amf0.Object{}
+	metadata.AddNumberProperty("width", 1920)
+	metadata.AddNumberProperty("height", 1080)
+	metadata.AddNumberProperty("framerate", 30)
+	utils.Assert(info.CheckMetaData(metadata) == nil)
+
+	metadata.FindProperty("height").Value = amf0.Number(1088)
+	utils.Assert(info.CheckMetaData(metadata) != nil)
+}
+
+func TestDemuxerVideoInfo(t *testing.T) {
+	output := &bytes.Buffer{}
+	writer := NewWriter(output)
+	_, err := writer.AddTrack(avformat.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdVP9, testVP9Record, nil))
+	utils.Assert(err == nil)
+	utils.Assert(writer.WriteHeader() == nil)
+	for i := 0; i < 10; i++ {
+		packet := avformat.NewVideoPacket(testVP9KeyFrame, int64(i*40), int64(i*40), true, avformat.PacketTypeAVCC, utils.AVCodecIdVP9, 0, 1000)
+		utils.Assert(writer.WritePacket(packet) == nil)
+	}
+	utils.Assert(writer.Close() == nil)
+
+	handler := &PacketCollector{}
+	demuxer := NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	_, err = demuxer.Input(output.Bytes())
+	utils.Assert(err == nil)
+
+	// VP9的分辨率来自关键帧
+	utils.Assert(len(handler.tracks) == 1)
+	utils.Assert(handler.tracks[0].GetStream().CodecParameters.Width() == 640)
+	utils.Assert(demuxer.VideoInfo().Width == 640 && demuxer.VideoInfo().Height == 360)
+	utils.Assert(bytes.Equal(handler.tracks[0].GetStream().CodecParameters.MP4ExtraData(), testVP9Record))
+}
+
+type VideoInfoCollector struct {
+	PacketCollector
+	infos      []*VideoInfo
+	mismatches []error
+}
+
+func (v *VideoInfoCollector) OnVideoInfo(track avformat.Track, info *VideoInfo, mismatch error) {
+	v.infos = append(v.infos, info)
+	v.mismatches = append(v.mismatches, mismatch)
+}
+
+func TestVideoInfoHandler(t *testing.T) {
+	// onMetaData中的宽度与sps不一致
+	metaData := &amf0.Object{}
+	metaData.AddNumberProperty("width", 1920)
+	output := &bytes.Buffer{}
+	writer := NewWriterWithMuxer(output, NewMuxer(metaData))
+	stream := flvtest.NewVideoStream()
+	index, err := writer.AddTrack(stream)
+	utils.Assert(err == nil)
+	utils.Assert(writer.WriteHeader() == nil)
+
+	frame := []byte{0x0, 0x0, 0x0, 0x2, 0x65, 0x88}
+	for i := 0; i < 20; i++ {
+		// 切换为1920x1080
+		if i == 10 {
+			sps, _ := hex.DecodeString("67640028acd940780227e5c044000003000400000300c83c60c658")
+			stream.Data, stream.CodecParameters, err = NewVideoCodecData(utils.AVCodecIdH264, nil, sps, flvtest.PPS)
+			utils.Assert(err == nil)
+			utils.Assert(writer.WriteSequenceHeader(index, 400) == nil)
+		}
+
+		packet := avformat.NewVideoPacket(frame, int64(i*40), int64(i*40), i%10 == 0, avformat.PacketTypeAVCC, utils.AVCodecIdH264, 0, 1000)
+		utils.Assert(writer.WritePacket(packet) == nil)
+	}
+	utils.Assert(writer.Close() == nil)
+
+	handler := &VideoInfoCollector{}
+	demuxer := NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	_, err = demuxer.Input(output.Bytes())
+	utils.Assert(err == nil)
+
+	utils.Assert(len(handler.infos) == 2)
+	utils.Assert(handler.infos[0].Width == 1280 && handler.mismatches[0] != nil)
+	utils.Assert(handler.infos[1].Width == 1920 && handler.mismatches[1] == nil)
+	utils.Assert(demuxer.VideoInfo() == handler.infos[1])
+
+	info, err := TrackVideoInfo(handler.tracks[0])
+	utils.Assert(err == nil && info.Width == 1920 && info.Height == 1080)
+}
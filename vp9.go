@@ -0,0 +1,89 @@
+package flv
+
+import (
+	"fmt"
+	"github.com/lkmio/avformat/bufio"
+)
+
+// ParseVPCodecConfigurationRecord 解析VPCodecConfigurationRecord, record中没有分辨率, 由关键帧的帧头获取
+func ParseVPCodecConfigurationRecord(record []byte) (*VideoInfo, error) {
+	// version(8) flags(24) profile(8) level(8) bitDepth(4) chromaSubsampling(3) videoFullRangeFlag(1)
+	if len(record) < 7 {
+		return nil, fmt.Errorf("invalid vp codec configuration record")
+	}
+
+	info := &VideoInfo{
+		Profile:  int(record[4]),
+		Level:    int(record[5]),
+		BitDepth: int(record[6] >> 4),
+	}
+
+	// 0-4:2:0 vertical/1-4:2:0 colocated/2-4:2:2/3-4:4:4
+	switch record[6] >> 1 & 0x7 {
+	case 0, 1:
+		info.ChromaFormat = ChromaFormat420
+	case 2:
+		info.ChromaFormat = ChromaFormat422
+	default:
+		info.ChromaFormat = ChromaFormat444
+	}
+
+	return info, nil
+}
+
+// ParseVP9FrameSize 解析VP9关键帧uncompressed header中的分辨率
+func ParseVP9FrameSize(frame []byte) (int, int, error) {
+	reader := &bufio.BitsReader{Data: frame}
+	// frame_marker
+	if reader.Read(2) != 2 {
+		return 0, 0, fmt.Errorf("invalid vp9 frame marker")
+	}
+
+	// profile_low_bit profile_high_bit
+	profile := int(reader.Read(1))
+	profile |= int(reader.Read(1)) << 1
+	if profile == 3 {
+		reader.Seek(1)
+	}
+
+	// show_existing_frame
+	if reader.Read(1) == 1 {
+		return 0, 0, fmt.Errorf("vp9 frame is not a key frame")
+	}
+
+	// frame_type(1) show_frame(1) error_resilient_mode(1)
+	if reader.Read(1) != 0 {
+		return 0, 0, fmt.Errorf("vp9 frame is not a key frame")
+	}
+
+	reader.Seek(2)
+	if reader.Read(24) != 0x498342 {
+		return 0, 0, fmt.Errorf("invalid vp9 sync code")
+	}
+
+	// color_config
+	if profile >= 2 {
+		// ten_or_twelve_bit
+		reader.Seek(1)
+	}
+
+	// color_space不是CS_RGB
+	if reader.Read(3) != 7 {
+		// color_range
+		reader.Seek(1)
+		if profile == 1 || profile == 3 {
+			// subsampling_x subsampling_y reserved_zero
+			reader.Seek(3)
+		}
+	} else if profile == 1 || profile == 3 {
+		reader.Seek(1)
+	}
+
+	width := int(reader.Read(16)) + 1
+	height := int(reader.Read(16)) + 1
+	if overflow(reader) {
+		return 0, 0, fmt.Errorf("invalid vp9 frame header")
+	}
+
+	return width, height, nil
+}
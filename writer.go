@@ -0,0 +1,239 @@
+package flv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv/amf0"
+	"io"
+	"net"
+)
+
+// Writer 基于io.Writer的flv写入器. 由Writer负责tag头的内存分配, tag头和负载通过net.Buffers一次性写出, 负载不会被拷贝.
+// 非线程安全.
+type Writer struct {
+	muxer         *Muxer
+	writer        io.Writer
+	buffer        []byte    // tag头缓冲区
+	vector        [2][]byte // net.Buffers的底层数组, 避免每次写入都分配
+	headerWritten bool
+	videoWritten  bool
+	closed        bool
+}
+
+func (w *Writer) Muxer() *Muxer {
+	return w.muxer
+}
+
+func (w *Writer) AddTrack(stream *avformat.AVStream) (int, error) {
+	return w.muxer.AddTrack(stream)
+}
+
+// alloc 返回至少size字节的tag头缓冲区
+func (w *Writer) alloc(size int) []byte {
+	if len(w.buffer) < size {
+		w.buffer = make([]byte, size)
+	}
+
+	return w.buffer
+}
+
+func (w *Writer) write(header, payload []byte) error {
+	w.vector[0] = header
+	w.vector[1] = payload
+	buffers := net.Buffers(w.vector[:])
+	if len(payload) == 0 {
+		buffers = buffers[:1]
+	}
+
+	_, err := buffers.WriteTo(w.writer)
+	w.vector[0], w.vector[1] = nil, nil
+	return err
+}
+
+// WriteHeader 写入flv头, onMetaData和所有track的sequence header
+func (w *Writer) WriteHeader() error {
+	if w.headerWritten {
+		return fmt.Errorf("header has been written")
+	}
+
+	buffer := w.alloc(w.muxer.ComputeHeaderSize())
+	n := w.muxer.WriteHeader(buffer)
+	w.headerWritten = true
+	return w.write(buffer[:n], nil)
+}
+
+// WritePacket 写入音视频帧, 时间戳转换为毫秒
+func (w *Writer) WritePacket(packet *avformat.AVPacket) error {
+	if !w.headerWritten {
+		return fmt.Errorf("header has not been written")
+	}
+
+	dts := packet.ConvertDts(1000)
+	pts := packet.ConvertPts(1000)
+	buffer := w.alloc(TagHeaderSize + MaxVideoDataHeaderSize)
+
+	if utils.AVMediaTypeVideo == packet.MediaType {
+		// 第一帧视频前写入颜色信息
+		if track := w.muxer.Tracks.FindTrackWithType(utils.AVMediaTypeVideo); !w.videoWritten && track != nil && track.GetStream().Colors != nil {
+			colors := track.GetStream().Colors
+			n := w.muxer.Input(buffer, packet.MediaType, len(colors), dts, pts, false, FrameTypeVideoInfoCommand)
+			if err := w.write(buffer[:n], colors); err != nil {
+				return err
+			}
+		}
+
+		w.videoWritten = true
+	}
+
+	data := packet.Data
+	if utils.AVMediaTypeVideo == packet.MediaType && avformat.PacketTypeAnnexB == packet.PacketType && (utils.AVCodecIdH264 == packet.CodecID || utils.AVCodecIdH265 == packet.CodecID) {
+		frame, sequenceHeader, err := w.muxer.ConvertAnnexB(data)
+		if err == ErrSequenceHeaderNotFound {
+			// 丢弃第一个sequence header之前的帧
+			return nil
+		} else if err != nil {
+			return err
+		} else if sequenceHeader != nil {
+			if err = w.writeSequenceHeader(packet.MediaType, sequenceHeader, dts); err != nil {
+				return err
+			}
+		}
+
+		data = frame
+	}
+
+	if utils.AVMediaTypeAudio == packet.MediaType && utils.AVCodecIdAAC == packet.CodecID && IsADTS(data) {
+		return w.writeADTS(data, dts)
+	}
+
+	frameType := FrameTypeInterFrame
+	if packet.Key {
+		frameType = FrameTypeKeyFrame
+	}
+
+	n := w.muxer.Input(buffer, packet.MediaType, len(data), dts, pts, false, frameType)
+	return w.write(buffer[:n], data)
+}
+
+// writeADTS 去掉ADTS头后写入, 多个ADTS帧按照每帧1024个采样递增时间戳
+func (w *Writer) writeADTS(data []byte, dts int64) error {
+	frames, sequenceHeader, err := w.muxer.ConvertADTS(data)
+	if err != nil {
+		return err
+	} else if sequenceHeader != nil {
+		if err = w.writeSequenceHeader(utils.AVMediaTypeAudio, sequenceHeader, dts); err != nil {
+			return err
+		}
+	}
+
+	sampleRate := w.muxer.Tracks.FindTrackWithType(utils.AVMediaTypeAudio).GetStream().SampleRate
+	buffer := w.alloc(TagHeaderSize + MaxAudioDataHeaderSize)
+	for i, frame := range frames {
+		ts := dts
+		if sampleRate > 0 {
+			ts += int64(i * utils.DefaultAACFrameLength * 1000 / sampleRate)
+		}
+
+		n := w.muxer.Input(buffer, utils.AVMediaTypeAudio, len(frame), ts, ts, false, 0)
+		if err = w.write(buffer[:n], frame); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (w *Writer) writeSequenceHeader(mediaType utils.AVMediaType, data []byte, ts int64) error {
+	buffer := w.alloc(TagHeaderSize + MaxVideoDataHeaderSize)
+	n := w.muxer.Input(buffer, mediaType, len(data), ts, ts, true, 0)
+	return w.write(buffer[:n], data)
+}
+
+// WriteSequenceHeader 写入track当前编码器信息的sequence header, 用于流中途的分辨率或编码器切换
+func (w *Writer) WriteSequenceHeader(index int, ts uint32) error {
+	stream, extraData, err := w.muxer.sequenceHeader(index)
+	if err != nil {
+		return err
+	}
+
+	return w.writeSequenceHeader(stream.MediaType, extraData, int64(ts))
+}
+
+// WriteSequenceEnd 写入视频序列结束tag
+func (w *Writer) WriteSequenceEnd(index int, ts uint32) error {
+	buffer := w.alloc(TagHeaderSize + MaxVideoDataHeaderSize)
+	n, err := w.muxer.WriteSequenceEnd(buffer, index, ts)
+	if err != nil {
+		return err
+	}
+
+	return w.write(buffer[:n], nil)
+}
+
+// WriteScriptData 写入脚本tag
+func (w *Writer) WriteScriptData(name string, payload amf0.Element, ts uint32) error {
+	data := amf0.Data{}
+	data.AddString(name)
+	if payload != nil {
+		data.Add(payload)
+	}
+
+	buffer := w.alloc(TagHeaderSize + data.MarshalSize())
+	n, err := w.muxer.WriteScriptData(buffer, name, payload, ts)
+	if err != nil {
+		return err
+	}
+
+	return w.write(buffer[:n], nil)
+}
+
+// Flush 如果底层Writer支持Flush(例如bufio.Writer, http.ResponseWriter), 刷新缓冲数据
+func (w *Writer) Flush() error {
+	switch writer := w.writer.(type) {
+	case interface{ Flush() error }:
+		return writer.Flush()
+	case interface{ Flush() }:
+		writer.Flush()
+	}
+
+	return nil
+}
+
+// Close 写入最后一个tag的PreviousTagSize, 刷新并关闭底层Writer
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+
+	w.closed = true
+	var err error
+	if w.headerWritten {
+		binary.BigEndian.PutUint32(w.alloc(4), w.muxer.PrevTagSize())
+		err = w.write(w.buffer[:4], nil)
+	}
+
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+
+	if closer, ok := w.writer.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+func NewWriter(writer io.Writer) *Writer {
+	return NewWriterWithMuxer(writer, NewMuxer(nil))
+}
+
+func NewWriterWithMuxer(writer io.Writer, muxer *Muxer) *Writer {
+	return &Writer{
+		muxer:  muxer,
+		writer: writer,
+	}
+}
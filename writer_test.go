@@ -0,0 +1,282 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv/internal/flvtest"
+	"testing"
+)
+
+type PacketCollector struct {
+	avformat.OnUnpackStreamLogger
+	tracks  []avformat.Track
+	packets []*avformat.AVPacket
+}
+
+func (p *PacketCollector) OnNewTrack(track avformat.Track) {
+	p.tracks = append(p.tracks, track)
+}
+
+func (p *PacketCollector) OnTrackComplete() {
+}
+
+func (p *PacketCollector) OnPacket(packet *avformat.AVPacket) {
+	clone := *packet
+	clone.Data = make([]byte, len(packet.Data))
+	copy(clone.Data, packet.Data)
+	p.packets = append(p.packets, &clone)
+}
+
+func TestWriter(t *testing.T) {
+	output := &bytes.Buffer{}
+	writer := NewWriter(output)
+	flvtest.AddTracks(writer)
+	utils.Assert(writer.WritePacket(&avformat.AVPacket{}) != nil)
+	utils.Assert(writer.WriteHeader() == nil)
+
+	// 1秒视频和音频, 视频帧大于2048字节
+	frame := make([]byte, 4096)
+	frame[3] = byte(len(frame) - 4)
+	frame[2] = byte((len(frame) - 4) >> 8)
+	frame[4] = 0x65
+	for i := 0; i < 25; i++ {
+		packet := avformat.NewVideoPacket(frame, int64(i*40), int64(i*40+80), i == 0, avformat.PacketTypeAVCC, utils.AVCodecIdH264, 0, 1000)
+		utils.Assert(writer.WritePacket(packet) == nil)
+
+		audio := avformat.NewAudioPacket([]byte{0x21, 0x10, 0x04}, int64(i*40), utils.AVCodecIdAAC, 1, 1000)
+		utils.Assert(writer.WritePacket(audio) == nil)
+	}
+
+	utils.Assert(writer.Close() == nil)
+
+	handler := &PacketCollector{}
+	demuxer := NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	n, err := demuxer.Input(output.Bytes())
+	utils.Assert(err == nil)
+	// 末尾的PreviousTagSize不会被消费
+	utils.Assert(n == output.Len()-4)
+
+	utils.Assert(len(handler.tracks) == 2)
+	// 每个track最后一帧缓存在demuxer中
+	utils.Assert(len(handler.packets) == 48)
+	for _, packet := range handler.packets {
+		if utils.AVMediaTypeVideo == packet.MediaType {
+			utils.Assert(bytes.Equal(packet.Data, frame))
+			utils.Assert(packet.Pts-packet.Dts == 80)
+		} else {
+			utils.Assert(bytes.Equal(packet.Data, []byte{0x21, 0x10, 0x04}))
+		}
+	}
+}
+
+// recordingWriter 保存每次写入的切片
+type recordingWriter struct {
+	writes [][]byte
+}
+
+func (r *recordingWriter) Write(p []byte) (int, error) {
+	r.writes = append(r.writes, p)
+	return len(p), nil
+}
+
+func TestWriterSequenceHeader(t *testing.T) {
+	output := &recordingWriter{}
+	writer := NewWriter(output)
+	flvtest.AddTracks(writer)
+	utils.Assert(writer.WriteHeader() == nil)
+
+	// 无效的track索引返回错误
+	utils.Assert(writer.WriteSequenceHeader(-1, 0) != nil)
+	utils.Assert(writer.WriteSequenceHeader(2, 0) != nil)
+
+	// 负载不拷贝, 作为单独的切片写出
+	output.writes = nil
+	stream := writer.Muxer().Tracks.Get(1).GetStream()
+	utils.Assert(writer.WriteSequenceHeader(1, 400) == nil)
+	utils.Assert(len(output.writes) == 2 && &output.writes[1][0] == &stream.Data[0])
+	utils.Assert(TagType(output.writes[0][4]) == TagTypeAudioData && output.writes[0][len(output.writes[0])-1] == 0)
+}
+
+func TestWriterAnnexB(t *testing.T) {
+	output := &bytes.Buffer{}
+	writer := NewWriter(output)
+	// 没有编码器信息, 从关键帧的带内参数集生成
+	_, err := writer.AddTrack(avformat.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdH264, nil, nil))
+	utils.Assert(err == nil)
+	utils.Assert(writer.WriteHeader() == nil)
+
+	aud := []byte{0x0, 0x0, 0x0, 0x1, 0x09, 0xF0}
+	idr := []byte{0x0, 0x0, 0x1, 0x65, 0x88, 0x84, 0x21}
+	slice := []byte{0x0, 0x0, 0x0, 0x1, 0x41, 0x9A, 0x02}
+	var keyFrame []byte
+	keyFrame = append(keyFrame, aud...)
+	keyFrame = append(keyFrame, 0x0, 0x0, 0x0, 0x1)
+	keyFrame = append(keyFrame, flvtest.SPS...)
+	keyFrame = append(keyFrame, 0x0, 0x0, 0x0, 0x1)
+	keyFrame = append(keyFrame, flvtest.PPS...)
+	keyFrame = append(keyFrame, idr...)
+
+	for i := 0; i < 20; i++ {
+		data, key := slice, false
+		if i%10 == 1 {
+			data, key = keyFrame, true
+		}
+
+		packet := avformat.NewVideoPacket(data, int64(i*40), int64(i*40), key, avformat.PacketTypeAnnexB, utils.AVCodecIdH264, 0, 1000)
+		utils.Assert(writer.WritePacket(packet) == nil)
+	}
+
+	utils.Assert(writer.Close() == nil)
+
+	handler := &PacketCollector{}
+	demuxer := NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	_, err = demuxer.Input(output.Bytes())
+	utils.Assert(err == nil)
+
+	utils.Assert(len(handler.tracks) == 1)
+	stream := handler.tracks[0].GetStream()
+	utils.Assert(stream.CodecParameters.Width() == 1280 && stream.CodecParameters.Height() == 720)
+	// 第一个关键帧之前的帧被丢弃, 最后一帧缓存在demuxer中
+	utils.Assert(len(handler.packets) == 18)
+	utils.Assert(handler.packets[0].Key)
+	utils.Assert(bytes.Equal(handler.packets[0].Data, []byte{0x0, 0x0, 0x0, 0x4, 0x65, 0x88, 0x84, 0x21}))
+	utils.Assert(bytes.Equal(handler.packets[1].Data, []byte{0x0, 0x0, 0x0, 0x3, 0x41, 0x9A, 0x02}))
+}
+
+func TestWriterAnnexBUpdateSequenceHeader(t *testing.T) {
+	vps, _ := hex.DecodeString("40010c01ffff01600000030090000003000003005d999809")
+	pps, _ := hex.DecodeString("4401c172b46240")
+	// Main 8bit 4:2:0, Main10 4:2:0, RExt 10bit 4:2:2
+	var sps [3][]byte
+	sps[0], _ = hex.DecodeString("42010101600000030090000003000003005da00280802d165999a4932b9a808080820000030002000003003210")
+	sps[1], _ = hex.DecodeString("42010102200000030090000003000003005da00280802d136595e4932b20")
+	sps[2], _ = hex.DecodeString("42010104080000030090000003000003005db00280802d136595e4932b20")
+
+	output := &bytes.Buffer{}
+	writer := NewWriter(output)
+	_, err := writer.AddTrack(avformat.NewAVStream(utils.AVMediaTypeVideo, 0, utils.AVCodecIdH265, nil, nil))
+	utils.Assert(err == nil)
+	writer.Muxer().UpdateSequenceHeader = true
+	utils.Assert(writer.WriteHeader() == nil)
+
+	stream := writer.Muxer().Tracks.Get(0).GetStream()
+	idr := []byte{0x0, 0x0, 0x0, 0x1, 0x26, 0x01, 0xAF, 0x06}
+	slice := []byte{0x0, 0x0, 0x0, 0x1, 0x02, 0x01, 0xD0, 0x02}
+	for i := 0; i < 30; i++ {
+		data, key := slice, false
+		if i%10 == 0 {
+			data, key = nil, true
+			for _, nalu := range [][]byte{vps, sps[i/10], pps} {
+				data = append(append(data, 0x0, 0x0, 0x0, 0x1), nalu...)
+			}
+
+			data = append(data, idr...)
+		}
+
+		packet := avformat.NewVideoPacket(data, int64(i*40), int64(i*40), key, avformat.PacketTypeAnnexB, utils.AVCodecIdH265, 0, 1000)
+		utils.Assert(writer.WritePacket(packet) == nil)
+
+		// hvcC中的chroma_format_idc和位深来自sps
+		if key {
+			chromaFormat := []byte{1, 1, 2}[i/10]
+			bitDepth := []byte{0, 2, 2}[i/10]
+			utils.Assert(stream.Data[16] == 0xFC|chromaFormat && stream.Data[17] == 0xF8|bitDepth && stream.Data[18] == 0xF8|bitDepth)
+			utils.Assert(stream.Data[1]&0x1F == []byte{1, 2, 4}[i/10])
+		}
+	}
+
+	utils.Assert(writer.Close() == nil)
+
+	handler := &CodecParametersCollector{}
+	demuxer := NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	_, err = demuxer.Input(output.Bytes())
+	utils.Assert(err == nil)
+	demuxer.Flush()
+
+	utils.Assert(len(handler.tracks) == 1 && len(handler.packets) == 30)
+	var changed int
+	for _, event := range handler.events {
+		if event == "changed 1280x720" {
+			changed++
+		}
+	}
+
+	utils.Assert(changed == 2)
+}
+
+func newTestADTSFrame(profile, frequency, channels int, payload []byte) []byte {
+	frame := make([]byte, ADTSHeaderSize+len(payload))
+	utils.SetADtsHeader(frame, 0, profile, frequency, channels, len(frame))
+	copy(frame[ADTSHeaderSize:], payload)
+	return frame
+}
+
+func TestWriterADTS(t *testing.T) {
+	output := &bytes.Buffer{}
+	writer := NewWriter(output)
+	_, err := writer.AddTrack(avformat.NewAVStream(utils.AVMediaTypeAudio, 0, utils.AVCodecIdAAC, nil, nil))
+	utils.Assert(err == nil)
+	utils.Assert(writer.WriteHeader() == nil)
+
+	// AAC-LC 44100Hz 2通道, 每个packet包含2个ADTS帧
+	for i := 0; i < 20; i++ {
+		data := append(newTestADTSFrame(1, 4, 2, []byte{0x21, 0x10}), newTestADTSFrame(1, 4, 2, []byte{0x21, 0x11})...)
+		utils.Assert(writer.WritePacket(avformat.NewAudioPacket(data, int64(i*46), utils.AVCodecIdAAC, 0, 1000)) == nil)
+	}
+
+	stream := writer.Muxer().Tracks.Get(0).GetStream()
+	utils.Assert(bytes.Equal(stream.Data, flvtest.ASC))
+	utils.Assert(stream.SampleRate == 44100 && stream.Channels == 2)
+
+	// 切换为48000Hz单通道
+	utils.Assert(writer.WritePacket(avformat.NewAudioPacket(newTestADTSFrame(1, 3, 1, []byte{0x21, 0x12}), 920, utils.AVCodecIdAAC, 0, 1000)) == nil)
+	utils.Assert(bytes.Equal(stream.Data, []byte{0x11, 0x88}))
+	utils.Assert(stream.SampleRate == 48000 && stream.Channels == 1)
+	utils.Assert(writer.Close() == nil)
+
+	handler := &PacketCollector{}
+	demuxer := NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	_, err = demuxer.Input(output.Bytes())
+	utils.Assert(err == nil)
+
+	utils.Assert(len(handler.tracks) == 1)
+	// 编码器信息变化后, track更新为48000Hz
+	utils.Assert(handler.tracks[0].GetStream().SampleRate == 48000)
+	utils.Assert(len(handler.packets) == 40)
+	utils.Assert(bytes.Equal(handler.packets[0].Data, []byte{0x21, 0x10}))
+	utils.Assert(bytes.Equal(handler.packets[1].Data, []byte{0x21, 0x11}))
+	utils.Assert(handler.packets[1].Dts == 23)
+}
+
+func TestADTSHeader(t *testing.T) {
+	// 添加的ADTS头与编码器生成的相同
+	header, err := NewADTSHeader(flvtest.ASC)
+	utils.Assert(err == nil)
+	frame := AppendADTS([]byte{0xAA}, header, []byte{0x21, 0x10})
+	utils.Assert(bytes.Equal(frame[1:], newTestADTSFrame(1, 4, 2, []byte{0x21, 0x10})))
+
+	frames, _, err := SplitADTS(frame[1:])
+	utils.Assert(err == nil && len(frames) == 1 && bytes.Equal(frames[0], []byte{0x21, 0x10}))
+
+	// AAC-LD不能使用ADTS
+	_, err = NewADTSHeader([]byte{0xBA, 0x10})
+	utils.Assert(err != nil)
+}
+
+func TestParseParameterSets(t *testing.T) {
+	lengthSize, parameterSets, err := ParseParameterSets(flvtest.NewVideoStream())
+	utils.Assert(err == nil && lengthSize == 4)
+	utils.Assert(bytes.Equal(parameterSets, append(append(addStartCode(flvtest.SPS), 0, 0, 0, 1), flvtest.PPS...)))
+
+	// 没有CodecParameters时解析record
+	stream := flvtest.NewVideoStream()
+	stream.CodecParameters = nil
+	_, sets, err := ParseParameterSets(stream)
+	utils.Assert(err == nil && bytes.Equal(sets, parameterSets))
+}
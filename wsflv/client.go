@@ -0,0 +1,69 @@
+package wsflv
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/flv"
+	"time"
+)
+
+// Client WebSocket-FLV拉流客户端, 将收到的二进制消息输入Demuxer, 通过avformat.OnUnpackStreamHandler回调.
+// 消息不要求按tag边界分割. 服务端的ping由websocket库自动回复pong.
+type Client struct {
+	ReadTimeout time.Duration // 超过该时间没有收到消息断开连接, 0不限制
+
+	conn    *websocket.Conn
+	demuxer *flv.Demuxer
+	pending []byte
+}
+
+// Demuxer 返回内部的Demuxer, 用于获取Metadata和VideoInfo
+func (c *Client) Demuxer() *flv.Demuxer {
+	return c.demuxer
+}
+
+// Run 读取消息直到连接关闭. 服务端正常关闭(推流结束)或者调用Close时返回nil
+func (c *Client) Run() error {
+	defer c.conn.Close()
+
+	for {
+		if c.ReadTimeout > 0 {
+			_ = c.conn.SetReadDeadline(time.Now().Add(c.ReadTimeout))
+		}
+
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil
+			}
+
+			return err
+		}
+
+		c.pending = append(c.pending, data...)
+		n, err := c.demuxer.Input(c.pending)
+		if err != nil {
+			return err
+		}
+
+		c.pending = c.pending[:copy(c.pending, c.pending[n:])]
+	}
+}
+
+// Close 发送关闭消息, Run收到服务端回复的关闭消息后返回
+func (c *Client) Close() error {
+	return c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
+
+// Dial 连接WebSocket-FLV地址, 之后调用Run读取
+func Dial(ctx context.Context, url string, handler avformat.OnUnpackStreamHandler) (*Client, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	demuxer := flv.NewDemuxer(true)
+	demuxer.SetHandler(handler)
+	return &Client{conn: conn, demuxer: demuxer}, nil
+}
@@ -0,0 +1,185 @@
+// Package wsflv 通过WebSocket二进制消息传输flv流, 兼容flv.js和mpegts.js.
+// 第一个消息是flv头和PreviousTagSize0, 之后每个消息包含一个或多个完整的tag.
+package wsflv
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/lkmio/flv"
+	"github.com/lkmio/flv/httpflv"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Handler WebSocket-FLV播放的http.Handler, 从Registry查找直播流, 为每个连接创建一个订阅者.
+// 消费过慢由Broadcaster的队列策略处理, 被断开时以1013关闭连接; 推流结束时以1000正常关闭.
+type Handler struct {
+	Registry     httpflv.Registry
+	Upgrader     websocket.Upgrader           // 默认只允许同源请求, 跨域播放需设置Upgrader.CheckOrigin, 例如AllowAnyOrigin
+	TagsPerFrame int                          // 每个消息最多包含的tag数, 0不限制
+	PingInterval time.Duration                // 发送ping的间隔, 超过两个间隔没有收到pong断开连接. 0不发送
+	WriteTimeout time.Duration                // 单个消息的写超时, 0不限制
+	StreamName   func(r *http.Request) string // 自定义流名称解析
+}
+
+func (h *Handler) streamName(r *http.Request) string {
+	if h.StreamName != nil {
+		return h.StreamName(r)
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".flv")
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	broadcaster := h.Registry.Find(h.streamName(r))
+	if broadcaster == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	subscriber, err := broadcaster.Subscribe()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	defer subscriber.Close()
+
+	conn, err := h.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	done, readDone := make(chan struct{}), make(chan struct{})
+	defer close(done)
+	go func() {
+		h.readLoop(conn, subscriber)
+		close(readDone)
+	}()
+
+	if h.PingInterval > 0 {
+		go h.pingLoop(conn, done)
+	}
+
+	if err = h.writeMessage(conn, [][]byte{subscriber.Header()}); err != nil {
+		return
+	}
+
+	var buffers [][]byte
+	for {
+		tags, err := subscriber.Read()
+		if err == io.EOF {
+			closeConn(conn, readDone, websocket.CloseNormalClosure, "stream ended")
+			return
+		} else if err == flv.ErrSlowConsumer {
+			closeConn(conn, readDone, websocket.CloseTryAgainLater, err.Error())
+			return
+		} else if err != nil {
+			return
+		}
+
+		// 按TagsPerFrame分组发送
+		for i := 0; i < len(tags) && err == nil; i += len(buffers) {
+			buffers = buffers[:0]
+			for _, tag := range tags[i:] {
+				if h.TagsPerFrame > 0 && len(buffers) >= h.TagsPerFrame {
+					break
+				}
+
+				buffers = append(buffers, tag.Data)
+			}
+
+			err = h.writeMessage(conn, buffers)
+		}
+
+		for _, tag := range tags {
+			tag.Release()
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// writeMessage 将多个缓冲区作为一个二进制消息写出, 不拷贝
+func (h *Handler) writeMessage(conn *websocket.Conn, buffers [][]byte) error {
+	if h.WriteTimeout > 0 {
+		_ = conn.SetWriteDeadline(time.Now().Add(h.WriteTimeout))
+	}
+
+	writer, err := conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+
+	for _, buffer := range buffers {
+		if _, err = writer.Write(buffer); err != nil {
+			return err
+		}
+	}
+
+	return writer.Close()
+}
+
+// readLoop 处理客户端的控制消息, 客户端关闭或者pong超时后取消订阅
+func (h *Handler) readLoop(conn *websocket.Conn, subscriber *flv.Subscriber) {
+	defer subscriber.Close()
+
+	if h.PingInterval > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * h.PingInterval))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2 * h.PingInterval))
+		})
+	}
+
+	for {
+		if _, _, err := conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+func (h *Handler) pingLoop(conn *websocket.Conn, done chan struct{}) {
+	ticker := time.NewTicker(h.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(h.PingInterval)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// closeConn 发送关闭消息, 等待客户端回复关闭消息后再断开连接
+func closeConn(conn *websocket.Conn, readDone chan struct{}, code int, text string) {
+	if err := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second)); err != nil {
+		return
+	}
+
+	select {
+	case <-readDone:
+	case <-time.After(time.Second):
+	}
+}
+
+// AllowAnyOrigin 允许任意来源的请求, 用于Upgrader.CheckOrigin
+func AllowAnyOrigin(r *http.Request) bool {
+	return true
+}
+
+func NewHandler(registry httpflv.Registry) *Handler {
+	return &Handler{
+		Registry:     registry,
+		PingInterval: 10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+}
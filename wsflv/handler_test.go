@@ -0,0 +1,202 @@
+package wsflv
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/lkmio/avformat"
+	"github.com/lkmio/avformat/bufio"
+	"github.com/lkmio/avformat/utils"
+	"github.com/lkmio/flv"
+	"github.com/lkmio/flv/httpflv"
+	"github.com/lkmio/flv/internal/flvtest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type packetCollector struct {
+	avformat.OnUnpackStreamLogger
+	tracks  []avformat.Track
+	packets []*avformat.AVPacket
+}
+
+func (p *packetCollector) OnNewTrack(track avformat.Track) {
+	p.tracks = append(p.tracks, track)
+}
+
+func (p *packetCollector) OnTrackComplete() {
+}
+
+func (p *packetCollector) OnPacket(packet *avformat.AVPacket) {
+	clone := *packet
+	clone.Data = make([]byte, len(packet.Data))
+	copy(clone.Data, packet.Data)
+	p.packets = append(p.packets, &clone)
+}
+
+// newTestStream 注册直播流, 写入0-14帧
+func newTestStream(streams *httpflv.Streams) (*flv.Broadcaster, *flv.Writer) {
+	broadcaster := flv.NewBroadcaster(nil, 0)
+	utils.Assert(streams.Add("test", broadcaster) == nil)
+	writer := flv.NewWriter(broadcaster)
+	flvtest.AddTracks(writer)
+	utils.Assert(writer.WriteHeader() == nil)
+	flvtest.WriteGOPs(writer, 0, 15)
+	return broadcaster, writer
+}
+
+func waitSubscribers(broadcaster *flv.Broadcaster, count int) {
+	for broadcaster.Subscribers() != count {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newTestServer(handler *Handler) (*httptest.Server, string) {
+	server := httptest.NewServer(handler)
+	return server, "ws" + strings.TrimPrefix(server.URL, "http") + "/test.flv"
+}
+
+func TestHandlerTagsPerFrame(t *testing.T) {
+	streams := httpflv.NewStreams()
+	handler := NewHandler(streams)
+	handler.TagsPerFrame = 1
+	server, url := newTestServer(handler)
+	defer server.Close()
+
+	broadcaster, writer := newTestStream(streams)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	utils.Assert(err == nil)
+	defer conn.Close()
+
+	// 第一个消息是flv头
+	_, data, err := conn.ReadMessage()
+	utils.Assert(err == nil)
+	utils.Assert(len(data) == 13 && string(data[:3]) == "FLV")
+
+	waitSubscribers(broadcaster, 1)
+	flvtest.WriteGOPs(writer, 15, 5)
+	broadcaster.Close()
+
+	// 每个消息一个完整的tag: onMetaData, 2个sequence header, 10-19帧
+	var tags int
+	for {
+		_, data, err = conn.ReadMessage()
+		if err != nil {
+			utils.Assert(websocket.IsCloseError(err, websocket.CloseNormalClosure))
+			break
+		}
+
+		utils.Assert(len(data) == flv.TagHeaderSizeWithoutPrevTagSize+int(bufio.Uint24(data[1:]))+4)
+		tags++
+	}
+
+	utils.Assert(tags == 3+10*2)
+}
+
+func TestClient(t *testing.T) {
+	streams := httpflv.NewStreams()
+	server, url := newTestServer(NewHandler(streams))
+	defer server.Close()
+
+	broadcaster, writer := newTestStream(streams)
+	collector := &packetCollector{}
+	client, err := Dial(context.Background(), url, collector)
+	utils.Assert(err == nil)
+	done := make(chan error)
+	go func() {
+		done <- client.Run()
+	}()
+
+	// 推流结束后正常关闭
+	waitSubscribers(broadcaster, 1)
+	flvtest.WriteGOPs(writer, 15, 20)
+	broadcaster.Close()
+	utils.Assert(<-done == nil)
+
+	utils.Assert(len(collector.tracks) == 2)
+	utils.Assert(collector.packets[0].Key && collector.packets[0].Data[5] == 10)
+	utils.Assert(len(collector.packets) == 25*2-2)
+
+	// 客户端主动关闭
+	streams.Remove("test")
+	broadcaster, _ = newTestStream(streams)
+	client, err = Dial(context.Background(), url, &packetCollector{})
+	utils.Assert(err == nil)
+	go func() {
+		done <- client.Run()
+	}()
+
+	waitSubscribers(broadcaster, 1)
+	utils.Assert(client.Close() == nil)
+	utils.Assert(<-done == nil)
+	waitSubscribers(broadcaster, 0)
+}
+
+func TestHandlerPing(t *testing.T) {
+	streams := httpflv.NewStreams()
+	handler := NewHandler(streams)
+	handler.PingInterval = 20 * time.Millisecond
+	server, url := newTestServer(handler)
+	defer server.Close()
+
+	broadcaster, _ := newTestStream(streams)
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	utils.Assert(err == nil)
+	defer conn.Close()
+
+	// 读取消息时自动回复pong, 连接保持
+	pings := make(chan struct{}, 16)
+	conn.SetPingHandler(func(data string) error {
+		select {
+		case pings <- struct{}{}:
+		default:
+		}
+
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		<-pings
+	}
+
+	utils.Assert(broadcaster.Subscribers() == 1)
+
+	// 不回复pong的客户端被断开
+	conn2, _, err := websocket.DefaultDialer.Dial(url, nil)
+	utils.Assert(err == nil)
+	defer conn2.Close()
+	utils.Assert(broadcaster.Subscribers() == 2)
+	waitSubscribers(broadcaster, 1)
+}
+
+func TestHandlerCheckOrigin(t *testing.T) {
+	streams := httpflv.NewStreams()
+	handler := NewHandler(streams)
+	server, url := newTestServer(handler)
+	defer server.Close()
+
+	broadcaster, _ := newTestStream(streams)
+	defer broadcaster.Close()
+
+	// 默认拒绝跨域请求, 允许同源请求
+	_, response, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://example.com"}})
+	utils.Assert(err != nil && response.StatusCode == http.StatusForbidden)
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {server.URL}})
+	utils.Assert(err == nil)
+	conn.Close()
+
+	handler.Upgrader.CheckOrigin = AllowAnyOrigin
+	conn, _, err = websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://example.com"}})
+	utils.Assert(err == nil)
+	conn.Close()
+}